@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+
+	"wallet-go/pkg/config"
+	"wallet-go/pkg/db"
+	"wallet-go/pkg/wallet"
+)
+
+// chainverify walks the transaction hash chain from the first transaction to
+// the current head and recomputes every hash. With CHAIN_SIGNING_KEY it also
+// checks the checkpoint signatures. It prints the report as JSON to stdout and
+// exits with status 1 when a link is broken.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	config.LoadEnv()
+
+	var opts []wallet.Option
+	if chain := config.GetChainConfig(); chain.SigningKey != "" {
+		key, err := wallet.ParseChainSigningKey(chain.SigningKey)
+		if err != nil {
+			log.Fatalf("loading CHAIN_SIGNING_KEY: %v", err)
+		}
+		opts = append(opts, wallet.WithChainSigningKey(key))
+	}
+
+	conn := db.InitPostgres()
+	defer conn.Close()
+	svc := wallet.NewService(wallet.NewPostgresRepository(conn), opts...)
+	ctx := context.Background()
+
+	report, err := svc.VerifyChain(ctx)
+	if err != nil {
+		log.Fatalf("verifying chain: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("writing report: %v", err)
+	}
+	if !report.Valid {
+		log.Printf("Chain broken at link %d: %s", report.Break.Seq, report.Break.Reason)
+		os.Exit(1)
+	}
+}
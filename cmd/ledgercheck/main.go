@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+
+	"wallet-go/pkg/db"
+	"wallet-go/pkg/wallet"
+)
+
+// ledgercheck recomputes every wallet balance from the journal, compares it
+// with the stored balance and checks that the journal balances. It prints the
+// report as JSON to stdout and exits with status 1 when it finds a
+// discrepancy, so it can run from cron or a monitoring job.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	conn := db.InitPostgres()
+	defer conn.Close()
+	svc := wallet.NewService(wallet.NewPostgresRepository(conn))
+	ctx := context.Background()
+
+	report, err := svc.CheckLedger(ctx)
+	if err != nil {
+		log.Fatalf("checking ledger: %v", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("writing report: %v", err)
+	}
+	if !report.OK() {
+		log.Printf("Found %d discrepancies in %d wallets", len(report.Discrepancies), report.Wallets)
+		os.Exit(1)
+	}
+}
@@ -1,20 +1,195 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
+	"wallet-go/pkg/config"
 	"wallet-go/pkg/db"
 	"wallet-go/pkg/router"
+	"wallet-go/pkg/server"
+	"wallet-go/pkg/wallet"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	conn := db.InitPostgres()
-	defer conn.Close()
+	config.LoadEnv()
 
-	r := router.Setup(conn)
+	var repo wallet.Repository
+	var idem wallet.IdempotencyStore
+	var pool *sql.DB
+	switch backend := config.GetStorageConfig().Backend; backend {
+	case "memory":
+		// Everything is lost on restart, only meant for local demos
+		log.Println("Using in-memory storage")
+		repo = wallet.NewMemoryRepository()
+		idem = wallet.NewMemoryIdempotencyStore()
+	case "postgres":
+		pool = db.InitPostgres()
+		repo = wallet.NewPostgresRepository(pool)
+		idem = wallet.NewIdempotencyStore(pool)
+	default:
+		log.Fatalf("unknown STORAGE_BACKEND %q", backend)
+	}
 
-	log.Println("Server running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", r))
+	holds := config.GetHoldConfig()
+	webhooks := config.GetWebhookConfig()
+	schedules := config.GetScheduleConfig()
+	apiKeys := config.GetAPIKeyConfig()
+	opts := []wallet.Option{wallet.WithHoldTTL(holds.DefaultTTL), wallet.WithWebhookTimeout(webhooks.Timeout),
+		wallet.WithWebhookAllowedNetworks(webhooks.AllowedNetworks),
+		wallet.WithScheduleRetries(schedules.MaxAttempts, schedules.RetryBackoff), wallet.WithAPIKeyRotationGrace(apiKeys.RotationGrace),
+		wallet.WithAPIKeyPepper([]byte(apiKeys.Pepper))}
+	if fx := config.GetFXConfig(); fx.RatesFile != "" {
+		rates, err := wallet.LoadRatesFile(fx.RatesFile)
+		if err != nil {
+			log.Fatalf("loading FX rates: %v", err)
+		}
+		opts = append(opts, wallet.WithFXRates(rates, fx.QuoteTTL))
+	}
+	if fees := config.GetFeeConfig(); fees.File != "" {
+		schedule, err := wallet.LoadFeeFile(fees.File)
+		if err != nil {
+			log.Fatalf("loading fee schedule: %v", err)
+		}
+		opts = append(opts, wallet.WithFees(schedule))
+	}
+	if limits := config.GetLimitConfig(); limits.File != "" {
+		schedule, err := wallet.LoadLimitFile(limits.File)
+		if err != nil {
+			log.Fatalf("loading limits: %v", err)
+		}
+		opts = append(opts, wallet.WithLimits(schedule))
+	}
+
+	if chain := config.GetChainConfig(); chain.SigningKey != "" {
+		key, err := wallet.ParseChainSigningKey(chain.SigningKey)
+		if err != nil {
+			log.Fatalf("loading CHAIN_SIGNING_KEY: %v", err)
+		}
+		opts = append(opts, wallet.WithChainSigningKey(key))
+	} else {
+		log.Println("CHAIN_SIGNING_KEY not set, chain checkpoints are not signed")
+	}
+
+	svc := wallet.NewService(repo, opts...)
+
+	// Background workers run until the server has drained its requests
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	start := func(run func(context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run(workerCtx)
+		}()
+	}
+
+	// Release expired holds in the background
+	start(wallet.NewHoldSweeper(svc, holds.SweepInterval).Run)
+
+	// Send webhook deliveries and retry failed ones
+	start(wallet.NewWebhookDispatcher(svc, webhooks.DispatchInterval).Run)
+
+	// Run due scheduled transfers
+	start(wallet.NewTransferScheduler(svc, schedules.Interval).Run)
+
+	// Snapshot wallet balances daily for point-in-time queries
+	start(wallet.NewBalanceSnapshotter(svc, config.GetSnapshotConfig().Interval).Run)
+
+	// Check stored balances against the journal
+	start(wallet.NewLedgerChecker(svc, config.GetLedgerCheckConfig().Interval).Run)
+
+	// Forget nonces of signed requests once their replay window has ended
+	start(wallet.NewNonceSweeper(svc, apiKeys.NonceSweepInterval).Run)
+
+	// Delete Idempotency-Keys once their retention has ended
+	start(wallet.NewIdempotencySweeper(idem, config.GetIdempotencyConfig().SweepInterval).Run)
+
+	// Publish outbox events when a destination is configured
+	var outboxFile io.Closer
+	if outbox := config.GetOutboxConfig(); outbox.File != "" {
+		publisher, err := wallet.NewFilePublisher(outbox.File)
+		if err != nil {
+			log.Fatalf("opening outbox file: %v", err)
+		}
+		outboxFile = publisher
+		start(wallet.NewOutboxRelay(svc, publisher, outbox.RelayInterval).Run)
+	}
+
+	// Every request needs a bearer token or an API key signature unless
+	// authentication is turned off. The first API client is issued by an admin
+	// with a bearer token, so JWT keys are required either way, and so is the
+	// pepper API keys are derived with.
+	var authenticate func(http.Handler) http.Handler
+	if auth := config.GetAuthConfig(); auth.Disabled {
+		log.Println("Authentication is disabled, any caller can use any wallet")
+	} else {
+		verifier := wallet.NewJWTVerifier(auth.Issuer, auth.Audience)
+		if auth.HMACSecret != "" {
+			if err := verifier.AddHMACKey("", []byte(auth.HMACSecret)); err != nil {
+				log.Fatalf("loading JWT_HMAC_SECRET: %v", err)
+			}
+		}
+		if auth.PublicKeyFile != "" {
+			if err := verifier.LoadRSAPublicKeyFile("", auth.PublicKeyFile); err != nil {
+				log.Fatalf("loading JWT public key: %v", err)
+			}
+		}
+		if auth.JWKSFile != "" {
+			if err := verifier.LoadJWKSFile(auth.JWKSFile); err != nil {
+				log.Fatalf("loading JWKS: %v", err)
+			}
+		}
+		if !verifier.HasKeys() {
+			log.Fatalf("no JWT keys: set JWT_HMAC_SECRET, JWT_PUBLIC_KEY_FILE or JWT_JWKS_FILE, or AUTH_DISABLED=true")
+		}
+		if len(apiKeys.Pepper) < wallet.MinAPIKeyPepperLength {
+			log.Fatalf("API_KEY_PEPPER must be at least %d bytes, or AUTH_DISABLED=true", wallet.MinAPIKeyPepperLength)
+		}
+		authenticate = wallet.Authenticate(verifier, wallet.NewSignatureVerifier(svc, apiKeys.SignatureWindow))
+	}
+
+	r := router.Setup(svc, idem, authenticate)
+
+	// A response can not outlive the write timeout, so deadlines past it are never seen by the client
+	srvCfg := config.GetServerConfig()
+	timeouts := config.GetTimeoutConfig()
+	for name, d := range timeouts.Routes {
+		if srvCfg.WriteTimeout > 0 && d >= srvCfg.WriteTimeout {
+			log.Printf("ROUTE_TIMEOUTS %s=%s is not below SERVER_WRITE_TIMEOUT %s, its responses may be cut off", name, d, srvCfg.WriteTimeout)
+		}
+	}
+	if srvCfg.WriteTimeout > 0 && timeouts.Default >= srvCfg.WriteTimeout {
+		log.Printf("REQUEST_TIMEOUT %s is not below SERVER_WRITE_TIMEOUT %s, responses may be cut off", timeouts.Default, srvCfg.WriteTimeout)
+	}
+
+	// Serve until SIGTERM or Ctrl-C; a second signal ends the process at once
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	context.AfterFunc(ctx, stop)
+	exitCode := 0
+	if err := server.Run(ctx, server.New(srvCfg, r), srvCfg); err != nil {
+		log.Printf("Server error: %v", err)
+		exitCode = 1
+	}
+
+	// Stop the workers, cancelling the run they are in, before the outbox
+	// file and the DB pool they use are closed
+	stopWorkers()
+	workers.Wait()
+	if outboxFile != nil {
+		outboxFile.Close()
+	}
+	if pool != nil {
+		pool.Close()
+	}
+	log.Println("Server stopped")
+	os.Exit(exitCode)
 }
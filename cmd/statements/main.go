@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"wallet-go/pkg/db"
+	"wallet-go/pkg/wallet"
+)
+
+// statements writes the statements of one calendar month for every wallet, or
+// for one wallet, to files named <out>/<YYYY-MM>/<wallet_id>.<format>. It is
+// meant to run as a month-end batch job, e.g. from cron on the 1st.
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	lastMonth := time.Now().UTC().AddDate(0, -1, 0).Format("2006-01")
+	month := flag.String("month", lastMonth, "month to report, YYYY-MM (UTC)")
+	format := flag.String("format", wallet.StatementHTML, "json, csv or html")
+	out := flag.String("out", "statements", "directory the statements are written to")
+	walletFlag := flag.String("wallet", "", "only write the statement of this wallet")
+	flag.Parse()
+
+	from, err := time.Parse("2006-01", *month)
+	if err != nil {
+		log.Fatalf("invalid -month %q (must be YYYY-MM)", *month)
+	}
+	to := from.AddDate(0, 1, 0)
+	if *format != wallet.StatementJSON && *format != wallet.StatementCSV && *format != wallet.StatementHTML {
+		log.Fatalf("invalid -format %q (must be json, csv or html)", *format)
+	}
+
+	conn := db.InitPostgres()
+	defer conn.Close()
+	svc := wallet.NewService(wallet.NewPostgresRepository(conn))
+	ctx := context.Background()
+
+	var walletIDs []uuid.UUID
+	if *walletFlag != "" {
+		id, err := uuid.Parse(*walletFlag)
+		if err != nil {
+			log.Fatalf("invalid -wallet %q (must be UUID)", *walletFlag)
+		}
+		walletIDs = []uuid.UUID{id}
+	} else if walletIDs, err = svc.ListWalletIDs(ctx); err != nil {
+		log.Fatalf("listing wallets: %v", err)
+	}
+
+	dir := filepath.Join(*out, *month)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatalf("creating %s: %v", dir, err)
+	}
+
+	failed := 0
+	for _, id := range walletIDs {
+		if err := writeStatement(ctx, svc, id, from, to, *format, dir); err != nil {
+			log.Printf("statement of wallet %s: %v", id, err)
+			failed++
+		}
+	}
+	log.Printf("Wrote %d of %d statements for %s to %s", len(walletIDs)-failed, len(walletIDs), *month, dir)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// writeStatement builds the statement of one wallet and writes it to its file.
+func writeStatement(ctx context.Context, svc wallet.Service, walletID uuid.UUID, from, to time.Time, format, dir string) error {
+	st, err := svc.GetStatement(ctx, walletID, from, to)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s.%s", walletID, format))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := st.Write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
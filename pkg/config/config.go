@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	"log"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type DBConfig struct {
@@ -16,6 +20,95 @@ type DBConfig struct {
 	SSLMode  string
 }
 
+type ServerConfig struct {
+	Addr              string        // Listen address, e.g. ":8080"
+	ReadTimeout       time.Duration // Time to read a whole request, body included
+	ReadHeaderTimeout time.Duration // Time to read the request headers
+	WriteTimeout      time.Duration // Time from the end of the request headers to the end of the response
+	IdleTimeout       time.Duration // How long an idle keep-alive connection is kept open
+	MaxHeaderBytes    int           // Largest accepted request header
+	TLSCertFile       string        // PEM certificate, TLS is served when it and TLSKeyFile are set
+	TLSKeyFile        string        // PEM private key of TLSCertFile
+	ShutdownTimeout   time.Duration // Time in-flight requests get to finish on SIGTERM
+}
+
+type StorageConfig struct {
+	Backend string // "postgres" (default) or "memory"
+}
+
+type IdempotencyConfig struct {
+	Retention     time.Duration // How long an Idempotency-Key and its stored response are kept
+	SweepInterval time.Duration // How often expired keys are deleted
+}
+
+type FXConfig struct {
+	RatesFile string        // JSON file of "FROM/TO": "rate" pairs, cross-currency transfers are off when empty
+	QuoteTTL  time.Duration // How long an FX quote can be executed
+}
+
+type FeeConfig struct {
+	File string // JSON file of fee rules, no fees are charged when empty
+}
+
+type LimitConfig struct {
+	File string // JSON file of limits per wallet tier, only wallet overrides apply when empty
+}
+
+type OutboxConfig struct {
+	File          string        // NDJSON file the relay publishes events to, the relay does not run when empty
+	RelayInterval time.Duration // How often the relay publishes new events
+}
+
+type WebhookConfig struct {
+	Timeout          time.Duration  // Time a receiver has to answer a delivery
+	DispatchInterval time.Duration  // How often due deliveries are sent
+	AllowedNetworks  []netip.Prefix // Internal networks webhooks may still be sent to
+}
+
+type ChainConfig struct {
+	SigningKey string // Base64 Ed25519 seed that signs chain checkpoints, unsigned when empty
+}
+
+type ScheduleConfig struct {
+	Interval     time.Duration // How often due scheduled transfers are run
+	MaxAttempts  int           // Attempts per run before it is skipped
+	RetryBackoff time.Duration // Delay after the first failed attempt, doubled after each one
+}
+
+type SnapshotConfig struct {
+	Interval time.Duration // How often a missing daily balance snapshot is taken
+}
+
+type LedgerCheckConfig struct {
+	Interval time.Duration // How often the server checks the ledger
+}
+
+type AuthConfig struct {
+	Disabled      bool   // Serve the API without authentication, only meant for local demos
+	HMACSecret    string // HS256 key of bearer tokens
+	PublicKeyFile string // PEM RSA public key of RS256 bearer tokens
+	JWKSFile      string // Local JWKS file with RSA and oct signing keys
+	Issuer        string // Required iss claim, not checked when empty
+	Audience      string // Required aud claim, not checked when empty
+}
+
+type APIKeyConfig struct {
+	SignatureWindow    time.Duration // Clock skew allowed on signed requests, and how long nonces are kept
+	RotationGrace      time.Duration // How long the previous key of a client works after a rotation
+	NonceSweepInterval time.Duration // How often expired nonces are deleted
+	Pepper             string        // Server secret API keys are derived with, kept out of the database
+}
+
+type TimeoutConfig struct {
+	Default time.Duration            // Deadline of a request, no deadline when zero
+	Routes  map[string]time.Duration // Deadlines of single routes by name, e.g. GetStatement
+}
+
+type HoldConfig struct {
+	DefaultTTL    time.Duration // Expiry of holds created without expires_in
+	SweepInterval time.Duration // How often expired holds are released
+}
+
 // LoadEnv loads the .env file
 func LoadEnv() {
 	if err := godotenv.Load(); err != nil {
@@ -50,3 +143,240 @@ func (cfg DBConfig) GetDefaultDSN() string {
 		cfg.User, cfg.Password, cfg.Host, cfg.Port,
 	)
 }
+
+// GetServerConfig returns the HTTP server configuration
+func GetServerConfig() ServerConfig {
+	addr := os.Getenv("SERVER_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	return ServerConfig{
+		Addr:              addr,
+		ReadTimeout:       getDuration("SERVER_READ_TIMEOUT", 15*time.Second),
+		ReadHeaderTimeout: getDuration("SERVER_READ_HEADER_TIMEOUT", 5*time.Second),
+		WriteTimeout:      getDuration("SERVER_WRITE_TIMEOUT", 30*time.Second),
+		IdleTimeout:       getDuration("SERVER_IDLE_TIMEOUT", 2*time.Minute),
+		MaxHeaderBytes:    getInt("SERVER_MAX_HEADER_BYTES", 1<<20),
+		TLSCertFile:       os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:        os.Getenv("TLS_KEY_FILE"),
+		ShutdownTimeout:   getDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+}
+
+// TLS reports whether the server is configured to serve TLS
+func (cfg ServerConfig) TLS() bool {
+	return cfg.TLSCertFile != "" && cfg.TLSKeyFile != ""
+}
+
+// GetStorageConfig returns the storage backend configuration
+func GetStorageConfig() StorageConfig {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "postgres"
+	}
+	return StorageConfig{Backend: backend}
+}
+
+// GetIdempotencyConfig returns the Idempotency-Key configuration
+func GetIdempotencyConfig() IdempotencyConfig {
+	return IdempotencyConfig{
+		Retention:     getDuration("IDEMPOTENCY_RETENTION", 24*time.Hour),
+		SweepInterval: getDuration("IDEMPOTENCY_SWEEP_INTERVAL", 10*time.Minute),
+	}
+}
+
+// GetFXConfig returns the exchange rate configuration
+func GetFXConfig() FXConfig {
+	return FXConfig{
+		RatesFile: os.Getenv("FX_RATES_FILE"),
+		QuoteTTL:  getDuration("FX_QUOTE_TTL", 30*time.Second),
+	}
+}
+
+// GetFeeConfig returns the fee schedule configuration
+func GetFeeConfig() FeeConfig {
+	return FeeConfig{File: os.Getenv("FEES_FILE")}
+}
+
+// GetLimitConfig returns the limit schedule configuration
+func GetLimitConfig() LimitConfig {
+	return LimitConfig{File: os.Getenv("LIMITS_FILE")}
+}
+
+// GetOutboxConfig returns the outbox relay configuration
+func GetOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		File:          os.Getenv("OUTBOX_FILE"),
+		RelayInterval: getDuration("OUTBOX_RELAY_INTERVAL", time.Second),
+	}
+}
+
+// GetWebhookConfig returns the webhook delivery configuration
+func GetWebhookConfig() WebhookConfig {
+	cfg := WebhookConfig{
+		Timeout:          getDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		DispatchInterval: getDuration("WEBHOOK_DISPATCH_INTERVAL", 5*time.Second),
+	}
+	// WEBHOOK_ALLOWED_NETWORKS is a list of CIDRs or addresses, e.g. "10.20.0.0/16,192.168.1.5"
+	for _, val := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_NETWORKS"), ",") {
+		val = strings.TrimSpace(val)
+		if val == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(val)
+			if addrErr != nil {
+				log.Printf("invalid WEBHOOK_ALLOWED_NETWORKS entry %q, ignoring it", val)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.AllowedNetworks = append(cfg.AllowedNetworks, prefix)
+	}
+	return cfg
+}
+
+// GetChainConfig returns the hash chain configuration
+func GetChainConfig() ChainConfig {
+	return ChainConfig{SigningKey: os.Getenv("CHAIN_SIGNING_KEY")}
+}
+
+// GetScheduleConfig returns the scheduled transfer configuration
+func GetScheduleConfig() ScheduleConfig {
+	return ScheduleConfig{
+		Interval:     getDuration("SCHEDULE_INTERVAL", time.Minute),
+		MaxAttempts:  getInt("SCHEDULE_MAX_ATTEMPTS", 3),
+		RetryBackoff: getDuration("SCHEDULE_RETRY_BACKOFF", 15*time.Minute),
+	}
+}
+
+// GetSnapshotConfig returns the balance snapshot configuration
+func GetSnapshotConfig() SnapshotConfig {
+	return SnapshotConfig{
+		Interval: getDuration("SNAPSHOT_INTERVAL", time.Hour),
+	}
+}
+
+// GetLedgerCheckConfig returns the ledger integrity check configuration
+func GetLedgerCheckConfig() LedgerCheckConfig {
+	return LedgerCheckConfig{
+		Interval: getDuration("LEDGER_CHECK_INTERVAL", 24*time.Hour),
+	}
+}
+
+// GetAuthConfig returns the bearer token configuration
+func GetAuthConfig() AuthConfig {
+	return AuthConfig{
+		Disabled:      getBool("AUTH_DISABLED", false),
+		HMACSecret:    os.Getenv("JWT_HMAC_SECRET"),
+		PublicKeyFile: os.Getenv("JWT_PUBLIC_KEY_FILE"),
+		JWKSFile:      os.Getenv("JWT_JWKS_FILE"),
+		Issuer:        os.Getenv("JWT_ISSUER"),
+		Audience:      os.Getenv("JWT_AUDIENCE"),
+	}
+}
+
+// GetAPIKeyConfig returns the API key request signing configuration
+func GetAPIKeyConfig() APIKeyConfig {
+	return APIKeyConfig{
+		SignatureWindow:    getDuration("API_SIGNATURE_WINDOW", 5*time.Minute),
+		RotationGrace:      getDuration("API_KEY_ROTATION_GRACE", 24*time.Hour),
+		NonceSweepInterval: getDuration("API_NONCE_SWEEP_INTERVAL", 10*time.Minute),
+		Pepper:             os.Getenv("API_KEY_PEPPER"),
+	}
+}
+
+// GetHoldConfig returns the hold expiry configuration
+func GetHoldConfig() HoldConfig {
+	return HoldConfig{
+		DefaultTTL:    getDuration("HOLD_DEFAULT_TTL", 7*24*time.Hour),
+		SweepInterval: getDuration("HOLD_SWEEP_INTERVAL", time.Minute),
+	}
+}
+
+// GetTimeoutConfig returns the request deadline configuration
+func GetTimeoutConfig() TimeoutConfig {
+	cfg := TimeoutConfig{
+		Default: getTimeout("REQUEST_TIMEOUT", 10*time.Second),
+		Routes:  map[string]time.Duration{},
+	}
+	// ROUTE_TIMEOUTS is a list of Name=duration pairs, e.g. "GetStatement=60s,Transfer=5s"
+	for _, pair := range strings.Split(os.Getenv("ROUTE_TIMEOUTS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, val, _ := strings.Cut(pair, "=")
+		d, err := time.ParseDuration(strings.TrimSpace(val))
+		if err != nil || d < 0 {
+			log.Printf("invalid ROUTE_TIMEOUTS entry %q, using default %s", pair, cfg.Default)
+			continue
+		}
+		cfg.Routes[strings.TrimSpace(name)] = d
+	}
+	return cfg
+}
+
+// For returns the deadline of the named route
+func (cfg TimeoutConfig) For(route string) time.Duration {
+	if d, ok := cfg.Routes[route]; ok {
+		return d
+	}
+	return cfg.Default
+}
+
+// getDuration reads a positive Go duration (e.g. "24h") from the environment, falling back to def
+func getDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		log.Printf("invalid %s %q, using default %s", key, val, def)
+		return def
+	}
+	return d
+}
+
+// getTimeout reads a Go duration where 0 turns the timeout off, falling back to def
+func getTimeout(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s %q, using default %s", key, val, def)
+		return def
+	}
+	return d
+}
+
+// getInt reads a positive integer from the environment, falling back to def
+func getInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		log.Printf("invalid %s %q, using default %d", key, val, def)
+		return def
+	}
+	return n
+}
+
+// getBool reads a boolean (e.g. "true") from the environment, falling back to def
+func getBool(key string, def bool) bool {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		log.Printf("invalid %s %q, using default %t", key, val, def)
+		return def
+	}
+	return b
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		val  string
+		want time.Duration
+	}{
+		{"unset", "", time.Minute},
+		{"valid", "90s", 90 * time.Second},
+		{"invalid", "soon", time.Minute},
+		{"zero", "0s", time.Minute},
+		{"negative", "-5m", time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TEST_DURATION", tc.val)
+			assert.Equal(t, tc.want, getDuration("TEST_DURATION", time.Minute))
+		})
+	}
+}
+
+func TestGetScheduleConfig_ZeroIntervalFallsBack(t *testing.T) {
+	// A zero interval would panic in time.NewTicker
+	t.Setenv("SCHEDULE_INTERVAL", "0")
+	assert.Equal(t, time.Minute, GetScheduleConfig().Interval)
+}
+
+func TestGetTimeoutConfig(t *testing.T) {
+	t.Setenv("REQUEST_TIMEOUT", "-1s")
+	t.Setenv("ROUTE_TIMEOUTS", "GetStatement=60s, Transfer=-5s,Withdraw=later")
+
+	cfg := GetTimeoutConfig()
+	assert.Equal(t, 10*time.Second, cfg.Default)
+	assert.Equal(t, map[string]time.Duration{"GetStatement": time.Minute}, cfg.Routes)
+	assert.Equal(t, 10*time.Second, cfg.For("Transfer"))
+
+	// 0 turns the deadline off rather than falling back
+	t.Setenv("REQUEST_TIMEOUT", "0")
+	t.Setenv("ROUTE_TIMEOUTS", "GetStatement=0s")
+	cfg = GetTimeoutConfig()
+	assert.Equal(t, time.Duration(0), cfg.Default)
+	assert.Equal(t, time.Duration(0), cfg.For("GetStatement"))
+}
@@ -1,25 +1,314 @@
 -- Create extension for UUID support
 CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
 
+-- Table: users
+-- Owners of wallets, created with their first wallet
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY,                                  -- User ID supplied by the client
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 -- Table: wallets
 CREATE TABLE IF NOT EXISTS wallets (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique wallet ID
-    user_id UUID NOT NULL UNIQUE,                                -- ID of the user who owns the wallet
+    user_id UUID NOT NULL REFERENCES users(id),           -- ID of the user who owns the wallet, a user can have many
+    label VARCHAR(64) NOT NULL DEFAULT '',                -- Optional name given by the user
+    type VARCHAR(10) NOT NULL DEFAULT 'spending' CHECK (type IN ('spending', 'savings', 'business', 'revenue')),  -- Kind of wallet
     balance BIGINT NOT NULL DEFAULT 0,                    -- Balance in smallest currency unit (e.g., cents)
+    currency CHAR(3) NOT NULL DEFAULT 'USD',              -- ISO 4217 currency of the wallet
+    held BIGINT NOT NULL DEFAULT 0 CHECK (held >= 0),    -- Sum of active holds, available = balance - held
+    status VARCHAR(10) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'closed')),  -- Lifecycle state
+    inbound_blocked BOOLEAN NOT NULL DEFAULT FALSE,       -- Wallet can not receive deposits or transfers
+    outbound_blocked BOOLEAN NOT NULL DEFAULT FALSE,      -- Wallet can not send withdrawals, holds or transfers
+    tier VARCHAR(32) NOT NULL DEFAULT 'standard',         -- Limit tier, see LIMITS_FILE
+    limit_overrides JSONB,                                -- Wallet specific limits replacing those of the tier (nullable)
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: api_clients
+-- Server-to-server callers that sign their requests with an API key
+CREATE TABLE IF NOT EXISTS api_clients (
+    id UUID PRIMARY KEY,                                  -- Client ID, sent in the X-Client-ID header
+    name VARCHAR(100) NOT NULL,                           -- Who the client is, e.g. the calling service
+    scopes TEXT[] NOT NULL,                               -- read, deposit, withdraw, transfer or admin
+    key_prefix VARCHAR(16) NOT NULL,                      -- Start of the current key, to tell keys apart
+    key_seed CHAR(64) NOT NULL,                           -- Hex random seed the current key is derived from with API_KEY_PEPPER, never the key itself
+    prev_key_seed CHAR(64),                               -- Seed of the key replaced by the last rotation
+    prev_key_expires_at TIMESTAMP,                        -- The replaced key is accepted until this time
+    revoked_at TIMESTAMP,                                 -- No request is accepted after a revocation
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Table: api_nonces
+-- Nonces of signed requests, kept for the replay window so a request is accepted once
+CREATE TABLE IF NOT EXISTS api_nonces (
+    client_id UUID NOT NULL REFERENCES api_clients(id),
+    nonce VARCHAR(128) NOT NULL,                          -- X-Nonce header of the request
+    expires_at TIMESTAMP NOT NULL,                        -- End of the replay window of the request
+    PRIMARY KEY (client_id, nonce)
+);
+
 -- Table: transactions
 CREATE TABLE IF NOT EXISTS transactions (
     id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique transaction ID
     from_wallet UUID REFERENCES wallets(id) ON DELETE SET NULL,  -- Sender's wallet (nullable for deposits)
     to_wallet UUID REFERENCES wallets(id) ON DELETE SET NULL,    -- Receiver's wallet (nullable for withdrawals)
     amount BIGINT NOT NULL CHECK (amount > 0),            -- Transaction amount must be positive
-    type VARCHAR(20) NOT NULL CHECK (type IN ('deposit', 'withdrawal', 'transfer')),  -- Transaction type
+    currency CHAR(3) NOT NULL DEFAULT 'USD',              -- ISO 4217 currency of the amount
+    type VARCHAR(20) NOT NULL CHECK (type IN ('deposit', 'withdrawal', 'transfer', 'capture', 'reversal')),  -- Transaction type
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    target_amount BIGINT CHECK (target_amount > 0),      -- Amount credited to the receiver (cross-currency transfers only)
+    target_currency CHAR(3),                              -- Currency of the receiver (cross-currency transfers only)
+    fx_rate VARCHAR(40),                                  -- Rate used, target major units per source major unit
+    fx_rounding_mode VARCHAR(16),                         -- Rounding applied to the target amount
+    fx_quote_id UUID,                                     -- Executed quote (NULL when converted at the spot rate)
+    reverses_id UUID REFERENCES transactions(id),         -- Original transaction of a reversal
+    reason TEXT,                                          -- Why a reversal was made
+    fees JSONB,                                           -- Fee items charged to the sender on top of amount, NULL when none
+    reversed_amount BIGINT NOT NULL DEFAULT 0 CHECK (reversed_amount >= 0 AND reversed_amount <= amount),  -- Part of the amount reversed so far
+    chain_seq BIGINT UNIQUE,                              -- Position in the hash chain (NULL for rows older than the chain)
+    prev_hash CHAR(64),                                   -- Hash of the previous link, all zeros for the first one
+    hash CHAR(64),                                        -- SHA-256 over the canonical fields and prev_hash
+    client_id UUID REFERENCES api_clients(id)             -- API client that made the transaction (NULL for users and background jobs)
+);
+
+-- Table: transaction_chain_head
+-- Last link of the transaction hash chain, locked by every insert so links are appended one at a time
+CREATE TABLE IF NOT EXISTS transaction_chain_head (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),       -- Single row
+    seq BIGINT NOT NULL,                                  -- chain_seq of the last transaction, 0 while the chain is empty
+    hash CHAR(64) NOT NULL                                -- hash of the last transaction
+);
+
+INSERT INTO transaction_chain_head (id, seq, hash) VALUES
+    (TRUE, 0, '0000000000000000000000000000000000000000000000000000000000000000')
+ON CONFLICT (id) DO NOTHING;
+
+-- Table: chain_checkpoints
+-- Signed commitments to the hash chain every 1000 links; inclusion proofs end at the next one
+CREATE TABLE IF NOT EXISTS chain_checkpoints (
+    seq BIGINT PRIMARY KEY,                               -- chain_seq of the link
+    hash CHAR(64) NOT NULL,                               -- hash of that link
+    signature TEXT NOT NULL DEFAULT '',                   -- Base64 Ed25519 signature of "seq.hash" (empty without a signing key)
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
+-- Table: ledger_accounts
+-- Internal accounts that sit on the other side of money entering or leaving the system
+CREATE TABLE IF NOT EXISTS ledger_accounts (
+    id UUID PRIMARY KEY,                                  -- Fixed account ID (see constants.go)
+    code VARCHAR(32) NOT NULL UNIQUE,                     -- Machine readable account code
+    name VARCHAR(100) NOT NULL,                           -- Human readable account name
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO ledger_accounts (id, code, name) VALUES
+    ('00000000-0000-0000-0000-000000000001', 'cash_in', 'Cash in (deposits clearing)'),
+    ('00000000-0000-0000-0000-000000000002', 'cash_out', 'Cash out (withdrawals clearing)'),
+    ('00000000-0000-0000-0000-000000000004', 'fx', 'FX position (cross-currency transfers)')
+ON CONFLICT (id) DO NOTHING;
+
+-- Table: ledger_entries
+-- Double-entry journal. Every transaction posts debit and credit lines that sum to the same amount
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique entry ID
+    transaction_id UUID NOT NULL REFERENCES transactions(id) ON DELETE CASCADE,  -- Transaction the entry belongs to
+    account_id UUID NOT NULL,                             -- Wallet ID or ledger_accounts ID
+    direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')),  -- Side of the entry
+    amount BIGINT NOT NULL CHECK (amount > 0),            -- Entry amount must be positive
+    currency CHAR(3) NOT NULL DEFAULT 'USD',              -- ISO 4217 currency of the amount
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: fx_quotes
+-- Priced cross-currency transfers, executable once before they expire
+CREATE TABLE IF NOT EXISTS fx_quotes (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique quote ID
+    from_wallet UUID NOT NULL REFERENCES wallets(id),     -- Wallet to debit
+    to_wallet UUID NOT NULL REFERENCES wallets(id),       -- Wallet to credit
+    source_amount BIGINT NOT NULL CHECK (source_amount > 0),  -- Amount debited, in minor units of source_currency
+    source_currency CHAR(3) NOT NULL,                     -- Currency of the sender
+    target_amount BIGINT NOT NULL CHECK (target_amount > 0),  -- Amount credited, in minor units of target_currency
+    target_currency CHAR(3) NOT NULL,                     -- Currency of the receiver
+    rate VARCHAR(40) NOT NULL,                            -- Target major units per source major unit
+    rounding_mode VARCHAR(16) NOT NULL,                   -- Rounding applied to the target amount
+    expires_at TIMESTAMP NOT NULL,                        -- Quote can not be executed after this
+    transaction_id UUID REFERENCES transactions(id),      -- Set once the quote is executed
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: holds
+-- Funds reserved on a wallet until they are captured, voided or the hold expires
+CREATE TABLE IF NOT EXISTS holds (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique hold ID
+    wallet_id UUID NOT NULL REFERENCES wallets(id),       -- Wallet the funds are reserved on
+    amount BIGINT NOT NULL CHECK (amount > 0),            -- Reserved amount in minor units
+    currency CHAR(3) NOT NULL,                            -- ISO 4217 currency of the amount
+    captured_amount BIGINT NOT NULL DEFAULT 0 CHECK (captured_amount >= 0 AND captured_amount <= amount),  -- Amount taken by the capture
+    status VARCHAR(10) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'captured', 'voided', 'expired')),  -- Hold status
+    expires_at TIMESTAMP NOT NULL,                        -- Hold is released by the sweeper after this
+    transaction_id UUID REFERENCES transactions(id),      -- Capture transaction
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: wallet_state_events
+-- Audit log of every status or block change made by an admin
+CREATE TABLE IF NOT EXISTS wallet_state_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),       -- Unique event ID
+    wallet_id UUID NOT NULL REFERENCES wallets(id),       -- Wallet that was changed
+    from_status VARCHAR(10) NOT NULL,                     -- Status before the change
+    to_status VARCHAR(10) NOT NULL,                       -- Status after the change
+    inbound_blocked BOOLEAN NOT NULL,                     -- Inbound block after the change
+    outbound_blocked BOOLEAN NOT NULL,                    -- Outbound block after the change
+    actor VARCHAR(255) NOT NULL,                          -- Who made the change
+    reason TEXT NOT NULL,                                 -- Why the change was made
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: outbox_events
+-- Domain events written in the same DB transaction as the change they describe, published by the outbox relay
+CREATE TABLE IF NOT EXISTS outbox_events (
+    seq BIGSERIAL PRIMARY KEY,                            -- Publishing order
+    id UUID NOT NULL UNIQUE,                              -- Unique event ID, lets consumers drop duplicates
+    type VARCHAR(32) NOT NULL,                            -- Event type, e.g. FundsDeposited or HoldCaptured
+    wallet_id UUID NOT NULL REFERENCES wallets(id),       -- Wallet the event is about, the sender for transfers
+    payload JSONB NOT NULL,                               -- The created wallet or the transaction
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_at TIMESTAMP,                               -- Set once the relay has published the event (nullable)
+    claimed_until TIMESTAMP                               -- Until when a relay publishes the event (nullable)
+);
+
+-- Table: webhook_subscriptions
+-- URLs receiving the events of one wallet or of every wallet of one user
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id UUID PRIMARY KEY,                                  -- Unique subscription ID
+    wallet_id UUID REFERENCES wallets(id),                -- Wallet whose events are sent (nullable for user subscriptions)
+    user_id UUID REFERENCES users(id),                    -- User whose wallets' events are sent (nullable for wallet subscriptions)
+    url TEXT NOT NULL,                                    -- Where events are POSTed
+    event_types TEXT[] NOT NULL DEFAULT '{}',             -- Events sent, all when empty
+    secret TEXT NOT NULL,                                 -- HMAC-SHA256 key of the signature header
+    active BOOLEAN NOT NULL DEFAULT TRUE,                 -- Inactive subscriptions get no new deliveries
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK ((wallet_id IS NULL) <> (user_id IS NULL))
+);
+
+-- Table: webhook_deliveries
+-- One event to send to one subscription, retried with backoff until delivered or dead
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id UUID PRIMARY KEY,                                  -- Unique delivery ID, sent in the X-Webhook-Delivery header
+    subscription_id UUID NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_id UUID NOT NULL,                               -- Outbox event that is sent
+    event_type VARCHAR(32) NOT NULL,
+    payload JSONB NOT NULL,                               -- Request body
+    status VARCHAR(16) NOT NULL,                          -- pending, delivered or dead
+    attempts INTEGER NOT NULL DEFAULT 0,                  -- Failed attempts since created or replayed
+    next_attempt_at TIMESTAMP NOT NULL,                   -- When a pending delivery is sent next
+    last_error TEXT NOT NULL DEFAULT '',                  -- Why the last attempt failed
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    claim_id UUID,                                        -- Set while a dispatcher sends the delivery (nullable)
+    UNIQUE (subscription_id, event_id)
+);
+
+-- Table: webhook_attempts
+-- Log of every request made for a delivery
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+    id UUID PRIMARY KEY,
+    delivery_id UUID NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    status_code INTEGER,                                  -- HTTP status of the response (nullable when there was none)
+    error TEXT NOT NULL DEFAULT '',                       -- Why the attempt failed
+    duration_ms BIGINT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: scheduled_transfers
+-- One-off or recurring transfers made by the scheduler
+CREATE TABLE IF NOT EXISTS scheduled_transfers (
+    id UUID PRIMARY KEY,
+    from_wallet UUID NOT NULL REFERENCES wallets(id),
+    to_wallet UUID NOT NULL REFERENCES wallets(id),
+    amount BIGINT NOT NULL CHECK (amount > 0),            -- Amount of each run in minor units
+    currency CHAR(3) NOT NULL,
+    frequency VARCHAR(16) NOT NULL,                       -- once, daily, weekly, monthly or cron
+    cron VARCHAR(128) NOT NULL DEFAULT '',                -- Five field cron expression (UTC) for the cron frequency
+    start_at TIMESTAMP NOT NULL,                          -- First possible run, recurrences are counted from it
+    end_at TIMESTAMP,                                     -- No run after this time (nullable)
+    max_runs INTEGER NOT NULL DEFAULT 0,                  -- Completed after this many transfers, 0 for unlimited
+    run_count INTEGER NOT NULL DEFAULT 0,                 -- Transfers made so far
+    status VARCHAR(16) NOT NULL,                          -- active, paused, completed or canceled
+    next_run_at TIMESTAMP,                                -- Scheduled time of the next run (NULL once finished)
+    attempts INTEGER NOT NULL DEFAULT 0,                  -- Failed attempts of the next run
+    next_attempt_at TIMESTAMP,                            -- When the next run is attempted, later than next_run_at on retries
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: schedule_runs
+-- Every attempt of a scheduled transfer
+CREATE TABLE IF NOT EXISTS schedule_runs (
+    id UUID PRIMARY KEY,
+    schedule_id UUID NOT NULL REFERENCES scheduled_transfers(id),
+    scheduled_for TIMESTAMP NOT NULL,                     -- Scheduled time of the run
+    attempt INTEGER NOT NULL,
+    status VARCHAR(16) NOT NULL,                          -- succeeded, failed or skipped
+    idempotency_key VARCHAR(255) UNIQUE,                  -- Set on succeeded runs so a run never moves money twice
+    transaction_id UUID,                                  -- Transfer made by the run (nullable)
+    error TEXT NOT NULL DEFAULT '',                       -- Why the attempt failed
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Table: balance_snapshots
+-- Daily ledger balance of every wallet, so point-in-time balances only replay the journal since the last snapshot
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+    wallet_id UUID NOT NULL REFERENCES wallets(id),
+    currency CHAR(3) NOT NULL,                            -- ISO 4217 currency of the balance
+    as_of TIMESTAMP NOT NULL,                             -- Balance after every transaction created before this time
+    balance BIGINT NOT NULL,                              -- Ledger balance in minor units
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (wallet_id, as_of)
+);
+
+-- Table: idempotency_keys
+-- Outcome of money-moving requests sent with an Idempotency-Key header, replayed on retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope VARCHAR(64) NOT NULL DEFAULT '',                -- Caller owning the key: user:<id>, client:<id> or empty without auth
+    key VARCHAR(255) NOT NULL,                            -- Client supplied Idempotency-Key
+    fingerprint CHAR(64) NOT NULL,                        -- SHA-256 of method, path and body of the first request
+    status_code INT,                                      -- Stored HTTP status (NULL while the request is in flight)
+    transaction_id UUID,                                  -- Stored transaction ID (nullable for failed requests)
+    body TEXT,                                            -- Stored response body, problem+json for failed requests (NULL while in flight)
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,                        -- Key can be reused after this time
+    PRIMARY KEY (scope, key)
+);
+
 -- Indexes for performance
-CREATE INDEX IF NOT EXISTS idx_wallet_user_id ON wallets(user_id);
-CREATE INDEX IF NOT EXISTS idx_transactions_wallets ON transactions(from_wallet, to_wallet);
+CREATE INDEX IF NOT EXISTS idx_wallet_user_id ON wallets(user_id, created_at);
+-- Transaction history is read newest first per side of the transfer, see ListTransactions
+CREATE INDEX IF NOT EXISTS idx_transactions_from_history ON transactions(from_wallet, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_transactions_to_history ON transactions(to_wallet, created_at DESC, id DESC);
+CREATE INDEX IF NOT EXISTS idx_transactions_reverses_id ON transactions(reverses_id);
+-- Expired nonces are purged by expiry
+CREATE INDEX IF NOT EXISTS idx_api_nonces_expires_at ON api_nonces(expires_at);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_account ON ledger_entries(account_id, currency);
+CREATE INDEX IF NOT EXISTS idx_ledger_entries_transaction ON ledger_entries(transaction_id);
+-- The relay only reads the unpublished events
+CREATE INDEX IF NOT EXISTS idx_outbox_unpublished ON outbox_events(seq) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_wallet ON webhook_subscriptions(wallet_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_user ON webhook_subscriptions(user_id);
+-- Only pending deliveries are scanned by the dispatcher
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts(delivery_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_from ON scheduled_transfers(from_wallet, created_at);
+-- Only active schedules are scanned by the scheduler
+CREATE INDEX IF NOT EXISTS idx_scheduled_transfers_due ON scheduled_transfers(next_attempt_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_schedule_runs_schedule ON schedule_runs(schedule_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_holds_wallet ON holds(wallet_id);
+-- Only active holds are scanned by the expiry sweeper
+CREATE INDEX IF NOT EXISTS idx_holds_active_expires_at ON holds(expires_at) WHERE status = 'active';
+CREATE INDEX IF NOT EXISTS idx_wallet_state_events_wallet ON wallet_state_events(wallet_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
@@ -1,24 +1,83 @@
 package router
 
 import (
-	"database/sql"
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"wallet-go/pkg/config"
 	"wallet-go/pkg/wallet"
 )
 
-func Setup(db *sql.DB) http.Handler {
+// Setup defines the external APIs on top of the given wallet service. Routes
+// are named after their handler method, which is how ROUTE_TIMEOUTS refers to
+// them. Every request goes through auth, see wallet.Authenticate; a nil auth turns
+// authentication, the ownership checks and the API client scopes off.
+func Setup(svc wallet.Service, idem wallet.IdempotencyStore, auth func(http.Handler) http.Handler) http.Handler {
 	r := mux.NewRouter()
-	s := wallet.NewService(db)
-	h := wallet.NewHandler(s)
-
-	r.HandleFunc("/wallet", h.CreateWallet).Methods("POST")
-	r.HandleFunc("/wallet/{wallet_id}/deposit", h.Deposit).Methods("POST")
-	r.HandleFunc("/wallet/{wallet_id}/withdraw", h.Withdraw).Methods("POST")
-	r.HandleFunc("/wallet/transfer", h.Transfer).Methods("POST")
-	r.HandleFunc("/wallet/{wallet_id}/balance", h.GetBalance).Methods("GET")
-	r.HandleFunc("/wallet/{wallet_id}/transactions", h.GetTransactions).Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(wallet.NotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(wallet.MethodNotAllowed)
+	h := wallet.NewHandler(svc)
+
+	// Every request has a deadline, looked up by the name of its route, that
+	// also covers the database lookups of auth
+	r.Use(wallet.Timeout(config.GetTimeoutConfig().For))
+	if auth != nil {
+		r.Use(auth)
+	}
+
+	// Money-moving endpoints replay stored responses for retried Idempotency-Keys
+	retention := config.GetIdempotencyConfig().Retention
+	idempotent := func(next http.HandlerFunc) http.HandlerFunc {
+		return wallet.Idempotent(idem, retention, next)
+	}
+
+	// API clients need the scope of each route, users are checked by wallet ownership
+	read := func(next http.HandlerFunc) http.HandlerFunc { return wallet.RequireScope(wallet.ScopeRead, next) }
+	deposit := func(next http.HandlerFunc) http.HandlerFunc { return wallet.RequireScope(wallet.ScopeDeposit, next) }
+	withdraw := func(next http.HandlerFunc) http.HandlerFunc { return wallet.RequireScope(wallet.ScopeWithdraw, next) }
+	transfer := func(next http.HandlerFunc) http.HandlerFunc { return wallet.RequireScope(wallet.ScopeTransfer, next) }
+	admin := func(next http.HandlerFunc) http.HandlerFunc { return wallet.RequireScope(wallet.ScopeAdmin, next) }
+
+	r.HandleFunc("/wallet", admin(h.CreateWallet)).Methods("POST").Name("CreateWallet")
+	r.HandleFunc("/users/{user_id}/wallets", read(h.ListWallets)).Methods("GET").Name("ListWallets")
+	r.HandleFunc("/wallet/{wallet_id}/deposit", deposit(idempotent(h.Deposit))).Methods("POST").Name("Deposit")
+	r.HandleFunc("/wallet/{wallet_id}/withdraw", withdraw(idempotent(h.Withdraw))).Methods("POST").Name("Withdraw")
+	r.HandleFunc("/wallet/transfer", transfer(idempotent(h.Transfer))).Methods("POST").Name("Transfer")
+	r.HandleFunc("/wallet/transfer/quote", transfer(h.QuoteTransfer)).Methods("POST").Name("QuoteTransfer")
+	r.HandleFunc("/wallet/transfer/quote/{quote_id}/execute", transfer(idempotent(h.ExecuteQuote))).Methods("POST").Name("ExecuteQuote")
+	r.HandleFunc("/wallet/transactions/{transaction_id}/reverse", admin(idempotent(h.Reverse))).Methods("POST").Name("Reverse")
+	r.HandleFunc("/wallet/transactions/{transaction_id}/proof", read(h.GetInclusionProof)).Methods("GET").Name("GetInclusionProof")
+	r.HandleFunc("/wallet/{wallet_id}/holds", withdraw(h.CreateHold)).Methods("POST").Name("CreateHold")
+	r.HandleFunc("/wallet/holds/{hold_id}", read(h.GetHold)).Methods("GET").Name("GetHold")
+	r.HandleFunc("/wallet/holds/{hold_id}/capture", withdraw(idempotent(h.CaptureHold))).Methods("POST").Name("CaptureHold")
+	r.HandleFunc("/wallet/holds/{hold_id}/void", withdraw(idempotent(h.VoidHold))).Methods("POST").Name("VoidHold")
+	r.HandleFunc("/wallet/{wallet_id}/balance", read(h.GetBalance)).Methods("GET").Name("GetBalance")
+	r.HandleFunc("/wallet/{wallet_id}/fees/preview", read(h.PreviewFees)).Methods("GET").Name("PreviewFees")
+	r.HandleFunc("/wallet/{wallet_id}/transactions", read(h.GetTransactions)).Methods("GET").Name("GetTransactions")
+	r.HandleFunc("/wallet/{wallet_id}/statement", read(h.GetStatement)).Methods("GET").Name("GetStatement")
+	r.HandleFunc("/admin/wallets/{wallet_id}/state", admin(h.ChangeWalletState)).Methods("POST").Name("ChangeWalletState")
+	r.HandleFunc("/admin/wallets/{wallet_id}/state-events", admin(h.GetWalletStateEvents)).Methods("GET").Name("GetWalletStateEvents")
+	r.HandleFunc("/admin/wallets/{wallet_id}/limits", admin(h.GetWalletLimits)).Methods("GET").Name("GetWalletLimits")
+	r.HandleFunc("/admin/wallets/{wallet_id}/limits", admin(h.SetWalletLimits)).Methods("PUT").Name("SetWalletLimits")
+	r.HandleFunc("/admin/revenue", admin(h.ListRevenueWallets)).Methods("GET").Name("ListRevenueWallets")
+	r.HandleFunc("/admin/api-clients", admin(h.IssueAPIClient)).Methods("POST").Name("IssueAPIClient")
+	r.HandleFunc("/admin/api-clients", admin(h.ListAPIClients)).Methods("GET").Name("ListAPIClients")
+	r.HandleFunc("/admin/api-clients/{client_id}/rotate", admin(h.RotateAPIKey)).Methods("POST").Name("RotateAPIKey")
+	r.HandleFunc("/admin/api-clients/{client_id}/revoke", admin(h.RevokeAPIClient)).Methods("POST").Name("RevokeAPIClient")
+	r.HandleFunc("/webhooks", admin(h.CreateWebhook)).Methods("POST").Name("CreateWebhook")
+	r.HandleFunc("/webhooks", read(h.ListWebhooks)).Methods("GET").Name("ListWebhooks")
+	r.HandleFunc("/webhooks/{subscription_id}", read(h.GetWebhook)).Methods("GET").Name("GetWebhook")
+	r.HandleFunc("/webhooks/{subscription_id}", admin(h.UpdateWebhook)).Methods("PUT").Name("UpdateWebhook")
+	r.HandleFunc("/webhooks/{subscription_id}", admin(h.DeleteWebhook)).Methods("DELETE").Name("DeleteWebhook")
+	r.HandleFunc("/webhooks/{subscription_id}/deliveries", read(h.ListWebhookDeliveries)).Methods("GET").Name("ListWebhookDeliveries")
+	r.HandleFunc("/webhooks/deliveries/{delivery_id}/attempts", read(h.ListWebhookAttempts)).Methods("GET").Name("ListWebhookAttempts")
+	r.HandleFunc("/webhooks/deliveries/{delivery_id}/replay", admin(h.ReplayWebhookDelivery)).Methods("POST").Name("ReplayWebhookDelivery")
+	r.HandleFunc("/schedules", transfer(idempotent(h.CreateSchedule))).Methods("POST").Name("CreateSchedule")
+	r.HandleFunc("/schedules/{schedule_id}", read(h.GetSchedule)).Methods("GET").Name("GetSchedule")
+	r.HandleFunc("/schedules/{schedule_id}", transfer(h.UpdateSchedule)).Methods("PUT").Name("UpdateSchedule")
+	r.HandleFunc("/schedules/{schedule_id}", transfer(h.CancelSchedule)).Methods("DELETE").Name("CancelSchedule")
+	r.HandleFunc("/schedules/{schedule_id}/runs", read(h.ListScheduleRuns)).Methods("GET").Name("ListScheduleRuns")
+	r.HandleFunc("/wallet/{wallet_id}/schedules", read(h.ListSchedules)).Methods("GET").Name("ListSchedules")
 
 	return r
 }
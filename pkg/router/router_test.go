@@ -0,0 +1,366 @@
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"wallet-go/pkg/wallet"
+)
+
+// do sends a request through the full HTTP stack and decodes the JSON response into out.
+func do(t *testing.T, h http.Handler, method, path, body string, headers map[string]string, out interface{}) int {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	if out != nil {
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), out))
+	}
+	return res.Code
+}
+
+// TestSetup_InMemoryStack runs the wallet API end to end on the in-memory storage.
+func TestSetup_InMemoryStack(t *testing.T) {
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository()), wallet.NewMemoryIdempotencyStore(), nil)
+
+	var alice, bob struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &alice))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &bob))
+
+	// A retried deposit with the same Idempotency-Key only moves money once
+	key := map[string]string{wallet.IdempotencyKeyHeader: "deposit-1"}
+	var first, retry wallet.TransactionResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, key, &first))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, key, &retry))
+	assert.Equal(t, first.TransactionID, retry.TransactionID)
+
+	transfer := `{"from_id":"` + alice.ID + `","to_id":"` + bob.ID + `","amount":300,"currency":"USD"}`
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/transfer", transfer, nil, nil))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+bob.ID+"/withdraw", `{"amount": 100, "currency": "USD"}`, nil, nil))
+
+	var balance wallet.BalanceResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 700, Ledger: 700, Available: 700, Currency: "USD"}, balance)
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+bob.ID+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 200, Ledger: 200, Available: 200, Currency: "USD"}, balance)
+
+	var page struct {
+		Transactions []map[string]interface{} `json:"transactions"`
+		NextCursor   string                   `json:"next_cursor"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+bob.ID+"/transactions", "", nil, &page))
+	assert.Len(t, page.Transactions, 2)
+
+	// Page through alice's history one transaction at a time
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/transactions?limit=1", "", nil, &page))
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "transfer", page.Transactions[0]["type"])
+	cursor := page.NextCursor
+	page.NextCursor = ""
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/transactions?limit=1&cursor="+cursor, "", nil, &page))
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, "deposit", page.Transactions[0]["type"])
+	assert.Empty(t, page.NextCursor)
+}
+
+// TestSetup_ScheduleReplay retries a schedule creation with the same
+// Idempotency-Key and gets the first response back, schedule included.
+func TestSetup_ScheduleReplay(t *testing.T) {
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository()), wallet.NewMemoryIdempotencyStore(), nil)
+
+	var alice, bob struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &alice))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &bob))
+
+	key := map[string]string{wallet.IdempotencyKeyHeader: "schedule-1"}
+	body := `{"from_id":"` + alice.ID + `","to_id":"` + bob.ID + `","amount":100,"currency":"USD","frequency":"daily"}`
+	var first, retry map[string]interface{}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/schedules", body, key, &first))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/schedules", body, key, &retry))
+	assert.NotEmpty(t, first["id"])
+	assert.Equal(t, first, retry)
+
+	var schedules []map[string]interface{}
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/schedules", "", nil, &schedules))
+	assert.Len(t, schedules, 1)
+}
+
+// TestSetup_CrossCurrencyQuote quotes and executes a USD to EUR transfer through the HTTP API.
+func TestSetup_CrossCurrencyQuote(t *testing.T) {
+	rates, err := wallet.NewStaticRateProvider(map[string]string{"USD/EUR": "0.9"})
+	assert.NoError(t, err)
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository(), wallet.WithFXRates(rates, time.Minute)), wallet.NewMemoryIdempotencyStore(), nil)
+
+	var alice, bob struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &alice))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`","currency":"EUR"}`, nil, &bob))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, nil, nil))
+
+	var quote struct {
+		ID     string       `json:"id"`
+		Target wallet.Money `json:"target"`
+	}
+	body := `{"from_id":"` + alice.ID + `","to_id":"` + bob.ID + `","amount":500,"currency":"USD"}`
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet/transfer/quote", body, nil, &quote))
+	assert.Equal(t, wallet.Money{Amount: 450, Currency: "EUR"}, quote.Target)
+
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/transfer/quote/"+quote.ID+"/execute", "", nil, nil))
+	var problem wallet.Problem
+	assert.Equal(t, http.StatusConflict, do(t, h, "POST", "/wallet/transfer/quote/"+quote.ID+"/execute", "", nil, &problem))
+	assert.Equal(t, "QUOTE_EXECUTED", problem.Code)
+
+	var balance wallet.BalanceResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+bob.ID+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 450, Ledger: 450, Available: 450, Currency: "EUR"}, balance)
+}
+
+// TestSetup_FeeRevenue charges a withdrawal fee and reads it back from the
+// revenue wallet through the HTTP API.
+func TestSetup_FeeRevenue(t *testing.T) {
+	fees, err := wallet.NewFeeSchedule([]wallet.FeeRule{{Name: "withdrawal_fee", TxnType: wallet.TxnTypeWithdrawal, Currency: "USD", Flat: 25}})
+	assert.NoError(t, err)
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository(), wallet.WithFees(fees)), wallet.NewMemoryIdempotencyStore(), nil)
+
+	var alice struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &alice))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, nil, nil))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/withdraw", `{"amount": 100, "currency": "USD"}`, nil, nil))
+
+	var revenue []map[string]interface{}
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/admin/revenue", "", nil, &revenue))
+	if assert.Len(t, revenue, 1) {
+		assert.Equal(t, wallet.RevenueWalletID("USD").String(), revenue[0]["id"])
+		assert.Equal(t, "revenue", revenue[0]["type"])
+	}
+
+	var balance wallet.BalanceResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+wallet.RevenueWalletID("USD").String()+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 25, Ledger: 25, Available: 25, Currency: "USD"}, balance)
+}
+
+// TestSetup_Holds reserves funds and captures part of them through the HTTP API.
+func TestSetup_Holds(t *testing.T) {
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository()), wallet.NewMemoryIdempotencyStore(), nil)
+
+	var alice struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+uuid.NewString()+`"}`, nil, &alice))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+alice.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, nil, nil))
+
+	var hold struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet/"+alice.ID+"/holds", `{"amount": 400, "currency": "USD"}`, nil, &hold))
+	assert.Equal(t, "active", hold.Status)
+
+	var balance wallet.BalanceResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 1000, Ledger: 1000, Available: 600, Currency: "USD"}, balance)
+
+	// A retried capture with the same Idempotency-Key only captures once
+	key := map[string]string{wallet.IdempotencyKeyHeader: "capture-1"}
+	var first, retry wallet.TransactionResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/holds/"+hold.ID+"/capture", `{"amount": 250}`, key, &first))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/holds/"+hold.ID+"/capture", `{"amount": 250}`, key, &retry))
+	assert.Equal(t, first.TransactionID, retry.TransactionID)
+	assert.Equal(t, http.StatusConflict, do(t, h, "POST", "/wallet/holds/"+hold.ID+"/void", "", nil, nil))
+
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/holds/"+hold.ID, "", nil, &hold))
+	assert.Equal(t, "captured", hold.Status)
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+alice.ID+"/balance", "", nil, &balance))
+	assert.Equal(t, wallet.BalanceResponse{Balance: 750, Ledger: 750, Available: 750, Currency: "USD"}, balance)
+}
+
+// TestSetup_UserWallets creates two wallets for one user and lists them.
+func TestSetup_UserWallets(t *testing.T) {
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository()), wallet.NewMemoryIdempotencyStore(), nil)
+	userID := uuid.NewString()
+
+	var spending, savings struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+userID+`"}`, nil, &spending))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+userID+`","label":"Rainy day","type":"savings"}`, nil, &savings))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+savings.ID+"/deposit", `{"amount": 250, "currency": "USD"}`, nil, nil))
+
+	var wallets []struct {
+		ID      string `json:"id"`
+		Label   string `json:"label"`
+		Type    string `json:"type"`
+		Balance int64  `json:"balance"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/users/"+userID+"/wallets", "", nil, &wallets))
+	assert.Len(t, wallets, 2)
+	assert.Equal(t, spending.ID, wallets[0].ID)
+	assert.Equal(t, "spending", wallets[0].Type)
+	assert.Equal(t, "Rainy day", wallets[1].Label)
+	assert.Equal(t, int64(250), wallets[1].Balance)
+
+	var problem wallet.Problem
+	assert.Equal(t, http.StatusNotFound, do(t, h, "GET", "/users/"+uuid.NewString()+"/wallets", "", nil, &problem))
+	assert.Equal(t, "USER_NOT_FOUND", problem.Code)
+	assert.Equal(t, http.StatusNotFound, do(t, h, "GET", "/users", "", nil, &problem))
+	assert.Equal(t, wallet.CodeRouteNotFound, problem.Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(t, h, "DELETE", "/users/"+userID+"/wallets", "", nil, &problem))
+	assert.Equal(t, wallet.CodeMethodNotAllowed, problem.Code)
+}
+
+// bearer returns the Authorization header of an HS256 token for userID.
+func bearer(t *testing.T, secret []byte, userID, scope string) map[string]string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": "HS256", "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": userID, "scope": scope, "exp": time.Now().Add(time.Hour).Unix()})
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return map[string]string{"Authorization": "Bearer " + signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))}
+}
+
+// TestSetup_Authentication checks that only the owner of a wallet or an admin can use it.
+func TestSetup_Authentication(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	auth := wallet.NewJWTVerifier("", "")
+	assert.NoError(t, auth.AddHMACKey("", secret))
+	h := Setup(wallet.NewService(wallet.NewMemoryRepository()), wallet.NewMemoryIdempotencyStore(), wallet.Authenticate(auth, nil))
+
+	aliceID, malloryID := uuid.NewString(), uuid.NewString()
+	alice, mallory := bearer(t, secret, aliceID, ""), bearer(t, secret, malloryID, "")
+	admin := bearer(t, secret, uuid.NewString(), wallet.ScopeAdmin)
+
+	var w struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusUnauthorized, do(t, h, "POST", "/wallet", `{"user_id":"`+aliceID+`"}`, nil, nil))
+	assert.Equal(t, http.StatusForbidden, do(t, h, "POST", "/wallet", `{"user_id":"`+aliceID+`"}`, mallory, nil))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+aliceID+`"}`, alice, &w))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+w.ID+"/deposit", `{"amount": 1000, "currency": "USD"}`, alice, nil))
+
+	// Someone else's wallet can not be read or emptied
+	assert.Equal(t, http.StatusForbidden, do(t, h, "POST", "/wallet/"+w.ID+"/withdraw", `{"amount": 1000, "currency": "USD"}`, mallory, nil))
+	assert.Equal(t, http.StatusForbidden, do(t, h, "GET", "/wallet/"+w.ID+"/balance", "", mallory, nil))
+	assert.Equal(t, http.StatusForbidden, do(t, h, "GET", "/users/"+aliceID+"/wallets", "", mallory, nil))
+	assert.Equal(t, http.StatusForbidden, do(t, h, "GET", "/admin/wallets/"+w.ID+"/limits", "", alice, nil))
+
+	// An admin bypasses the ownership check
+	var balance wallet.BalanceResponse
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/wallet/"+w.ID+"/balance", "", admin, &balance))
+	assert.Equal(t, int64(1000), balance.Ledger)
+	assert.Equal(t, http.StatusOK, do(t, h, "GET", "/admin/wallets/"+w.ID+"/limits", "", admin, nil))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+w.ID+"/withdraw", `{"amount": 400, "currency": "USD"}`, alice, nil))
+
+	// An Idempotency-Key of another user does not replay its response
+	key := map[string]string{wallet.IdempotencyKeyHeader: "withdraw-1"}
+	for k, v := range alice {
+		key[k] = v
+	}
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/wallet/"+w.ID+"/withdraw", `{"amount": 100, "currency": "USD"}`, key, nil))
+	for k, v := range mallory {
+		key[k] = v
+	}
+	assert.NotEqual(t, http.StatusOK, do(t, h, "POST", "/wallet/"+w.ID+"/withdraw", `{"amount": 100, "currency": "USD"}`, key, nil))
+}
+
+// signed sends a request signed with an API key and decodes the JSON response into out.
+func signed(t *testing.T, h http.Handler, method, path, body, clientID, apiKey string, out interface{}) int {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	assert.NoError(t, wallet.SignRequest(req, uuid.MustParse(clientID), apiKey, time.Now()))
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	if out != nil {
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), out))
+	}
+	return res.Code
+}
+
+// TestSetup_APIClients checks that API clients are issued by an admin, sign
+// their requests and are limited to their scopes.
+func TestSetup_APIClients(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	jwt := wallet.NewJWTVerifier("", "")
+	assert.NoError(t, jwt.AddHMACKey("", secret))
+	svc := wallet.NewService(wallet.NewMemoryRepository())
+	h := Setup(svc, wallet.NewMemoryIdempotencyStore(), wallet.Authenticate(jwt, wallet.NewSignatureVerifier(svc, time.Minute)))
+
+	userID := uuid.NewString()
+	admin, user := bearer(t, secret, uuid.NewString(), wallet.ScopeAdmin), bearer(t, secret, userID, "")
+	var w struct {
+		ID string `json:"id"`
+	}
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/wallet", `{"user_id":"`+userID+`"}`, user, &w))
+
+	var issued struct {
+		Client struct {
+			ID     string   `json:"id"`
+			Scopes []string `json:"scopes"`
+		} `json:"client"`
+		APIKey string `json:"api_key"`
+	}
+	assert.Equal(t, http.StatusForbidden, do(t, h, "POST", "/admin/api-clients", `{"name":"payments","scopes":["read","deposit"]}`, user, nil))
+	assert.Equal(t, http.StatusCreated, do(t, h, "POST", "/admin/api-clients", `{"name":"payments","scopes":["read","deposit"]}`, admin, &issued))
+	clientID, apiKey := issued.Client.ID, issued.APIKey
+
+	// The client may deposit into any wallet, but only within its scopes
+	assert.Equal(t, http.StatusOK, signed(t, h, "POST", "/wallet/"+w.ID+"/deposit", `{"amount": 500, "currency": "USD"}`, clientID, apiKey, nil))
+	assert.Equal(t, http.StatusForbidden, signed(t, h, "POST", "/wallet/"+w.ID+"/withdraw", `{"amount": 100, "currency": "USD"}`, clientID, apiKey, nil))
+	assert.Equal(t, http.StatusForbidden, signed(t, h, "GET", "/admin/api-clients", "", clientID, apiKey, nil))
+
+	// The deposit records the client
+	var page struct {
+		Transactions []struct {
+			ClientID string `json:"client_id"`
+		} `json:"transactions"`
+	}
+	assert.Equal(t, http.StatusOK, signed(t, h, "GET", "/wallet/"+w.ID+"/transactions", "", clientID, apiKey, &page))
+	assert.Len(t, page.Transactions, 1)
+	assert.Equal(t, clientID, page.Transactions[0].ClientID)
+
+	// A replayed or altered request is refused
+	req := httptest.NewRequest("GET", "/wallet/"+w.ID+"/balance", nil)
+	assert.NoError(t, wallet.SignRequest(req, uuid.MustParse(clientID), apiKey, time.Now()))
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		assert.Equal(t, want, res.Code, "attempt %d", i+1)
+	}
+	req = httptest.NewRequest("GET", "/wallet/"+w.ID+"/balance", nil)
+	assert.NoError(t, wallet.SignRequest(req, uuid.MustParse(clientID), apiKey, time.Now()))
+	req.URL.Path = "/wallet/" + uuid.NewString() + "/balance"
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+
+	// After a rotation both keys work until the grace period ends, a revocation stops both
+	var rotated struct {
+		APIKey string `json:"api_key"`
+	}
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/admin/api-clients/"+clientID+"/rotate", "", admin, &rotated))
+	assert.NotEqual(t, apiKey, rotated.APIKey)
+	assert.Equal(t, http.StatusOK, signed(t, h, "GET", "/wallet/"+w.ID+"/balance", "", clientID, apiKey, nil))
+	assert.Equal(t, http.StatusOK, signed(t, h, "GET", "/wallet/"+w.ID+"/balance", "", clientID, rotated.APIKey, nil))
+	assert.Equal(t, http.StatusOK, do(t, h, "POST", "/admin/api-clients/"+clientID+"/revoke", "", admin, nil))
+	assert.Equal(t, http.StatusUnauthorized, signed(t, h, "GET", "/wallet/"+w.ID+"/balance", "", clientID, rotated.APIKey, nil))
+}
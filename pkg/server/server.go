@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"wallet-go/pkg/config"
+)
+
+// New returns an HTTP server for handler with the timeouts and header limit
+// of cfg. TLS needs at least version 1.2.
+func New(cfg config.ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+// Run listens on the address of srv and serves it, with TLS when cfg has a
+// certificate and key, until ctx is done. See serve for the shutdown.
+func Run(ctx context.Context, srv *http.Server, cfg config.ServerConfig) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	if cfg.TLS() {
+		scheme = "https"
+	}
+	log.Printf("Server running at %s://%s", scheme, ln.Addr())
+	return serve(ctx, srv, ln, cfg)
+}
+
+// serve serves srv on ln until ctx is done. It then stops accepting
+// connections and waits up to cfg.ShutdownTimeout for in-flight requests to
+// finish. Requests still running after that are cut off, which cancels their
+// contexts so their transactions roll back. serve returns once every handler
+// has returned, so the database can be closed after it; the error is nil
+// after a clean drain.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, cfg config.ServerConfig) error {
+	// Shutdown does not wait for the handlers of connections it cuts off
+	var active sync.WaitGroup
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active.Add(1)
+		defer active.Done()
+		next.ServeHTTP(w, r)
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		if cfg.TLS() {
+			errs <- srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+		} else {
+			errs <- srv.Serve(ln)
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		// The server failed before a shutdown was asked for
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining in-flight requests for up to %s", cfg.ShutdownTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(drainCtx)
+	if err != nil {
+		log.Printf("Requests still running after %s are cut off", cfg.ShutdownTimeout)
+		srv.Close()
+		err = fmt.Errorf("draining requests: %w", err)
+	}
+	<-errs
+	active.Wait()
+	return err
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"wallet-go/pkg/config"
+)
+
+// start serves handler on a free local port until the returned cancel is
+// called; the error of serve is sent on the returned channel.
+func start(t *testing.T, handler http.Handler, cfg config.ServerConfig) (string, context.CancelFunc, <-chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, New(cfg, handler), ln, cfg) }()
+	return ln.Addr().String(), cancel, done
+}
+
+func TestServe_DrainsInFlightRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	addr, shutdown, done := start(t, handler, config.ServerConfig{ShutdownTimeout: 5 * time.Second})
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Post("http://"+addr+"/wallet/transfer", "application/json", nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-started
+	shutdown()
+
+	// New connections are refused while the request in flight goes on
+	assert.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", addr)
+		return err != nil
+	}, time.Second, 5*time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("serve returned before the request finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Equal(t, http.StatusCreated, <-status)
+	assert.NoError(t, <-done)
+}
+
+func TestServe_CutsOffRequestsAfterTimeout(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		close(cancelled)
+	})
+	addr, shutdown, done := start(t, handler, config.ServerConfig{ShutdownTimeout: 20 * time.Millisecond})
+
+	go http.Get("http://" + addr + "/wallet/abc/statement")
+	<-started
+	shutdown()
+
+	// serve waits for the cut-off handler, whose context is cancelled
+	err := <-done
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("serve returned before the handler")
+	}
+}
+
+func TestServe_TLS(t *testing.T) {
+	certFile, keyFile := writeCert(t)
+	cfg := config.ServerConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, ShutdownTimeout: time.Second}
+	addr, shutdown, done := start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), cfg)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://" + addr + "/wallet/abc/balance")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, uint16(tls.VersionTLS13), res.TLS.Version)
+
+	shutdown()
+	assert.NoError(t, <-done)
+}
+
+func TestRun_TLSNeedsCertAndKey(t *testing.T) {
+	cfg := config.ServerConfig{Addr: "127.0.0.1:0", TLSCertFile: "cert.pem"}
+	err := Run(context.Background(), New(cfg, http.NotFoundHandler()), cfg)
+	assert.Error(t, err)
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key.
+func writeCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "wallet-go test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
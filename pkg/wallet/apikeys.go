@@ -0,0 +1,373 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// validScopes are the scopes an API client can be given.
+var validScopes = map[string]bool{ScopeRead: true, ScopeDeposit: true, ScopeWithdraw: true, ScopeTransfer: true, ScopeAdmin: true}
+
+// newAPIKey generates a random seed and returns the API key derived from it
+// with its shown prefix and the hex seed, the form it is stored in.
+func (s *service) newAPIKey() (key, prefix, seed string, err error) {
+	b := make([]byte, apiKeyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	seed = hex.EncodeToString(b)
+	key = s.deriveAPIKey(b)
+	return key, key[:apiKeyShownPrefix], seed, nil
+}
+
+// deriveAPIKey is the API key of a seed: the HMAC-SHA256 of the seed under
+// the pepper. Without the pepper a stored seed is of no use for signing.
+func (s *service) deriveAPIKey(seed []byte) string {
+	mac := hmac.New(sha256.New, s.keyPepper)
+	mac.Write(seed)
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signingKeys returns the keys requests of a client may be signed with at
+// now, the raw SHA-256 of its current API key and of the replaced one during
+// the rotation grace period.
+func (s *service) signingKeys(c *apiClient, now time.Time) [][]byte {
+	seeds := []string{c.KeySeed}
+	if c.PrevKeySeed != "" && c.PrevKeyExpiresAt != nil && now.Before(*c.PrevKeyExpiresAt) {
+		seeds = append(seeds, c.PrevKeySeed)
+	}
+	var keys [][]byte
+	for _, seed := range seeds {
+		b, err := hex.DecodeString(seed)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256([]byte(s.deriveAPIKey(b)))
+		keys = append(keys, sum[:])
+	}
+	return keys
+}
+
+// IssueAPIClient creates an API client with a new key. Scopes are read,
+// deposit, withdraw, transfer or admin; at least one is required. The key is
+// returned once and only the seed it is derived from is stored.
+func (s *service) IssueAPIClient(ctx context.Context, name string, scopes []string) (*IssuedAPIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrClientNameRequired
+	}
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+	var granted []string
+	seen := map[string]bool{}
+	for _, scope := range scopes {
+		if !validScopes[scope] {
+			return nil, ErrInvalidScope
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			granted = append(granted, scope)
+		}
+	}
+
+	key, prefix, seed, err := s.newAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	c := &apiClient{ID: uuid.New(), Name: name, Scopes: granted, KeyPrefix: prefix, KeySeed: seed, CreatedAt: now, UpdatedAt: now}
+	if err := s.repo.InsertAPIClient(ctx, c); err != nil {
+		return nil, err
+	}
+	return &IssuedAPIKey{Client: c, APIKey: key}, nil
+}
+
+// ListAPIClients returns all API clients, oldest first, without their keys.
+func (s *service) ListAPIClients(ctx context.Context) ([]apiClient, error) {
+	clients, err := s.repo.ListAPIClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if clients == nil {
+		clients = []apiClient{}
+	}
+	return clients, nil
+}
+
+// RotateAPIKey gives a client a new key. The replaced key keeps working for
+// the rotation grace period, a key replaced earlier stops working at once.
+func (s *service) RotateAPIKey(ctx context.Context, clientID uuid.UUID) (*IssuedAPIKey, error) {
+	key, prefix, seed, err := s.newAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var c *apiClient
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		var err error
+		c, err = q.LockAPIClient(ctx, clientID)
+		if err != nil {
+			return err
+		}
+		if c.RevokedAt != nil {
+			return ErrAPIClientRevoked
+		}
+
+		now := time.Now().UTC()
+		c.PrevKeySeed, c.PrevKeyExpiresAt = "", nil
+		if s.keyGrace > 0 {
+			expires := now.Add(s.keyGrace)
+			c.PrevKeySeed, c.PrevKeyExpiresAt = c.KeySeed, &expires
+		}
+		c.KeyPrefix, c.KeySeed, c.UpdatedAt = prefix, seed, now
+		return q.UpdateAPIClient(ctx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedAPIKey{Client: c, APIKey: key}, nil
+}
+
+// RevokeAPIClient stops every key of a client from working. Revoking a
+// revoked client returns it unchanged.
+func (s *service) RevokeAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	var c *apiClient
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		var err error
+		c, err = q.LockAPIClient(ctx, clientID)
+		if err != nil || c.RevokedAt != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		c.RevokedAt, c.UpdatedAt = &now, now
+		c.PrevKeySeed, c.PrevKeyExpiresAt = "", nil
+		return q.UpdateAPIClient(ctx, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ForClient returns a service that records clientID on the transactions it
+// creates.
+func (s *service) ForClient(clientID uuid.UUID) Service {
+	copied := *s
+	copied.clientID = &clientID
+	return &copied
+}
+
+// GetAPIClient returns an API client or ErrAPIClientNotFound.
+func (s *service) GetAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	return s.repo.GetAPIClient(ctx, clientID)
+}
+
+// UseNonce records the nonce of a signed request until expiresAt, or returns
+// ErrNonceReused when the client already sent it.
+func (s *service) UseNonce(ctx context.Context, clientID uuid.UUID, nonce string, expiresAt time.Time) error {
+	return s.repo.UseNonce(ctx, clientID, nonce, expiresAt)
+}
+
+// PurgeNonces deletes the nonces whose replay window ended at or before now.
+func (s *service) PurgeNonces(ctx context.Context, now time.Time) (int64, error) {
+	return s.repo.DeleteExpiredNonces(ctx, now)
+}
+
+// signingString is the string a request signature is computed over.
+func signingString(method, requestURI, timestamp, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:])
+}
+
+// requestSignature is the hex HMAC-SHA256 of a signing string under the key
+// hash, the raw SHA-256 of the API key.
+func requestSignature(keyHash []byte, signing string) string {
+	mac := hmac.New(sha256.New, keyHash)
+	mac.Write([]byte(signing))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs r with an API key, setting the X-Client-ID, X-Timestamp,
+// X-Nonce and X-Signature headers. The body is read and restored.
+func SignRequest(r *http.Request, clientID uuid.UUID, apiKey string, now time.Time) error {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(b)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	keyHash := sha256.Sum256([]byte(apiKey))
+	r.Header.Set(ClientIDHeader, clientID.String())
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set(NonceHeader, nonce)
+	r.Header.Set(SignatureHeader, requestSignature(keyHash[:], signingString(r.Method, r.URL.RequestURI(), timestamp, nonce, body)))
+	return nil
+}
+
+// clientStore is the part of the service used by the SignatureVerifier.
+type clientStore interface {
+	GetAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error)
+	UseNonce(ctx context.Context, clientID uuid.UUID, nonce string, expiresAt time.Time) error
+	signingKeys(c *apiClient, now time.Time) [][]byte
+}
+
+// SignatureVerifier checks requests signed with an API key.
+type SignatureVerifier struct {
+	clients clientStore
+	window  time.Duration // Allowed distance of X-Timestamp from now
+	now     func() time.Time
+}
+
+// NewSignatureVerifier initializes a verifier accepting timestamps within
+// window of the server clock.
+func NewSignatureVerifier(clients clientStore, window time.Duration) *SignatureVerifier {
+	return &SignatureVerifier{clients: clients, window: window, now: time.Now}
+}
+
+// Verify checks the signature headers of r and returns the client as a
+// principal. The nonce is only recorded once the signature is valid, so
+// forged requests cannot use up nonces. The body is read and restored.
+func (v *SignatureVerifier) Verify(r *http.Request) (*Principal, error) {
+	ctx := r.Context()
+	clientID, err := uuid.Parse(r.Header.Get(ClientIDHeader))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	timestamp := r.Header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	sentAt := time.Unix(seconds, 0)
+	now := v.now()
+	if sentAt.Before(now.Add(-v.window)) || sentAt.After(now.Add(v.window)) {
+		return nil, ErrSignatureExpired
+	}
+	nonce := r.Header.Get(NonceHeader)
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return nil, ErrInvalidNonce
+	}
+	signature, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	// Unknown and revoked clients get the same answer as a bad signature
+	c, err := v.clients.GetAPIClient(ctx, clientID)
+	if err == ErrAPIClientNotFound {
+		return nil, ErrInvalidSignature
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.RevokedAt != nil {
+		return nil, ErrInvalidSignature
+	}
+	signing := signingString(r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	valid := false
+	for _, keyHash := range v.clients.signingKeys(c, now) {
+		expected, _ := hex.DecodeString(requestSignature(keyHash, signing))
+		if hmac.Equal(signature, expected) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, ErrInvalidSignature
+	}
+
+	// The nonce is kept until the timestamp leaves the window, after which the
+	// request is refused anyway
+	if err := v.clients.UseNonce(ctx, c.ID, nonce, sentAt.Add(v.window)); err != nil {
+		return nil, err
+	}
+	return &Principal{ClientID: &c.ID, Scopes: c.Scopes}, nil
+}
+
+// RequireScope lets API clients call next only when they were granted scope
+// or ScopeAdmin; other clients get 403. Users authenticated by a bearer token
+// and unauthenticated requests are passed through, their access is decided
+// by the ownership check.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := PrincipalFrom(r.Context()); p != nil && p.ClientID != nil && !p.HasScope(scope) && !p.IsAdmin() {
+			writeError(w, r, fmt.Errorf("%w: %s scope required", ErrForbidden, scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// serviceFor returns the service recording the API client of the request on
+// new transactions, or the shared service for other callers.
+func (h *handler) serviceFor(r *http.Request) Service {
+	if p := PrincipalFrom(r.Context()); p != nil && p.ClientID != nil {
+		return h.service.ForClient(*p.ClientID)
+	}
+	return h.service
+}
+
+// nonceSweeper is the part of the service used by the NonceSweeper.
+type nonceSweeper interface {
+	PurgeNonces(ctx context.Context, now time.Time) (int64, error)
+}
+
+// NonceSweeper periodically deletes nonces whose replay window has ended.
+type NonceSweeper struct {
+	nonces   nonceSweeper
+	interval time.Duration
+}
+
+// NewNonceSweeper initializes a sweeper that purges nonces every interval.
+func NewNonceSweeper(nonces nonceSweeper, interval time.Duration) *NonceSweeper {
+	return &NonceSweeper{nonces: nonces, interval: interval}
+}
+
+// Run purges expired nonces every interval until ctx is canceled.
+func (sw *NonceSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := sw.nonces.PurgeNonces(ctx, now); err != nil {
+				log.Printf("Nonce sweeper error: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_IssueRotateRevokeAPIClient(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+
+	issued, err := svc.IssueAPIClient(ctx, " payments ", []string{ScopeRead, ScopeDeposit, ScopeRead})
+	assert.NoError(t, err)
+	assert.Equal(t, "payments", issued.Client.Name)
+	assert.Equal(t, []string{ScopeRead, ScopeDeposit}, issued.Client.Scopes)
+	assert.Equal(t, issued.APIKey[:apiKeyShownPrefix], issued.Client.KeyPrefix)
+
+	// Only the seed of the key is stored
+	stored, err := repo.GetAPIClient(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	assert.Len(t, stored.KeySeed, 2*apiKeyBytes)
+	assert.NotContains(t, issued.APIKey, stored.KeySeed)
+
+	rotated, err := svc.RotateAPIKey(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, issued.APIKey, rotated.APIKey)
+	assert.Equal(t, stored.KeySeed, rotated.Client.PrevKeySeed)
+	assert.WithinDuration(t, time.Now().Add(DefaultAPIKeyRotationGrace), *rotated.Client.PrevKeyExpiresAt, time.Minute)
+
+	revoked, err := svc.RevokeAPIClient(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	assert.Empty(t, revoked.PrevKeySeed)
+	_, err = svc.RotateAPIKey(ctx, issued.Client.ID)
+	assert.Equal(t, ErrAPIClientRevoked, err)
+
+	clients, err := svc.ListAPIClients(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, clients, 1)
+
+	_, err = svc.IssueAPIClient(ctx, "", []string{ScopeRead})
+	assert.Equal(t, ErrClientNameRequired, err)
+	_, err = svc.IssueAPIClient(ctx, "payments", []string{"everything"})
+	assert.Equal(t, ErrInvalidScope, err)
+	_, err = svc.IssueAPIClient(ctx, "payments", nil)
+	assert.Equal(t, ErrInvalidScope, err)
+	_, err = svc.RevokeAPIClient(ctx, uuid.New())
+	assert.Equal(t, ErrAPIClientNotFound, err)
+}
+
+// signedRequest returns a POST request signed at a time.
+func signedRequest(t *testing.T, clientID uuid.UUID, apiKey string, at time.Time) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/wallet/transfer?dry_run=1", bytes.NewBufferString(`{"amount":100}`))
+	assert.NoError(t, SignRequest(req, clientID, apiKey, at))
+	return req
+}
+
+func TestSignatureVerifier_Verify(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	issued, err := svc.IssueAPIClient(ctx, "payments", []string{ScopeTransfer})
+	assert.NoError(t, err)
+	clientID := issued.Client.ID
+	v := NewSignatureVerifier(svc, time.Minute)
+
+	p, err := v.Verify(signedRequest(t, clientID, issued.APIKey, time.Now()))
+	assert.NoError(t, err)
+	assert.Equal(t, clientID, *p.ClientID)
+	assert.True(t, p.HasScope(ScopeTransfer))
+
+	// The same request is accepted once
+	req := signedRequest(t, clientID, issued.APIKey, time.Now())
+	headers := req.Header.Clone()
+	_, err = v.Verify(req)
+	assert.NoError(t, err)
+	replay := httptest.NewRequest(http.MethodPost, "/wallet/transfer?dry_run=1", bytes.NewBufferString(`{"amount":100}`))
+	replay.Header = headers
+	_, err = v.Verify(replay)
+	assert.Equal(t, ErrNonceReused, err)
+
+	tests := []struct {
+		name string
+		edit func(r *http.Request)
+		want error
+	}{
+		{"body changed", func(r *http.Request) {
+			r.Body = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"amount":999}`)).Body
+		}, ErrInvalidSignature},
+		{"query changed", func(r *http.Request) { r.URL.RawQuery = "dry_run=0" }, ErrInvalidSignature},
+		{"method changed", func(r *http.Request) { r.Method = http.MethodPut }, ErrInvalidSignature},
+		{"timestamp changed", func(r *http.Request) { r.Header.Set(TimestampHeader, "1") }, ErrSignatureExpired},
+		{"short nonce", func(r *http.Request) { r.Header.Set(NonceHeader, "abc") }, ErrInvalidNonce},
+		{"unknown client", func(r *http.Request) { r.Header.Set(ClientIDHeader, uuid.NewString()) }, ErrInvalidSignature},
+		{"wrong key", func(r *http.Request) { *r = *signedRequest(t, clientID, "wk_guessed", time.Now()) }, ErrInvalidSignature},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := signedRequest(t, clientID, issued.APIKey, time.Now())
+			tc.edit(req)
+			_, err := v.Verify(req)
+			assert.Equal(t, tc.want, err)
+		})
+	}
+
+	_, err = v.Verify(signedRequest(t, clientID, issued.APIKey, time.Now().Add(-2*time.Minute)))
+	assert.Equal(t, ErrSignatureExpired, err)
+	_, err = v.Verify(signedRequest(t, clientID, issued.APIKey, time.Now().Add(2*time.Minute)))
+	assert.Equal(t, ErrSignatureExpired, err)
+}
+
+func TestSignatureVerifier_RotationGrace(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	issued, err := svc.IssueAPIClient(ctx, "payments", []string{ScopeRead})
+	assert.NoError(t, err)
+	rotated, err := svc.RotateAPIKey(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	v := NewSignatureVerifier(svc, time.Minute)
+
+	// Both keys work during the grace period, only the new one after it
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, issued.APIKey, time.Now()))
+	assert.NoError(t, err)
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, rotated.APIKey, time.Now()))
+	assert.NoError(t, err)
+
+	later := time.Now().Add(DefaultAPIKeyRotationGrace + time.Hour)
+	v.now = func() time.Time { return later }
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, issued.APIKey, later))
+	assert.Equal(t, ErrInvalidSignature, err)
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, rotated.APIKey, later))
+	assert.NoError(t, err)
+
+	// A revoked client is refused like an unknown one
+	_, err = svc.RevokeAPIClient(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, rotated.APIKey, later))
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	// Without a grace period the old key stops working at once
+	svc = NewService(NewMemoryRepository(), WithAPIKeyRotationGrace(0))
+	issued, err = svc.IssueAPIClient(ctx, "payments", []string{ScopeRead})
+	assert.NoError(t, err)
+	_, err = svc.RotateAPIKey(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	_, err = NewSignatureVerifier(svc, time.Minute).Verify(signedRequest(t, issued.Client.ID, issued.APIKey, time.Now()))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestSignatureVerifier_KeysNeedThePepper(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	svc := NewService(repo, WithAPIKeyPepper([]byte("pepper-of-this-server-0123456789")))
+	issued, err := svc.IssueAPIClient(ctx, "payments", []string{ScopeRead})
+	assert.NoError(t, err)
+	_, err = NewSignatureVerifier(svc, time.Minute).Verify(signedRequest(t, issued.Client.ID, issued.APIKey, time.Now()))
+	assert.NoError(t, err)
+
+	// Whoever reads the stored seed can not sign with it, neither as the key
+	// nor as its hash
+	stored, err := repo.GetAPIClient(ctx, issued.Client.ID)
+	assert.NoError(t, err)
+	v := NewSignatureVerifier(svc, time.Minute)
+	_, err = v.Verify(signedRequest(t, issued.Client.ID, stored.KeySeed, time.Now()))
+	assert.Equal(t, ErrInvalidSignature, err)
+	req := signedRequest(t, issued.Client.ID, issued.APIKey, time.Now())
+	seed, err := hex.DecodeString(stored.KeySeed)
+	assert.NoError(t, err)
+	req.Header.Set(SignatureHeader, requestSignature(seed, signingString(req.Method, req.URL.RequestURI(),
+		req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader), []byte(`{"amount":100}`))))
+	_, err = v.Verify(req)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	// Another pepper derives other keys from the same seeds
+	other := NewService(repo, WithAPIKeyPepper([]byte("pepper-of-another-server-0123456")))
+	_, err = NewSignatureVerifier(other, time.Minute).Verify(signedRequest(t, issued.Client.ID, issued.APIKey, time.Now()))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestService_PurgeNonces(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	clientID := uuid.New()
+	assert.NoError(t, svc.UseNonce(ctx, clientID, "expired-nonce-0001", time.Now().Add(-time.Second)))
+	assert.NoError(t, svc.UseNonce(ctx, clientID, "current-nonce-0001", time.Now().Add(time.Minute)))
+
+	n, err := svc.PurgeNonces(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, ErrNonceReused, repo.UseNonce(ctx, clientID, "current-nonce-0001", time.Now()))
+}
+
+func TestService_ForClientRecordsClientID(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	clientID := uuid.New()
+
+	txnID, err := svc.ForClient(clientID).Withdraw(ctx, walletID, usd(100))
+	assert.NoError(t, err)
+	txn, err := repo.GetChainedTransaction(ctx, txnID)
+	assert.NoError(t, err)
+	assert.Equal(t, &clientID, txn.ClientID)
+
+	// The client is part of the hashed fields, and the shared service records none
+	report, err := svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Nil(t, repo.transactions[0].ClientID)
+}
+
+func TestRequireScope(t *testing.T) {
+	clientID := uuid.New()
+	h := RequireScope(ScopeWithdraw, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name     string
+		p        *Principal
+		wantCode int
+	}{
+		{"client with scope", &Principal{ClientID: &clientID, Scopes: []string{ScopeWithdraw}}, http.StatusNoContent},
+		{"admin client", &Principal{ClientID: &clientID, Scopes: []string{ScopeAdmin}}, http.StatusNoContent},
+		{"client without scope", &Principal{ClientID: &clientID, Scopes: []string{ScopeRead, ScopeDeposit}}, http.StatusForbidden},
+		{"user", &Principal{UserID: uuid.New()}, http.StatusNoContent},
+		{"no principal", nil, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/wallet/"+uuid.NewString()+"/withdraw", nil)
+			if tc.p != nil {
+				req = req.WithContext(WithPrincipal(req.Context(), tc.p))
+			}
+			res := httptest.NewRecorder()
+			h(res, req)
+			assert.Equal(t, tc.wantCode, res.Code)
+		})
+	}
+}
@@ -0,0 +1,485 @@
+package wallet
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Principal is the authenticated caller of a request: a user with a bearer
+// token, or an API client signing its requests.
+type Principal struct {
+	UserID   uuid.UUID  `json:"user_id"`             // User the caller acts as, the sub claim of the token
+	ClientID *uuid.UUID `json:"client_id,omitempty"` // API client of a signed request, nil for users
+	Scopes   []string   `json:"scopes"`              // Granted scopes, the space separated scope claim or the client scopes
+}
+
+// HasScope reports whether the principal was granted a scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the principal may act on every wallet.
+func (p *Principal) IsAdmin() bool {
+	return p.HasScope(ScopeAdmin)
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the caller of a request.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the caller stored by WithPrincipal, or nil when the
+// request was not authenticated.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// JWTVerifier checks bearer tokens signed with HS256 or RS256. Keys are found
+// by the kid header of the token; a token without kid uses the key added
+// without one, or the only key of its algorithm.
+type JWTVerifier struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	issuer   string // Required iss claim, not checked when empty
+	audience string // Required aud claim, not checked when empty
+	now      func() time.Time
+}
+
+// NewJWTVerifier initializes a verifier without keys.
+func NewJWTVerifier(issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{hmacKeys: map[string][]byte{}, rsaKeys: map[string]*rsa.PublicKey{},
+		issuer: issuer, audience: audience, now: time.Now}
+}
+
+// AddHMACKey adds an HS256 key, at least jwtMinHMACKeyLen bytes long.
+func (v *JWTVerifier) AddHMACKey(kid string, secret []byte) error {
+	if len(secret) < jwtMinHMACKeyLen {
+		return fmt.Errorf("HS256 key %q must be at least %d bytes", kid, jwtMinHMACKeyLen)
+	}
+	v.hmacKeys[kid] = secret
+	return nil
+}
+
+// AddRSAKey adds an RS256 public key.
+func (v *JWTVerifier) AddRSAKey(kid string, key *rsa.PublicKey) {
+	v.rsaKeys[kid] = key
+}
+
+// HasKeys reports whether any key was added.
+func (v *JWTVerifier) HasKeys() bool {
+	return len(v.hmacKeys)+len(v.rsaKeys) > 0
+}
+
+// LoadRSAPublicKeyFile adds the RS256 key of a PEM file holding a PKIX
+// ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY") RSA public key.
+func (v *JWTVerifier) LoadRSAPublicKeyFile(kid, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM block", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("%s: not an RSA public key", path)
+	}
+	v.AddRSAKey(kid, rsaKey)
+	return nil
+}
+
+// jwk is one key of a JSON Web Key Set. Only RSA and oct keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"` // RSA modulus, base64url
+	E   string `json:"e"` // RSA exponent, base64url
+	K   string `json:"k"` // Symmetric key, base64url
+}
+
+// LoadJWKSFile adds the signing keys of a local JWKS file: RSA keys for RS256
+// and oct keys for HS256. Encryption keys and other key types are skipped.
+func (v *JWTVerifier) LoadJWKSFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	added := 0
+	for _, key := range set.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(key.N)
+			if err != nil || len(n) == 0 {
+				return fmt.Errorf("%s: key %q has an invalid modulus", path, key.Kid)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(key.E)
+			if err != nil || len(e) == 0 || len(e) > 4 {
+				return fmt.Errorf("%s: key %q has an invalid exponent", path, key.Kid)
+			}
+			exponent := new(big.Int).SetBytes(e).Int64()
+			if exponent > math.MaxInt32 {
+				return fmt.Errorf("%s: key %q has an invalid exponent", path, key.Kid)
+			}
+			v.AddRSAKey(key.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent)})
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil {
+				return fmt.Errorf("%s: key %q has an invalid value", path, key.Kid)
+			}
+			if err := v.AddHMACKey(key.Kid, secret); err != nil {
+				return fmt.Errorf("%s: %w", path, err)
+			}
+		default:
+			continue
+		}
+		added++
+	}
+	if added == 0 {
+		return fmt.Errorf("%s: no RSA or oct signing keys", path)
+	}
+	return nil
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwtClaims are the registered claims checked by Verify and the scope claim.
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // A string or an array of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+}
+
+// hasAudience reports whether the aud claim names aud.
+func (c *jwtClaims) hasAudience(aud string) bool {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return one == aud
+	}
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		for _, a := range many {
+			if a == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// invalidToken wraps ErrInvalidToken with the reason a token was refused.
+func invalidToken(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, reason)
+}
+
+// decodeSegment decodes a base64url token segment, into out unless it is nil.
+func decodeSegment(segment string, out interface{}) ([]byte, error) {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil || out == nil {
+		return data, err
+	}
+	return data, json.Unmarshal(data, out)
+}
+
+// Verify checks the signature, exp, nbf, iss and aud of a compact JWT and
+// returns its principal. The sub claim must be a user UUID.
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+	var header jwtHeader
+	if _, err := decodeSegment(parts[0], &header); err != nil {
+		return nil, invalidToken("malformed header")
+	}
+	signature, err := decodeSegment(parts[2], nil)
+	if err != nil {
+		return nil, invalidToken("malformed signature")
+	}
+
+	// The key decides the algorithm, so an RSA public key is never used as an HMAC secret
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		secret, ok := lookupKey(v.hmacKeys, header.Kid)
+		if !ok {
+			return nil, invalidToken("unknown signing key")
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, invalidToken("bad signature")
+		}
+	case "RS256":
+		key, ok := lookupKey(v.rsaKeys, header.Kid)
+		if !ok {
+			return nil, invalidToken("unknown signing key")
+		}
+		sum := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], signature) != nil {
+			return nil, invalidToken("bad signature")
+		}
+	default:
+		return nil, invalidToken(fmt.Sprintf("unsupported algorithm %q", header.Alg))
+	}
+
+	var claims jwtClaims
+	if _, err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+	now := v.now()
+	if claims.ExpiresAt == nil {
+		return nil, invalidToken("exp claim is required")
+	}
+	if now.Add(-jwtLeeway).After(unixTime(*claims.ExpiresAt)) {
+		return nil, invalidToken("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return nil, invalidToken("token is not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, invalidToken("wrong issuer")
+	}
+	if v.audience != "" && !claims.hasAudience(v.audience) {
+		return nil, invalidToken("wrong audience")
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, invalidToken("sub claim must be a user UUID")
+	}
+	return &Principal{UserID: userID, Scopes: strings.Fields(claims.Scope)}, nil
+}
+
+// lookupKey finds the key of a kid. Without kid the key added without one is
+// used, or the only key there is.
+func lookupKey[K any](keys map[string]K, kid string) (K, bool) {
+	if key, ok := keys[kid]; ok || kid != "" {
+		return key, ok
+	}
+	var only K
+	if len(keys) != 1 {
+		return only, false
+	}
+	for _, key := range keys {
+		only = key
+	}
+	return only, true
+}
+
+// unixTime converts a NumericDate claim, seconds since the epoch.
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second)))
+}
+
+// Authenticate requires a valid bearer token or, on requests with an
+// X-Client-ID header, a valid API key signature on every request and puts
+// the principal into the request context. Other requests get 401. Either
+// verifier may be nil to refuse that kind of caller.
+func Authenticate(v *JWTVerifier, signatures *SignatureVerifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get(ClientIDHeader) != "" {
+				if signatures == nil {
+					unauthorized(w, r, `Signature`, ErrInvalidSignature)
+					return
+				}
+				p, err := signatures.Verify(r)
+				switch err {
+				case nil:
+					next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+				case ErrInvalidSignature, ErrSignatureExpired, ErrInvalidNonce, ErrNonceReused:
+					unauthorized(w, r, `Signature error="invalid_signature"`, err)
+				default:
+					writeError(w, r, err)
+				}
+				return
+			}
+
+			scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+			if v == nil || !found || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+				unauthorized(w, r, `Bearer`, ErrUnauthenticated)
+				return
+			}
+			p, err := v.Verify(strings.TrimSpace(token))
+			if err != nil {
+				unauthorized(w, r, `Bearer error="invalid_token"`, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// unauthorized writes a 401 response with its WWW-Authenticate challenge.
+func unauthorized(w http.ResponseWriter, r *http.Request, challenge string, err error) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, r, err)
+}
+
+// ResourceOwners returns the users who own a resource, one of the Resource
+// constants: the owner of a wallet, the owners of both sides of a
+// transaction, the owner of the wallet a hold, quote or schedule debits, or
+// the owner of a webhook subscription and its deliveries. A user owns itself.
+func (s *service) ResourceOwners(ctx context.Context, kind string, id uuid.UUID) ([]uuid.UUID, error) {
+	var walletIDs []uuid.UUID
+	switch kind {
+	case ResourceUser:
+		return []uuid.UUID{id}, nil
+	case ResourceWallet:
+		walletIDs = []uuid.UUID{id}
+	case ResourceTransaction:
+		txn, err := s.repo.GetChainedTransaction(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, walletID := range []*uuid.UUID{txn.FromWallet, txn.ToWallet} {
+			if walletID != nil {
+				walletIDs = append(walletIDs, *walletID)
+			}
+		}
+	case ResourceHold:
+		h, err := s.repo.GetHold(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		walletIDs = []uuid.UUID{h.WalletID}
+	case ResourceQuote:
+		quote, err := s.repo.GetQuote(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		walletIDs = []uuid.UUID{quote.FromWallet}
+	case ResourceSchedule:
+		sch, err := s.repo.GetSchedule(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		walletIDs = []uuid.UUID{sch.FromWallet}
+	case ResourceDelivery:
+		d, err := s.repo.GetWebhookDelivery(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		id = d.SubscriptionID
+		fallthrough
+	case ResourceWebhook:
+		sub, err := s.repo.GetWebhookSubscription(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if sub.UserID != nil {
+			return []uuid.UUID{*sub.UserID}, nil
+		}
+		walletIDs = []uuid.UUID{*sub.WalletID}
+	default:
+		return nil, fmt.Errorf("unknown resource %q", kind)
+	}
+
+	owners := make([]uuid.UUID, 0, len(walletIDs))
+	for _, walletID := range walletIDs {
+		w, err := s.repo.GetWallet(ctx, walletID)
+		if err != nil {
+			return nil, err
+		}
+		owners = append(owners, w.UserID)
+	}
+	return owners, nil
+}
+
+// authorize writes an error response and returns false unless the caller
+// may act on a resource: an admin, an API client or an owner of the
+// resource. Someone else's resource is answered with 403. Requests without a
+// principal are allowed, authentication is then turned off.
+//
+// API clients are trusted backend services, not end users, and have no owner:
+// within their scopes they reach every wallet, like an admin does. Issuing a
+// client is itself an admin action.
+func (h *handler) authorize(w http.ResponseWriter, r *http.Request, kind string, id uuid.UUID) bool {
+	p := PrincipalFrom(r.Context())
+	if p == nil || p.IsAdmin() || p.ClientID != nil {
+		return true
+	}
+
+	owners, err := h.service.ResourceOwners(r.Context(), kind, id)
+	if err != nil {
+		writeError(w, r, err)
+		return false
+	}
+	for _, owner := range owners {
+		if owner == p.UserID {
+			return true
+		}
+	}
+	forbidden(w, r)
+	return false
+}
+
+// authorizeAdmin writes 403 and returns false unless the caller has the admin
+// scope. Requests without a principal are allowed.
+func (h *handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if p := PrincipalFrom(r.Context()); p != nil && !p.IsAdmin() {
+		forbidden(w, r)
+		return false
+	}
+	return true
+}
+
+// forbidden writes the 403 response of a caller acting on someone else's resource.
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, ErrForbidden)
+}
@@ -0,0 +1,208 @@
+package wallet
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+var testHMACKey = []byte("0123456789abcdef0123456789abcdef")
+
+// signToken builds a compact JWT; key is an HMAC secret for HS256 or an RSA
+// private key for RS256.
+func signToken(t *testing.T, header, claims map[string]interface{}, key interface{}) string {
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		assert.NoError(t, err)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(header) + "." + encode(claims)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		assert.NoError(t, err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// validClaims are claims accepted by a verifier for issuer "wallet" and audience "api".
+func validClaims(userID uuid.UUID, scope string) map[string]interface{} {
+	return map[string]interface{}{"sub": userID.String(), "iss": "wallet", "aud": []string{"api", "other"},
+		"exp": time.Now().Add(time.Hour).Unix(), "scope": scope}
+}
+
+func TestJWTVerifier_HS256(t *testing.T) {
+	v := NewJWTVerifier("wallet", "api")
+	assert.NoError(t, v.AddHMACKey("", testHMACKey))
+	userID := uuid.New()
+
+	p, err := v.Verify(signToken(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, validClaims(userID, "read admin"), testHMACKey))
+	assert.NoError(t, err)
+	assert.Equal(t, userID, p.UserID)
+	assert.True(t, p.IsAdmin())
+	assert.True(t, p.HasScope("read"))
+
+	tests := []struct {
+		name   string
+		edit   func(claims map[string]interface{})
+		key    []byte
+		reason string
+	}{
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, testHMACKey, "token has expired"},
+		{"no exp", func(c map[string]interface{}) { delete(c, "exp") }, testHMACKey, "exp claim is required"},
+		{"not yet valid", func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() }, testHMACKey, "token is not valid yet"},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "someone" }, testHMACKey, "wrong issuer"},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, testHMACKey, "wrong audience"},
+		{"sub not a UUID", func(c map[string]interface{}) { c["sub"] = "alice" }, testHMACKey, "sub claim must be a user UUID"},
+		{"bad signature", func(map[string]interface{}) {}, []byte("fedcba9876543210fedcba9876543210"), "bad signature"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := validClaims(userID, "")
+			tc.edit(claims)
+			_, err := v.Verify(signToken(t, map[string]interface{}{"alg": "HS256"}, claims, tc.key))
+			assert.ErrorIs(t, err, ErrInvalidToken)
+			assert.Contains(t, err.Error(), tc.reason)
+		})
+	}
+
+	// A short secret is refused
+	assert.Error(t, v.AddHMACKey("short", []byte("secret")))
+}
+
+func TestJWTVerifier_RS256AndJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())},
+		{"kty": "oct", "kid": "hmac-1", "k": base64.RawURLEncoding.EncodeToString(testHMACKey)},
+		{"kty": "EC", "kid": "ec-1"},
+	}}
+	data, err := json.Marshal(jwks)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+
+	v := NewJWTVerifier("", "")
+	assert.NoError(t, v.LoadJWKSFile(path))
+	userID := uuid.New()
+	claims := map[string]interface{}{"sub": userID.String(), "exp": time.Now().Add(time.Minute).Unix()}
+
+	p, err := v.Verify(signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, key))
+	assert.NoError(t, err)
+	assert.Equal(t, userID, p.UserID)
+	assert.Empty(t, p.Scopes)
+
+	// Without kid the only RSA key is used
+	_, err = v.Verify(signToken(t, map[string]interface{}{"alg": "RS256"}, claims, key))
+	assert.NoError(t, err)
+	_, err = v.Verify(signToken(t, map[string]interface{}{"alg": "HS256", "kid": "hmac-1"}, claims, testHMACKey))
+	assert.NoError(t, err)
+
+	_, err = v.Verify(signToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-2"}, claims, key))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// The algorithm must match the key: the RSA modulus is no HMAC secret, and unsigned tokens are refused
+	_, err = v.Verify(signToken(t, map[string]interface{}{"alg": "HS256", "kid": "rsa-1"}, claims, key.N.Bytes()))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.Verify(signToken(t, map[string]interface{}{"alg": "none"}, claims, []byte{}))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.Verify("not-a-token")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestAuthenticate(t *testing.T) {
+	v := NewJWTVerifier("", "")
+	assert.NoError(t, v.AddHMACKey("", testHMACKey))
+	userID := uuid.New()
+
+	var got *Principal
+	h := Authenticate(v, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = PrincipalFrom(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		header   string
+		wantCode int
+	}{
+		{"valid token", "Bearer " + signToken(t, map[string]interface{}{"alg": "HS256"}, validClaims(userID, ""), testHMACKey), http.StatusOK},
+		{"no header", "", http.StatusUnauthorized},
+		{"basic auth", "Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized},
+		{"invalid token", "Bearer abc.def.ghi", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got = nil
+			req := httptest.NewRequest(http.MethodGet, "/wallet/"+uuid.NewString()+"/balance", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			res := httptest.NewRecorder()
+
+			h.ServeHTTP(res, req)
+			assert.Equal(t, tc.wantCode, res.Code)
+			if tc.wantCode == http.StatusOK {
+				assert.Equal(t, userID, got.UserID)
+			} else {
+				assert.Nil(t, got)
+				assert.Contains(t, res.Header().Get("WWW-Authenticate"), "Bearer")
+			}
+		})
+	}
+}
+
+func TestService_ResourceOwners(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	from, _ := repo.GetWallet(ctx, fromID)
+	to, _ := repo.GetWallet(ctx, toID)
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.NoError(t, err)
+	h, err := svc.CreateHold(ctx, toID, usd(50), time.Hour)
+	assert.NoError(t, err)
+
+	owners, err := svc.ResourceOwners(ctx, ResourceTransaction, txnID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{from.UserID, to.UserID}, owners)
+	owners, err = svc.ResourceOwners(ctx, ResourceHold, h.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{to.UserID}, owners)
+	owners, err = svc.ResourceOwners(ctx, ResourceUser, from.UserID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{from.UserID}, owners)
+
+	_, err = svc.ResourceOwners(ctx, ResourceWallet, uuid.New())
+	assert.Equal(t, ErrWalletNotFound, err)
+	_, err = svc.ResourceOwners(ctx, ResourceQuote, uuid.New())
+	assert.Equal(t, ErrQuoteNotFound, err)
+	_, err = svc.ResourceOwners(ctx, ResourceDelivery, uuid.New())
+	assert.Equal(t, ErrDeliveryNotFound, err)
+}
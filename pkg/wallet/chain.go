@@ -0,0 +1,302 @@
+package wallet
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// chainHead is the last link of the transaction hash chain.
+type chainHead struct {
+	Seq  int64  `json:"seq"`  // Chain position of the last transaction, 0 while the chain is empty
+	Hash string `json:"hash"` // Hash of the last transaction, chainGenesisHash while the chain is empty
+}
+
+// chainRecord is the canonical form of the fields of a transaction that are
+// hashed. Fields that change after the insert, like the reversed amount, are
+// left out.
+type chainRecord struct {
+	ID         uuid.UUID     `json:"id"`
+	Type       string        `json:"type"`
+	FromWallet *uuid.UUID    `json:"from_wallet"`
+	ToWallet   *uuid.UUID    `json:"to_wallet"`
+	Amount     int64         `json:"amount"`
+	Currency   string        `json:"currency"`
+	FX         *fxConversion `json:"fx"`
+	Fees       []feeItem     `json:"fees"`
+	ReversesID *uuid.UUID    `json:"reverses_id"`
+	Reason     string        `json:"reason"`
+	CreatedAt  string        `json:"created_at"`          // RFC 3339 in UTC with microseconds
+	ClientID   *uuid.UUID    `json:"client_id,omitempty"` // Left out when nil, so older links keep their hash
+}
+
+// canonicalTransaction returns the bytes of a transaction that go into its
+// chain hash.
+func canonicalTransaction(txn *transaction) []byte {
+	record := chainRecord{ID: txn.ID, Type: txn.Type, FromWallet: txn.FromWallet, ToWallet: txn.ToWallet, Amount: txn.Amount,
+		Currency: txn.Currency, FX: txn.FX, ReversesID: txn.ReversesID, Reason: txn.Reason, ClientID: txn.ClientID,
+		CreatedAt: txn.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z")}
+	if len(txn.Fees) > 0 {
+		record.Fees = txn.Fees
+	}
+	data, _ := json.Marshal(record)
+	return data
+}
+
+// transactionDigest is the hex SHA-256 of the canonical form of a transaction.
+func transactionDigest(txn *transaction) string {
+	sum := sha256.Sum256(canonicalTransaction(txn))
+	return hex.EncodeToString(sum[:])
+}
+
+// linkHash chains a transaction digest to the hash of the previous link:
+// hex SHA-256 of the previous hash followed by the digest, both in hex.
+func linkHash(prevHash, digest string) string {
+	sum := sha256.Sum256([]byte(prevHash + digest))
+	return hex.EncodeToString(sum[:])
+}
+
+// ChainCheckpoint commits to the hash of the chain at a position. It is signed
+// with the chain signing key, so a proof that ends at it can be checked
+// without trusting the database that served it.
+type ChainCheckpoint struct {
+	Seq       int64     `json:"seq"`                 // Chain position of the link
+	Hash      string    `json:"hash"`                // Hash of that link
+	Signature string    `json:"signature,omitempty"` // Base64 Ed25519 signature of "seq.hash", empty without a signing key
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkpointMessage is what a checkpoint signature covers: the decimal
+// position, a dot and the hash.
+func checkpointMessage(seq int64, hash string) []byte {
+	return []byte(strconv.FormatInt(seq, 10) + "." + hash)
+}
+
+// VerifyCheckpoint reports whether cp is signed by the private key of key.
+func VerifyCheckpoint(key ed25519.PublicKey, cp *ChainCheckpoint) bool {
+	sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, checkpointMessage(cp.Seq, cp.Hash), sig)
+}
+
+// ParseChainSigningKey decodes a base64 Ed25519 seed of 32 bytes into the key
+// that signs chain checkpoints.
+func ParseChainSigningKey(seed string) (ed25519.PrivateKey, error) {
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.SeedSize {
+		return nil, errors.New("chain signing key must be a base64 seed of 32 bytes")
+	}
+	return ed25519.NewKeyFromSeed(b), nil
+}
+
+// checkpoint returns a checkpoint of a link, signed when the service has a key.
+func (s *service) checkpoint(seq int64, hash string) *ChainCheckpoint {
+	cp := &ChainCheckpoint{Seq: seq, Hash: hash, CreatedAt: time.Now().UTC().Truncate(time.Microsecond)}
+	if s.chainKey != nil {
+		cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.chainKey, checkpointMessage(seq, hash)))
+	}
+	return cp
+}
+
+// insertChained appends txn to the hash chain and stores it through q. The
+// chain head stays locked until the transaction ends, so links are added one
+// at a time in commit order. Every chainCheckpointInterval links a checkpoint
+// of the new link is stored with it.
+func (s *service) insertChained(ctx context.Context, q Queries, txn *transaction) error {
+	head, err := q.LockChainHead(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Stored timestamps keep microseconds, the hash must match what is read back
+	txn.CreatedAt = txn.CreatedAt.UTC().Truncate(time.Microsecond)
+	txn.ChainSeq = head.Seq + 1
+	txn.PrevHash = head.Hash
+	txn.Hash = linkHash(head.Hash, transactionDigest(txn))
+	if err := q.InsertTransaction(ctx, txn); err != nil {
+		return err
+	}
+	if err := q.UpdateChainHead(ctx, &chainHead{Seq: txn.ChainSeq, Hash: txn.Hash}); err != nil {
+		return err
+	}
+	if txn.ChainSeq%s.checkpointEvery != 0 {
+		return nil
+	}
+	return q.InsertChainCheckpoint(ctx, s.checkpoint(txn.ChainSeq, txn.Hash))
+}
+
+// ChainReport is the result of walking the transaction hash chain.
+type ChainReport struct {
+	CheckedAt      time.Time        `json:"checked_at"`
+	Head           chainHead        `json:"head"`                      // Head the chain was verified up to
+	Links          int64            `json:"links"`                     // Links verified before the first break
+	Checkpoints    int64            `json:"checkpoints"`               // Checkpoints verified before the first break
+	LastCheckpoint *ChainCheckpoint `json:"last_checkpoint,omitempty"` // Latest verified checkpoint
+	PublicKey      string           `json:"public_key,omitempty"`      // Base64 key checkpoint signatures are checked with
+	Valid          bool             `json:"valid"`                     // The whole chain up to Head is intact
+	Break          *ChainBreak      `json:"break,omitempty"`           // First broken link
+}
+
+// ChainBreak is the first link of the chain that does not verify.
+type ChainBreak struct {
+	Seq           int64      `json:"seq"`                      // Chain position of the broken link
+	TransactionID *uuid.UUID `json:"transaction_id,omitempty"` // Transaction at that position, when there is one
+	Reason        string     `json:"reason"`
+}
+
+// VerifyChain walks the hash chain from the first transaction to the current
+// head, recomputing every hash and comparing the links that have a checkpoint
+// with it, and reports the first broken link. With a signing key the
+// checkpoint signatures are checked too, so a chain rewritten together with
+// its head still fails at the first checkpoint it changed. Links added while
+// it runs are not checked.
+func (s *service) VerifyChain(ctx context.Context) (*ChainReport, error) {
+	head, err := s.repo.GetChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := &ChainReport{CheckedAt: time.Now().UTC(), Head: *head}
+	var public ed25519.PublicKey
+	if s.chainKey != nil {
+		public = s.chainKey.Public().(ed25519.PublicKey)
+		report.PublicKey = base64.StdEncoding.EncodeToString(public)
+	}
+	broken := func(seq int64, txnID *uuid.UUID, reason string) (*ChainReport, error) {
+		report.Break = &ChainBreak{Seq: seq, TransactionID: txnID, Reason: reason}
+		return report, nil
+	}
+
+	prev := chainHead{Hash: chainGenesisHash}
+	next, err := s.repo.NextChainCheckpoint(ctx, 1)
+	if err != nil {
+		return nil, err
+	}
+	for prev.Seq < head.Seq {
+		txns, err := s.repo.ListChainedTransactions(ctx, prev.Seq, chainBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(txns) == 0 {
+			return broken(prev.Seq+1, nil, "chain ends before the head")
+		}
+		for i := range txns {
+			txn := &txns[i]
+			if prev.Seq == head.Seq {
+				break
+			}
+			if txn.ChainSeq != prev.Seq+1 {
+				return broken(prev.Seq+1, nil, "link is missing")
+			}
+			if txn.PrevHash != prev.Hash {
+				return broken(txn.ChainSeq, &txn.ID, "prev_hash does not match the hash of the previous link")
+			}
+			if txn.Hash != linkHash(txn.PrevHash, transactionDigest(txn)) {
+				return broken(txn.ChainSeq, &txn.ID, "hash does not match the transaction fields")
+			}
+			prev = chainHead{Seq: txn.ChainSeq, Hash: txn.Hash}
+			report.Links++
+
+			if next == nil || next.Seq != txn.ChainSeq {
+				continue
+			}
+			if next.Hash != txn.Hash {
+				return broken(txn.ChainSeq, &txn.ID, "hash does not match the checkpoint")
+			}
+			if public != nil && !VerifyCheckpoint(public, next) {
+				return broken(txn.ChainSeq, &txn.ID, "checkpoint signature does not verify")
+			}
+			report.Checkpoints++
+			report.LastCheckpoint = next
+			if next, err = s.repo.NextChainCheckpoint(ctx, txn.ChainSeq+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if prev.Hash != head.Hash {
+		return broken(head.Seq, nil, "last link does not match the chain head")
+	}
+	report.Valid = true
+	return report, nil
+}
+
+// InclusionProof shows that a transaction is part of the hash chain. Starting
+// from Hash, folding in each digest of Path with linkHash gives Anchor.Hash:
+// the hash of the first checkpoint at or after the transaction, or of the
+// chain head when there is none yet.
+type InclusionProof struct {
+	TransactionID uuid.UUID        `json:"transaction_id"`
+	Seq           int64            `json:"seq"`                  // Chain position of the transaction
+	Canonical     string           `json:"canonical"`            // Exact bytes hashed into Digest
+	Digest        string           `json:"digest"`               // SHA-256 of Canonical
+	PrevHash      string           `json:"prev_hash"`            // Hash of the previous link
+	Hash          string           `json:"hash"`                 // linkHash(PrevHash, Digest)
+	Path          []string         `json:"path"`                 // Digests of the following links up to Anchor, in chain order
+	Anchor        chainHead        `json:"anchor"`               // Link the proof ends at
+	Checkpoint    *ChainCheckpoint `json:"checkpoint,omitempty"` // Signed checkpoint of Anchor, nil when Anchor is the head
+	Head          chainHead        `json:"head"`                 // Current chain head
+}
+
+// GetInclusionProof returns the proof that a transaction is in the hash chain,
+// up to the next checkpoint, so it holds fewer than chainCheckpointInterval
+// digests, or up to the current head for the newest transactions.
+func (s *service) GetInclusionProof(ctx context.Context, txnID uuid.UUID) (*InclusionProof, error) {
+	txn, err := s.repo.GetChainedTransaction(ctx, txnID)
+	if err != nil {
+		return nil, err
+	}
+	if txn.ChainSeq == 0 {
+		return nil, ErrTransactionNotChained
+	}
+	head, err := s.repo.GetChainHead(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint, err := s.repo.NextChainCheckpoint(ctx, txn.ChainSeq)
+	if err != nil {
+		return nil, err
+	}
+	end := *head
+	if checkpoint != nil {
+		end = chainHead{Seq: checkpoint.Seq, Hash: checkpoint.Hash}
+	}
+
+	proof := &InclusionProof{TransactionID: txn.ID, Seq: txn.ChainSeq, Canonical: string(canonicalTransaction(txn)),
+		Digest: transactionDigest(txn), PrevHash: txn.PrevHash, Hash: txn.Hash, Path: []string{},
+		Anchor: chainHead{Seq: txn.ChainSeq, Hash: txn.Hash}, Checkpoint: checkpoint, Head: *head}
+	for proof.Anchor.Seq < end.Seq {
+		limit := chainBatchSize
+		if rest := end.Seq - proof.Anchor.Seq; rest < int64(limit) {
+			limit = int(rest)
+		}
+		txns, err := s.repo.ListChainedTransactions(ctx, proof.Anchor.Seq, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(txns) == 0 {
+			break
+		}
+		for i := range txns {
+			// A missing link ends the proof early, VerifyChain reports it
+			if txns[i].ChainSeq != proof.Anchor.Seq+1 {
+				return proof, nil
+			}
+			proof.Path = append(proof.Path, transactionDigest(&txns[i]))
+			proof.Anchor = chainHead{Seq: txns[i].ChainSeq, Hash: txns[i].Hash}
+		}
+	}
+	return proof, nil
+}
@@ -0,0 +1,228 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// chainFixture makes a deposit, a charged withdrawal, a transfer, a reversal
+// and a hold capture, one link each. The options are applied before.
+func chainFixture(t *testing.T, opts ...Option) (*service, *memoryRepository, []uuid.UUID) {
+	ctx := context.Background()
+	svc, repo := newFeeService(t)
+	for _, opt := range opts {
+		opt(svc)
+	}
+	fromID := fundedWallet(t, svc, 10000)
+	toID := fundedWallet(t, svc, 0)
+
+	withdrawalID, err := svc.Withdraw(ctx, fromID, usd(1000))
+	assert.NoError(t, err)
+	transferID, err := svc.Transfer(ctx, fromID, toID, usd(2000))
+	assert.NoError(t, err)
+	reversalID, err := svc.Reverse(ctx, transferID, 500, "refund", false)
+	assert.NoError(t, err)
+	h, err := svc.CreateHold(ctx, toID, usd(300), time.Hour)
+	assert.NoError(t, err)
+	captureID, err := svc.CaptureHold(ctx, h.ID, 200)
+	assert.NoError(t, err)
+	return svc, repo, []uuid.UUID{repo.transactions[0].ID, withdrawalID, transferID, reversalID, captureID}
+}
+
+func TestService_HashChainLinksEveryTransaction(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, ids := chainFixture(t)
+
+	prev := chainGenesisHash
+	for i, txn := range repo.transactions {
+		assert.Equal(t, ids[i], txn.ID)
+		assert.Equal(t, int64(i+1), txn.ChainSeq)
+		assert.Equal(t, prev, txn.PrevHash)
+		assert.Len(t, txn.Hash, 64)
+		prev = txn.Hash
+	}
+
+	report, err := svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Nil(t, report.Break)
+	assert.Equal(t, int64(5), report.Links)
+	assert.Equal(t, chainHead{Seq: 5, Hash: prev}, report.Head)
+}
+
+func TestService_VerifyChainReportsFirstBreak(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, ids := chainFixture(t)
+
+	// Edits that bypassed the service, the first one is reported
+	repo.transactions[3].Reason = "edited"
+	repo.transactions[1].Amount = 1
+	report, err := svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.False(t, report.Valid)
+	assert.Equal(t, &ChainBreak{Seq: 2, TransactionID: &ids[1], Reason: "hash does not match the transaction fields"}, report.Break)
+	assert.Equal(t, int64(1), report.Links)
+
+	// Only the reversed amount may change after the insert
+	repo.transactions[1].Amount = 1000
+	repo.transactions[3].Reason = "refund"
+	repo.transactions[2].Reversed = 0
+	report, err = svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+
+	// A deleted row leaves a gap
+	repo.transactions = append(repo.transactions[:2], repo.transactions[3:]...)
+	report, err = svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &ChainBreak{Seq: 3, Reason: "link is missing"}, report.Break)
+
+	// A rehashed row breaks the link to the next one
+	svc, repo, ids = chainFixture(t)
+	txn := &repo.transactions[1]
+	txn.Amount = 1
+	txn.Hash = linkHash(txn.PrevHash, transactionDigest(txn))
+	report, err = svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &ChainBreak{Seq: 3, TransactionID: &ids[2], Reason: "prev_hash does not match the hash of the previous link"}, report.Break)
+}
+
+func TestService_GetInclusionProof(t *testing.T) {
+	ctx := context.Background()
+	svc, _, ids := chainFixture(t)
+
+	proof, err := svc.GetInclusionProof(ctx, ids[1])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), proof.Seq)
+	assert.Contains(t, proof.Canonical, `"type":"withdrawal"`)
+	assert.Len(t, proof.Path, 3)
+	assert.Equal(t, proof.Head, proof.Anchor)
+	assert.Nil(t, proof.Checkpoint)
+
+	// Recompute the proof the way a client would
+	sum := sha256.Sum256([]byte(proof.Canonical))
+	assert.Equal(t, hex.EncodeToString(sum[:]), proof.Digest)
+	hash := linkHash(proof.PrevHash, proof.Digest)
+	assert.Equal(t, proof.Hash, hash)
+	for _, digest := range proof.Path {
+		hash = linkHash(hash, digest)
+	}
+	assert.Equal(t, proof.Head.Hash, hash)
+
+	// The last transaction is the head itself
+	proof, err = svc.GetInclusionProof(ctx, ids[4])
+	assert.NoError(t, err)
+	assert.Empty(t, proof.Path)
+	assert.Equal(t, proof.Hash, proof.Head.Hash)
+}
+
+// checkpointEveryTwo checkpoints every second link, signed with a fixed key.
+func checkpointEveryTwo(s *service) {
+	s.checkpointEvery = 2
+	s.chainKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+}
+
+func TestService_ChainCheckpoints(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, _ := chainFixture(t, checkpointEveryTwo)
+	public := svc.chainKey.Public().(ed25519.PublicKey)
+
+	assert.Len(t, repo.checkpoints, 2)
+	for i, cp := range repo.checkpoints {
+		assert.Equal(t, int64(2*i+2), cp.Seq)
+		assert.Equal(t, repo.transactions[2*i+1].Hash, cp.Hash)
+		assert.True(t, VerifyCheckpoint(public, &cp))
+	}
+
+	report, err := svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, int64(2), report.Checkpoints)
+	assert.Equal(t, int64(4), report.LastCheckpoint.Seq)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(public), report.PublicKey)
+
+	// Rewriting the chain and its head from the second link on is caught at
+	// the first checkpoint it changed
+	prev := repo.transactions[0].Hash
+	repo.transactions[1].Amount = 1
+	for i := 1; i < len(repo.transactions); i++ {
+		txn := &repo.transactions[i]
+		txn.PrevHash = prev
+		txn.Hash = linkHash(prev, transactionDigest(txn))
+		prev = txn.Hash
+	}
+	repo.chainHead.Hash = prev
+	report, err = svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &ChainBreak{Seq: 2, TransactionID: &repo.transactions[1].ID, Reason: "hash does not match the checkpoint"}, report.Break)
+
+	// Rewriting the checkpoint too needs the signing key
+	repo.checkpoints[0].Hash = repo.transactions[1].Hash
+	report, err = svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, &ChainBreak{Seq: 2, TransactionID: &repo.transactions[1].ID, Reason: "checkpoint signature does not verify"}, report.Break)
+}
+
+func TestService_GetInclusionProofEndsAtCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	svc, repo, ids := chainFixture(t, checkpointEveryTwo)
+	public := svc.chainKey.Public().(ed25519.PublicKey)
+
+	// The withdrawal at 2 is checkpointed itself, the transfer at 3 runs to 4
+	proof, err := svc.GetInclusionProof(ctx, ids[1])
+	assert.NoError(t, err)
+	assert.Empty(t, proof.Path)
+	assert.Equal(t, int64(2), proof.Checkpoint.Seq)
+
+	proof, err = svc.GetInclusionProof(ctx, ids[2])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{transactionDigest(&repo.transactions[3])}, proof.Path)
+	assert.Equal(t, chainHead{Seq: 4, Hash: repo.transactions[3].Hash}, proof.Anchor)
+	assert.Equal(t, linkHash(proof.Hash, proof.Path[0]), proof.Checkpoint.Hash)
+	assert.True(t, VerifyCheckpoint(public, proof.Checkpoint))
+
+	// Links past the last checkpoint run to the head
+	proof, err = svc.GetInclusionProof(ctx, ids[4])
+	assert.NoError(t, err)
+	assert.Nil(t, proof.Checkpoint)
+	assert.Equal(t, proof.Head, proof.Anchor)
+
+	// A forged signature fails
+	cp := repo.checkpoints[0]
+	cp.Hash = repo.transactions[0].Hash
+	assert.False(t, VerifyCheckpoint(public, &cp))
+}
+
+func TestParseChainSigningKey(t *testing.T) {
+	seed := bytes.Repeat([]byte{7}, ed25519.SeedSize)
+	key, err := ParseChainSigningKey(base64.StdEncoding.EncodeToString(seed))
+	assert.NoError(t, err)
+	assert.Equal(t, ed25519.NewKeyFromSeed(seed), key)
+
+	_, err = ParseChainSigningKey(base64.StdEncoding.EncodeToString(seed[:16]))
+	assert.Error(t, err)
+	_, err = ParseChainSigningKey("not base64")
+	assert.Error(t, err)
+}
+
+func TestService_GetInclusionProofErrors(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	_, err := svc.GetInclusionProof(ctx, uuid.New())
+	assert.Equal(t, ErrTransactionNotFound, err)
+
+	// Rows stored before the chain existed have no chain position
+	old := transaction{ID: uuid.New(), Amount: 10, Currency: "USD", Type: TxnTypeDeposit, CreatedAt: time.Now()}
+	repo.transactions = append(repo.transactions, old)
+	_, err = svc.GetInclusionProof(ctx, old.ID)
+	assert.Equal(t, ErrTransactionNotChained, err)
+}
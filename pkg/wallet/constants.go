@@ -1,8 +1,271 @@
 package wallet
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
 // transaction types used throughout the wallet service.
 const (
 	TxnTypeDeposit    = "deposit"
 	TxnTypeWithdrawal = "withdrawal"
 	TxnTypeTransfer   = "transfer"
+	TxnTypeCapture    = "capture"  // settlement of a hold
+	TxnTypeReversal   = "reversal" // compensating transaction, see Reverse
+)
+
+// wallet lifecycle statuses. Frozen wallets can neither send nor receive
+// money; closed wallets are final.
+const (
+	WalletActive = "active"
+	WalletFrozen = "frozen"
+	WalletClosed = "closed"
+)
+
+// wallet types, chosen when a wallet is created.
+const (
+	WalletTypeSpending = "spending" // default
+	WalletTypeSavings  = "savings"
+	WalletTypeBusiness = "business"
+	WalletTypeRevenue  = "revenue" // internal, see RevenueWalletID
+)
+
+// limit periods. Period limits reset at the start of each UTC calendar day,
+// week (Monday) or month.
+const (
+	LimitPerTransaction = "transaction"
+	LimitDaily          = "daily"
+	LimitWeekly         = "weekly"
+	LimitMonthly        = "monthly"
+)
+
+// kinds of limit reported by a LimitError.
+const (
+	LimitKindAmount = "amount"
+	LimitKindCount  = "count"
+)
+
+// DefaultLimitTier is the limit tier of new wallets.
+const DefaultLimitTier = "standard"
+
+// MaxLimitTierLength is the longest name a limit tier can have.
+const MaxLimitTierLength = 32
+
+// MaxWalletLabelLength is the longest label a wallet can be given, in characters.
+const MaxWalletLabelLength = 64
+
+// hold statuses. Only active holds reduce the available balance.
+const (
+	HoldActive   = "active"
+	HoldCaptured = "captured"
+	HoldVoided   = "voided"
+	HoldExpired  = "expired"
+)
+
+// hold expiry defaults.
+const (
+	DefaultHoldTTL     = 7 * 24 * time.Hour // TTL of holds created without one
+	MaxHoldTTL         = 30 * 24 * time.Hour
+	holdSweepBatchSize = 100 // expired holds released per sweeper query
+)
+
+// schedule frequencies. Cron schedules follow a five field cron expression in UTC.
+const (
+	ScheduleOnce    = "once"
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+	ScheduleCron    = "cron"
+)
+
+// schedule statuses. Completed and canceled schedules never run again.
+const (
+	ScheduleActive    = "active"
+	SchedulePaused    = "paused"
+	ScheduleCompleted = "completed"
+	ScheduleCanceled  = "canceled"
+)
+
+// schedule run statuses.
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"  // the run is retried
+	RunSkipped   = "skipped" // the last attempt failed, the schedule moved on
+)
+
+// schedule retry defaults and worker settings.
+const (
+	DefaultScheduleMaxAttempts  = 3                // Attempts per run before it is skipped
+	DefaultScheduleRetryBackoff = 15 * time.Minute // Delay after the first failed attempt, doubled after each one
+	scheduleBatchSize           = 100              // due schedules run per worker pass
+	maxScheduleRuns             = 100              // runs listed per schedule
+)
+
+// snapshotSettleDelay is how long after midnight UTC the daily balance
+// snapshot is taken, so transactions created before midnight have committed.
+const snapshotSettleDelay = 5 * time.Minute
+
+// kinds of ledger check discrepancies, see CheckLedger.
+const (
+	DiscrepancyBalanceMismatch       = "balance_mismatch"       // Stored wallet balance differs from its journal
+	DiscrepancyNegativeBalance       = "negative_balance"       // Stored wallet balance is below zero
+	DiscrepancyNegativeLedger        = "negative_ledger"        // Journal balance of a wallet is below zero
+	DiscrepancyNegativeHeld          = "negative_held"          // Held amount of a wallet is below zero
+	DiscrepancyUnbalancedCurrency    = "unbalanced_currency"    // Whole journal does not net to zero in a currency
+	DiscrepancyUnbalancedTransaction = "unbalanced_transaction" // Transaction without journal lines or with lines that do not balance
+)
+
+// ledgerCheckMaxTransactions caps the unbalanced transactions listed in a
+// ledger check report.
+const ledgerCheckMaxTransactions = 100
+
+// statement formats.
+const (
+	StatementJSON = "json"
+	StatementCSV  = "csv"
+	StatementHTML = "html" // printable page, laid out for A4 / PDF
+)
+
+// outbox event types.
+const (
+	EventWalletCreated    = "WalletCreated"
+	EventFundsDeposited   = "FundsDeposited"
+	EventFundsWithdrawn   = "FundsWithdrawn"
+	EventFundsTransferred = "FundsTransferred"
+	EventHoldCaptured     = "HoldCaptured"
+	EventFundsReversed    = "FundsReversed"
+)
+
+// webhook delivery statuses. Dead deliveries have used all their attempts and
+// are only sent again when replayed.
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookDead      = "dead"
+)
+
+// webhook delivery settings.
+const (
+	WebhookMaxAttempts    = 10               // Failed attempts before a delivery is dead
+	webhookBaseBackoff    = 30 * time.Second // Delay after the first failed attempt, doubled after each one
+	webhookMaxBackoff     = 6 * time.Hour
+	webhookBatchSize      = 50 // due deliveries sent per dispatcher run
+	webhookMinSecretBytes = 16
+	DefaultWebhookTimeout = 10 * time.Second // Time a receiver has to answer
+	webhookClaimTTL       = 5 * time.Minute  // Time a dispatcher has to send a delivery it claimed
+)
+
+// headers sent with every webhook request. The signature is
+// "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body)).
+const (
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// ScopeAdmin is the token scope of operators. It allows the /admin endpoints
+// and reversals, and bypasses the wallet ownership check.
+const ScopeAdmin = "admin"
+
+// scopes of API clients, checked per route by RequireScope. ScopeAdmin
+// grants all of them.
+const (
+	ScopeRead     = "read"     // GET endpoints
+	ScopeDeposit  = "deposit"  // deposits
+	ScopeWithdraw = "withdraw" // withdrawals and holds
+	ScopeTransfer = "transfer" // transfers, quotes and schedules
+)
+
+// headers of a request signed with an API key. The signature is
+// hex(HMAC-SHA256(sha256(api key), method + "\n" + path and query + "\n" +
+// timestamp + "\n" + nonce + "\n" + hex(sha256(body)))), see SignRequest.
+const (
+	ClientIDHeader  = "X-Client-ID"
+	TimestampHeader = "X-Timestamp" // Unix seconds
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
 )
+
+// API key settings.
+const (
+	DefaultSignatureWindow     = 5 * time.Minute // Clock skew allowed on X-Timestamp, and how long nonces are kept
+	DefaultAPIKeyRotationGrace = 24 * time.Hour  // How long the previous key works after a rotation
+	MinAPIKeyPepperLength      = 32              // Shortest API_KEY_PEPPER accepted
+	apiKeyPrefix               = "wk_"
+	apiKeyBytes                = 32 // random bytes of a key
+	apiKeyShownPrefix          = 10 // characters of a key stored in the clear, to tell keys apart
+	minNonceLength             = 16
+	maxNonceLength             = 128
+)
+
+// resources whose owners are checked before a request acts on them, see
+// ResourceOwners.
+const (
+	ResourceUser        = "user"
+	ResourceWallet      = "wallet"
+	ResourceTransaction = "transaction"
+	ResourceHold        = "hold"
+	ResourceQuote       = "quote"
+	ResourceSchedule    = "schedule"
+	ResourceWebhook     = "webhook"
+	ResourceDelivery    = "delivery"
+)
+
+// jwtLeeway is the clock skew allowed when checking the exp and nbf claims of a token.
+const jwtLeeway = 30 * time.Second
+
+// jwtMinHMACKeyLen is the shortest HS256 key accepted, the size of the hash.
+const jwtMinHMACKeyLen = 32
+
+// chainGenesisHash is the previous hash of the first link of the transaction hash chain.
+const chainGenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// chainBatchSize is the number of chained transactions read at a time when
+// walking the hash chain.
+const chainBatchSize = 500
+
+// chainCheckpointInterval is the number of links between two signed chain
+// checkpoints. An inclusion proof runs to the next checkpoint, so it folds in
+// fewer links than this.
+const chainCheckpointInterval = 1000
+
+// outboxBatchSize is the number of events the relay claims and publishes per batch.
+const outboxBatchSize = 100
+
+// outboxClaimTTL is how long a relay has to publish the batch it claimed.
+// Another relay takes the batch over once the claim has run out.
+const outboxClaimTTL = time.Minute
+
+// DefaultCurrency is used for new wallets created without a currency.
+const DefaultCurrency = "USD"
+
+// sides of a ledger entry. Wallets are liabilities of the company, so a credit
+// increases a wallet balance and a debit decreases it.
+const (
+	EntryDebit  = "debit"
+	EntryCredit = "credit"
+)
+
+// internal ledger accounts seeded by schema.sql. They are the counterparty for
+// money entering or leaving the system. AccountFX holds the currency position
+// taken by cross-currency transfers.
+var (
+	AccountCashIn  = uuid.MustParse("00000000-0000-0000-0000-000000000001")
+	AccountCashOut = uuid.MustParse("00000000-0000-0000-0000-000000000002")
+	AccountFX      = uuid.MustParse("00000000-0000-0000-0000-000000000004")
+)
+
+// SystemUserID owns the internal revenue wallets.
+var SystemUserID = uuid.MustParse("00000000-0000-0000-0000-0000000000ff")
+
+// RevenueWalletID returns the fixed ID of the revenue wallet that collects the
+// fees of a currency: all ones followed by the ASCII code of the currency. The
+// IDs sort after every other wallet, so a transaction crediting fees after
+// locking its wallets in UUID order still takes its locks in that order.
+func RevenueWalletID(currency string) uuid.UUID {
+	id := uuid.UUID{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	copy(id[13:], currency)
+	return id
+}
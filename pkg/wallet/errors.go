@@ -3,10 +3,80 @@ package wallet
 import "errors"
 
 var (
-	ErrWalletNotFound     = errors.New("wallet not found")
-	ErrInsufficientFunds  = errors.New("insufficient balance")
-	ErrInvalidAmount      = errors.New("amount must be greater than zero")
-	ErrSameWalletTransfer = errors.New("cannot transfer to the same wallet")
-	ErrSourceInvalid      = errors.New("sender wallet does not exist")
-	ErrDestinationInvalid = errors.New("recipient wallet does not exist")
+	ErrWalletNotFound         = errors.New("wallet not found")
+	ErrInsufficientFunds      = errors.New("insufficient balance")
+	ErrInvalidAmount          = errors.New("amount must be greater than zero")
+	ErrSameWalletTransfer     = errors.New("cannot transfer to the same wallet")
+	ErrSourceInvalid          = errors.New("sender wallet does not exist")
+	ErrDestinationInvalid     = errors.New("recipient wallet does not exist")
+	ErrUnbalancedEntries      = errors.New("ledger entries do not balance")
+	ErrLedgerMismatch         = errors.New("wallet balance does not match ledger")
+	ErrCurrencyRequired       = errors.New("currency is required")
+	ErrUnsupportedCurrency    = errors.New("unsupported currency")
+	ErrCurrencyMismatch       = errors.New("amount currency does not match wallet currency")
+	ErrInvalidDecimal         = errors.New("invalid decimal amount")
+	ErrInvalidRate            = errors.New("exchange rate must be a positive decimal")
+	ErrRateUnavailable        = errors.New("no exchange rate for currency pair")
+	ErrQuoteNotFound          = errors.New("quote not found")
+	ErrQuoteExpired           = errors.New("quote has expired")
+	ErrQuoteExecuted          = errors.New("quote has already been executed")
+	ErrInvalidFilter          = errors.New("invalid transaction filter")
+	ErrInvalidCursor          = errors.New("invalid cursor")
+	ErrHoldNotFound           = errors.New("hold not found")
+	ErrHoldNotActive          = errors.New("hold is no longer active")
+	ErrHoldExpired            = errors.New("hold has expired")
+	ErrCaptureExceedsHold     = errors.New("capture amount exceeds hold amount")
+	ErrInvalidHoldTTL         = errors.New("invalid hold ttl")
+	ErrTransactionNotFound    = errors.New("transaction not found")
+	ErrTransactionNotChained  = errors.New("transaction predates the hash chain")
+	ErrReasonRequired         = errors.New("reason is required")
+	ErrNotReversible          = errors.New("reversals cannot be reversed")
+	ErrAlreadyReversed        = errors.New("transaction has already been fully reversed")
+	ErrReversalTooLarge       = errors.New("reversal amount exceeds the unreversed amount")
+	ErrFundsAlreadySpent      = errors.New("recipient has already spent the funds")
+	ErrWalletFrozen           = errors.New("wallet is frozen")
+	ErrWalletClosed           = errors.New("wallet is closed")
+	ErrInboundBlocked         = errors.New("wallet is blocked from receiving funds")
+	ErrOutboundBlocked        = errors.New("wallet is blocked from sending funds")
+	ErrInvalidWalletStatus    = errors.New("invalid wallet status")
+	ErrInvalidTransition      = errors.New("wallet status transition not allowed")
+	ErrWalletNotEmpty         = errors.New("wallet balance must be zero to close")
+	ErrActorRequired          = errors.New("actor is required")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrInvalidWalletType      = errors.New("invalid wallet type")
+	ErrLabelTooLong           = errors.New("wallet label is too long")
+	ErrInvalidFeeRule         = errors.New("invalid fee rule")
+	ErrInvalidTxnType         = errors.New("invalid transaction type")
+	ErrLimitExceeded          = errors.New("limit exceeded")
+	ErrInvalidLimit           = errors.New("invalid limit")
+	ErrInvalidTier            = errors.New("invalid limit tier")
+	ErrWebhookNotFound        = errors.New("webhook subscription not found")
+	ErrDeliveryNotFound       = errors.New("webhook delivery not found")
+	ErrDeliveryNotDue         = errors.New("webhook delivery is not due")
+	ErrInvalidWebhookURL      = errors.New("webhook url must be an absolute http or https url")
+	ErrWebhookAddressBlocked  = errors.New("webhook url must resolve to a public address")
+	ErrInvalidEventType       = errors.New("invalid event type")
+	ErrInvalidWebhookOwner    = errors.New("webhook needs either a wallet_id or a user_id")
+	ErrWebhookSecretShort     = errors.New("webhook secret must be at least 16 characters")
+	ErrScheduleNotFound       = errors.New("schedule not found")
+	ErrScheduleNotDue         = errors.New("schedule is not due")
+	ErrScheduleFinished       = errors.New("schedule is completed or canceled")
+	ErrInvalidSchedule        = errors.New("invalid schedule")
+	ErrRunAlreadyExecuted     = errors.New("schedule run has already been executed")
+	ErrInvalidAsOf            = errors.New("as_of must be a time in the past")
+	ErrInvalidStatementPeriod = errors.New("statement period needs from before to")
+	ErrInvalidStatementFormat = errors.New("statement format must be json, csv or html")
+	ErrUnauthenticated        = errors.New("authentication required")
+	ErrInvalidToken           = errors.New("invalid bearer token")
+	ErrForbidden              = errors.New("not allowed to access this resource")
+	ErrAPIClientNotFound      = errors.New("api client not found")
+	ErrAPIClientRevoked       = errors.New("api client has been revoked")
+	ErrClientNameRequired     = errors.New("api client name is required")
+	ErrInvalidScope           = errors.New("invalid scope")
+	ErrInvalidSignature       = errors.New("invalid request signature")
+	ErrSignatureExpired       = errors.New("request timestamp is outside the signature window")
+	ErrInvalidNonce           = errors.New("nonce must be 16 to 128 characters")
+	ErrNonceReused            = errors.New("nonce has already been used")
+	ErrIdempotencyKeyReused   = errors.New("Idempotency-Key was already used with a different request")
+	ErrIdempotencyKeyInUse    = errors.New("a request with this Idempotency-Key is still in progress")
 )
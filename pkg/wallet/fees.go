@@ -0,0 +1,315 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// FeeRule is one line of a fee schedule as written in the fees file. A rule
+// applies to one transaction type and optionally only to one currency and/or
+// wallet type. Rules with the same name are alternatives: the most specific
+// matching one is charged. Rules with different names are charged together and
+// show up as separate items on the transaction.
+type FeeRule struct {
+	Name       string    `json:"name"`        // Item name shown on the transaction, e.g. "withdrawal_fee"
+	TxnType    string    `json:"txn_type"`    // withdrawal or transfer
+	Currency   string    `json:"currency"`    // Only transactions in this currency, any when empty
+	WalletType string    `json:"wallet_type"` // Only wallets of this type, any when empty
+	Flat       int64     `json:"flat"`        // Fixed fee in minor units
+	Percent    string    `json:"percent"`     // Percentage of the amount as a decimal, e.g. "1.5"
+	Tiers      []FeeTier `json:"tiers"`       // Amount bands replacing flat and percent, in ascending order
+	Min        int64     `json:"min"`         // Smallest fee charged, in minor units
+	Max        int64     `json:"max"`         // Largest fee charged in minor units, no cap when zero
+}
+
+// FeeTier is the flat and percentage fee for amounts up to UpTo (inclusive).
+// The last tier of a rule has no UpTo and covers every larger amount.
+type FeeTier struct {
+	UpTo    int64  `json:"up_to"`
+	Flat    int64  `json:"flat"`
+	Percent string `json:"percent"`
+}
+
+// feeRate is a flat plus percentage fee, with the percentage parsed.
+type feeRate struct {
+	upTo    int64
+	flat    int64
+	percent *big.Rat
+}
+
+// feeRule is a validated FeeRule.
+type feeRule struct {
+	name, txnType, currency, walletType string
+	tiers                               []feeRate // a rule without tiers has a single unbounded one
+	min, max                            int64
+}
+
+// FeeSchedule computes the fees of withdrawals and transfers.
+type FeeSchedule struct {
+	rules []feeRule
+}
+
+// NewFeeSchedule validates rules and builds a schedule from them. Amounts in a
+// rule are minor units, so rules with a flat part, caps or tiers must name
+// their currency.
+func NewFeeSchedule(rules []FeeRule) (*FeeSchedule, error) {
+	fs := &FeeSchedule{}
+	for i, r := range rules {
+		rule, err := newFeeRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("fee rule %d (%s): %w", i, r.Name, err)
+		}
+		fs.rules = append(fs.rules, rule)
+	}
+	return fs, nil
+}
+
+// LoadFeeFile reads a JSON array of fee rules into a schedule.
+func LoadFeeFile(path string) (*FeeSchedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []FeeRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewFeeSchedule(rules)
+}
+
+func newFeeRule(r FeeRule) (feeRule, error) {
+	rule := feeRule{name: strings.TrimSpace(r.Name), txnType: r.TxnType, walletType: r.WalletType, min: r.Min, max: r.Max}
+	if rule.name == "" {
+		return feeRule{}, fmt.Errorf("%w: name is required", ErrInvalidFeeRule)
+	}
+	if r.TxnType != TxnTypeWithdrawal && r.TxnType != TxnTypeTransfer {
+		return feeRule{}, fmt.Errorf("%w: txn_type must be withdrawal or transfer", ErrInvalidFeeRule)
+	}
+	switch r.WalletType {
+	case "", WalletTypeSpending, WalletTypeSavings, WalletTypeBusiness:
+	default:
+		return feeRule{}, ErrInvalidWalletType
+	}
+	if r.Currency != "" {
+		code, err := NormalizeCurrency(r.Currency)
+		if err != nil {
+			return feeRule{}, err
+		}
+		rule.currency = code
+	}
+	if r.Min < 0 || r.Max < 0 || (r.Max > 0 && r.Max < r.Min) {
+		return feeRule{}, fmt.Errorf("%w: invalid min/max", ErrInvalidFeeRule)
+	}
+
+	tiers := r.Tiers
+	if len(tiers) == 0 {
+		tiers = []FeeTier{{Flat: r.Flat, Percent: r.Percent}}
+	} else if r.Flat != 0 || r.Percent != "" {
+		return feeRule{}, fmt.Errorf("%w: use either tiers or flat/percent", ErrInvalidFeeRule)
+	}
+	for i, t := range tiers {
+		last := i == len(tiers)-1
+		if (t.UpTo == 0) != last || (i > 0 && t.UpTo != 0 && t.UpTo <= tiers[i-1].UpTo) {
+			return feeRule{}, fmt.Errorf("%w: tiers must be ascending and only the last may omit up_to", ErrInvalidFeeRule)
+		}
+		if t.Flat < 0 {
+			return feeRule{}, fmt.Errorf("%w: negative flat fee", ErrInvalidFeeRule)
+		}
+		percent := new(big.Rat)
+		if t.Percent != "" {
+			p, ok := new(big.Rat).SetString(strings.TrimSpace(t.Percent))
+			if !ok || p.Sign() < 0 || p.Cmp(big.NewRat(100, 1)) > 0 {
+				return feeRule{}, fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidFeeRule)
+			}
+			percent = p
+		}
+		rule.tiers = append(rule.tiers, feeRate{upTo: t.UpTo, flat: t.Flat, percent: percent})
+	}
+
+	fixed := r.Min != 0 || r.Max != 0 || len(r.Tiers) > 0 || r.Flat != 0
+	if fixed && rule.currency == "" {
+		return feeRule{}, fmt.Errorf("%w: currency is required for flat fees, caps and tiers", ErrInvalidFeeRule)
+	}
+	return rule, nil
+}
+
+// matches reports whether the rule applies and how specific it is.
+func (r feeRule) matches(txnType, walletType, currency string) (bool, int) {
+	if r.txnType != txnType ||
+		(r.currency != "" && r.currency != currency) ||
+		(r.walletType != "" && r.walletType != walletType) {
+		return false, 0
+	}
+	specificity := 0
+	if r.currency != "" {
+		specificity++
+	}
+	if r.walletType != "" {
+		specificity++
+	}
+	return true, specificity
+}
+
+// fee computes the rule's fee on amount: the tier covering the amount, flat
+// plus percentage rounded half to even, then capped by min and max.
+func (r feeRule) fee(amount int64) int64 {
+	tier := r.tiers[len(r.tiers)-1]
+	for _, t := range r.tiers {
+		if t.upTo != 0 && amount <= t.upTo {
+			tier = t
+			break
+		}
+	}
+
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(amount), tier.percent)
+	v.Quo(v, big.NewRat(100, 1))
+	fee := roundHalfEven(v).Int64()
+	if fee > math.MaxInt64-tier.flat {
+		// Too large to charge, debitFor refuses the amount
+		fee = math.MaxInt64
+	} else {
+		fee += tier.flat
+	}
+	if fee < r.min {
+		fee = r.min
+	}
+	if r.max > 0 && fee > r.max {
+		fee = r.max
+	}
+	return fee
+}
+
+// compute returns the fee items charged on amount for a transaction of
+// txnType paid by a wallet of walletType, in the order of the schedule. A nil
+// schedule charges nothing.
+func (fs *FeeSchedule) compute(txnType, walletType string, amount Money) []feeItem {
+	if fs == nil {
+		return nil
+	}
+
+	// Pick the most specific matching rule per name, the first on ties
+	chosen := map[string]int{}
+	var order []string
+	best := map[string]int{}
+	for i, r := range fs.rules {
+		ok, specificity := r.matches(txnType, walletType, amount.Currency)
+		if !ok {
+			continue
+		}
+		if _, seen := chosen[r.name]; !seen {
+			order = append(order, r.name)
+		} else if specificity <= best[r.name] {
+			continue
+		}
+		chosen[r.name], best[r.name] = i, specificity
+	}
+
+	var items []feeItem
+	for _, name := range order {
+		if fee := fs.rules[chosen[name]].fee(amount.Amount); fee > 0 {
+			items = append(items, feeItem{Name: name, Amount: fee, Currency: amount.Currency})
+		}
+	}
+	return items
+}
+
+// feeTotal sums fee items, which always share the currency of the amount.
+func feeTotal(items []feeItem) int64 {
+	var total int64
+	for _, f := range items {
+		total += f.Amount
+	}
+	return total
+}
+
+// debitFor returns amount plus its fee items, what the paying wallet is
+// debited, or ErrInvalidAmount when the sum does not fit an int64.
+func debitFor(amount int64, items []feeItem) (int64, error) {
+	debit := amount
+	for _, f := range items {
+		if f.Amount > math.MaxInt64-debit {
+			return 0, ErrInvalidAmount
+		}
+		debit += f.Amount
+	}
+	return debit, nil
+}
+
+// feeEntries books each fee item from the paying wallet to the revenue wallet
+// of its currency.
+func feeEntries(walletID uuid.UUID, items []feeItem) []ledgerEntry {
+	var entries []ledgerEntry
+	for _, f := range items {
+		entries = append(entries, entryPair(walletID, RevenueWalletID(f.Currency), Money{Amount: f.Amount, Currency: f.Currency})...)
+	}
+	return entries
+}
+
+// creditFees adds the fee items to the balance of the revenue wallet of their
+// currency, creating the wallet with the first fee charged in that currency.
+func creditFees(ctx context.Context, q Queries, items []feeItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	code := items[0].Currency
+	revenue := &wallet{ID: RevenueWalletID(code), UserID: SystemUserID, Currency: code, Label: "Fee revenue " + code, Type: WalletTypeRevenue, Status: WalletActive, Tier: DefaultLimitTier}
+	if err := q.EnsureUser(ctx, SystemUserID); err != nil {
+		return err
+	}
+	if err := q.EnsureWallet(ctx, revenue); err != nil {
+		return err
+	}
+	return q.AdjustBalance(ctx, revenue.ID, feeTotal(items))
+}
+
+// ListRevenueWallets returns the revenue wallets with the fees collected in
+// each currency.
+func (s *service) ListRevenueWallets(ctx context.Context) ([]wallet, error) {
+	wallets, err := s.repo.ListWallets(ctx, SystemUserID)
+	if err != nil {
+		return nil, err
+	}
+	if wallets == nil {
+		wallets = []wallet{}
+	}
+	return wallets, nil
+}
+
+// PreviewFees returns the fees a withdrawal or transfer of amount from a
+// wallet would be charged right now, without moving any money.
+func (s *service) PreviewFees(ctx context.Context, walletID uuid.UUID, txnType string, amount Money) (*FeePreview, error) {
+	amount, err := validateAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	if txnType != TxnTypeWithdrawal && txnType != TxnTypeTransfer {
+		return nil, ErrInvalidTxnType
+	}
+
+	w, err := s.repo.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if w.Currency != amount.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+
+	fees := s.fees.compute(txnType, w.Type, amount)
+	if fees == nil {
+		fees = []feeItem{}
+	}
+	debit, err := debitFor(amount.Amount, fees)
+	if err != nil {
+		return nil, err
+	}
+	total := Money{Amount: feeTotal(fees), Currency: amount.Currency}
+	return &FeePreview{Amount: amount, Fees: fees, TotalFee: total,
+		TotalDebit: Money{Amount: debit, Currency: amount.Currency}}, nil
+}
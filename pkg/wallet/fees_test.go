@@ -0,0 +1,101 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeRule_Fee(t *testing.T) {
+	tests := []struct {
+		name   string
+		rule   FeeRule
+		amount int64
+		want   int64
+	}{
+		{"flat", FeeRule{Flat: 100}, 5000, 100},
+		{"percentage", FeeRule{Percent: "1.5"}, 10000, 150},
+		{"percentage half rounds to even down", FeeRule{Percent: "0.5"}, 100, 0},
+		{"percentage half rounds to even up", FeeRule{Percent: "0.5"}, 300, 2},
+		{"flat plus percentage", FeeRule{Flat: 30, Percent: "2.9"}, 1000, 59},
+		{"min cap", FeeRule{Percent: "1", Min: 50}, 1000, 50},
+		{"max cap", FeeRule{Percent: "1", Max: 500}, 100000, 500},
+		{"first tier", FeeRule{Tiers: []FeeTier{{UpTo: 1000, Flat: 10}, {UpTo: 5000, Percent: "1"}, {Flat: 25}}}, 1000, 10},
+		{"middle tier", FeeRule{Tiers: []FeeTier{{UpTo: 1000, Flat: 10}, {UpTo: 5000, Percent: "1"}, {Flat: 25}}}, 4000, 40},
+		{"last tier", FeeRule{Tiers: []FeeTier{{UpTo: 1000, Flat: 10}, {UpTo: 5000, Percent: "1"}, {Flat: 25}}}, 9000, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rule.Name, tt.rule.TxnType, tt.rule.Currency = "fee", TxnTypeWithdrawal, "USD"
+			rule, err := newFeeRule(tt.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, rule.fee(tt.amount))
+		})
+	}
+}
+
+func TestFeeSchedule_Compute(t *testing.T) {
+	fs, err := NewFeeSchedule([]FeeRule{
+		{Name: "withdrawal_fee", TxnType: TxnTypeWithdrawal, Percent: "1"},
+		{Name: "withdrawal_fee", TxnType: TxnTypeWithdrawal, Currency: "usd", Flat: 100},
+		{Name: "withdrawal_fee", TxnType: TxnTypeWithdrawal, Currency: "USD", WalletType: WalletTypeSavings, Flat: 300},
+		{Name: "network_fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Flat: 5},
+		{Name: "transfer_fee", TxnType: TxnTypeTransfer, WalletType: WalletTypeBusiness, Percent: "0.5"},
+	})
+	assert.NoError(t, err)
+
+	// The most specific rule per name wins, different names are itemised
+	assert.Equal(t, []feeItem{{"withdrawal_fee", 100, "USD"}, {"network_fee", 5, "USD"}},
+		fs.compute(TxnTypeWithdrawal, WalletTypeSpending, usd(1000)))
+	assert.Equal(t, []feeItem{{"withdrawal_fee", 300, "USD"}, {"network_fee", 5, "USD"}},
+		fs.compute(TxnTypeWithdrawal, WalletTypeSavings, usd(1000)))
+	assert.Equal(t, []feeItem{{"withdrawal_fee", 10, "EUR"}},
+		fs.compute(TxnTypeWithdrawal, WalletTypeSpending, Money{Amount: 1000, Currency: "EUR"}))
+
+	assert.Equal(t, []feeItem{{"transfer_fee", 5, "USD"}}, fs.compute(TxnTypeTransfer, WalletTypeBusiness, usd(1000)))
+	assert.Nil(t, fs.compute(TxnTypeTransfer, WalletTypeSpending, usd(1000)))
+
+	var none *FeeSchedule
+	assert.Nil(t, none.compute(TxnTypeWithdrawal, WalletTypeSpending, usd(1000)))
+}
+
+func TestNewFeeSchedule_InvalidRules(t *testing.T) {
+	invalid := []FeeRule{
+		{TxnType: TxnTypeWithdrawal, Percent: "1"},
+		{Name: "fee", TxnType: TxnTypeDeposit, Percent: "1"},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Percent: "101"},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Percent: "abc"},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Flat: 100},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Min: 500, Max: 100},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Flat: 10, Tiers: []FeeTier{{Flat: 10}}},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Tiers: []FeeTier{{UpTo: 500}, {UpTo: 100}, {}}},
+		{Name: "fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Tiers: []FeeTier{{UpTo: 500}}},
+	}
+	for _, rule := range invalid {
+		_, err := NewFeeSchedule([]FeeRule{rule})
+		assert.ErrorIs(t, err, ErrInvalidFeeRule, "%+v", rule)
+	}
+
+	_, err := NewFeeSchedule([]FeeRule{{Name: "fee", TxnType: TxnTypeWithdrawal, WalletType: "checking", Percent: "1"}})
+	assert.ErrorIs(t, err, ErrInvalidWalletType)
+	_, err = NewFeeSchedule([]FeeRule{{Name: "fee", TxnType: TxnTypeWithdrawal, Currency: "XYZ", Flat: 1}})
+	assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+}
+
+func TestLoadFeeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fees.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"name": "withdrawal_fee", "txn_type": "withdrawal", "currency": "USD", "flat": 25}]`), 0o600))
+
+	fs, err := LoadFeeFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []feeItem{{"withdrawal_fee", 25, "USD"}}, fs.compute(TxnTypeWithdrawal, WalletTypeSpending, usd(100)))
+
+	// The example schedule shipped with the repository must load
+	_, err = LoadFeeFile(filepath.Join("..", "..", "fees.example.json"))
+	assert.NoError(t, err)
+
+	_, err = LoadFeeFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,146 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RoundingHalfEven rounds converted amounts to the nearest minor unit, ties
+// to the even unit. It is the rounding mode recorded on every conversion.
+const RoundingHalfEven = "half_even"
+
+// rateDecimals is the precision that rates are rounded to before they are
+// used, so the recorded rate reproduces the converted amount exactly.
+const rateDecimals = 12
+
+// FXRateProvider returns the exchange rate between two currencies as the
+// number of major units of `to` bought by one major unit of `from`.
+type FXRateProvider interface {
+	Rate(from, to string) (*big.Rat, error)
+}
+
+// staticRateProvider is an FXRateProvider backed by a fixed table of rates,
+// meant for local use and tests.
+type staticRateProvider struct {
+	mu    sync.RWMutex
+	rates map[string]*big.Rat // keyed by "FROM/TO"
+}
+
+// NewStaticRateProvider builds a provider from rates keyed by "FROM/TO",
+// e.g. {"USD/EUR": "0.92"}. The inverse pair is derived when it is missing.
+func NewStaticRateProvider(rates map[string]string) (*staticRateProvider, error) {
+	p := &staticRateProvider{rates: map[string]*big.Rat{}}
+	for pair, rate := range rates {
+		from, to, ok := strings.Cut(pair, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid currency pair %q", pair)
+		}
+		if err := p.SetRate(from, to, rate); err != nil {
+			return nil, fmt.Errorf("%s: %w", pair, err)
+		}
+	}
+	return p, nil
+}
+
+// LoadRatesFile reads a JSON object of "FROM/TO": "rate" pairs into a static provider.
+func LoadRatesFile(path string) (*staticRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rates map[string]string
+	if err := json.Unmarshal(data, &rates); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewStaticRateProvider(rates)
+}
+
+// SetRate adds or replaces the rate of a currency pair.
+func (p *staticRateProvider) SetRate(from, to, rate string) error {
+	from, err := NormalizeCurrency(from)
+	if err != nil {
+		return err
+	}
+	to, err = NormalizeCurrency(to)
+	if err != nil {
+		return err
+	}
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(rate))
+	if !ok || r.Sign() <= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidRate, rate)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rates[from+"/"+to] = r
+	return nil
+}
+
+// Rate returns the rate of a pair, falling back to the inverse of the reverse pair.
+func (p *staticRateProvider) Rate(from, to string) (*big.Rat, error) {
+	if from == to {
+		return big.NewRat(1, 1), nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if r, ok := p.rates[from+"/"+to]; ok {
+		return new(big.Rat).Set(r), nil
+	}
+	if r, ok := p.rates[to+"/"+from]; ok {
+		return new(big.Rat).Inv(r), nil
+	}
+	return nil, ErrRateUnavailable
+}
+
+// formatRate rounds a rate to rateDecimals and formats it without trailing zeros.
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(rateDecimals)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+// convert turns amount into the target currency at rate, rounding half to even
+// to the minor unit of the target currency.
+func convert(amount Money, target string, rate *big.Rat) (Money, error) {
+	srcExp, err := CurrencyExponent(amount.Currency)
+	if err != nil {
+		return Money{}, err
+	}
+	dstExp, err := CurrencyExponent(target)
+	if err != nil {
+		return Money{}, err
+	}
+
+	// target minor = source minor * rate * 10^dstExp / 10^srcExp
+	v := new(big.Rat).Mul(new(big.Rat).SetInt64(amount.Amount), rate)
+	v.Mul(v, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(dstExp)), nil)))
+	v.Quo(v, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(srcExp)), nil)))
+
+	q := roundHalfEven(v)
+	if !q.IsInt64() {
+		return Money{}, ErrInvalidAmount
+	}
+	return Money{Amount: q.Int64(), Currency: target}, nil
+}
+
+// roundHalfEven rounds v to the nearest integer, ties to the even integer.
+func roundHalfEven(v *big.Rat) *big.Int {
+	q, r := new(big.Int).QuoRem(v.Num(), v.Denom(), new(big.Int))
+	switch new(big.Int).Mul(r, big.NewInt(2)).CmpAbs(v.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(int64(r.Sign())))
+	case 0:
+		if q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(int64(r.Sign())))
+		}
+	}
+	return q
+}
+
+// Compile-time check to ensure staticRateProvider implements FXRateProvider interface
+var _ FXRateProvider = (*staticRateProvider)(nil)
@@ -0,0 +1,97 @@
+package wallet
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticRateProvider(t *testing.T) {
+	p, err := NewStaticRateProvider(map[string]string{"usd/EUR": "0.8"})
+	assert.NoError(t, err)
+
+	r, err := p.Rate("USD", "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(4, 5), r)
+
+	// The reverse pair is derived from the inverse
+	r, err = p.Rate("EUR", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(5, 4), r)
+
+	r, err = p.Rate("USD", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewRat(1, 1), r)
+
+	_, err = p.Rate("USD", "JPY")
+	assert.Equal(t, ErrRateUnavailable, err)
+
+	assert.NoError(t, p.SetRate("USD", "JPY", "150.25"))
+	r, err = p.Rate("USD", "JPY")
+	assert.NoError(t, err)
+	assert.Equal(t, "150.25", formatRate(r))
+}
+
+func TestStaticRateProvider_InvalidRates(t *testing.T) {
+	_, err := NewStaticRateProvider(map[string]string{"USDEUR": "0.9"})
+	assert.Error(t, err)
+
+	_, err = NewStaticRateProvider(map[string]string{"USD/XYZ": "0.9"})
+	assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+
+	_, err = NewStaticRateProvider(map[string]string{"USD/EUR": "-1"})
+	assert.ErrorIs(t, err, ErrInvalidRate)
+
+	_, err = NewStaticRateProvider(map[string]string{"USD/EUR": "abc"})
+	assert.ErrorIs(t, err, ErrInvalidRate)
+}
+
+func TestLoadRatesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rates.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"USD/EUR": "0.92", "GBP/USD": "1.27"}`), 0o600))
+
+	p, err := LoadRatesFile(path)
+	assert.NoError(t, err)
+	r, err := p.Rate("GBP", "USD")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.27", formatRate(r))
+
+	_, err = LoadRatesFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount Money
+		target string
+		rate   string
+		want   int64
+	}{
+		{"same exponent", Money{Amount: 10000, Currency: "USD"}, "EUR", "0.92", 9200},
+		{"to zero decimals", Money{Amount: 1000, Currency: "USD"}, "JPY", "150.31", 1503},
+		{"from zero decimals", Money{Amount: 1000, Currency: "JPY"}, "USD", "0.0066", 660},
+		{"to three decimals", Money{Amount: 100, Currency: "USD"}, "KWD", "0.3075", 308},
+		{"half rounds to even down", Money{Amount: 5, Currency: "USD"}, "EUR", "0.5", 2},
+		{"half rounds to even up", Money{Amount: 7, Currency: "USD"}, "EUR", "0.5", 4},
+		{"above half rounds up", Money{Amount: 1, Currency: "USD"}, "EUR", "0.6", 1},
+		{"below half rounds down", Money{Amount: 1, Currency: "USD"}, "EUR", "0.4", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rate, _ := new(big.Rat).SetString(tt.rate)
+			got, err := convert(tt.amount, tt.target, rate)
+			assert.NoError(t, err)
+			assert.Equal(t, Money{Amount: tt.want, Currency: tt.target}, got)
+		})
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	assert.Equal(t, "0.92", formatRate(big.NewRat(92, 100)))
+	assert.Equal(t, "2", formatRate(big.NewRat(2, 1)))
+	assert.Equal(t, "0.333333333333", formatRate(big.NewRat(1, 3)))
+}
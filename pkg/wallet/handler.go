@@ -2,9 +2,14 @@ package wallet
 
 import (
 	"encoding/json" // Used to parse and return JSON
+	"fmt"
 	"github.com/gorilla/mux"
+	"io"
+	"log"
 	"net/http" // Used for HTTP request/response handling
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid" // Used to generate and parse UUIDs
 )
@@ -20,9 +25,24 @@ func NewHandler(svc Service) *handler {
 }
 
 type TransactionResponse struct {
-	Status        string     `json:"status"`                   // e.g. "success" or "error"
+	Status        string     `json:"status"`                   // "success", errors are answered with a Problem
 	TransactionID *uuid.UUID `json:"transaction_id,omitempty"` // optional
-	Error         string     `json:"error,omitempty"`          // optional
+}
+
+// BalanceResponse is the body returned by the balance endpoint.
+type BalanceResponse struct {
+	Balance   int64  `json:"balance"`   // Ledger balance, kept for older clients
+	Ledger    int64  `json:"ledger"`    // Posted balance in minor units of the currency
+	Available int64  `json:"available"` // Ledger balance minus active holds
+	Currency  string `json:"currency"`  // ISO 4217 currency of the wallet
+}
+
+// HistoricalBalanceResponse is the body returned by the balance endpoint with as_of.
+type HistoricalBalanceResponse struct {
+	Balance  int64     `json:"balance"`  // Ledger balance, kept for older clients
+	Ledger   int64     `json:"ledger"`   // Posted balance at as_of in minor units of the currency
+	Currency string    `json:"currency"` // ISO 4217 currency of the wallet
+	AsOf     time.Time `json:"as_of"`    // Point in time of the balance
 }
 
 // writeJSON is a helper to write a JSON response with the correct headers.
@@ -35,32 +55,41 @@ func writeJSON(w http.ResponseWriter, status int, data interface{}) {
 // CreateWallet handles the API request to create a wallet for a user.
 func (h *handler) CreateWallet(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		UserID string `json:"user_id"` // The user ID that the wallet is for
+		UserID   string `json:"user_id"`  // The user ID that the wallet is for
+		Currency string `json:"currency"` // ISO 4217 currency, defaults to USD
+		Label    string `json:"label"`    // Optional name of the wallet
+		Type     string `json:"type"`     // spending, savings or business, defaults to spending
 	}
 
 	// Decode JSON request body into `body`
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid JSON body",
-		})
+		writeError(w, r, errInvalidJSON)
 		return
 	}
 
 	// Validate UUID format
 	userID, err := uuid.Parse(strings.TrimSpace(body.UserID))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid user_id format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid user_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceUser, userID) {
+		return
+	}
+
+	currency := body.Currency
+	if strings.TrimSpace(currency) == "" {
+		currency = DefaultCurrency
+	}
+	if _, err := NormalizeCurrency(currency); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Call the service to create a wallet
-	wallet, err := h.service.CreateWallet(userID)
+	wallet, err := h.service.CreateWallet(r.Context(), userID, currency, body.Label, body.Type)
 	if err != nil {
-		http.Error(w, "Wallet Creation failed", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
@@ -68,6 +97,27 @@ func (h *handler) CreateWallet(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusCreated, wallet)
 }
 
+// ListWallets returns all wallets of a user with their balances.
+func (h *handler) ListWallets(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	userID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["user_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid user_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceUser, userID) {
+		return
+	}
+
+	wallets, err := h.service.ListWallets(r.Context(), userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, wallets)
+}
+
 // Deposit handles the API request to deposit funds into a wallet.
 func (h *handler) Deposit(w http.ResponseWriter, r *http.Request) {
 	// Extract wallet_id from URL path
@@ -77,40 +127,39 @@ func (h *handler) Deposit(w http.ResponseWriter, r *http.Request) {
 	// Validate UUID
 	walletID, err := uuid.Parse(strings.TrimSpace(walletIDStr))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid wallet_id format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
 		return
 	}
 
 	var body struct {
-		Amount int64 `json:"amount"`
+		Amount   int64  `json:"amount"`   // Amount in minor units of the currency
+		Currency string `json:"currency"` // ISO 4217 currency, must match the wallet
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid JSON body",
-		})
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	amount, err := NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Call the service to perform the deposit
-	txnId, err := h.service.Deposit(walletID, body.Amount)
+	txnId, err := h.serviceFor(r).Deposit(r.Context(), walletID, amount)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status:        "error",
-			TransactionID: nil,
-			Error:         err.Error(),
-		})
+		writeError(w, r, err)
 		return
 	}
 
 	// Respond with HTTP 200 and the txn id of successful txn
 	writeJSON(w, http.StatusOK, TransactionResponse{
 		Status:        "success",
-		Error:         "",
 		TransactionID: &txnId,
 	})
 }
@@ -124,100 +173,211 @@ func (h *handler) Withdraw(w http.ResponseWriter, r *http.Request) {
 	// Validate UUID
 	walletID, err := uuid.Parse(strings.TrimSpace(walletIDStr))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid wallet_id format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
 		return
 	}
 
 	var body struct {
-		Amount int64 `json:"amount"`
+		Amount   int64  `json:"amount"`   // Amount in minor units of the currency
+		Currency string `json:"currency"` // ISO 4217 currency, must match the wallet
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid JSON body",
-		})
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	amount, err := NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Call the service to perform the withdrawal
-	txnId, err := h.service.Withdraw(walletID, body.Amount)
+	txnId, err := h.serviceFor(r).Withdraw(r.Context(), walletID, amount)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status:        "error",
-			TransactionID: nil,
-			Error:         err.Error(),
-		})
+		writeError(w, r, err)
 		return
 	}
 
 	// Respond with HTTP 200 and the txn id of successful txn
 	writeJSON(w, http.StatusOK, TransactionResponse{
 		Status:        "success",
-		Error:         "",
 		TransactionID: &txnId,
 	})
 }
 
-// Transfer handles transferring funds from one wallet to another.
-func (h *handler) Transfer(w http.ResponseWriter, r *http.Request) {
+// decodeTransfer parses the body shared by the transfer and quote endpoints.
+// It writes the error response and returns false when the body is invalid.
+func decodeTransfer(w http.ResponseWriter, r *http.Request) (uuid.UUID, uuid.UUID, Money, bool) {
 	var body struct {
-		FromID string `json:"from_id"`
-		ToID   string `json:"to_id"`
-		Amount int64  `json:"amount"`
+		FromID   string `json:"from_id"`
+		ToID     string `json:"to_id"`
+		Amount   int64  `json:"amount"`   // Amount in minor units of the currency
+		Currency string `json:"currency"` // ISO 4217 currency, must match the sender wallet
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid JSON body",
-		})
-		return
+		writeError(w, r, errInvalidJSON)
+		return uuid.Nil, uuid.Nil, Money{}, false
 	}
 
 	// Validate UUID format
 	frmWalletID, err := uuid.Parse(strings.TrimSpace(body.FromID))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid Source wallet format (must be UUID)",
-		})
-		return
+		writeError(w, r, badRequest("Invalid Source wallet format (must be UUID)"))
+		return uuid.Nil, uuid.Nil, Money{}, false
 	}
 
 	// Validate UUID format
 	toWalletID, err := uuid.Parse(strings.TrimSpace(body.ToID))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid Destination wallet format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid Destination wallet format (must be UUID)"))
+		return uuid.Nil, uuid.Nil, Money{}, false
+	}
+
+	amount, err := NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		writeError(w, r, err)
+		return uuid.Nil, uuid.Nil, Money{}, false
+	}
+
+	return frmWalletID, toWalletID, amount, true
+}
+
+// Transfer handles transferring funds from one wallet to another.
+func (h *handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	frmWalletID, toWalletID, amount, ok := decodeTransfer(w, r)
+	if !ok {
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, frmWalletID) {
 		return
 	}
 
 	// Call the service to perform the transfer
-	txnId, err := h.service.Transfer(frmWalletID, toWalletID, body.Amount)
+	txnId, err := h.serviceFor(r).Transfer(r.Context(), frmWalletID, toWalletID, amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Respond with HTTP 200 and the txn id of successful txn
+	writeJSON(w, http.StatusOK, TransactionResponse{
+		Status:        "success",
+		TransactionID: &txnId,
+	})
+}
+
+// QuoteTransfer prices a cross-currency transfer and returns the quote to execute.
+func (h *handler) QuoteTransfer(w http.ResponseWriter, r *http.Request) {
+	frmWalletID, toWalletID, amount, ok := decodeTransfer(w, r)
+	if !ok {
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, frmWalletID) {
+		return
+	}
+
+	quote, err := h.service.QuoteTransfer(r.Context(), frmWalletID, toWalletID, amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Respond with HTTP 201 and the quote
+	writeJSON(w, http.StatusCreated, quote)
+}
+
+// ExecuteQuote performs the transfer priced by a quote.
+func (h *handler) ExecuteQuote(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	quoteID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["quote_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid quote_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceQuote, quoteID) {
+		return
+	}
+
+	txnId, err := h.serviceFor(r).ExecuteQuote(r.Context(), quoteID)
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status:        "error",
-			TransactionID: nil,
-			Error:         err.Error(),
-		})
+		writeError(w, r, err)
 		return
 	}
 
 	// Respond with HTTP 200 and the txn id of successful txn
 	writeJSON(w, http.StatusOK, TransactionResponse{
 		Status:        "success",
-		Error:         "",
 		TransactionID: &txnId,
 	})
 }
 
-// GetBalance handles retrieving the wallet balance.
+// Reverse posts a full or partial reversal of a transaction.
+func (h *handler) Reverse(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	txnID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["transaction_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid transaction_id format (must be UUID)"))
+		return
+	}
+
+	var body struct {
+		Amount        int64  `json:"amount"`         // Amount to reverse in minor units of the original, the unreversed rest when zero
+		Reason        string `json:"reason"`         // Why the transaction is reversed
+		AllowNegative bool   `json:"allow_negative"` // Operator override: reverse even if the receiver spent the funds
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	txnId, err := h.serviceFor(r).Reverse(r.Context(), txnID, body.Amount, body.Reason, body.AllowNegative)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Respond with HTTP 200 and the txn id of the reversal
+	writeJSON(w, http.StatusOK, TransactionResponse{
+		Status:        "success",
+		TransactionID: &txnId,
+	})
+}
+
+// GetInclusionProof returns the proof that a transaction is part of the
+// transaction hash chain.
+func (h *handler) GetInclusionProof(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	txnID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["transaction_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid transaction_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceTransaction, txnID) {
+		return
+	}
+
+	proof, err := h.service.GetInclusionProof(r.Context(), txnID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, proof)
+}
+
+// GetBalance handles retrieving the wallet balance, or with the as_of query
+// parameter the ledger balance at a past time.
 func (h *handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	// Extract wallet_id from URL path
 	vars := mux.Vars(r)
@@ -226,47 +386,964 @@ func (h *handler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	// Validate UUID
 	walletID, err := uuid.Parse(strings.TrimSpace(walletIDStr))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid wallet_id format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
+		return
+	}
+
+	if raw := r.URL.Query().Get("as_of"); raw != "" {
+		h.getBalanceAt(w, r, walletID, raw)
 		return
 	}
 
 	// Get balance from the service
-	balance, err := h.service.GetBalance(walletID)
+	balance, err := h.service.GetBalance(r.Context(), walletID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	// Return the balance as JSON
-	writeJSON(w, http.StatusOK, map[string]int64{"balance": balance})
+	// Return the balances and their currency as JSON
+	writeJSON(w, http.StatusOK, BalanceResponse{
+		Balance:   balance.Ledger.Amount,
+		Ledger:    balance.Ledger.Amount,
+		Available: balance.Available.Amount,
+		Currency:  balance.Ledger.Currency,
+	})
 }
 
-// GetTransactions returns the transaction history for a wallet.
-func (h *handler) GetTransactions(w http.ResponseWriter, r *http.Request) {
-	// Extract wallet_id from URL path
-	vars := mux.Vars(r)
-	walletIDStr := vars["wallet_id"]
+// getBalanceAt writes the ledger balance of a wallet at as_of.
+func (h *handler) getBalanceAt(w http.ResponseWriter, r *http.Request, walletID uuid.UUID, raw string) {
+	asOf, err := parseStatementTime(raw)
+	if err != nil {
+		writeError(w, r, badRequest("Invalid as_of (must be YYYY-MM-DD or RFC 3339)"))
+		return
+	}
+
+	balance, err := h.service.GetBalanceAt(r.Context(), walletID, asOf)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, HistoricalBalanceResponse{
+		Balance:  balance.Amount,
+		Ledger:   balance.Amount,
+		Currency: balance.Currency,
+		AsOf:     asOf.UTC(),
+	})
+}
 
+// PreviewFees returns the fees a withdrawal or transfer would be charged,
+// from the query parameters type, amount and currency.
+func (h *handler) PreviewFees(w http.ResponseWriter, r *http.Request) {
 	// Validate UUID
-	walletID, err := uuid.Parse(strings.TrimSpace(walletIDStr))
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
 	if err != nil {
-		writeJSON(w, http.StatusBadRequest, TransactionResponse{
-			Status: "error",
-			Error:  "Invalid wallet_id format (must be UUID)",
-		})
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
 		return
 	}
 
-	// Retrieve transactions
-	txns, err := h.service.GetTransactions(walletID)
+	query := r.URL.Query()
+	value, err := strconv.ParseInt(query.Get("amount"), 10, 64)
+	if err != nil {
+		writeError(w, r, badRequest("amount must be an integer"))
+		return
+	}
+	amount, err := NewMoney(value, query.Get("currency"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	preview, err := h.service.PreviewFees(r.Context(), walletID, query.Get("type"), amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// CreateHold reserves funds on a wallet.
+func (h *handler) CreateHold(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
+		return
+	}
+
+	var body struct {
+		Amount    int64  `json:"amount"`     // Amount in minor units of the currency
+		Currency  string `json:"currency"`   // ISO 4217 currency, must match the wallet
+		ExpiresIn int64  `json:"expires_in"` // TTL in seconds, the server default when zero
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	amount, err := NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	hold, err := h.service.CreateHold(r.Context(), walletID, amount, time.Duration(body.ExpiresIn)*time.Second)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Respond with HTTP 201 and the hold
+	writeJSON(w, http.StatusCreated, hold)
+}
+
+// GetHold returns a hold and its status.
+func (h *handler) GetHold(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	holdID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["hold_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid hold_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceHold, holdID) {
+		return
+	}
+
+	hold, err := h.service.GetHold(r.Context(), holdID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, hold)
+}
+
+// CaptureHold settles a hold. The body is optional; without an amount the
+// whole hold is captured.
+func (h *handler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	holdID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["hold_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid hold_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceHold, holdID) {
+		return
+	}
+
+	var body struct {
+		Amount int64 `json:"amount"` // Amount to capture in minor units, the whole hold when zero
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	txnId, err := h.serviceFor(r).CaptureHold(r.Context(), holdID, body.Amount)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Respond with HTTP 200 and the txn id of the capture
+	writeJSON(w, http.StatusOK, TransactionResponse{
+		Status:        "success",
+		TransactionID: &txnId,
+	})
+}
+
+// VoidHold releases a hold without moving money.
+func (h *handler) VoidHold(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	holdID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["hold_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid hold_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceHold, holdID) {
+		return
+	}
+
+	if err := h.service.VoidHold(r.Context(), holdID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, TransactionResponse{Status: "success"})
+}
+
+// ChangeWalletState lets an admin freeze, unfreeze or close a wallet and set
+// its inbound and outbound blocks. Blocks left out of the body are unchanged.
+func (h *handler) ChangeWalletState(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+
+	var body struct {
+		Status          string `json:"status"`           // active, frozen or closed; unchanged when empty
+		InboundBlocked  *bool  `json:"inbound_blocked"`  // Block deposits and incoming transfers
+		OutboundBlocked *bool  `json:"outbound_blocked"` // Block withdrawals, holds and outgoing transfers
+		Actor           string `json:"actor"`            // Who makes the change
+		Reason          string `json:"reason"`           // Why the change is made
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	updated, err := h.service.ChangeWalletState(r.Context(), walletID, WalletStateChange{Status: body.Status,
+		InboundBlocked: body.InboundBlocked, OutboundBlocked: body.OutboundBlocked, Actor: body.Actor, Reason: body.Reason})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// GetWalletStateEvents returns who changed the state of a wallet, when and why.
+func (h *handler) GetWalletStateEvents(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+
+	events, err := h.service.GetWalletStateEvents(r.Context(), walletID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, events)
+}
+
+// SetWalletLimits lets an admin move a wallet to another limit tier and
+// replace its limit overrides. Fields left out of the body are unchanged.
+func (h *handler) SetWalletLimits(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+
+	var body struct {
+		Tier      string   `json:"tier"`      // New limit tier, unchanged when empty
+		Overrides *[]Limit `json:"overrides"` // Replaces all overrides, unchanged when left out
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	updated, err := h.service.SetWalletLimits(r.Context(), walletID, WalletLimitsChange{Tier: body.Tier, Overrides: body.Overrides})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// GetWalletLimits returns the limits of a wallet and their usage in the current period.
+func (h *handler) GetWalletLimits(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+
+	limits, err := h.service.GetWalletLimits(r.Context(), walletID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, limits)
+}
+
+// ListRevenueWallets returns the internal revenue wallets that collect the
+// fees, one per currency.
+func (h *handler) ListRevenueWallets(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	wallets, err := h.service.ListRevenueWallets(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, wallets)
+}
+
+// decodeOwnerID parses an optional wallet_id or user_id; empty means nil.
+func decodeOwnerID(raw string) (*uuid.UUID, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// CreateWebhook subscribes a URL to the events of a wallet or of all wallets
+// of a user. The response holds the signing secret, which is not shown again.
+func (h *handler) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		WalletID   string   `json:"wallet_id"`   // Wallet whose events are sent
+		UserID     string   `json:"user_id"`     // Or user whose wallets' events are sent
+		URL        string   `json:"url"`         // Absolute http or https URL
+		EventTypes []string `json:"event_types"` // Events to send, all when empty
+		Secret     string   `json:"secret"`      // Signing secret, generated when empty
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	walletID, err := decodeOwnerID(body.WalletID)
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	userID, err := decodeOwnerID(body.UserID)
+	if err != nil {
+		writeError(w, r, badRequest("Invalid user_id format (must be UUID)"))
+		return
+	}
+	if walletID != nil && !h.authorize(w, r, ResourceWallet, *walletID) {
+		return
+	}
+	if userID != nil && !h.authorize(w, r, ResourceUser, *userID) {
+		return
+	}
+
+	sub, err := h.service.CreateWebhook(r.Context(), WebhookRequest{WalletID: walletID, UserID: userID, URL: body.URL,
+		EventTypes: body.EventTypes, Secret: body.Secret})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, sub)
+}
+
+// ListWebhooks returns the subscriptions of the wallet_id or user_id query parameter.
+func (h *handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	walletID, err := decodeOwnerID(r.URL.Query().Get("wallet_id"))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	userID, err := decodeOwnerID(r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid user_id format (must be UUID)"))
+		return
+	}
+	if walletID != nil && !h.authorize(w, r, ResourceWallet, *walletID) {
+		return
+	}
+	if userID != nil && !h.authorize(w, r, ResourceUser, *userID) {
+		return
+	}
+
+	subs, err := h.service.ListWebhooks(r.Context(), walletID, userID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, subs)
+}
+
+// GetWebhook returns a subscription without its secret.
+func (h *handler) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	subscriptionID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["subscription_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid subscription_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWebhook, subscriptionID) {
+		return
+	}
+
+	sub, err := h.service.GetWebhook(r.Context(), subscriptionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// UpdateWebhook changes the URL, event types, secret or active flag of a
+// subscription. Fields left out of the body are unchanged.
+func (h *handler) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	subscriptionID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["subscription_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid subscription_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWebhook, subscriptionID) {
+		return
+	}
+
+	var body struct {
+		URL        string    `json:"url"`         // New URL, unchanged when empty
+		EventTypes *[]string `json:"event_types"` // Replaces the event types, unchanged when left out
+		Secret     string    `json:"secret"`      // New signing secret, unchanged when empty
+		Active     *bool     `json:"active"`      // Pause or resume deliveries
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	sub, err := h.service.UpdateWebhook(r.Context(), subscriptionID, WebhookUpdate{URL: body.URL, EventTypes: body.EventTypes,
+		Secret: body.Secret, Active: body.Active})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub)
+}
+
+// DeleteWebhook deletes a subscription with its deliveries.
+func (h *handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	subscriptionID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["subscription_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid subscription_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWebhook, subscriptionID) {
+		return
+	}
+
+	err = h.service.DeleteWebhook(r.Context(), subscriptionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a subscription.
+func (h *handler) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	subscriptionID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["subscription_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid subscription_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWebhook, subscriptionID) {
+		return
+	}
+
+	deliveries, err := h.service.ListWebhookDeliveries(r.Context(), subscriptionID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// ListWebhookAttempts returns the attempts log of a delivery.
+func (h *handler) ListWebhookAttempts(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	deliveryID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["delivery_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid delivery_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceDelivery, deliveryID) {
+		return
+	}
+
+	attempts, err := h.service.ListWebhookAttempts(r.Context(), deliveryID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+// ReplayWebhookDelivery queues a delivery to be sent again, e.g. after it went dead.
+func (h *handler) ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	deliveryID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["delivery_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid delivery_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceDelivery, deliveryID) {
+		return
+	}
+
+	delivery, err := h.service.ReplayWebhookDelivery(r.Context(), deliveryID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, delivery)
+}
+
+// CreateSchedule creates a one-off or recurring transfer run by the scheduler.
+func (h *handler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		FromID    string     `json:"from_id"`
+		ToID      string     `json:"to_id"`
+		Amount    int64      `json:"amount"`    // Amount in minor units of the currency
+		Currency  string     `json:"currency"`  // ISO 4217 currency, must match the sender wallet
+		Frequency string     `json:"frequency"` // once, daily, weekly, monthly or cron
+		Cron      string     `json:"cron"`      // Five field cron expression (UTC) for the cron frequency
+		StartAt   time.Time  `json:"start_at"`  // First run (RFC 3339), now when left out
+		EndAt     *time.Time `json:"end_at"`    // No run after this time (RFC 3339)
+		MaxRuns   int        `json:"max_runs"`  // Completed after this many transfers, unlimited when zero
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	// Validate UUID format
+	frmWalletID, err := uuid.Parse(strings.TrimSpace(body.FromID))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid Source wallet format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, frmWalletID) {
+		return
+	}
+
+	// Validate UUID format
+	toWalletID, err := uuid.Parse(strings.TrimSpace(body.ToID))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid Destination wallet format (must be UUID)"))
+		return
+	}
+
+	amount, err := NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sch, err := h.service.CreateSchedule(r.Context(), ScheduleRequest{FromWallet: frmWalletID, ToWallet: toWalletID, Amount: amount,
+		Frequency: body.Frequency, Cron: body.Cron, StartAt: body.StartAt, EndAt: body.EndAt, MaxRuns: body.MaxRuns})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, sch)
+}
+
+// ListSchedules returns the scheduled transfers sent from a wallet.
+func (h *handler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
+		return
+	}
+
+	schedules, err := h.service.ListSchedules(r.Context(), walletID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedules)
+}
+
+// GetSchedule returns a scheduled transfer and its next run.
+func (h *handler) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	scheduleID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["schedule_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid schedule_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceSchedule, scheduleID) {
+		return
+	}
+
+	sch, err := h.service.GetSchedule(r.Context(), scheduleID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sch)
+}
+
+// UpdateSchedule changes the amount, end date or maximum runs of a schedule,
+// or pauses or resumes it. Fields left out of the body are unchanged.
+func (h *handler) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	scheduleID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["schedule_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid schedule_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceSchedule, scheduleID) {
+		return
+	}
+
+	var body struct {
+		Amount  *int64          `json:"amount"`   // New amount in minor units
+		EndAt   json.RawMessage `json:"end_at"`   // New end (RFC 3339), null removes it
+		MaxRuns *int            `json:"max_runs"` // New maximum runs, zero for unlimited
+		Status  string          `json:"status"`   // active or paused
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	update := ScheduleUpdate{Amount: body.Amount, MaxRuns: body.MaxRuns, Status: body.Status}
+	if len(body.EndAt) > 0 {
+		// null decodes to the zero time, which removes the end date
+		var end time.Time
+		if string(body.EndAt) != "null" {
+			if err := json.Unmarshal(body.EndAt, &end); err != nil {
+				writeError(w, r, badRequest("Invalid end_at (must be RFC 3339)"))
+				return
+			}
+		}
+		update.EndAt = &end
+	}
+
+	sch, err := h.service.UpdateSchedule(r.Context(), scheduleID, update)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sch)
+}
+
+// CancelSchedule stops a schedule for good and returns it.
+func (h *handler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	scheduleID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["schedule_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid schedule_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceSchedule, scheduleID) {
+		return
+	}
+
+	sch, err := h.service.CancelSchedule(r.Context(), scheduleID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sch)
+}
+
+// ListScheduleRuns returns the latest runs of a schedule, newest first.
+func (h *handler) ListScheduleRuns(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	scheduleID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["schedule_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid schedule_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceSchedule, scheduleID) {
+		return
+	}
+
+	runs, err := h.service.ListScheduleRuns(r.Context(), scheduleID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// parseStatementTime reads a statement bound given as RFC 3339 or as a date
+// (YYYY-MM-DD, midnight UTC).
+func parseStatementTime(raw string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+// GetStatement returns the statement of a wallet for [from, to) in the format
+// query parameter: json (default), csv or html.
+func (h *handler) GetStatement(w http.ResponseWriter, r *http.Request) {
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["wallet_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
+		return
+	}
+
+	query := r.URL.Query()
+	from, err := parseStatementTime(query.Get("from"))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid from (must be YYYY-MM-DD or RFC 3339)"))
+		return
+	}
+	to, err := parseStatementTime(query.Get("to"))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid to (must be YYYY-MM-DD or RFC 3339)"))
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = StatementJSON
+	}
+	if format != StatementJSON && format != StatementCSV && format != StatementHTML {
+		writeError(w, r, ErrInvalidStatementFormat)
+		return
+	}
+
+	st, err := h.service.GetStatement(r.Context(), walletID, from, to)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", StatementContentType(format))
+	if format == StatementCSV {
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%s-%s.csv"`, walletID, from.Format("2006-01-02")))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := st.Write(w, format); err != nil {
+		log.Printf("Statement write error: %v", err)
+	}
+}
+
+// parseTransactionFilter reads the history filters from the query string:
+// type, direction, min_amount, max_amount, from, to (RFC 3339), counterparty,
+// cursor and limit.
+func parseTransactionFilter(r *http.Request) (TransactionFilter, error) {
+	query := r.URL.Query()
+	filter := TransactionFilter{
+		Type:      query.Get("type"),
+		Direction: query.Get("direction"),
+		Cursor:    query.Get("cursor"),
+	}
+
+	var err error
+	for name, dst := range map[string]*int64{"min_amount": &filter.MinAmount, "max_amount": &filter.MaxAmount} {
+		if v := query.Get(name); v != "" {
+			if *dst, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return filter, fmt.Errorf("%w: %s must be an integer", ErrInvalidFilter, name)
+			}
+		}
+	}
+	for name, dst := range map[string]*time.Time{"from": &filter.Since, "to": &filter.Until} {
+		if v := query.Get(name); v != "" {
+			if *dst, err = time.Parse(time.RFC3339, v); err != nil {
+				return filter, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidFilter, name)
+			}
+		}
+	}
+	if v := query.Get("counterparty"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return filter, fmt.Errorf("%w: counterparty must be a UUID", ErrInvalidFilter)
+		}
+		filter.Counterparty = &id
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit <= 0 {
+			return filter, fmt.Errorf("%w: limit must be a positive integer", ErrInvalidFilter)
+		}
+	}
+	return filter, nil
+}
+
+// GetTransactions returns one page of the transaction history for a wallet.
+func (h *handler) GetTransactions(w http.ResponseWriter, r *http.Request) {
+	// Extract wallet_id from URL path
+	vars := mux.Vars(r)
+	walletIDStr := vars["wallet_id"]
+
+	// Validate UUID
+	walletID, err := uuid.Parse(strings.TrimSpace(walletIDStr))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid wallet_id format (must be UUID)"))
+		return
+	}
+	if !h.authorize(w, r, ResourceWallet, walletID) {
+		return
+	}
+
+	filter, err := parseTransactionFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Retrieve transactions
+	page, err := h.service.GetTransactions(r.Context(), walletID, filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Return the page of transactions and the cursor of the next page in JSON format
+	writeJSON(w, http.StatusOK, page)
+}
+
+// IssueAPIClient creates an API client for a server-to-server caller. The
+// key is only returned in this response.
+func (h *handler) IssueAPIClient(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var body struct {
+		Name   string   `json:"name"`   // Who the client is
+		Scopes []string `json:"scopes"` // read, deposit, withdraw, transfer or admin
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, r, errInvalidJSON)
+		return
+	}
+
+	issued, err := h.service.IssueAPIClient(r.Context(), body.Name, body.Scopes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, issued)
+}
+
+// ListAPIClients returns all API clients without their keys.
+func (h *handler) ListAPIClients(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	clients, err := h.service.ListAPIClients(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, clients)
+}
+
+// RotateAPIKey gives an API client a new key; the old one keeps working for
+// the rotation grace period.
+func (h *handler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	clientID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["client_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid client_id format (must be UUID)"))
+		return
+	}
+
+	issued, err := h.service.RotateAPIKey(r.Context(), clientID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, issued)
+}
+
+// RevokeAPIClient stops every key of an API client from working.
+func (h *handler) RevokeAPIClient(w http.ResponseWriter, r *http.Request) {
+	// Admin scope only
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Validate UUID
+	clientID, err := uuid.Parse(strings.TrimSpace(mux.Vars(r)["client_id"]))
+	if err != nil {
+		writeError(w, r, badRequest("Invalid client_id format (must be UUID)"))
+		return
+	}
+
+	revoked, err := h.service.RevokeAPIClient(r.Context(), clientID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// Return the transactions in JSON format
-	writeJSON(w, http.StatusOK, txns)
+	writeJSON(w, http.StatusOK, revoked)
 }
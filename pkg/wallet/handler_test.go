@@ -2,18 +2,26 @@ package wallet
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCreateWallet(t *testing.T) {
 	mock := &mockService{
-		MockCreateWallet: func(userID uuid.UUID) (*wallet, error) {
-			return &wallet{ID: uuid.New(), UserID: userID}, nil
+		MockCreateWallet: func(ctx context.Context, userID uuid.UUID, currency, label, walletType string) (*wallet, error) {
+			if walletType == "checking" {
+				return nil, ErrInvalidWalletType
+			}
+			return &wallet{ID: uuid.New(), UserID: userID, Label: label, Type: walletType}, nil
 		},
 	}
 	h := NewHandler(mock)
@@ -50,12 +58,100 @@ func TestCreateWallet(t *testing.T) {
 			t.Errorf("expected 400, got %d", res.Code)
 		}
 	})
+
+	t.Run("unsupported currency", func(t *testing.T) {
+		body := []byte(`{"user_id":"` + uuid.New().String() + `","currency":"XYZ"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet", bytes.NewBuffer(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWallet(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+
+	t.Run("label and type", func(t *testing.T) {
+		body := []byte(`{"user_id":"` + uuid.New().String() + `","label":"Holiday","type":"savings"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet", bytes.NewBuffer(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWallet(res, req)
+		if res.Code != http.StatusCreated {
+			t.Errorf("expected 201, got %d", res.Code)
+		}
+		if !strings.Contains(res.Body.String(), `"label":"Holiday","type":"savings"`) {
+			t.Errorf("expected label and type in the response, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("invalid type", func(t *testing.T) {
+		body := []byte(`{"user_id":"` + uuid.New().String() + `","type":"checking"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet", bytes.NewBuffer(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWallet(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+}
+
+func TestListWallets(t *testing.T) {
+	userID := uuid.New()
+	mock := &mockService{
+		MockListWallets: func(ctx context.Context, id uuid.UUID) ([]wallet, error) {
+			if id != userID {
+				return nil, ErrUserNotFound
+			}
+			return []wallet{{ID: uuid.New(), UserID: userID, Balance: 500, Currency: "USD", Type: WalletTypeSpending},
+				{ID: uuid.New(), UserID: userID, Balance: 100, Currency: "USD", Type: WalletTypeSavings}}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid user", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users/"+userID.String()+"/wallets", nil)
+		req = mux.SetURLVars(req, map[string]string{"user_id": userID.String()})
+		res := httptest.NewRecorder()
+
+		h.ListWallets(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		var wallets []wallet
+		if err := json.Unmarshal(res.Body.Bytes(), &wallets); err != nil || len(wallets) != 2 {
+			t.Errorf("expected 2 wallets, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodGet, "/users/"+id+"/wallets", nil)
+		req = mux.SetURLVars(req, map[string]string{"user_id": id})
+		res := httptest.NewRecorder()
+
+		h.ListWallets(res, req)
+		if res.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", res.Code)
+		}
+	})
+
+	t.Run("invalid user_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/users/invalid/wallets", nil)
+		req = mux.SetURLVars(req, map[string]string{"user_id": "invalid"})
+		res := httptest.NewRecorder()
+
+		h.ListWallets(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
 }
 
 // TestDeposit tests the Deposit handler using wallet_id in URL
 func TestDeposit(t *testing.T) {
 	mock := &mockService{
-		MockDeposit: func(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
 			return uuid.New(), nil
 		},
 	}
@@ -63,7 +159,7 @@ func TestDeposit(t *testing.T) {
 
 	t.Run("valid request", func(t *testing.T) {
 		id := uuid.New()
-		body := []byte(`{"amount": 100}`)
+		body := []byte(`{"amount": 100, "currency": "USD"}`)
 		req := httptest.NewRequest(http.MethodPost, "/wallet/"+id.String()+"/deposit", bytes.NewBuffer(body))
 		req = mux.SetURLVars(req, map[string]string{"wallet_id": id.String()})
 		res := httptest.NewRecorder()
@@ -74,6 +170,19 @@ func TestDeposit(t *testing.T) {
 		}
 	})
 
+	t.Run("missing currency", func(t *testing.T) {
+		id := uuid.New()
+		body := []byte(`{"amount": 100}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/"+id.String()+"/deposit", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id.String()})
+		res := httptest.NewRecorder()
+
+		h.Deposit(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+
 	t.Run("invalid wallet_id", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/wallet/invalid-uuid/deposit", nil)
 		req = mux.SetURLVars(req, map[string]string{"wallet_id": "invalid-uuid"})
@@ -89,7 +198,7 @@ func TestDeposit(t *testing.T) {
 // TestWithdraw tests the Withdraw handler using wallet_id in URL
 func TestWithdraw(t *testing.T) {
 	mock := &mockService{
-		MockWithdraw: func(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
+		MockWithdraw: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
 			return uuid.New(), nil
 		},
 	}
@@ -97,7 +206,7 @@ func TestWithdraw(t *testing.T) {
 
 	t.Run("valid request", func(t *testing.T) {
 		id := uuid.New()
-		body := []byte(`{"amount": 50}`)
+		body := []byte(`{"amount": 50, "currency": "USD"}`)
 		req := httptest.NewRequest(http.MethodPost, "/wallet/"+id.String()+"/withdraw", bytes.NewBuffer(body))
 		req = mux.SetURLVars(req, map[string]string{"wallet_id": id.String()})
 		res := httptest.NewRecorder()
@@ -123,8 +232,8 @@ func TestWithdraw(t *testing.T) {
 // TestGetBalance with wallet_id in URL query param
 func TestGetBalance(t *testing.T) {
 	mock := &mockService{
-		MockGetBalance: func(walletID uuid.UUID) (int64, error) {
-			return 500, nil
+		MockGetBalance: func(ctx context.Context, walletID uuid.UUID) (*Balance, error) {
+			return &Balance{Ledger: Money{Amount: 500, Currency: "USD"}, Available: Money{Amount: 300, Currency: "USD"}}, nil
 		},
 	}
 	h := NewHandler(mock)
@@ -140,6 +249,9 @@ func TestGetBalance(t *testing.T) {
 		if res.Code != http.StatusOK {
 			t.Errorf("expected 200, got %d", res.Code)
 		}
+		if !strings.Contains(res.Body.String(), `"ledger":500,"available":300`) {
+			t.Errorf("expected ledger and available balances, got %s", res.Body.String())
+		}
 	})
 
 	t.Run("invalid wallet_id", func(t *testing.T) {
@@ -154,13 +266,68 @@ func TestGetBalance(t *testing.T) {
 	})
 }
 
+// TestGetBalanceAsOf with as_of in URL query param
+func TestGetBalanceAsOf(t *testing.T) {
+	var gotAt time.Time
+	mock := &mockService{
+		MockGetBalanceAt: func(ctx context.Context, walletID uuid.UUID, at time.Time) (Money, error) {
+			gotAt = at
+			if at.Year() > 2100 {
+				return Money{}, ErrInvalidAsOf
+			}
+			return Money{Amount: 420, Currency: "USD"}, nil
+		},
+	}
+	h := NewHandler(mock)
+	id := uuid.New().String()
+
+	tests := []struct {
+		name     string
+		asOf     string
+		wantCode int
+	}{
+		{"date", "2025-03-01", http.StatusOK},
+		{"RFC 3339", "2025-03-01T12:00:00Z", http.StatusOK},
+		{"invalid as_of", "yesterday", http.StatusBadRequest},
+		{"future as_of", "2200-01-01", http.StatusUnprocessableEntity},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/balance?as_of="+tc.asOf, nil)
+			req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+			res := httptest.NewRecorder()
+
+			h.GetBalance(res, req)
+			if res.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, res.Code)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/balance?as_of=2025-03-01", nil)
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+	res := httptest.NewRecorder()
+	h.GetBalance(res, req)
+	if !gotAt.Equal(time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected as_of at midnight UTC, got %s", gotAt)
+	}
+	if !strings.Contains(res.Body.String(), `"ledger":420,"currency":"USD","as_of":"2025-03-01T00:00:00Z"`) {
+		t.Errorf("expected the historical balance, got %s", res.Body.String())
+	}
+	if strings.Contains(res.Body.String(), "available") {
+		t.Errorf("expected no available balance, got %s", res.Body.String())
+	}
+}
+
 // TestGetTransactions with wallet_id in URL query param
 func TestGetTransactions(t *testing.T) {
+	var got TransactionFilter
 	mock := &mockService{
-		MockGetTransactions: func(walletID uuid.UUID) ([]transaction, error) {
-			return []transaction{
+		MockGetTransactions: func(ctx context.Context, walletID uuid.UUID, filter TransactionFilter) (*TransactionPage, error) {
+			got = filter
+			return &TransactionPage{Transactions: []transaction{
 				{Amount: 100, Type: "deposit"},
-			}, nil
+			}}, nil
 		},
 	}
 	h := NewHandler(mock)
@@ -177,6 +344,40 @@ func TestGetTransactions(t *testing.T) {
 		}
 	})
 
+	t.Run("filters", func(t *testing.T) {
+		id := uuid.New().String()
+		cp := uuid.New()
+		req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/transactions?type=transfer&direction=out&min_amount=10&max_amount=500"+
+			"&from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z&counterparty="+cp.String()+"&cursor=abc&limit=20", nil)
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.GetTransactions(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		want := TransactionFilter{Type: "transfer", Direction: "out", MinAmount: 10, MaxAmount: 500,
+			Since: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Until: time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC),
+			Counterparty: &cp, Cursor: "abc", Limit: 20}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("expected filter %+v, got %+v", want, got)
+		}
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		id := uuid.New().String()
+		for _, query := range []string{"min_amount=ten", "from=yesterday", "counterparty=nope", "limit=0"} {
+			req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/transactions?"+query, nil)
+			req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+			res := httptest.NewRecorder()
+
+			h.GetTransactions(res, req)
+			if res.Code != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected 422, got %d", query, res.Code)
+			}
+		}
+	})
+
 	t.Run("invalid wallet_id", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/wallet/invalid-uuid/transactions", nil)
 		req = mux.SetURLVars(req, map[string]string{"wallet_id": "invalid-uuid"})
@@ -192,7 +393,7 @@ func TestGetTransactions(t *testing.T) {
 // TestTransfer still takes wallet IDs from request body
 func TestTransfer(t *testing.T) {
 	mock := &mockService{
-		MockTransfer: func(from uuid.UUID, to uuid.UUID, amt int64) (uuid.UUID, error) {
+		MockTransfer: func(ctx context.Context, from uuid.UUID, to uuid.UUID, amt Money) (uuid.UUID, error) {
 			return uuid.New(), nil
 		},
 	}
@@ -201,7 +402,7 @@ func TestTransfer(t *testing.T) {
 	t.Run("valid transfer", func(t *testing.T) {
 		fromID := uuid.New().String()
 		toID := uuid.New().String()
-		body := []byte(`{"from_id":"` + fromID + `", "to_id":"` + toID + `", "amount":100}`)
+		body := []byte(`{"from_id":"` + fromID + `", "to_id":"` + toID + `", "amount":100, "currency":"USD"}`)
 		req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewBuffer(body))
 		res := httptest.NewRecorder()
 
@@ -212,7 +413,7 @@ func TestTransfer(t *testing.T) {
 	})
 
 	t.Run("invalid from_id", func(t *testing.T) {
-		body := []byte(`{"from_id":"invalid", "to_id":"` + uuid.New().String() + `", "amount":100}`)
+		body := []byte(`{"from_id":"invalid", "to_id":"` + uuid.New().String() + `", "amount":100, "currency":"USD"}`)
 		req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewBuffer(body))
 		res := httptest.NewRecorder()
 
@@ -222,3 +423,967 @@ func TestTransfer(t *testing.T) {
 		}
 	})
 }
+
+func TestQuoteTransfer(t *testing.T) {
+	mock := &mockService{
+		MockQuoteTransfer: func(ctx context.Context, from uuid.UUID, to uuid.UUID, amt Money) (*fxQuote, error) {
+			if amt.Currency != "USD" {
+				return nil, ErrCurrencyMismatch
+			}
+			return &fxQuote{ID: uuid.New(), FromWallet: from, ToWallet: to, Source: amt}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid quote", func(t *testing.T) {
+		body := []byte(`{"from_id":"` + uuid.New().String() + `", "to_id":"` + uuid.New().String() + `", "amount":100, "currency":"USD"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transfer/quote", bytes.NewBuffer(body))
+		res := httptest.NewRecorder()
+
+		h.QuoteTransfer(res, req)
+		if res.Code != http.StatusCreated {
+			t.Errorf("expected 201, got %d", res.Code)
+		}
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		body := []byte(`{"from_id":"` + uuid.New().String() + `", "to_id":"` + uuid.New().String() + `", "amount":100, "currency":"EUR"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transfer/quote", bytes.NewBuffer(body))
+		res := httptest.NewRecorder()
+
+		h.QuoteTransfer(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+}
+
+func TestExecuteQuote(t *testing.T) {
+	mock := &mockService{
+		MockExecuteQuote: func(ctx context.Context, quoteID uuid.UUID) (uuid.UUID, error) {
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid request", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transfer/quote/"+id+"/execute", nil)
+		req = mux.SetURLVars(req, map[string]string{"quote_id": id})
+		res := httptest.NewRecorder()
+
+		h.ExecuteQuote(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+	})
+
+	t.Run("invalid quote_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transfer/quote/invalid/execute", nil)
+		req = mux.SetURLVars(req, map[string]string{"quote_id": "invalid"})
+		res := httptest.NewRecorder()
+
+		h.ExecuteQuote(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+}
+
+func TestCreateHold(t *testing.T) {
+	var gotTTL time.Duration
+	mock := &mockService{
+		MockCreateHold: func(ctx context.Context, walletID uuid.UUID, amt Money, ttl time.Duration) (*hold, error) {
+			gotTTL = ttl
+			if amt.Amount > 1000 {
+				return nil, ErrInsufficientFunds
+			}
+			return &hold{ID: uuid.New(), WalletID: walletID, Amount: amt.Amount, Currency: amt.Currency, Status: HoldActive}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid hold", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"amount":100, "currency":"USD", "expires_in":3600}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/"+id+"/holds", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.CreateHold(res, req)
+		if res.Code != http.StatusCreated {
+			t.Errorf("expected 201, got %d", res.Code)
+		}
+		if gotTTL != time.Hour {
+			t.Errorf("expected ttl 1h, got %s", gotTTL)
+		}
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"amount":5000, "currency":"USD"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/"+id+"/holds", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.CreateHold(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+}
+
+func TestGetHold(t *testing.T) {
+	mock := &mockService{
+		MockGetHold: func(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+			return nil, ErrHoldNotFound
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodGet, "/wallet/holds/"+id, nil)
+	req = mux.SetURLVars(req, map[string]string{"hold_id": id})
+	res := httptest.NewRecorder()
+
+	h.GetHold(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.Code)
+	}
+}
+
+func TestCaptureHold(t *testing.T) {
+	var gotAmount int64
+	mock := &mockService{
+		MockCaptureHold: func(ctx context.Context, holdID uuid.UUID, amount int64) (uuid.UUID, error) {
+			gotAmount = amount
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("partial capture", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodPost, "/wallet/holds/"+id+"/capture", bytes.NewBufferString(`{"amount":250}`))
+		req = mux.SetURLVars(req, map[string]string{"hold_id": id})
+		res := httptest.NewRecorder()
+
+		h.CaptureHold(res, req)
+		if res.Code != http.StatusOK || gotAmount != 250 {
+			t.Errorf("expected 200 capturing 250, got %d capturing %d", res.Code, gotAmount)
+		}
+	})
+
+	t.Run("full capture without body", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodPost, "/wallet/holds/"+id+"/capture", nil)
+		req = mux.SetURLVars(req, map[string]string{"hold_id": id})
+		res := httptest.NewRecorder()
+
+		h.CaptureHold(res, req)
+		if res.Code != http.StatusOK || gotAmount != 0 {
+			t.Errorf("expected 200 capturing 0, got %d capturing %d", res.Code, gotAmount)
+		}
+	})
+
+	t.Run("invalid hold_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/wallet/holds/invalid/capture", nil)
+		req = mux.SetURLVars(req, map[string]string{"hold_id": "invalid"})
+		res := httptest.NewRecorder()
+
+		h.CaptureHold(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+}
+
+func TestVoidHold(t *testing.T) {
+	mock := &mockService{
+		MockVoidHold: func(ctx context.Context, holdID uuid.UUID) error {
+			return ErrHoldNotActive
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodPost, "/wallet/holds/"+id+"/void", nil)
+	req = mux.SetURLVars(req, map[string]string{"hold_id": id})
+	res := httptest.NewRecorder()
+
+	h.VoidHold(res, req)
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected 409, got %d", res.Code)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	var gotReason string
+	var gotAllowNegative bool
+	mock := &mockService{
+		MockReverse: func(ctx context.Context, txnID uuid.UUID, amount int64, reason string, allowNegative bool) (uuid.UUID, error) {
+			gotReason, gotAllowNegative = reason, allowNegative
+			if amount > 1000 {
+				return uuid.Nil, ErrReversalTooLarge
+			}
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid reversal", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"amount":100, "reason":"duplicate", "allow_negative":true}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transactions/"+id+"/reverse", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"transaction_id": id})
+		res := httptest.NewRecorder()
+
+		h.Reverse(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		if gotReason != "duplicate" || !gotAllowNegative {
+			t.Errorf("expected reason and allow_negative to be passed, got %q %v", gotReason, gotAllowNegative)
+		}
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"amount":5000, "reason":"duplicate"}`)
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transactions/"+id+"/reverse", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"transaction_id": id})
+		res := httptest.NewRecorder()
+
+		h.Reverse(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+
+	t.Run("invalid transaction_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/wallet/transactions/invalid/reverse", bytes.NewBufferString(`{}`))
+		req = mux.SetURLVars(req, map[string]string{"transaction_id": "invalid"})
+		res := httptest.NewRecorder()
+
+		h.Reverse(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+}
+
+func TestChangeWalletState(t *testing.T) {
+	var got WalletStateChange
+	mock := &mockService{
+		MockChangeWalletState: func(ctx context.Context, walletID uuid.UUID, change WalletStateChange) (*wallet, error) {
+			got = change
+			if change.Status == WalletClosed {
+				return nil, ErrWalletNotEmpty
+			}
+			return &wallet{ID: walletID, Status: change.Status, OutboundBlocked: *change.OutboundBlocked}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("freeze", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"status":"frozen", "outbound_blocked":true, "actor":"ops", "reason":"chargeback"}`)
+		req := httptest.NewRequest(http.MethodPost, "/admin/wallets/"+id+"/state", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.ChangeWalletState(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		if got.Actor != "ops" || got.Reason != "chargeback" || got.InboundBlocked != nil {
+			t.Errorf("expected actor, reason and only the outbound block to be passed, got %+v", got)
+		}
+		if !strings.Contains(res.Body.String(), `"status":"frozen"`) {
+			t.Errorf("expected the updated wallet, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"status":"closed", "actor":"ops", "reason":"user request"}`)
+		req := httptest.NewRequest(http.MethodPost, "/admin/wallets/"+id+"/state", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.ChangeWalletState(res, req)
+		if res.Code != http.StatusConflict {
+			t.Errorf("expected 409, got %d", res.Code)
+		}
+	})
+
+	t.Run("invalid wallet_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/wallets/invalid/state", bytes.NewBufferString(`{}`))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": "invalid"})
+		res := httptest.NewRecorder()
+
+		h.ChangeWalletState(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+}
+
+func TestGetWalletStateEvents(t *testing.T) {
+	mock := &mockService{
+		MockGetWalletStateEvents: func(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error) {
+			return nil, ErrWalletNotFound
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodGet, "/admin/wallets/"+id+"/state-events", nil)
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+	res := httptest.NewRecorder()
+
+	h.GetWalletStateEvents(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.Code)
+	}
+}
+
+func TestPreviewFees(t *testing.T) {
+	var gotType string
+	mock := &mockService{
+		MockPreviewFees: func(ctx context.Context, walletID uuid.UUID, txnType string, amount Money) (*FeePreview, error) {
+			gotType = txnType
+			fee := Money{Amount: 25, Currency: amount.Currency}
+			return &FeePreview{Amount: amount, Fees: []feeItem{{Name: "withdrawal_fee", Amount: 25, Currency: amount.Currency}},
+				TotalFee: fee, TotalDebit: Money{Amount: amount.Amount + fee.Amount, Currency: amount.Currency}}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("valid request", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/fees/preview?type=withdrawal&amount=100&currency=USD", nil)
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.PreviewFees(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		if gotType != TxnTypeWithdrawal {
+			t.Errorf("expected type withdrawal, got %q", gotType)
+		}
+		if !strings.Contains(res.Body.String(), `"total_debit":{"amount":125,"currency":"USD"}`) {
+			t.Errorf("expected total_debit in the response, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("invalid amount", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/fees/preview?type=withdrawal&amount=ten&currency=USD", nil)
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.PreviewFees(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+}
+
+func TestWithdraw_LimitExceeded(t *testing.T) {
+	mock := &mockService{
+		MockWithdraw: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			return uuid.Nil, &LimitError{TxnType: TxnTypeWithdrawal, Period: LimitDaily, Kind: LimitKindAmount, Limit: 1000, Remaining: 250, Currency: "USD"}
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodPost, "/wallet/"+id+"/withdraw", bytes.NewBufferString(`{"amount":500,"currency":"USD"}`))
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+	res := httptest.NewRecorder()
+
+	h.Withdraw(res, req)
+	if res.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"limit":{"txn_type":"withdrawal","period":"daily","kind":"amount","limit":1000,"remaining":250,"currency":"USD"}`) {
+		t.Errorf("expected the limit in the response, got %s", res.Body.String())
+	}
+}
+
+func TestSetWalletLimits(t *testing.T) {
+	var got WalletLimitsChange
+	mock := &mockService{
+		MockSetWalletLimits: func(ctx context.Context, walletID uuid.UUID, change WalletLimitsChange) (*wallet, error) {
+			got = change
+			if change.Tier == "gold" {
+				return nil, ErrInvalidTier
+			}
+			return &wallet{ID: walletID, Tier: change.Tier}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("change tier and overrides", func(t *testing.T) {
+		id := uuid.New().String()
+		body := []byte(`{"tier":"premium", "overrides":[{"txn_type":"withdrawal","period":"daily","max_amount":5000}]}`)
+		req := httptest.NewRequest(http.MethodPut, "/admin/wallets/"+id+"/limits", bytes.NewBuffer(body))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.SetWalletLimits(res, req)
+		if res.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", res.Code)
+		}
+		if got.Overrides == nil || len(*got.Overrides) != 1 || (*got.Overrides)[0].MaxAmount != 5000 {
+			t.Errorf("expected the overrides to be passed, got %+v", got)
+		}
+		if !strings.Contains(res.Body.String(), `"tier":"premium"`) {
+			t.Errorf("expected the updated wallet, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("overrides left out", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodPut, "/admin/wallets/"+id+"/limits", bytes.NewBufferString(`{"tier":"premium"}`))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.SetWalletLimits(res, req)
+		if got.Overrides != nil {
+			t.Errorf("expected overrides to be unchanged, got %+v", *got.Overrides)
+		}
+	})
+
+	t.Run("service error", func(t *testing.T) {
+		id := uuid.New().String()
+		req := httptest.NewRequest(http.MethodPut, "/admin/wallets/"+id+"/limits", bytes.NewBufferString(`{"tier":"gold"}`))
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.SetWalletLimits(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+}
+
+func TestGetWalletLimits(t *testing.T) {
+	mock := &mockService{
+		MockGetWalletLimits: func(ctx context.Context, walletID uuid.UUID) (*WalletLimits, error) {
+			return nil, ErrWalletNotFound
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodGet, "/admin/wallets/"+id+"/limits", nil)
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+	res := httptest.NewRecorder()
+
+	h.GetWalletLimits(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.Code)
+	}
+}
+
+func TestCreateWebhook(t *testing.T) {
+	var got WebhookRequest
+	mock := &mockService{
+		MockCreateWebhook: func(ctx context.Context, req WebhookRequest) (*webhookSubscription, error) {
+			got = req
+			if req.URL == "ftp://example.com" {
+				return nil, ErrInvalidWebhookURL
+			}
+			if req.WalletID != nil && *req.WalletID == uuid.Nil {
+				return nil, ErrWalletNotFound
+			}
+			return &webhookSubscription{ID: uuid.New(), WalletID: req.WalletID, URL: req.URL, Secret: "generated-secret"}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	t.Run("wallet subscription", func(t *testing.T) {
+		walletID := uuid.New()
+		body := `{"wallet_id":"` + walletID.String() + `","url":"https://example.com/hooks","event_types":["FundsDeposited"]}`
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWebhook(res, req)
+		if res.Code != http.StatusCreated {
+			t.Errorf("expected 201, got %d", res.Code)
+		}
+		if got.WalletID == nil || *got.WalletID != walletID || got.UserID != nil || len(got.EventTypes) != 1 {
+			t.Errorf("expected the request to be passed, got %+v", got)
+		}
+		if !strings.Contains(res.Body.String(), `"secret":"generated-secret"`) {
+			t.Errorf("expected the secret in the response, got %s", res.Body.String())
+		}
+	})
+
+	t.Run("invalid user_id", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(`{"user_id":"nope","url":"https://example.com"}`))
+		res := httptest.NewRecorder()
+
+		h.CreateWebhook(res, req)
+		if res.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", res.Code)
+		}
+	})
+
+	t.Run("invalid url", func(t *testing.T) {
+		body := `{"wallet_id":"` + uuid.NewString() + `","url":"ftp://example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWebhook(res, req)
+		if res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected 422, got %d", res.Code)
+		}
+	})
+
+	t.Run("wallet not found", func(t *testing.T) {
+		body := `{"wallet_id":"` + uuid.Nil.String() + `","url":"https://example.com"}`
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewBufferString(body))
+		res := httptest.NewRecorder()
+
+		h.CreateWebhook(res, req)
+		if res.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", res.Code)
+		}
+	})
+}
+
+func TestListWebhooks(t *testing.T) {
+	mock := &mockService{
+		MockListWebhooks: func(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error) {
+			if (walletID == nil) == (userID == nil) {
+				return nil, ErrInvalidWebhookOwner
+			}
+			return []webhookSubscription{{ID: uuid.New(), UserID: userID, URL: "https://example.com"}}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	req := httptest.NewRequest(http.MethodGet, "/webhooks?user_id="+uuid.NewString(), nil)
+	res := httptest.NewRecorder()
+	h.ListWebhooks(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", res.Code)
+	}
+	var subs []webhookSubscription
+	if err := json.Unmarshal(res.Body.Bytes(), &subs); err != nil || len(subs) != 1 {
+		t.Errorf("expected one subscription, got %s", res.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/webhooks", nil)
+	res = httptest.NewRecorder()
+	h.ListWebhooks(res, req)
+	if res.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 without an owner, got %d", res.Code)
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	deleted := uuid.New()
+	mock := &mockService{
+		MockDeleteWebhook: func(ctx context.Context, subscriptionID uuid.UUID) error {
+			if subscriptionID != deleted {
+				return ErrWebhookNotFound
+			}
+			return nil
+		},
+	}
+	h := NewHandler(mock)
+
+	for id, want := range map[uuid.UUID]int{deleted: http.StatusNoContent, uuid.New(): http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodDelete, "/webhooks/"+id.String(), nil)
+		req = mux.SetURLVars(req, map[string]string{"subscription_id": id.String()})
+		res := httptest.NewRecorder()
+
+		h.DeleteWebhook(res, req)
+		if res.Code != want {
+			t.Errorf("expected %d, got %d", want, res.Code)
+		}
+	}
+}
+
+func TestReplayWebhookDelivery(t *testing.T) {
+	mock := &mockService{
+		MockReplayWebhookDelivery: func(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+			return &webhookDelivery{ID: deliveryID, Status: WebhookPending}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/deliveries/"+id+"/replay", nil)
+	req = mux.SetURLVars(req, map[string]string{"delivery_id": id})
+	res := httptest.NewRecorder()
+
+	h.ReplayWebhookDelivery(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"status":"pending"`) {
+		t.Errorf("expected the pending delivery, got %s", res.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/webhooks/deliveries/nope/replay", nil)
+	req = mux.SetURLVars(req, map[string]string{"delivery_id": "nope"})
+	res = httptest.NewRecorder()
+	h.ReplayWebhookDelivery(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", res.Code)
+	}
+}
+
+func TestCreateSchedule(t *testing.T) {
+	var got ScheduleRequest
+	mock := &mockService{
+		MockCreateSchedule: func(ctx context.Context, req ScheduleRequest) (*scheduledTransfer, error) {
+			got = req
+			if req.Frequency == "hourly" {
+				return nil, ErrInvalidSchedule
+			}
+			return &scheduledTransfer{ID: uuid.New(), Frequency: req.Frequency, Status: ScheduleActive}, nil
+		},
+	}
+	h := NewHandler(mock)
+	fromID, toID := uuid.New(), uuid.New()
+
+	body := `{"from_id":"` + fromID.String() + `","to_id":"` + toID.String() + `","amount":500,"currency":"USD",` +
+		`"frequency":"monthly","start_at":"2030-01-31T09:00:00Z","max_runs":12}`
+	req := httptest.NewRequest(http.MethodPost, "/schedules", bytes.NewBufferString(body))
+	res := httptest.NewRecorder()
+
+	h.CreateSchedule(res, req)
+	if res.Code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", res.Code)
+	}
+	if got.FromWallet != fromID || got.ToWallet != toID || got.Amount != usd(500) || got.MaxRuns != 12 ||
+		!got.StartAt.Equal(time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)) || got.EndAt != nil {
+		t.Errorf("expected the request to be passed, got %+v", got)
+	}
+
+	for body, want := range map[string]int{
+		`{"from_id":"nope","to_id":"` + toID.String() + `","amount":500,"currency":"USD","frequency":"daily"}`:                      http.StatusBadRequest,
+		`{"from_id":"` + fromID.String() + `","to_id":"` + toID.String() + `","amount":500,"currency":"USD","frequency":"hourly"}`:  http.StatusUnprocessableEntity,
+		`{"from_id":"` + fromID.String() + `","to_id":"` + toID.String() + `","amount":500,"currency":"USD","start_at":"tomorrow"}`: http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/schedules", bytes.NewBufferString(body))
+		res := httptest.NewRecorder()
+
+		h.CreateSchedule(res, req)
+		if res.Code != want {
+			t.Errorf("expected %d for %s, got %d", want, body, res.Code)
+		}
+	}
+}
+
+func TestUpdateSchedule(t *testing.T) {
+	var got ScheduleUpdate
+	mock := &mockService{
+		MockUpdateSchedule: func(ctx context.Context, scheduleID uuid.UUID, update ScheduleUpdate) (*scheduledTransfer, error) {
+			got = update
+			if scheduleID == uuid.Nil {
+				return nil, ErrScheduleNotFound
+			}
+			return &scheduledTransfer{ID: scheduleID, Status: SchedulePaused}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	tests := []struct {
+		name, id, body string
+		want           int
+		check          func() bool
+	}{
+		{"pause", uuid.NewString(), `{"status":"paused","amount":250}`, http.StatusOK,
+			func() bool { return got.Status == SchedulePaused && *got.Amount == 250 && got.EndAt == nil }},
+		{"remove end", uuid.NewString(), `{"end_at":null}`, http.StatusOK,
+			func() bool { return got.EndAt != nil && got.EndAt.IsZero() }},
+		{"invalid end", uuid.NewString(), `{"end_at":"soon"}`, http.StatusBadRequest, nil},
+		{"not found", uuid.Nil.String(), `{}`, http.StatusNotFound, nil},
+		{"invalid id", "nope", `{}`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		got = ScheduleUpdate{}
+		req := httptest.NewRequest(http.MethodPut, "/schedules/"+tt.id, bytes.NewBufferString(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"schedule_id": tt.id})
+		res := httptest.NewRecorder()
+
+		h.UpdateSchedule(res, req)
+		if res.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, res.Code)
+		}
+		if tt.check != nil && !tt.check() {
+			t.Errorf("%s: unexpected update %+v", tt.name, got)
+		}
+	}
+}
+
+func TestCancelSchedule(t *testing.T) {
+	canceled, finished := uuid.New(), uuid.New()
+	mock := &mockService{
+		MockCancelSchedule: func(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+			switch scheduleID {
+			case canceled:
+				return &scheduledTransfer{ID: scheduleID, Status: ScheduleCanceled}, nil
+			case finished:
+				return nil, ErrScheduleFinished
+			}
+			return nil, ErrScheduleNotFound
+		},
+	}
+	h := NewHandler(mock)
+
+	for id, want := range map[uuid.UUID]int{canceled: http.StatusOK, finished: http.StatusConflict, uuid.New(): http.StatusNotFound} {
+		req := httptest.NewRequest(http.MethodDelete, "/schedules/"+id.String(), nil)
+		req = mux.SetURLVars(req, map[string]string{"schedule_id": id.String()})
+		res := httptest.NewRecorder()
+
+		h.CancelSchedule(res, req)
+		if res.Code != want {
+			t.Errorf("expected %d, got %d", want, res.Code)
+		}
+	}
+}
+
+func TestListScheduleRuns(t *testing.T) {
+	mock := &mockService{
+		MockListScheduleRuns: func(ctx context.Context, scheduleID uuid.UUID) ([]scheduleRun, error) {
+			return []scheduleRun{{ID: uuid.New(), ScheduleID: scheduleID, Attempt: 1, Status: RunSucceeded}}, nil
+		},
+		MockListSchedules: func(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error) {
+			return nil, ErrWalletNotFound
+		},
+	}
+	h := NewHandler(mock)
+
+	id := uuid.New().String()
+	req := httptest.NewRequest(http.MethodGet, "/schedules/"+id+"/runs", nil)
+	req = mux.SetURLVars(req, map[string]string{"schedule_id": id})
+	res := httptest.NewRecorder()
+
+	h.ListScheduleRuns(res, req)
+	if res.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"status":"succeeded"`) {
+		t.Errorf("expected the run, got %s", res.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/schedules", nil)
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+	res = httptest.NewRecorder()
+	h.ListSchedules(res, req)
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", res.Code)
+	}
+}
+
+func TestGetStatement(t *testing.T) {
+	walletID := uuid.New()
+	var gotFrom, gotTo time.Time
+	mock := &mockService{
+		MockGetStatement: func(ctx context.Context, id uuid.UUID, from, to time.Time) (*Statement, error) {
+			if id != walletID {
+				return nil, ErrWalletNotFound
+			}
+			if !from.Before(to) {
+				return nil, ErrInvalidStatementPeriod
+			}
+			gotFrom, gotTo = from, to
+			return &Statement{WalletID: id, Currency: "USD", From: from, To: to, OpeningBalance: 1000, ClosingBalance: 1000,
+				Lines: []StatementLine{}, Totals: []StatementTotal{}}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	tests := []struct {
+		name, id, query string
+		want            int
+		contentType     string
+	}{
+		{"json", walletID.String(), "from=2025-01-01&to=2025-02-01", http.StatusOK, "application/json"},
+		{"csv", walletID.String(), "from=2025-01-01&to=2025-02-01&format=csv", http.StatusOK, "text/csv; charset=utf-8"},
+		{"html", walletID.String(), "from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z&format=html", http.StatusOK, "text/html; charset=utf-8"},
+		{"invalid format", walletID.String(), "from=2025-01-01&to=2025-02-01&format=pdf", http.StatusUnprocessableEntity, ""},
+		{"missing from", walletID.String(), "to=2025-02-01", http.StatusBadRequest, ""},
+		{"empty period", walletID.String(), "from=2025-02-01&to=2025-01-01", http.StatusUnprocessableEntity, ""},
+		{"not found", uuid.NewString(), "from=2025-01-01&to=2025-02-01", http.StatusNotFound, ""},
+		{"invalid id", "nope", "from=2025-01-01&to=2025-02-01", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/wallet/"+tt.id+"/statement?"+tt.query, nil)
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": tt.id})
+		res := httptest.NewRecorder()
+
+		h.GetStatement(res, req)
+		if res.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, res.Code)
+		}
+		if tt.contentType != "" && res.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("%s: expected content type %s, got %s", tt.name, tt.contentType, res.Header().Get("Content-Type"))
+		}
+	}
+	if !gotFrom.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) || !gotTo.Equal(time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected January, got %s to %s", gotFrom, gotTo)
+	}
+}
+
+// TestGetInclusionProof with transaction_id in URL path
+func TestGetInclusionProof(t *testing.T) {
+	known := uuid.New()
+	mock := &mockService{
+		MockGetProof: func(ctx context.Context, txnID uuid.UUID) (*InclusionProof, error) {
+			if txnID != known {
+				return nil, ErrTransactionNotFound
+			}
+			return &InclusionProof{TransactionID: txnID, Seq: 7, Path: []string{}, Head: chainHead{Seq: 7, Hash: "abc"}}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	tests := []struct {
+		name     string
+		id       string
+		wantCode int
+	}{
+		{"known transaction", known.String(), http.StatusOK},
+		{"unknown transaction", uuid.New().String(), http.StatusNotFound},
+		{"invalid transaction_id", "invalid-uuid", http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/wallet/transactions/"+tc.id+"/proof", nil)
+			req = mux.SetURLVars(req, map[string]string{"transaction_id": tc.id})
+			res := httptest.NewRecorder()
+
+			h.GetInclusionProof(res, req)
+			if res.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, res.Code)
+			}
+			if tc.wantCode == http.StatusOK && !strings.Contains(res.Body.String(), `"seq":7`) {
+				t.Errorf("expected the proof, got %s", res.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithdraw_Authorization(t *testing.T) {
+	owner, walletID := uuid.New(), uuid.New()
+	mock := &mockService{
+		MockResourceOwners: func(ctx context.Context, kind string, id uuid.UUID) ([]uuid.UUID, error) {
+			if kind != ResourceWallet || id != walletID {
+				return nil, ErrWalletNotFound
+			}
+			return []uuid.UUID{owner}, nil
+		},
+		MockWithdraw: func(context.Context, uuid.UUID, Money) (uuid.UUID, error) {
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		walletID  uuid.UUID
+		wantCode  int
+	}{
+		{"owner", &Principal{UserID: owner}, walletID, http.StatusOK},
+		{"other user", &Principal{UserID: uuid.New(), Scopes: []string{"read"}}, walletID, http.StatusForbidden},
+		{"admin", &Principal{UserID: uuid.New(), Scopes: []string{ScopeAdmin}}, walletID, http.StatusOK},
+		{"authentication off", nil, walletID, http.StatusOK},
+		{"unknown wallet", &Principal{UserID: owner}, uuid.New(), http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/wallet/"+tc.walletID.String()+"/withdraw",
+				strings.NewReader(`{"amount": 100, "currency": "USD"}`))
+			req = mux.SetURLVars(req, map[string]string{"wallet_id": tc.walletID.String()})
+			if tc.principal != nil {
+				req = req.WithContext(WithPrincipal(req.Context(), tc.principal))
+			}
+			res := httptest.NewRecorder()
+
+			h.Withdraw(res, req)
+			if res.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestReverse_RequiresAdmin(t *testing.T) {
+	mock := &mockService{
+		MockReverse: func(context.Context, uuid.UUID, int64, string, bool) (uuid.UUID, error) {
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+
+	for _, tc := range []struct {
+		name     string
+		scopes   []string
+		wantCode int
+	}{
+		{"admin", []string{ScopeAdmin}, http.StatusOK},
+		{"user", nil, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			txnID := uuid.NewString()
+			req := httptest.NewRequest(http.MethodPost, "/wallet/transactions/"+txnID+"/reverse", strings.NewReader(`{"reason": "refund"}`))
+			req = mux.SetURLVars(req, map[string]string{"transaction_id": txnID})
+			req = req.WithContext(WithPrincipal(req.Context(), &Principal{UserID: uuid.New(), Scopes: tc.scopes}))
+			res := httptest.NewRecorder()
+
+			h.Reverse(res, req)
+			if res.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, res.Code)
+			}
+		})
+	}
+}
+
+func TestIssueAPIClient(t *testing.T) {
+	mock := &mockService{
+		MockIssueAPIClient: func(ctx context.Context, name string, scopes []string) (*IssuedAPIKey, error) {
+			if len(scopes) == 0 {
+				return nil, ErrInvalidScope
+			}
+			return &IssuedAPIKey{Client: &apiClient{ID: uuid.New(), Name: name, Scopes: scopes}, APIKey: "wk_secret"}, nil
+		},
+	}
+	h := NewHandler(mock)
+
+	for _, tc := range []struct {
+		name     string
+		body     string
+		scopes   []string
+		wantCode int
+	}{
+		{"admin", `{"name": "payments", "scopes": ["deposit"]}`, []string{ScopeAdmin}, http.StatusCreated},
+		{"no scopes", `{"name": "payments"}`, []string{ScopeAdmin}, http.StatusUnprocessableEntity},
+		{"invalid JSON", `{"name":`, []string{ScopeAdmin}, http.StatusBadRequest},
+		{"user", `{"name": "payments", "scopes": ["deposit"]}`, nil, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/api-clients", strings.NewReader(tc.body))
+			req = req.WithContext(WithPrincipal(req.Context(), &Principal{UserID: uuid.New(), Scopes: tc.scopes}))
+			res := httptest.NewRecorder()
+
+			h.IssueAPIClient(res, req)
+			if res.Code != tc.wantCode {
+				t.Errorf("expected %d, got %d", tc.wantCode, res.Code)
+			}
+			if tc.wantCode == http.StatusCreated && !strings.Contains(res.Body.String(), `"api_key":"wk_secret"`) {
+				t.Errorf("expected the api key in the response, got %s", res.Body.String())
+			}
+		})
+	}
+}
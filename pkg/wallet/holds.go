@@ -0,0 +1,267 @@
+package wallet
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// CreateHold reserves amount on a wallet until the hold is captured, voided or
+// expires after ttl (the service default when zero). The reserved funds stay in
+// the ledger balance but are no longer available for withdrawals and transfers.
+func (s *service) CreateHold(ctx context.Context, walletID uuid.UUID, amount Money, ttl time.Duration) (*hold, error) {
+	amount, err := validateAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	if ttl == 0 {
+		ttl = s.holdTTL
+	}
+	if ttl < 0 || ttl > MaxHoldTTL {
+		return nil, ErrInvalidHoldTTL
+	}
+
+	var h *hold
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the wallet row so the available balance cannot change until commit
+		wallets, err := q.LockWallets(ctx, walletID)
+		if err != nil {
+			return err
+		}
+		w := wallets[walletID]
+
+		// A hold is the first half of a withdrawal
+		if err := checkOutbound(w); err != nil {
+			return err
+		}
+
+		if w.Currency != amount.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		// Refuse up front a hold whose capture would break a withdrawal limit
+		// or could not pay the withdrawal fee; both are charged at capture
+		if err := s.checkLimits(ctx, q, w, TxnTypeWithdrawal, amount.Amount); err != nil {
+			return err
+		}
+		fees := s.fees.compute(TxnTypeWithdrawal, w.Type, amount)
+		debit, err := debitFor(amount.Amount, fees)
+		if err != nil {
+			return err
+		}
+		if w.Available() < debit {
+			return ErrInsufficientFunds
+		}
+
+		if err := q.AdjustHeld(ctx, walletID, amount.Amount); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		h = &hold{ID: uuid.New(), WalletID: walletID, Amount: amount.Amount, Currency: amount.Currency,
+			Status: HoldActive, ExpiresAt: now.Add(ttl), CreatedAt: now, UpdatedAt: now}
+		return q.InsertHold(ctx, h)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// CaptureHold takes amount (the whole hold when zero) out of the wallet and
+// releases the rest of the hold. A hold can be captured once, before it expires.
+// The capture counts towards the withdrawal limits and pays the withdrawal
+// fee, on top of the captured amount.
+func (s *service) CaptureHold(ctx context.Context, holdID uuid.UUID, amount int64) (uuid.UUID, error) {
+	if amount < 0 {
+		return uuid.Nil, ErrInvalidAmount
+	}
+
+	var txnId uuid.UUID
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the hold first, then its wallet, like quotes
+		h, err := q.LockHold(ctx, holdID)
+		if err != nil {
+			return err
+		}
+		if h.Status != HoldActive {
+			return ErrHoldNotActive
+		}
+		now := time.Now()
+		if !now.Before(h.ExpiresAt) {
+			return ErrHoldExpired
+		}
+		if amount == 0 {
+			amount = h.Amount
+		}
+		if amount > h.Amount {
+			return ErrCaptureExceedsHold
+		}
+
+		wallets, err := q.LockWallets(ctx, h.WalletID)
+		if err != nil {
+			return err
+		}
+		w := wallets[h.WalletID]
+		if err := checkOutbound(w); err != nil {
+			return err
+		}
+
+		// Captured money leaves the system like a withdrawal, so it is limited
+		// and charged like one. The fee is paid from funds outside the hold.
+		captured := Money{Amount: amount, Currency: h.Currency}
+		if err := s.checkLimits(ctx, q, w, TxnTypeWithdrawal, amount); err != nil {
+			return err
+		}
+		fees := s.fees.compute(TxnTypeWithdrawal, w.Type, captured)
+		debit, err := debitFor(amount, fees)
+		if err != nil {
+			return err
+		}
+		if w.Available()+h.Amount < debit {
+			return ErrInsufficientFunds
+		}
+
+		// Release the whole hold and take the captured part from the balance
+		if err := q.AdjustHeld(ctx, h.WalletID, -h.Amount); err != nil {
+			return err
+		}
+		if err := q.AdjustBalance(ctx, h.WalletID, -debit); err != nil {
+			return err
+		}
+		if err := creditFees(ctx, q, fees); err != nil {
+			return err
+		}
+
+		// Log transaction as "capture"
+		txn := &transaction{ID: uuid.New(), FromWallet: &h.WalletID, Amount: amount, Currency: h.Currency, Type: TxnTypeCapture, CreatedAt: now, Fees: fees, ClientID: s.clientID}
+		if err := s.insertChained(ctx, q, txn); err != nil {
+			return err
+		}
+		txnId = txn.ID
+
+		if err := postEntries(ctx, q, txnId, append(entryPair(h.WalletID, AccountCashOut, captured), feeEntries(h.WalletID, fees)...)); err != nil {
+			return err
+		}
+
+		h.Status, h.CapturedAmount, h.TransactionID, h.UpdatedAt = HoldCaptured, amount, &txnId, now
+		if err := q.UpdateHold(ctx, h); err != nil {
+			return err
+		}
+		return recordEvent(ctx, q, EventHoldCaptured, h.WalletID, txn)
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return txnId, nil
+}
+
+// VoidHold releases an active hold without moving any money.
+func (s *service) VoidHold(ctx context.Context, holdID uuid.UUID) error {
+	return s.repo.RunInTx(ctx, func(q Queries) error {
+		h, err := q.LockHold(ctx, holdID)
+		if err != nil {
+			return err
+		}
+		if h.Status != HoldActive {
+			return ErrHoldNotActive
+		}
+		return s.releaseHold(ctx, q, h, HoldVoided, time.Now())
+	})
+}
+
+// releaseHold gives the funds of a locked active hold back to its wallet and
+// moves the hold to status.
+func (s *service) releaseHold(ctx context.Context, q Queries, h *hold, status string, now time.Time) error {
+	if _, err := q.LockWallets(ctx, h.WalletID); err != nil {
+		return err
+	}
+	if err := q.AdjustHeld(ctx, h.WalletID, -h.Amount); err != nil {
+		return err
+	}
+	h.Status, h.UpdatedAt = status, now
+	return q.UpdateHold(ctx, h)
+}
+
+// GetHold returns a hold by ID.
+func (s *service) GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	return s.repo.GetHold(ctx, holdID)
+}
+
+// ExpireHolds releases every active hold that expired at or before now and
+// returns how many were released. Each hold is released in its own transaction.
+func (s *service) ExpireHolds(ctx context.Context, now time.Time) (int, error) {
+	expired := 0
+	for {
+		ids, err := s.repo.ListExpiredHolds(ctx, now, holdSweepBatchSize)
+		if err != nil {
+			return expired, err
+		}
+
+		for _, id := range ids {
+			err := s.repo.RunInTx(ctx, func(q Queries) error {
+				// The hold may have been captured or voided since it was listed
+				h, err := q.LockHold(ctx, id)
+				if err != nil {
+					return err
+				}
+				if h.Status != HoldActive || h.ExpiresAt.After(now) {
+					return ErrHoldNotActive
+				}
+				return s.releaseHold(ctx, q, h, HoldExpired, now)
+			})
+			if err == ErrHoldNotActive {
+				continue
+			}
+			if err != nil {
+				return expired, err
+			}
+			expired++
+		}
+
+		if len(ids) < holdSweepBatchSize {
+			return expired, nil
+		}
+	}
+}
+
+// holdExpirer is the part of the service used by the HoldSweeper.
+type holdExpirer interface {
+	ExpireHolds(ctx context.Context, now time.Time) (int, error)
+}
+
+// HoldSweeper periodically releases expired holds.
+type HoldSweeper struct {
+	holds    holdExpirer
+	interval time.Duration
+}
+
+// NewHoldSweeper initializes a sweeper that expires holds every interval.
+func NewHoldSweeper(holds holdExpirer, interval time.Duration) *HoldSweeper {
+	return &HoldSweeper{holds: holds, interval: interval}
+}
+
+// Run sweeps expired holds every interval until ctx is canceled.
+func (sw *HoldSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := sw.holds.ExpireHolds(ctx, now)
+			if err != nil {
+				log.Printf("Hold sweeper error: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Hold sweeper released %d expired holds", n)
+			}
+		}
+	}
+}
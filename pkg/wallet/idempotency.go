@@ -0,0 +1,350 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKeyHeader is the request header clients use to make retries safe.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLen matches the size of idempotency_keys.key.
+const maxIdempotencyKeyLen = 255
+
+// idempotencyRecord is the stored outcome of a request sent with an Idempotency-Key.
+type idempotencyRecord struct {
+	Scope         string     // Caller the key belongs to, see idempotencyScope
+	Key           string     // Client supplied key
+	Fingerprint   string     // SHA-256 of the first request
+	StatusCode    int        // Stored HTTP status, 0 while the first request is still in flight
+	TransactionID *uuid.UUID // Stored transaction ID, nil for failed requests and responses without one
+	Body          string     // Stored response body, a problem+json document for failed requests
+	ExpiresAt     time.Time  // Key can be reused after this time
+}
+
+// IdempotencyStore persists Idempotency-Keys and the responses they produced.
+// Keys are unique per scope, so callers can not collide with each other's keys.
+type IdempotencyStore interface {
+	// Reserve claims key of scope for a new request. When an unexpired record
+	// already exists it is returned with reserved set to false.
+	Reserve(ctx context.Context, scope, key, fingerprint string, expiresAt time.Time) (rec *idempotencyRecord, reserved bool, err error)
+	// Complete stores the response of a reserved key.
+	Complete(ctx context.Context, rec *idempotencyRecord) error
+	// Release drops a reserved key so the request can be retried from scratch.
+	Release(ctx context.Context, scope, key string) error
+	// Purge deletes the keys that expired before now and returns how many.
+	Purge(ctx context.Context, now time.Time) (int64, error)
+}
+
+// idempotencyStore is the Postgres implementation of IdempotencyStore.
+type idempotencyStore struct {
+	db *sql.DB
+}
+
+// NewIdempotencyStore initializes a Postgres backed IdempotencyStore.
+func NewIdempotencyStore(db *sql.DB) *idempotencyStore {
+	return &idempotencyStore{db: db}
+}
+
+// Reserve inserts key unless a record for it exists. An expired record the
+// sweeper has not purged yet is taken over by the new request.
+func (s *idempotencyStore) Reserve(ctx context.Context, scope, key, fingerprint string, expiresAt time.Time) (*idempotencyRecord, bool, error) {
+	res, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+                      VALUES ($1, $2, $3, $4)
+                      ON CONFLICT (scope, key) DO UPDATE
+                      SET fingerprint = EXCLUDED.fingerprint, status_code = NULL, transaction_id = NULL, body = NULL,
+                          created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+                      WHERE idempotency_keys.expires_at <= $5`,
+		scope, key, fingerprint, expiresAt, time.Now())
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+		return nil, false, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, false, err
+	} else if n == 1 {
+		return &idempotencyRecord{Scope: scope, Key: key, Fingerprint: fingerprint, ExpiresAt: expiresAt}, true, nil
+	}
+
+	rec := &idempotencyRecord{Scope: scope, Key: key}
+	var status sql.NullInt64
+	var body sql.NullString
+	err = s.db.QueryRowContext(ctx, `
+        SELECT fingerprint, status_code, transaction_id, body, expires_at
+        FROM idempotency_keys
+        WHERE scope = $1 AND key = $2`, scope, key).Scan(&rec.Fingerprint, &status, &rec.TransactionID, &body, &rec.ExpiresAt)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, false, err
+	}
+	rec.StatusCode = int(status.Int64)
+	rec.Body = body.String
+	return rec, false, nil
+}
+
+// Complete stores the outcome of a reserved key.
+func (s *idempotencyStore) Complete(ctx context.Context, rec *idempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET status_code = $1, transaction_id = $2, body = $3 WHERE scope = $4 AND key = $5`,
+		rec.StatusCode, rec.TransactionID, sql.NullString{String: rec.Body, Valid: rec.Body != ""}, rec.Scope, rec.Key)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// Release deletes a reserved key.
+func (s *idempotencyStore) Release(ctx context.Context, scope, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key)
+	if err != nil {
+		log.Printf("DB Delete error: %v", err)
+	}
+	return err
+}
+
+// Purge deletes expired keys.
+func (s *idempotencyStore) Purge(ctx context.Context, now time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, now)
+	if err != nil {
+		log.Printf("DB Delete error: %v", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// idempotencyRecordKey identifies a record of memoryIdempotencyStore.
+type idempotencyRecordKey struct {
+	scope, key string
+}
+
+// memoryIdempotencyStore is an in-memory implementation of IdempotencyStore.
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	records map[idempotencyRecordKey]idempotencyRecord
+}
+
+// NewMemoryIdempotencyStore initializes an empty in-memory IdempotencyStore.
+func NewMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{records: map[idempotencyRecordKey]idempotencyRecord{}}
+}
+
+func (m *memoryIdempotencyStore) Reserve(ctx context.Context, scope, key, fingerprint string, expiresAt time.Time) (*idempotencyRecord, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := idempotencyRecordKey{scope, key}
+	if rec, ok := m.records[k]; ok && rec.ExpiresAt.After(time.Now()) {
+		return &rec, false, nil
+	}
+	rec := idempotencyRecord{Scope: scope, Key: key, Fingerprint: fingerprint, ExpiresAt: expiresAt}
+	m.records[k] = rec
+	return &rec, true, nil
+}
+
+func (m *memoryIdempotencyStore) Complete(ctx context.Context, rec *idempotencyRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[idempotencyRecordKey{rec.Scope, rec.Key}] = *rec
+	return nil
+}
+
+func (m *memoryIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, idempotencyRecordKey{scope, key})
+	return nil
+}
+
+func (m *memoryIdempotencyStore) Purge(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var n int64
+	for k, rec := range m.records {
+		if !rec.ExpiresAt.After(now) {
+			delete(m.records, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// idempotencyScope returns the scope of the keys of the caller: the API
+// client or the user of the principal. Without authentication every caller
+// shares the empty scope.
+func idempotencyScope(r *http.Request) string {
+	p := PrincipalFrom(r.Context())
+	switch {
+	case p == nil:
+		return ""
+	case p.ClientID != nil:
+		return "client:" + p.ClientID.String()
+	default:
+		return "user:" + p.UserID.String()
+	}
+}
+
+// requestFingerprint hashes the parts of a request that must match on a retry.
+// The caller is not one of them, it is the scope of the key instead.
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// Idempotent wraps a money-moving handler so that retries carrying the same
+// Idempotency-Key replay the first response instead of moving money again.
+// Requests without the header are passed through unchanged.
+func Idempotent(store IdempotencyStore, retention time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, r, badRequest("Idempotency-Key must be at most 255 characters"))
+			return
+		}
+
+		// Read the body so it can be fingerprinted, then restore it for the handler
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, badRequest("Invalid request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		scope := idempotencyScope(r)
+		rec, reserved, err := store.Reserve(r.Context(), scope, key, fingerprint, time.Now().Add(retention))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if !reserved {
+			replayIdempotent(w, r, rec, fingerprint)
+			return
+		}
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next(rr, r)
+
+		// The outcome is stored even when the client has gone away meanwhile,
+		// otherwise the key would stay reserved until it expires
+		ctx := context.WithoutCancel(r.Context())
+
+		// Server errors and cancelled requests are not stored so the client can
+		// retry with the same key
+		if rr.status == 0 || rr.status == StatusClientClosedRequest || rr.status >= http.StatusInternalServerError {
+			if err := store.Release(ctx, scope, key); err != nil {
+				log.Printf("failed to release idempotency key %q: %v", key, err)
+			}
+			return
+		}
+
+		// The whole response is stored, since not every route answers with a
+		// TransactionResponse, e.g. a created schedule
+		rec.StatusCode, rec.Body = rr.status, rr.body.String()
+		if rr.status < http.StatusBadRequest {
+			var resp TransactionResponse
+			if err := json.Unmarshal(rr.body.Bytes(), &resp); err == nil {
+				rec.TransactionID = resp.TransactionID
+			}
+		}
+		if err := store.Complete(ctx, rec); err != nil {
+			log.Printf("failed to store response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// replayIdempotent answers a retry from a stored record.
+func replayIdempotent(w http.ResponseWriter, r *http.Request, rec *idempotencyRecord, fingerprint string) {
+	if rec.Fingerprint != fingerprint {
+		writeError(w, r, ErrIdempotencyKeyReused)
+		return
+	}
+
+	if rec.StatusCode == 0 {
+		writeError(w, r, ErrIdempotencyKeyInUse)
+		return
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	if rec.Body == "" {
+		// Stored before whole responses were kept
+		writeJSON(w, rec.StatusCode, TransactionResponse{
+			Status:        "success",
+			TransactionID: rec.TransactionID,
+		})
+		return
+	}
+
+	// The stored response is sent as it was
+	contentType := "application/json"
+	if rec.StatusCode >= http.StatusBadRequest {
+		contentType = ProblemContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(rec.StatusCode)
+	io.WriteString(w, rec.Body)
+}
+
+// IdempotencySweeper periodically deletes expired Idempotency-Keys.
+type IdempotencySweeper struct {
+	store    IdempotencyStore
+	interval time.Duration
+}
+
+// NewIdempotencySweeper initializes a sweeper that purges expired keys every interval.
+func NewIdempotencySweeper(store IdempotencyStore, interval time.Duration) *IdempotencySweeper {
+	return &IdempotencySweeper{store: store, interval: interval}
+}
+
+// Run purges expired keys every interval until ctx is canceled.
+func (sw *IdempotencySweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := sw.store.Purge(ctx, now); err != nil {
+				log.Printf("Idempotency sweeper error: %v", err)
+			}
+		}
+	}
+}
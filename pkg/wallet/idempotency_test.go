@@ -0,0 +1,277 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// depositRequest builds a deposit request carrying an Idempotency-Key.
+func depositRequest(walletID uuid.UUID, key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/wallet/"+walletID.String()+"/deposit", bytes.NewBufferString(body))
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": walletID.String()})
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	return req
+}
+
+func TestIdempotent_ReplaysFirstResponse(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), time.Hour, h.Deposit)
+	walletID := uuid.New()
+
+	first := httptest.NewRecorder()
+	wrapped(first, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	retry := httptest.NewRecorder()
+	wrapped(retry, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+
+	var a, b TransactionResponse
+	assert.NoError(t, json.Unmarshal(first.Body.Bytes(), &a))
+	assert.NoError(t, json.Unmarshal(retry.Body.Bytes(), &b))
+	assert.Equal(t, a.TransactionID, b.TransactionID)
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotent_DifferentBodyConflicts(t *testing.T) {
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), time.Hour, h.Deposit)
+	walletID := uuid.New()
+
+	first := httptest.NewRecorder()
+	wrapped(first, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+	assert.Equal(t, http.StatusOK, first.Code)
+
+	retry := httptest.NewRecorder()
+	wrapped(retry, depositRequest(walletID, "key-1", `{"amount": 999, "currency": "USD"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, retry.Code)
+}
+
+func TestIdempotent_InFlightConflicts(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore()
+	walletID := uuid.New()
+	req := depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`)
+
+	// Simulate a first request that has reserved the key but not finished yet
+	_, _, _ = store.Reserve(ctx, "", "key-1", requestFingerprint(req, []byte(`{"amount": 100, "currency": "USD"}`)), time.Now().Add(time.Hour))
+
+	h := NewHandler(&mockService{})
+	res := httptest.NewRecorder()
+	Idempotent(store, time.Hour, h.Deposit)(res, req)
+	assert.Equal(t, http.StatusConflict, res.Code)
+}
+
+func TestIdempotent_ReplaysStoredError(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			return uuid.Nil, ErrInvalidAmount
+		},
+	}
+	h := NewHandler(mock)
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), time.Hour, h.Deposit)
+	walletID := uuid.New()
+
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		wrapped(res, depositRequest(walletID, "key-1", `{"amount": 0, "currency": "USD"}`))
+		assert.Equal(t, http.StatusUnprocessableEntity, res.Code)
+		assert.Equal(t, ProblemContentType, res.Header().Get("Content-Type"))
+
+		var body Problem
+		assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &body))
+		assert.Equal(t, "INVALID_AMOUNT", body.Code)
+		assert.Equal(t, ErrInvalidAmount.Error(), body.Detail)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestIdempotent_ExpiredKeyRunsAgain(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), -time.Second, h.Deposit)
+	walletID := uuid.New()
+
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		wrapped(res, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotent_CancelledRequestReleasesKey(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			if calls == 1 {
+				return uuid.Nil, context.Canceled
+			}
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), time.Hour, h.Deposit)
+	walletID := uuid.New()
+
+	first := httptest.NewRecorder()
+	wrapped(first, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+	assert.Equal(t, StatusClientClosedRequest, first.Code)
+
+	retry := httptest.NewRecorder()
+	wrapped(retry, depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`))
+	assert.Equal(t, http.StatusOK, retry.Code)
+	assert.Empty(t, retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotent_NoHeaderPassesThrough(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			return uuid.New(), nil
+		},
+	}
+	h := NewHandler(mock)
+	store := NewMemoryIdempotencyStore()
+	wrapped := Idempotent(store, time.Hour, h.Deposit)
+	walletID := uuid.New()
+
+	for i := 0; i < 2; i++ {
+		res := httptest.NewRecorder()
+		wrapped(res, depositRequest(walletID, "", `{"amount": 100, "currency": "USD"}`))
+		assert.Equal(t, http.StatusOK, res.Code)
+	}
+	assert.Equal(t, 2, calls)
+	assert.Empty(t, store.records)
+}
+
+func TestIdempotencyStore_ReserveNewKey(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	store := NewIdempotencyStore(db)
+
+	mock.ExpectExec(`INSERT INTO idempotency_keys \(scope, key, fingerprint, expires_at\)`).
+		WithArgs("user:1", "key-1", "fp", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	rec, reserved, err := store.Reserve(ctx, "user:1", "key-1", "fp", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, "fp", rec.Fingerprint)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdempotencyStore_ReserveExistingKey(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	store := NewIdempotencyStore(db)
+	txnID := uuid.New()
+
+	mock.ExpectExec(`INSERT INTO idempotency_keys \(scope, key, fingerprint, expires_at\)`).
+		WithArgs("user:1", "key-1", "fp", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT fingerprint, status_code, transaction_id, body, expires_at FROM idempotency_keys WHERE scope = \$1 AND key = \$2`).
+		WithArgs("user:1", "key-1").
+		WillReturnRows(sqlmock.NewRows([]string{"fingerprint", "status_code", "transaction_id", "body", "expires_at"}).
+			AddRow("fp", 200, txnID, `{"status":"success"}`, time.Now().Add(time.Hour)))
+
+	rec, reserved, err := store.Reserve(ctx, "user:1", "key-1", "fp", time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, http.StatusOK, rec.StatusCode)
+	assert.Equal(t, txnID, *rec.TransactionID)
+	assert.Equal(t, `{"status":"success"}`, rec.Body)
+}
+
+func TestIdempotent_KeysAreScopedByCaller(t *testing.T) {
+	calls := 0
+	mock := &mockService{
+		MockDeposit: func(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+			calls++
+			return uuid.New(), nil
+		},
+	}
+	wrapped := Idempotent(NewMemoryIdempotencyStore(), time.Hour, NewHandler(mock).Deposit)
+	walletID := uuid.New()
+	clientID := uuid.New()
+
+	// The same key sent by two users and a client is three independent requests
+	admin := []string{ScopeAdmin}
+	for _, p := range []*Principal{{UserID: uuid.New(), Scopes: admin}, {UserID: uuid.New(), Scopes: admin}, {ClientID: &clientID, Scopes: admin}} {
+		req := depositRequest(walletID, "key-1", `{"amount": 100, "currency": "USD"}`)
+		res := httptest.NewRecorder()
+		wrapped(res, req.WithContext(WithPrincipal(req.Context(), p)))
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Empty(t, res.Header().Get("Idempotent-Replayed"))
+	}
+	assert.Equal(t, 3, calls)
+}
+
+func TestMemoryIdempotencyStore_Purge(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryIdempotencyStore()
+	_, _, _ = store.Reserve(ctx, "", "expired", "fp", time.Now().Add(-time.Second))
+	_, _, _ = store.Reserve(ctx, "", "current", "fp", time.Now().Add(time.Hour))
+
+	n, err := store.Purge(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Len(t, store.records, 1)
+}
+
+func TestIdempotencyStore_Purge(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	now := time.Now()
+
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE expires_at <= \$1`).
+		WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	n, err := NewIdempotencyStore(db).Purge(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
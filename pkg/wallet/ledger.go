@@ -0,0 +1,80 @@
+package wallet
+
+import (
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// entryPair builds the two journal lines for a simple movement of amount from
+// the debited account to the credited account.
+func entryPair(debitAccount, creditAccount uuid.UUID, amount Money) []ledgerEntry {
+	return []ledgerEntry{
+		{AccountID: debitAccount, Direction: EntryDebit, Amount: amount.Amount, Currency: amount.Currency},
+		{AccountID: creditAccount, Direction: EntryCredit, Amount: amount.Amount, Currency: amount.Currency},
+	}
+}
+
+// postEntries writes the journal lines of a transaction through q. The lines
+// must balance in every currency (total debits equal total credits), otherwise
+// nothing is written.
+func postEntries(ctx context.Context, q Queries, txnID uuid.UUID, entries []ledgerEntry) error {
+	net := map[string]int64{}
+	for _, e := range entries {
+		if e.Amount <= 0 || e.Currency == "" {
+			return ErrUnbalancedEntries
+		}
+		switch e.Direction {
+		case EntryDebit:
+			net[e.Currency] += e.Amount
+		case EntryCredit:
+			net[e.Currency] -= e.Amount
+		default:
+			return ErrUnbalancedEntries
+		}
+	}
+	if len(entries) == 0 {
+		return ErrUnbalancedEntries
+	}
+	for _, n := range net {
+		if n != 0 {
+			return ErrUnbalancedEntries
+		}
+	}
+
+	lines := make([]ledgerEntry, len(entries))
+	for i, e := range entries {
+		e.ID = uuid.New()
+		e.TransactionID = txnID
+		lines[i] = e
+	}
+	return q.InsertEntries(ctx, txnID, lines)
+}
+
+// LedgerBalance derives the balance of an account in a currency from the
+// journal. For wallets this is total credits minus total debits.
+func (s *service) LedgerBalance(ctx context.Context, accountID uuid.UUID, currency string) (int64, error) {
+	return s.repo.LedgerBalance(ctx, accountID, currency)
+}
+
+// VerifyBalance checks the stored wallet balance against the balance derived
+// from the journal and returns ErrLedgerMismatch when they differ.
+func (s *service) VerifyBalance(ctx context.Context, walletID uuid.UUID) error {
+	balance, err := s.GetBalance(ctx, walletID)
+	if err != nil {
+		return err
+	}
+	stored := balance.Ledger
+
+	derived, err := s.LedgerBalance(ctx, walletID, stored.Currency)
+	if err != nil {
+		return err
+	}
+
+	if stored.Amount != derived {
+		log.Printf("Ledger mismatch for wallet %s: stored=%d ledger=%d", walletID, stored.Amount, derived)
+		return ErrLedgerMismatch
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LedgerReport is the result of a ledger integrity check.
+type LedgerReport struct {
+	CheckedAt     time.Time           `json:"checked_at"`
+	Wallets       int                 `json:"wallets"`       // Wallets checked
+	Discrepancies []LedgerDiscrepancy `json:"discrepancies"` // Empty when the ledger is consistent
+}
+
+// LedgerDiscrepancy is one problem found by a ledger check.
+type LedgerDiscrepancy struct {
+	Kind          string     `json:"kind"`                     // One of the Discrepancy constants
+	WalletID      *uuid.UUID `json:"wallet_id,omitempty"`      // Wallet with the problem
+	TransactionID *uuid.UUID `json:"transaction_id,omitempty"` // Transaction with the problem
+	Currency      string     `json:"currency,omitempty"`
+	Expected      int64      `json:"expected"` // Correct value, the journal balance for balance_mismatch
+	Actual        int64      `json:"actual"`   // Value found
+	Message       string     `json:"message"`
+}
+
+// OK reports whether the check found no discrepancy.
+func (r *LedgerReport) OK() bool {
+	return len(r.Discrepancies) == 0
+}
+
+// CheckLedger recomputes every wallet balance from the journal lines of its
+// transactions and compares it with the stored balance, flags negative
+// balances and held amounts, and checks that the whole journal and every
+// transaction net to zero in each currency.
+func (s *service) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	report := &LedgerReport{CheckedAt: time.Now().UTC(), Discrepancies: []LedgerDiscrepancy{}}
+
+	balances, err := s.repo.ListWalletLedgerBalances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Wallets = len(balances)
+	for _, b := range balances {
+		walletID := b.WalletID
+		add := func(kind string, expected, actual int64, format string, args ...interface{}) {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: kind, WalletID: &walletID,
+				Currency: b.Currency, Expected: expected, Actual: actual, Message: fmt.Sprintf(format, args...)})
+		}
+		if b.Balance != b.Ledger {
+			add(DiscrepancyBalanceMismatch, b.Ledger, b.Balance, "stored balance %d, journal balance %d", b.Balance, b.Ledger)
+		}
+		if b.Balance < 0 {
+			add(DiscrepancyNegativeBalance, 0, b.Balance, "stored balance is negative")
+		}
+		if b.Ledger < 0 {
+			add(DiscrepancyNegativeLedger, 0, b.Ledger, "journal balance is negative")
+		}
+		if b.Held < 0 {
+			add(DiscrepancyNegativeHeld, 0, b.Held, "held amount is negative")
+		}
+	}
+
+	net, err := s.repo.LedgerNetByCurrency(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currencies := make([]string, 0, len(net))
+	for currency := range net {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		if net[currency] != 0 {
+			report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: DiscrepancyUnbalancedCurrency, Currency: currency,
+				Actual: net[currency], Message: fmt.Sprintf("journal credits minus debits in %s is %d", currency, net[currency])})
+		}
+	}
+
+	// Listed up to ledgerCheckMaxTransactions, one broken code path usually breaks many
+	txnIDs, err := s.repo.ListUnbalancedTransactions(ctx, ledgerCheckMaxTransactions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range txnIDs {
+		report.Discrepancies = append(report.Discrepancies, LedgerDiscrepancy{Kind: DiscrepancyUnbalancedTransaction, TransactionID: &txnIDs[i],
+			Message: "transaction has no journal lines or its lines do not balance"})
+	}
+	return report, nil
+}
+
+// ledgerChecker is the part of the service used by the LedgerChecker.
+type ledgerChecker interface {
+	CheckLedger(ctx context.Context) (*LedgerReport, error)
+}
+
+// LedgerChecker periodically checks the ledger and logs the report when it
+// finds a discrepancy.
+type LedgerChecker struct {
+	ledger   ledgerChecker
+	interval time.Duration
+}
+
+// NewLedgerChecker initializes a checker that runs every interval.
+func NewLedgerChecker(ledger ledgerChecker, interval time.Duration) *LedgerChecker {
+	return &LedgerChecker{ledger: ledger, interval: interval}
+}
+
+// Run checks the ledger until ctx is canceled.
+func (lc *LedgerChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(lc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := lc.ledger.CheckLedger(ctx)
+			if err != nil {
+				log.Printf("Ledger check error: %v", err)
+				continue
+			}
+			if !report.OK() {
+				body, _ := json.Marshal(report)
+				log.Printf("Ledger check found %d discrepancies: %s", len(report.Discrepancies), body)
+			}
+		}
+	}
+}
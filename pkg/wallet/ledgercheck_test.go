@@ -0,0 +1,113 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_CheckLedgerClean(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	fromID := fundedWallet(t, svc, 10000)
+	toID := fundedWallet(t, svc, 0)
+
+	_, err := svc.Withdraw(ctx, fromID, usd(1000))
+	assert.NoError(t, err)
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(2000))
+	assert.NoError(t, err)
+	_, err = svc.Reverse(ctx, txnID, 500, "refund", false)
+	assert.NoError(t, err)
+	h, err := svc.CreateHold(ctx, toID, usd(300), time.Hour)
+	assert.NoError(t, err)
+	_, err = svc.CaptureHold(ctx, h.ID, 200)
+	assert.NoError(t, err)
+
+	report, err := svc.CheckLedger(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.OK(), "%+v", report.Discrepancies)
+	// The two wallets and the revenue wallet collecting their fees
+	assert.Equal(t, 3, report.Wallets)
+}
+
+func TestService_CheckLedgerDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	tamperedID := fundedWallet(t, svc, 100)
+	negativeID := fundedWallet(t, svc, 0)
+	fundedWallet(t, svc, 50)
+
+	// Simulate writes that bypassed the service
+	repo.wallets[tamperedID].Balance = 1000
+	repo.wallets[negativeID].Balance = -20
+	repo.wallets[negativeID].Held = -5
+	orphan := transaction{ID: uuid.New(), Amount: 10, Currency: "USD", Type: TxnTypeDeposit, CreatedAt: time.Now()}
+	repo.transactions = append(repo.transactions, orphan)
+	repo.entries = append(repo.entries, ledgerEntry{ID: uuid.New(), TransactionID: orphan.ID, AccountID: AccountCashIn,
+		Direction: EntryDebit, Amount: 10, Currency: "EUR"})
+
+	report, err := svc.CheckLedger(ctx)
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 3, report.Wallets)
+
+	// Keyed by kind and wallet, the negative wallet also mismatches its journal
+	found := map[string]LedgerDiscrepancy{}
+	for _, d := range report.Discrepancies {
+		key := d.Kind
+		if d.WalletID != nil {
+			key += " " + d.WalletID.String()
+		}
+		found[key] = d
+	}
+	assert.Len(t, report.Discrepancies, 6)
+
+	mismatch := found[DiscrepancyBalanceMismatch+" "+tamperedID.String()]
+	assert.Equal(t, int64(100), mismatch.Expected)
+	assert.Equal(t, int64(1000), mismatch.Actual)
+	assert.Equal(t, int64(-20), found[DiscrepancyBalanceMismatch+" "+negativeID.String()].Actual)
+	assert.Equal(t, int64(-20), found[DiscrepancyNegativeBalance+" "+negativeID.String()].Actual)
+	assert.Equal(t, int64(-5), found[DiscrepancyNegativeHeld+" "+negativeID.String()].Actual)
+	assert.Equal(t, "EUR", found[DiscrepancyUnbalancedCurrency].Currency)
+	assert.Equal(t, int64(-10), found[DiscrepancyUnbalancedCurrency].Actual)
+	assert.Equal(t, &orphan.ID, found[DiscrepancyUnbalancedTransaction].TransactionID)
+}
+
+func TestLedgerChecker_Run(t *testing.T) {
+	svc, _ := newMemoryService()
+	fundedWallet(t, svc, 100)
+	checks := make(chan struct{}, 1)
+	checker := &countingLedgerChecker{svc: svc, checks: checks}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewLedgerChecker(checker, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-checks:
+	case <-time.After(time.Second):
+		t.Fatal("ledger was not checked")
+	}
+	cancel()
+	<-done
+}
+
+// countingLedgerChecker signals every ledger check it passes on.
+type countingLedgerChecker struct {
+	svc    *service
+	checks chan struct{}
+}
+
+func (c *countingLedgerChecker) CheckLedger(ctx context.Context) (*LedgerReport, error) {
+	select {
+	case c.checks <- struct{}{}:
+	default:
+	}
+	return c.svc.CheckLedger(ctx)
+}
@@ -0,0 +1,129 @@
+package wallet
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// checkInbound returns why w can not receive money, or nil.
+func checkInbound(w *wallet) error {
+	switch {
+	case w.Status == WalletClosed:
+		return ErrWalletClosed
+	case w.Status == WalletFrozen:
+		return ErrWalletFrozen
+	case w.InboundBlocked:
+		return ErrInboundBlocked
+	}
+	return nil
+}
+
+// checkOutbound returns why w can not send money, or nil.
+func checkOutbound(w *wallet) error {
+	switch {
+	case w.Status == WalletClosed:
+		return ErrWalletClosed
+	case w.Status == WalletFrozen:
+		return ErrWalletFrozen
+	case w.OutboundBlocked:
+		return ErrOutboundBlocked
+	}
+	return nil
+}
+
+// validTransition reports whether a wallet may move from one status to another.
+// Closing is final and only allowed from active or frozen.
+func validTransition(from, to string) bool {
+	switch from {
+	case WalletActive:
+		return to == WalletFrozen || to == WalletClosed
+	case WalletFrozen:
+		return to == WalletActive || to == WalletClosed
+	}
+	return false
+}
+
+// ChangeWalletState changes the status and/or the blocks of a wallet and
+// records who made the change and why. A wallet can only be closed when its
+// balance is zero and nothing is held on it.
+func (s *service) ChangeWalletState(ctx context.Context, walletID uuid.UUID, change WalletStateChange) (*wallet, error) {
+	change.Actor = strings.TrimSpace(change.Actor)
+	change.Reason = strings.TrimSpace(change.Reason)
+	if change.Actor == "" {
+		return nil, ErrActorRequired
+	}
+	if change.Reason == "" {
+		return nil, ErrReasonRequired
+	}
+	switch change.Status {
+	case "", WalletActive, WalletFrozen, WalletClosed:
+	default:
+		return nil, ErrInvalidWalletStatus
+	}
+
+	var updated *wallet
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the wallet so no money moves while its state changes
+		wallets, err := q.LockWallets(ctx, walletID)
+		if err != nil {
+			return err
+		}
+		w := wallets[walletID]
+		if w.Status == WalletClosed {
+			return ErrWalletClosed
+		}
+
+		from := w.Status
+		if change.Status != "" && change.Status != w.Status {
+			if !validTransition(w.Status, change.Status) {
+				return ErrInvalidTransition
+			}
+			if change.Status == WalletClosed && (w.Balance != 0 || w.Held != 0) {
+				return ErrWalletNotEmpty
+			}
+			w.Status = change.Status
+		}
+		if change.InboundBlocked != nil {
+			w.InboundBlocked = *change.InboundBlocked
+		}
+		if change.OutboundBlocked != nil {
+			w.OutboundBlocked = *change.OutboundBlocked
+		}
+
+		if err := q.UpdateWalletState(ctx, w); err != nil {
+			return err
+		}
+		updated = w
+		return q.InsertWalletStateEvent(ctx, &walletStateEvent{ID: uuid.New(), WalletID: walletID, FromStatus: from,
+			ToStatus: w.Status, InboundBlocked: w.InboundBlocked, OutboundBlocked: w.OutboundBlocked,
+			Actor: change.Actor, Reason: change.Reason, CreatedAt: time.Now()})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// GetWalletStateEvents returns the state change history of a wallet, oldest first.
+func (s *service) GetWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error) {
+	exists, err := s.WalletExists(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+
+	events, err := s.repo.ListWalletStateEvents(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = []walletStateEvent{}
+	}
+	return events, nil
+}
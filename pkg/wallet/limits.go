@@ -0,0 +1,323 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limit caps the amount and/or the number of one type of transaction of a
+// wallet. Period limits count what the wallet already did in the current UTC
+// calendar day, week (from Monday) or month. A zero MaxAmount or MaxCount sets
+// no cap of that kind.
+type Limit struct {
+	TxnType   string `json:"txn_type"`             // deposit, withdrawal or transfer
+	Currency  string `json:"currency,omitempty"`   // Only wallets in this currency, any when empty
+	Period    string `json:"period"`               // transaction, daily, weekly or monthly
+	MaxAmount int64  `json:"max_amount,omitempty"` // Largest amount, or total for the period, in minor units
+	MaxCount  int64  `json:"max_count,omitempty"`  // Most transactions in the period
+}
+
+// LimitSchedule holds the limits of every wallet tier.
+type LimitSchedule struct {
+	tiers map[string][]Limit
+}
+
+// NewLimitSchedule validates the limits of each tier and builds a schedule.
+// Amounts are minor units, so a limit with a MaxAmount must name its currency.
+func NewLimitSchedule(tiers map[string][]Limit) (*LimitSchedule, error) {
+	ls := &LimitSchedule{tiers: map[string][]Limit{}}
+	for tier, limits := range tiers {
+		if err := validateTier(tier); err != nil {
+			return nil, fmt.Errorf("tier %q: %w", tier, err)
+		}
+		seen := map[string]bool{}
+		for i, l := range limits {
+			l, err := validateLimit(l)
+			if err == nil && l.MaxAmount > 0 && l.Currency == "" {
+				err = fmt.Errorf("%w: currency is required for amount limits", ErrInvalidLimit)
+			}
+			key := l.TxnType + "/" + l.Currency + "/" + l.Period
+			if err == nil && seen[key] {
+				err = fmt.Errorf("%w: duplicate %s %s limit", ErrInvalidLimit, l.Period, l.TxnType)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("tier %q limit %d: %w", tier, i, err)
+			}
+			seen[key] = true
+			ls.tiers[tier] = append(ls.tiers[tier], l)
+		}
+	}
+	return ls, nil
+}
+
+// LoadLimitFile reads a JSON object of tier names to limits into a schedule.
+func LoadLimitFile(path string) (*LimitSchedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tiers map[string][]Limit
+	if err := json.Unmarshal(data, &tiers); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return NewLimitSchedule(tiers)
+}
+
+// validateTier checks the name of a tier.
+func validateTier(tier string) error {
+	if tier == "" || len(tier) > MaxLimitTierLength || strings.TrimSpace(tier) != tier {
+		return ErrInvalidTier
+	}
+	return nil
+}
+
+// validateLimit checks a limit and normalizes its currency code.
+func validateLimit(l Limit) (Limit, error) {
+	switch l.TxnType {
+	case TxnTypeDeposit, TxnTypeWithdrawal, TxnTypeTransfer:
+	default:
+		return Limit{}, fmt.Errorf("%w: txn_type must be deposit, withdrawal or transfer", ErrInvalidLimit)
+	}
+	switch l.Period {
+	case LimitPerTransaction, LimitDaily, LimitWeekly, LimitMonthly:
+	default:
+		return Limit{}, fmt.Errorf("%w: period must be transaction, daily, weekly or monthly", ErrInvalidLimit)
+	}
+	if l.MaxAmount < 0 || l.MaxCount < 0 || (l.MaxAmount == 0 && l.MaxCount == 0) {
+		return Limit{}, fmt.Errorf("%w: max_amount or max_count must be positive", ErrInvalidLimit)
+	}
+	if l.Period == LimitPerTransaction && l.MaxCount != 0 {
+		return Limit{}, fmt.Errorf("%w: a per transaction limit has no max_count", ErrInvalidLimit)
+	}
+	if l.Currency != "" {
+		code, err := NormalizeCurrency(l.Currency)
+		if err != nil {
+			return Limit{}, err
+		}
+		l.Currency = code
+	}
+	return l, nil
+}
+
+// has reports whether the schedule defines tier. The default tier always exists.
+func (ls *LimitSchedule) has(tier string) bool {
+	if tier == DefaultLimitTier {
+		return true
+	}
+	if ls == nil {
+		return false
+	}
+	_, ok := ls.tiers[tier]
+	return ok
+}
+
+// limitsFor returns the limits on transactions of txnType by w: the limits of
+// its tier for its currency, where the wallet's own overrides replace the tier
+// limits of the same period. A nil schedule only applies the overrides.
+func (ls *LimitSchedule) limitsFor(w *wallet, txnType string) []Limit {
+	var limits []Limit
+	overridden := map[string]bool{}
+	for _, o := range w.LimitOverrides {
+		if o.TxnType == txnType {
+			limits = append(limits, o)
+			overridden[o.Period] = true
+		}
+	}
+	if ls == nil {
+		return limits
+	}
+	for _, l := range ls.tiers[w.Tier] {
+		if l.TxnType == txnType && (l.Currency == "" || l.Currency == w.Currency) && !overridden[l.Period] {
+			limits = append(limits, l)
+		}
+	}
+	return limits
+}
+
+// periodStart returns when the UTC calendar period containing now began.
+func periodStart(period string, now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	switch period {
+	case LimitWeekly:
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case LimitMonthly:
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd returns when the period that began at start ends.
+func periodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case LimitWeekly:
+		return start.AddDate(0, 0, 7)
+	case LimitMonthly:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// LimitError is returned when a transaction would break a limit. It matches
+// ErrLimitExceeded with errors.Is.
+type LimitError struct {
+	TxnType   string `json:"txn_type"`           // Type of the refused transaction
+	Period    string `json:"period"`             // transaction, daily, weekly or monthly
+	Kind      string `json:"kind"`               // amount or count
+	Limit     int64  `json:"limit"`              // The limit that was hit
+	Remaining int64  `json:"remaining"`          // Amount or count still allowed in the period
+	Currency  string `json:"currency,omitempty"` // Currency of an amount limit
+}
+
+func (e *LimitError) Error() string {
+	unit := ""
+	if e.Currency != "" {
+		unit = " " + e.Currency
+	}
+	return fmt.Sprintf("%s: %s %s %s limit of %d%s, %d%s remaining",
+		ErrLimitExceeded, e.Period, e.TxnType, e.Kind, e.Limit, unit, e.Remaining, unit)
+}
+
+// Is makes errors.Is(err, ErrLimitExceeded) true for every LimitError.
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// checkLimits returns a *LimitError when a transaction of amount and txnType
+// by the locked wallet w would break one of its limits. Usage is read through
+// q, so it is consistent with the wallet row lock held by the caller.
+func (s *service) checkLimits(ctx context.Context, q Queries, w *wallet, txnType string, amount int64) error {
+	now := time.Now()
+	type usage struct{ total, count int64 }
+	used := map[string]usage{}
+
+	for _, l := range s.limits.limitsFor(w, txnType) {
+		if l.Period == LimitPerTransaction {
+			if amount > l.MaxAmount {
+				return &LimitError{TxnType: txnType, Period: l.Period, Kind: LimitKindAmount,
+					Limit: l.MaxAmount, Remaining: l.MaxAmount, Currency: w.Currency}
+			}
+			continue
+		}
+
+		u, ok := used[l.Period]
+		if !ok {
+			total, count, err := q.SumTransactions(ctx, w.ID, limitedAs(txnType), periodStart(l.Period, now))
+			if err != nil {
+				return err
+			}
+			u = usage{total, count}
+			used[l.Period] = u
+		}
+		if l.MaxCount > 0 && u.count >= l.MaxCount {
+			return &LimitError{TxnType: txnType, Period: l.Period, Kind: LimitKindCount,
+				Limit: l.MaxCount, Remaining: 0}
+		}
+		if l.MaxAmount > 0 && u.total+amount > l.MaxAmount {
+			return &LimitError{TxnType: txnType, Period: l.Period, Kind: LimitKindAmount,
+				Limit: l.MaxAmount, Remaining: max(l.MaxAmount-u.total, 0), Currency: w.Currency}
+		}
+	}
+	return nil
+}
+
+// limitedAs returns the transaction types whose usage counts towards the
+// limits of txnType. Captured holds take money out like withdrawals.
+func limitedAs(txnType string) []string {
+	if txnType == TxnTypeWithdrawal {
+		return []string{TxnTypeWithdrawal, TxnTypeCapture}
+	}
+	return []string{txnType}
+}
+
+// SetWalletLimits moves a wallet to another limit tier and/or replaces its
+// limit overrides. Overrides are in the wallet currency.
+func (s *service) SetWalletLimits(ctx context.Context, walletID uuid.UUID, change WalletLimitsChange) (*wallet, error) {
+	if change.Tier != "" && !s.limits.has(change.Tier) {
+		return nil, ErrInvalidTier
+	}
+
+	var updated *wallet
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		wallets, err := q.LockWallets(ctx, walletID)
+		if err != nil {
+			return err
+		}
+		w := wallets[walletID]
+		if w.Status == WalletClosed {
+			return ErrWalletClosed
+		}
+
+		if change.Tier != "" {
+			w.Tier = change.Tier
+		}
+		if change.Overrides != nil {
+			overrides := []Limit{}
+			seen := map[string]bool{}
+			for _, o := range *change.Overrides {
+				o, err := validateLimit(o)
+				if err != nil {
+					return err
+				}
+				if o.Currency != "" && o.Currency != w.Currency {
+					return ErrCurrencyMismatch
+				}
+				if seen[o.TxnType+"/"+o.Period] {
+					return fmt.Errorf("%w: duplicate %s %s limit", ErrInvalidLimit, o.Period, o.TxnType)
+				}
+				seen[o.TxnType+"/"+o.Period] = true
+				o.Currency = w.Currency
+				overrides = append(overrides, o)
+			}
+			w.LimitOverrides = overrides
+		}
+
+		if err := q.UpdateWalletLimits(ctx, w); err != nil {
+			return err
+		}
+		updated = w
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+// GetWalletLimits returns the tier and overrides of a wallet and every limit
+// that applies to it, with what was already used in the current period.
+func (s *service) GetWalletLimits(ctx context.Context, walletID uuid.UUID) (*WalletLimits, error) {
+	w, err := s.repo.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := &WalletLimits{Tier: w.Tier, Overrides: w.LimitOverrides, Limits: []LimitUsage{}}
+	if result.Overrides == nil {
+		result.Overrides = []Limit{}
+	}
+	for _, txnType := range []string{TxnTypeDeposit, TxnTypeWithdrawal, TxnTypeTransfer} {
+		for _, l := range s.limits.limitsFor(w, txnType) {
+			u := LimitUsage{Limit: l}
+			if l.Period != LimitPerTransaction {
+				start := periodStart(l.Period, now)
+				u.UsedAmount, u.UsedCount, err = s.repo.SumTransactions(ctx, w.ID, limitedAs(txnType), start)
+				if err != nil {
+					return nil, err
+				}
+				resets := periodEnd(l.Period, start)
+				u.ResetsAt = &resets
+			}
+			result.Limits = append(result.Limits, u)
+		}
+	}
+	return result, nil
+}
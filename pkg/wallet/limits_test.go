@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLimitSchedule_InvalidLimits(t *testing.T) {
+	invalid := []Limit{
+		{TxnType: TxnTypeCapture, Currency: "USD", Period: LimitDaily, MaxAmount: 100},
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: "hourly", MaxAmount: 100},
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily},
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: -1},
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitPerTransaction, MaxAmount: 100, MaxCount: 1},
+		{TxnType: TxnTypeWithdrawal, Period: LimitDaily, MaxAmount: 100},
+	}
+	for _, l := range invalid {
+		_, err := NewLimitSchedule(map[string][]Limit{DefaultLimitTier: {l}})
+		assert.ErrorIs(t, err, ErrInvalidLimit, "%+v", l)
+	}
+
+	daily := Limit{TxnType: TxnTypeWithdrawal, Currency: "usd", Period: LimitDaily, MaxAmount: 100}
+	_, err := NewLimitSchedule(map[string][]Limit{DefaultLimitTier: {daily, daily}})
+	assert.ErrorIs(t, err, ErrInvalidLimit)
+	_, err = NewLimitSchedule(map[string][]Limit{"": {daily}})
+	assert.ErrorIs(t, err, ErrInvalidTier)
+
+	ls, err := NewLimitSchedule(map[string][]Limit{DefaultLimitTier: {daily}})
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", ls.tiers[DefaultLimitTier][0].Currency)
+}
+
+func TestLimitSchedule_LimitsFor(t *testing.T) {
+	ls, err := NewLimitSchedule(map[string][]Limit{DefaultLimitTier: {
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitPerTransaction, MaxAmount: 100},
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: 500},
+		{TxnType: TxnTypeWithdrawal, Currency: "EUR", Period: LimitDaily, MaxAmount: 400},
+		{TxnType: TxnTypeWithdrawal, Period: LimitMonthly, MaxCount: 20},
+		{TxnType: TxnTypeDeposit, Currency: "USD", Period: LimitDaily, MaxAmount: 1000},
+	}})
+	assert.NoError(t, err)
+
+	override := Limit{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: 50}
+	w := &wallet{Currency: "USD", Tier: DefaultLimitTier, LimitOverrides: []Limit{override}}
+	assert.Equal(t, []Limit{override, ls.tiers[DefaultLimitTier][0], ls.tiers[DefaultLimitTier][3]}, ls.limitsFor(w, TxnTypeWithdrawal))
+	assert.Nil(t, ls.limitsFor(w, TxnTypeTransfer))
+
+	// Wallets of an unknown tier or without a schedule only get their overrides
+	w.Tier = "premium"
+	assert.Equal(t, []Limit{override}, ls.limitsFor(w, TxnTypeWithdrawal))
+	var none *LimitSchedule
+	assert.Equal(t, []Limit{override}, none.limitsFor(w, TxnTypeWithdrawal))
+}
+
+func TestPeriodStart(t *testing.T) {
+	// Thursday
+	now := time.Date(2024, 2, 29, 15, 4, 5, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), periodStart(LimitDaily, now))
+	assert.Equal(t, time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), periodStart(LimitWeekly, now))
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), periodStart(LimitMonthly, now))
+	assert.Equal(t, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), periodEnd(LimitMonthly, periodStart(LimitMonthly, now)))
+
+	// Weeks start on Monday, also seen from a Sunday
+	sunday := time.Date(2024, 3, 3, 23, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 2, 26, 0, 0, 0, 0, time.UTC), periodStart(LimitWeekly, sunday))
+
+	// Periods follow the UTC calendar whatever the zone of now
+	tokyo := time.Date(2024, 3, 1, 8, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	assert.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), periodStart(LimitDaily, tokyo))
+}
+
+func TestLoadLimitFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"standard": [{"txn_type": "deposit", "currency": "USD", "period": "weekly", "max_amount": 100}]}`), 0o600))
+
+	ls, err := LoadLimitFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, ls.limitsFor(&wallet{Currency: "USD", Tier: DefaultLimitTier}, TxnTypeDeposit), 1)
+
+	// The example limits shipped with the repository must load
+	_, err = LoadLimitFile(filepath.Join("..", "..", "limits.example.json"))
+	assert.NoError(t, err)
+
+	_, err = LoadLimitFile(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
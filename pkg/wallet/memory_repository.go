@@ -0,0 +1,1127 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// memoryRepository is an in-memory implementation of Repository for unit tests
+// and local demos. Transactions are serialized by a single lock, which gives
+// them the same isolation as wallet row locks in Postgres, and every write made
+// inside a transaction is undone if the transaction rolls back.
+type memoryRepository struct {
+	memoryQueries
+	mu           sync.Mutex
+	wallets      map[uuid.UUID]*wallet
+	userWallets  map[uuid.UUID][]uuid.UUID // wallet IDs per user, oldest first
+	transactions []transaction
+	chainHead    chainHead
+	checkpoints  []ChainCheckpoint // in chain order
+	entries      []ledgerEntry
+	snapshots    []balanceSnapshot
+	quotes       map[uuid.UUID]*fxQuote
+	holds        map[uuid.UUID]*hold
+	stateEvents  []walletStateEvent
+	outbox       []Event
+	published    map[int64]time.Time    // publishing time per outbox Seq
+	webhooks     []*webhookSubscription // oldest first
+	deliveries   []*webhookDelivery     // oldest first
+	attempts     []webhookAttempt
+	schedules    []*scheduledTransfer // oldest first
+	runs         []scheduleRun
+	apiClients   []*apiClient           // oldest first
+	nonces       map[nonceKey]time.Time // end of the replay window per used nonce
+}
+
+// nonceKey identifies a nonce sent by a client.
+type nonceKey struct {
+	clientID uuid.UUID
+	nonce    string
+}
+
+// memoryQueries runs Queries against a memoryRepository. Outside a transaction
+// each call takes the repository lock itself; inside a transaction the lock is
+// already held and writes record how to undo themselves.
+type memoryQueries struct {
+	repo *memoryRepository
+	undo *[]func() // nil when not inside a transaction
+}
+
+// NewMemoryRepository initializes an empty in-memory Repository.
+func NewMemoryRepository() *memoryRepository {
+	r := &memoryRepository{wallets: map[uuid.UUID]*wallet{}, userWallets: map[uuid.UUID][]uuid.UUID{}, quotes: map[uuid.UUID]*fxQuote{}, holds: map[uuid.UUID]*hold{},
+		published: map[int64]time.Time{}, chainHead: chainHead{Hash: chainGenesisHash}, nonces: map[nonceKey]time.Time{}}
+	r.memoryQueries = memoryQueries{repo: r}
+	return r
+}
+
+// RunInTx runs fn while holding the repository lock and rolls back every write
+// made through q when fn returns an error or panics, or when ctx is done
+// before fn returns, like a DB transaction whose commit is canceled.
+func (r *memoryRepository) RunInTx(ctx context.Context, fn func(q Queries) error) (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var undo []func()
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(&memoryQueries{repo: r, undo: &undo}); err != nil {
+		rollback()
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		rollback()
+		return err
+	}
+	return nil
+}
+
+// lock takes the repository lock unless the caller is inside a transaction.
+func (m *memoryQueries) lock() func() {
+	if m.undo != nil {
+		return func() {}
+	}
+	m.repo.mu.Lock()
+	return m.repo.mu.Unlock
+}
+
+// onRollback records how to undo a write made inside a transaction.
+func (m *memoryQueries) onRollback(fn func()) {
+	if m.undo != nil {
+		*m.undo = append(*m.undo, fn)
+	}
+}
+
+func (m *memoryQueries) WalletExists(ctx context.Context, walletID uuid.UUID) (bool, error) {
+	defer m.lock()()
+	_, ok := m.repo.wallets[walletID]
+	return ok, nil
+}
+
+func (m *memoryQueries) EnsureUser(ctx context.Context, userID uuid.UUID) error {
+	defer m.lock()()
+	if _, ok := m.repo.userWallets[userID]; !ok {
+		m.repo.userWallets[userID] = []uuid.UUID{}
+		m.onRollback(func() { delete(m.repo.userWallets, userID) })
+	}
+	return nil
+}
+
+func (m *memoryQueries) UserExists(ctx context.Context, userID uuid.UUID) (bool, error) {
+	defer m.lock()()
+	_, ok := m.repo.userWallets[userID]
+	return ok, nil
+}
+
+func (m *memoryQueries) ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error) {
+	defer m.lock()()
+	var wallets []wallet
+	for _, id := range m.repo.userWallets[userID] {
+		wallets = append(wallets, *m.repo.wallets[id])
+	}
+	return wallets, nil
+}
+
+func (m *memoryQueries) ListWalletIDs(ctx context.Context) ([]uuid.UUID, error) {
+	defer m.lock()()
+	ids := make([]uuid.UUID, 0, len(m.repo.wallets))
+	for id := range m.repo.wallets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	return ids, nil
+}
+
+func (m *memoryQueries) InsertWallet(ctx context.Context, w *wallet) error {
+	defer m.lock()()
+	m.insertWallet(w)
+	return nil
+}
+
+// insertWallet stores a copy of w; the caller holds the repository lock.
+func (m *memoryQueries) insertWallet(w *wallet) {
+	stored := *w
+	m.repo.wallets[w.ID] = &stored
+	ids := m.repo.userWallets[w.UserID]
+	m.repo.userWallets[w.UserID] = append(ids, w.ID)
+	m.onRollback(func() {
+		delete(m.repo.wallets, w.ID)
+		m.repo.userWallets[w.UserID] = ids
+	})
+}
+
+func (m *memoryQueries) EnsureWallet(ctx context.Context, w *wallet) error {
+	defer m.lock()()
+	if _, ok := m.repo.wallets[w.ID]; !ok {
+		m.insertWallet(w)
+	}
+	return nil
+}
+
+func (m *memoryQueries) GetWallet(ctx context.Context, walletID uuid.UUID) (*wallet, error) {
+	defer m.lock()()
+	w, ok := m.repo.wallets[walletID]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	copied := *w
+	return &copied, nil
+}
+
+// LockWallets returns copies of the wallets. The repository lock held by the
+// transaction already excludes every other writer.
+func (m *memoryQueries) LockWallets(ctx context.Context, walletIDs ...uuid.UUID) (map[uuid.UUID]*wallet, error) {
+	defer m.lock()()
+	wallets := make(map[uuid.UUID]*wallet, len(walletIDs))
+	for _, id := range walletIDs {
+		w, ok := m.repo.wallets[id]
+		if !ok {
+			return nil, ErrWalletNotFound
+		}
+		copied := *w
+		wallets[id] = &copied
+	}
+	return wallets, nil
+}
+
+func (m *memoryQueries) AdjustBalance(ctx context.Context, walletID uuid.UUID, delta int64) error {
+	defer m.lock()()
+	w, ok := m.repo.wallets[walletID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	w.Balance += delta
+	m.onRollback(func() { w.Balance -= delta })
+	return nil
+}
+
+func (m *memoryQueries) AdjustHeld(ctx context.Context, walletID uuid.UUID, delta int64) error {
+	defer m.lock()()
+	w, ok := m.repo.wallets[walletID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	w.Held += delta
+	m.onRollback(func() { w.Held -= delta })
+	return nil
+}
+
+func (m *memoryQueries) InsertTransaction(ctx context.Context, txn *transaction) error {
+	defer m.lock()()
+	n := len(m.repo.transactions)
+	m.repo.transactions = append(m.repo.transactions, *txn)
+	m.onRollback(func() { m.repo.transactions = m.repo.transactions[:n] })
+	return nil
+}
+
+// LockChainHead returns the head. The repository lock held by the
+// transaction already keeps appends in order.
+func (m *memoryQueries) LockChainHead(ctx context.Context) (*chainHead, error) {
+	defer m.lock()()
+	head := m.repo.chainHead
+	return &head, nil
+}
+
+func (m *memoryQueries) UpdateChainHead(ctx context.Context, head *chainHead) error {
+	defer m.lock()()
+	old := m.repo.chainHead
+	m.repo.chainHead = *head
+	m.onRollback(func() { m.repo.chainHead = old })
+	return nil
+}
+
+func (m *memoryQueries) GetChainHead(ctx context.Context) (*chainHead, error) {
+	defer m.lock()()
+	head := m.repo.chainHead
+	return &head, nil
+}
+
+func (m *memoryQueries) InsertChainCheckpoint(ctx context.Context, cp *ChainCheckpoint) error {
+	defer m.lock()()
+	n := len(m.repo.checkpoints)
+	m.repo.checkpoints = append(m.repo.checkpoints, *cp)
+	m.onRollback(func() { m.repo.checkpoints = m.repo.checkpoints[:n] })
+	return nil
+}
+
+// NextChainCheckpoint relies on checkpoints being appended in chain order.
+func (m *memoryQueries) NextChainCheckpoint(ctx context.Context, seq int64) (*ChainCheckpoint, error) {
+	defer m.lock()()
+	for _, cp := range m.repo.checkpoints {
+		if cp.Seq >= seq {
+			copied := cp
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryQueries) GetChainedTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error) {
+	defer m.lock()()
+	for _, txn := range m.repo.transactions {
+		if txn.ID == txnID {
+			copied := txn
+			return &copied, nil
+		}
+	}
+	return nil, ErrTransactionNotFound
+}
+
+// ListChainedTransactions relies on transactions being appended in chain order.
+func (m *memoryQueries) ListChainedTransactions(ctx context.Context, afterSeq int64, limit int) ([]transaction, error) {
+	defer m.lock()()
+	var txns []transaction
+	for _, txn := range m.repo.transactions {
+		if txn.ChainSeq > afterSeq && len(txns) < limit {
+			txns = append(txns, txn)
+		}
+	}
+	return txns, nil
+}
+
+// LockTransaction returns a copy of the transaction. The repository lock held
+// by the transaction already excludes every other writer.
+func (m *memoryQueries) LockTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error) {
+	defer m.lock()()
+	for _, txn := range m.repo.transactions {
+		if txn.ID == txnID {
+			copied := txn
+			return &copied, nil
+		}
+	}
+	return nil, ErrTransactionNotFound
+}
+
+func (m *memoryQueries) AddReversedAmount(ctx context.Context, txnID uuid.UUID, amount int64) error {
+	defer m.lock()()
+	for i := range m.repo.transactions {
+		if m.repo.transactions[i].ID == txnID {
+			m.repo.transactions[i].Reversed += amount
+			m.onRollback(func() { m.repo.transactions[i].Reversed -= amount })
+			return nil
+		}
+	}
+	return ErrTransactionNotFound
+}
+
+func (m *memoryQueries) InsertEntries(ctx context.Context, txnID uuid.UUID, entries []ledgerEntry) error {
+	defer m.lock()()
+	n := len(m.repo.entries)
+	for _, e := range entries {
+		e.TransactionID = txnID
+		m.repo.entries = append(m.repo.entries, e)
+	}
+	m.onRollback(func() { m.repo.entries = m.repo.entries[:n] })
+	return nil
+}
+
+func (m *memoryQueries) LedgerBalance(ctx context.Context, accountID uuid.UUID, currency string) (int64, error) {
+	defer m.lock()()
+	var balance int64
+	for _, e := range m.repo.entries {
+		if e.AccountID != accountID || e.Currency != currency {
+			continue
+		}
+		if e.Direction == EntryCredit {
+			balance += e.Amount
+		} else {
+			balance -= e.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *memoryQueries) ListWalletLedgerBalances(ctx context.Context) ([]walletLedgerBalance, error) {
+	defer m.lock()()
+	ledger := map[uuid.UUID]int64{}
+	for _, e := range m.repo.entries {
+		w, ok := m.repo.wallets[e.AccountID]
+		if !ok || e.Currency != w.Currency {
+			continue
+		}
+		if e.Direction == EntryCredit {
+			ledger[e.AccountID] += e.Amount
+		} else {
+			ledger[e.AccountID] -= e.Amount
+		}
+	}
+
+	balances := make([]walletLedgerBalance, 0, len(m.repo.wallets))
+	for id, w := range m.repo.wallets {
+		balances = append(balances, walletLedgerBalance{WalletID: id, Currency: w.Currency, Balance: w.Balance, Held: w.Held, Ledger: ledger[id]})
+	}
+	sort.Slice(balances, func(i, j int) bool { return bytes.Compare(balances[i].WalletID[:], balances[j].WalletID[:]) < 0 })
+	return balances, nil
+}
+
+func (m *memoryQueries) LedgerNetByCurrency(ctx context.Context) (map[string]int64, error) {
+	defer m.lock()()
+	net := map[string]int64{}
+	for _, e := range m.repo.entries {
+		if e.Direction == EntryCredit {
+			net[e.Currency] += e.Amount
+		} else {
+			net[e.Currency] -= e.Amount
+		}
+	}
+	return net, nil
+}
+
+func (m *memoryQueries) ListUnbalancedTransactions(ctx context.Context, limit int) ([]uuid.UUID, error) {
+	defer m.lock()()
+	net := map[uuid.UUID]map[string]int64{}
+	for _, e := range m.repo.entries {
+		if net[e.TransactionID] == nil {
+			net[e.TransactionID] = map[string]int64{}
+		}
+		if e.Direction == EntryCredit {
+			net[e.TransactionID][e.Currency] += e.Amount
+		} else {
+			net[e.TransactionID][e.Currency] -= e.Amount
+		}
+	}
+
+	var ids []uuid.UUID
+	for _, txn := range m.repo.transactions {
+		currencies, ok := net[txn.ID]
+		unbalanced := !ok
+		for _, n := range currencies {
+			unbalanced = unbalanced || n != 0
+		}
+		if unbalanced {
+			ids = append(ids, txn.ID)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+// LedgerNetChange sums the journal lines of the transactions created in
+// [from, to), which are looked up by ID since entries carry no timestamp.
+func (m *memoryQueries) LedgerNetChange(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) (int64, error) {
+	defer m.lock()()
+	created := m.transactionTimes()
+	var balance int64
+	for _, e := range m.repo.entries {
+		at := created[e.TransactionID]
+		if e.AccountID != accountID || e.Currency != currency || at.Before(from) || !at.Before(to) {
+			continue
+		}
+		if e.Direction == EntryCredit {
+			balance += e.Amount
+		} else {
+			balance -= e.Amount
+		}
+	}
+	return balance, nil
+}
+
+func (m *memoryQueries) ListAccountMovements(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) ([]accountMovement, error) {
+	defer m.lock()()
+	changes := map[uuid.UUID]int64{}
+	for _, e := range m.repo.entries {
+		if e.AccountID != accountID || e.Currency != currency {
+			continue
+		}
+		if e.Direction == EntryCredit {
+			changes[e.TransactionID] += e.Amount
+		} else {
+			changes[e.TransactionID] -= e.Amount
+		}
+	}
+
+	var movements []accountMovement
+	for _, txn := range m.repo.transactions {
+		change, ok := changes[txn.ID]
+		if ok && !txn.CreatedAt.Before(from) && txn.CreatedAt.Before(to) {
+			movements = append(movements, accountMovement{Transaction: txn, Change: change})
+		}
+	}
+	sort.SliceStable(movements, func(i, j int) bool {
+		a, b := movements[i].Transaction, movements[j].Transaction
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0
+	})
+	return movements, nil
+}
+
+func (m *memoryQueries) InsertBalanceSnapshot(ctx context.Context, snap *balanceSnapshot) error {
+	defer m.lock()()
+	for _, existing := range m.repo.snapshots {
+		if existing.WalletID == snap.WalletID && existing.AsOf.Equal(snap.AsOf) {
+			return nil
+		}
+	}
+	n := len(m.repo.snapshots)
+	m.repo.snapshots = append(m.repo.snapshots, *snap)
+	m.onRollback(func() { m.repo.snapshots = m.repo.snapshots[:n] })
+	return nil
+}
+
+func (m *memoryQueries) LatestBalanceSnapshot(ctx context.Context, walletID uuid.UUID, at time.Time) (*balanceSnapshot, error) {
+	defer m.lock()()
+	var latest *balanceSnapshot
+	for i, snap := range m.repo.snapshots {
+		if snap.WalletID == walletID && !snap.AsOf.After(at) && (latest == nil || snap.AsOf.After(latest.AsOf)) {
+			latest = &m.repo.snapshots[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	found := *latest
+	return &found, nil
+}
+
+// transactionTimes maps every transaction ID to its creation time. The caller
+// holds the lock.
+func (m *memoryQueries) transactionTimes() map[uuid.UUID]time.Time {
+	created := make(map[uuid.UUID]time.Time, len(m.repo.transactions))
+	for _, txn := range m.repo.transactions {
+		created[txn.ID] = txn.CreatedAt
+	}
+	return created
+}
+
+func (m *memoryQueries) InsertQuote(ctx context.Context, quote *fxQuote) error {
+	defer m.lock()()
+	stored := *quote
+	m.repo.quotes[quote.ID] = &stored
+	m.onRollback(func() { delete(m.repo.quotes, quote.ID) })
+	return nil
+}
+
+func (m *memoryQueries) GetQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error) {
+	defer m.lock()()
+	quote, ok := m.repo.quotes[quoteID]
+	if !ok {
+		return nil, ErrQuoteNotFound
+	}
+	copied := *quote
+	return &copied, nil
+}
+
+// LockQuote returns a copy of the quote. The repository lock held by the
+// transaction already excludes every other writer.
+func (m *memoryQueries) LockQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error) {
+	defer m.lock()()
+	quote, ok := m.repo.quotes[quoteID]
+	if !ok {
+		return nil, ErrQuoteNotFound
+	}
+	copied := *quote
+	return &copied, nil
+}
+
+func (m *memoryQueries) MarkQuoteExecuted(ctx context.Context, quoteID, txnID uuid.UUID) error {
+	defer m.lock()()
+	quote, ok := m.repo.quotes[quoteID]
+	if !ok {
+		return ErrQuoteNotFound
+	}
+	prev := quote.TransactionID
+	quote.TransactionID = &txnID
+	m.onRollback(func() { quote.TransactionID = prev })
+	return nil
+}
+
+func (m *memoryQueries) InsertHold(ctx context.Context, h *hold) error {
+	defer m.lock()()
+	stored := *h
+	m.repo.holds[h.ID] = &stored
+	m.onRollback(func() { delete(m.repo.holds, h.ID) })
+	return nil
+}
+
+func (m *memoryQueries) GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	defer m.lock()()
+	h, ok := m.repo.holds[holdID]
+	if !ok {
+		return nil, ErrHoldNotFound
+	}
+	copied := *h
+	return &copied, nil
+}
+
+// LockHold returns a copy of the hold. The repository lock held by the
+// transaction already excludes every other writer.
+func (m *memoryQueries) LockHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	return m.GetHold(ctx, holdID)
+}
+
+func (m *memoryQueries) UpdateHold(ctx context.Context, h *hold) error {
+	defer m.lock()()
+	stored, ok := m.repo.holds[h.ID]
+	if !ok {
+		return ErrHoldNotFound
+	}
+	prev := *stored
+	*stored = *h
+	m.onRollback(func() { *stored = prev })
+	return nil
+}
+
+func (m *memoryQueries) ListExpiredHolds(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	defer m.lock()()
+	var expired []*hold
+	for _, h := range m.repo.holds {
+		if h.Status == HoldActive && !h.ExpiresAt.After(now) {
+			expired = append(expired, h)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].ExpiresAt.Before(expired[j].ExpiresAt) })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+	ids := make([]uuid.UUID, len(expired))
+	for i, h := range expired {
+		ids[i] = h.ID
+	}
+	return ids, nil
+}
+
+func (m *memoryQueries) UpdateWalletState(ctx context.Context, w *wallet) error {
+	defer m.lock()()
+	stored, ok := m.repo.wallets[w.ID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	status, inbound, outbound := stored.Status, stored.InboundBlocked, stored.OutboundBlocked
+	stored.Status, stored.InboundBlocked, stored.OutboundBlocked = w.Status, w.InboundBlocked, w.OutboundBlocked
+	m.onRollback(func() { stored.Status, stored.InboundBlocked, stored.OutboundBlocked = status, inbound, outbound })
+	return nil
+}
+
+func (m *memoryQueries) UpdateWalletLimits(ctx context.Context, w *wallet) error {
+	defer m.lock()()
+	stored, ok := m.repo.wallets[w.ID]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	tier, overrides := stored.Tier, stored.LimitOverrides
+	stored.Tier, stored.LimitOverrides = w.Tier, append([]Limit(nil), w.LimitOverrides...)
+	m.onRollback(func() { stored.Tier, stored.LimitOverrides = tier, overrides })
+	return nil
+}
+
+func (m *memoryQueries) SumTransactions(ctx context.Context, walletID uuid.UUID, txnTypes []string, since time.Time) (int64, int64, error) {
+	defer m.lock()()
+	var total, count int64
+	for _, txn := range m.repo.transactions {
+		side := txn.FromWallet
+		if txn.Type == TxnTypeDeposit {
+			side = txn.ToWallet
+		}
+		if slices.Contains(txnTypes, txn.Type) && side != nil && *side == walletID && !txn.CreatedAt.Before(since) {
+			total += txn.Amount
+			count++
+		}
+	}
+	return total, count, nil
+}
+
+func (m *memoryQueries) InsertWalletStateEvent(ctx context.Context, e *walletStateEvent) error {
+	defer m.lock()()
+	n := len(m.repo.stateEvents)
+	m.repo.stateEvents = append(m.repo.stateEvents, *e)
+	m.onRollback(func() { m.repo.stateEvents = m.repo.stateEvents[:n] })
+	return nil
+}
+
+func (m *memoryQueries) ListWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error) {
+	defer m.lock()()
+	var events []walletStateEvent
+	for _, e := range m.repo.stateEvents {
+		if e.WalletID == walletID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryQueries) ListTransactions(ctx context.Context, walletID uuid.UUID, q transactionQuery) ([]transaction, error) {
+	defer m.lock()()
+	var txns []transaction
+	for _, txn := range m.repo.transactions {
+		if q.matches(walletID, txn) {
+			txns = append(txns, txn)
+		}
+	}
+	sort.Slice(txns, func(i, j int) bool {
+		if !txns[i].CreatedAt.Equal(txns[j].CreatedAt) {
+			return txns[i].CreatedAt.After(txns[j].CreatedAt)
+		}
+		return bytes.Compare(txns[i].ID[:], txns[j].ID[:]) > 0
+	})
+	if len(txns) > q.Limit {
+		txns = txns[:q.Limit]
+	}
+	return txns, nil
+}
+
+// Compile-time check to ensure memoryRepository implements Repository interface
+var _ Repository = (*memoryRepository)(nil)
+
+func (m *memoryQueries) InsertEvent(ctx context.Context, e *Event) error {
+	defer m.lock()()
+	n := len(m.repo.outbox)
+	e.Seq = int64(n + 1)
+	m.repo.outbox = append(m.repo.outbox, *e)
+	m.onRollback(func() { m.repo.outbox = m.repo.outbox[:n] })
+	return nil
+}
+
+// LockUnpublishedEvents returns copies of the oldest unpublished events. The
+// repository lock held by the transaction already excludes other relays.
+func (m *memoryQueries) LockUnpublishedEvents(ctx context.Context, limit int) ([]Event, error) {
+	defer m.lock()()
+	var events []Event
+	for _, e := range m.repo.outbox {
+		if _, ok := m.repo.published[e.Seq]; !ok && len(events) < limit {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (m *memoryQueries) ClaimEvents(ctx context.Context, seqs []int64, until time.Time) error {
+	defer m.lock()()
+	for _, seq := range seqs {
+		i, prev := seq-1, m.repo.outbox[seq-1].ClaimedUntil
+		m.repo.outbox[i].ClaimedUntil = &until
+		m.onRollback(func() { m.repo.outbox[i].ClaimedUntil = prev })
+	}
+	return nil
+}
+
+func (m *memoryQueries) MarkEventsPublished(ctx context.Context, seqs []int64, at time.Time) error {
+	defer m.lock()()
+	for _, seq := range seqs {
+		m.repo.published[seq] = at
+	}
+	m.onRollback(func() {
+		for _, seq := range seqs {
+			delete(m.repo.published, seq)
+		}
+	})
+	return nil
+}
+
+// copyWebhook returns a copy of sub that shares no slice with it.
+func copyWebhook(sub *webhookSubscription) webhookSubscription {
+	copied := *sub
+	copied.EventTypes = append([]string{}, sub.EventTypes...)
+	return copied
+}
+
+func (m *memoryQueries) InsertWebhookSubscription(ctx context.Context, sub *webhookSubscription) error {
+	defer m.lock()()
+	stored := copyWebhook(sub)
+	n := len(m.repo.webhooks)
+	m.repo.webhooks = append(m.repo.webhooks, &stored)
+	m.onRollback(func() { m.repo.webhooks = m.repo.webhooks[:n] })
+	return nil
+}
+
+func (m *memoryQueries) GetWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error) {
+	defer m.lock()()
+	for _, sub := range m.repo.webhooks {
+		if sub.ID == subscriptionID {
+			copied := copyWebhook(sub)
+			return &copied, nil
+		}
+	}
+	return nil, ErrWebhookNotFound
+}
+
+func (m *memoryQueries) ListWebhookSubscriptions(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error) {
+	defer m.lock()()
+	var subs []webhookSubscription
+	for _, sub := range m.repo.webhooks {
+		if (walletID != nil && sub.WalletID != nil && *sub.WalletID == *walletID) ||
+			(userID != nil && sub.UserID != nil && *sub.UserID == *userID) {
+			subs = append(subs, copyWebhook(sub))
+		}
+	}
+	return subs, nil
+}
+
+func (m *memoryQueries) ListEventWebhooks(ctx context.Context, walletIDs []uuid.UUID) ([]webhookSubscription, error) {
+	defer m.lock()()
+	wallets := map[uuid.UUID]bool{}
+	users := map[uuid.UUID]bool{}
+	for _, id := range walletIDs {
+		wallets[id] = true
+		if w, ok := m.repo.wallets[id]; ok {
+			users[w.UserID] = true
+		}
+	}
+
+	var subs []webhookSubscription
+	for _, sub := range m.repo.webhooks {
+		if sub.Active && ((sub.WalletID != nil && wallets[*sub.WalletID]) || (sub.UserID != nil && users[*sub.UserID])) {
+			subs = append(subs, copyWebhook(sub))
+		}
+	}
+	return subs, nil
+}
+
+func (m *memoryQueries) UpdateWebhookSubscription(ctx context.Context, sub *webhookSubscription) error {
+	defer m.lock()()
+	for _, stored := range m.repo.webhooks {
+		if stored.ID == sub.ID {
+			prev := *stored
+			stored.URL, stored.EventTypes, stored.Secret, stored.Active, stored.UpdatedAt =
+				sub.URL, append([]string{}, sub.EventTypes...), sub.Secret, sub.Active, sub.UpdatedAt
+			m.onRollback(func() { *stored = prev })
+			return nil
+		}
+	}
+	return ErrWebhookNotFound
+}
+
+func (m *memoryQueries) DeleteWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) error {
+	defer m.lock()()
+	webhooks, deliveries, attempts := m.repo.webhooks, m.repo.deliveries, m.repo.attempts
+
+	var keptWebhooks []*webhookSubscription
+	for _, sub := range webhooks {
+		if sub.ID != subscriptionID {
+			keptWebhooks = append(keptWebhooks, sub)
+		}
+	}
+	if len(keptWebhooks) == len(webhooks) {
+		return ErrWebhookNotFound
+	}
+
+	deleted := map[uuid.UUID]bool{}
+	var keptDeliveries []*webhookDelivery
+	for _, d := range deliveries {
+		if d.SubscriptionID == subscriptionID {
+			deleted[d.ID] = true
+		} else {
+			keptDeliveries = append(keptDeliveries, d)
+		}
+	}
+	var keptAttempts []webhookAttempt
+	for _, a := range attempts {
+		if !deleted[a.DeliveryID] {
+			keptAttempts = append(keptAttempts, a)
+		}
+	}
+
+	m.repo.webhooks, m.repo.deliveries, m.repo.attempts = keptWebhooks, keptDeliveries, keptAttempts
+	m.onRollback(func() { m.repo.webhooks, m.repo.deliveries, m.repo.attempts = webhooks, deliveries, attempts })
+	return nil
+}
+
+func (m *memoryQueries) InsertWebhookDelivery(ctx context.Context, d *webhookDelivery) error {
+	defer m.lock()()
+	stored := *d
+	n := len(m.repo.deliveries)
+	m.repo.deliveries = append(m.repo.deliveries, &stored)
+	m.onRollback(func() { m.repo.deliveries = m.repo.deliveries[:n] })
+	return nil
+}
+
+func (m *memoryQueries) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	defer m.lock()()
+	var due []*webhookDelivery
+	for _, d := range m.repo.deliveries {
+		if d.Status == WebhookPending && !d.NextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+
+	var ids []uuid.UUID
+	for _, d := range due {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, d.ID)
+	}
+	return ids, nil
+}
+
+func (m *memoryQueries) GetWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	defer m.lock()()
+	for _, d := range m.repo.deliveries {
+		if d.ID == deliveryID {
+			copied := *d
+			return &copied, nil
+		}
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+// LockWebhookDelivery returns a copy of the delivery. The repository lock held
+// by the transaction already excludes other dispatchers.
+func (m *memoryQueries) LockWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	defer m.lock()()
+	for _, d := range m.repo.deliveries {
+		if d.ID == deliveryID {
+			copied := *d
+			return &copied, nil
+		}
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+func (m *memoryQueries) UpdateWebhookDelivery(ctx context.Context, d *webhookDelivery) error {
+	defer m.lock()()
+	for _, stored := range m.repo.deliveries {
+		if stored.ID == d.ID {
+			prev := *stored
+			stored.Status, stored.Attempts, stored.NextAttemptAt, stored.LastError, stored.UpdatedAt, stored.ClaimID =
+				d.Status, d.Attempts, d.NextAttemptAt, d.LastError, d.UpdatedAt, d.ClaimID
+			m.onRollback(func() { *stored = prev })
+			return nil
+		}
+	}
+	return ErrDeliveryNotFound
+}
+
+func (m *memoryQueries) ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID, limit int) ([]webhookDelivery, error) {
+	defer m.lock()()
+	var deliveries []webhookDelivery
+	for i := len(m.repo.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := m.repo.deliveries[i]; d.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, *d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (m *memoryQueries) InsertWebhookAttempt(ctx context.Context, a *webhookAttempt) error {
+	defer m.lock()()
+	n := len(m.repo.attempts)
+	m.repo.attempts = append(m.repo.attempts, *a)
+	m.onRollback(func() { m.repo.attempts = m.repo.attempts[:n] })
+	return nil
+}
+
+func (m *memoryQueries) ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error) {
+	defer m.lock()()
+	var attempts []webhookAttempt
+	for _, a := range m.repo.attempts {
+		if a.DeliveryID == deliveryID {
+			attempts = append(attempts, a)
+		}
+	}
+	return attempts, nil
+}
+
+// copySchedule returns a copy of sch that shares no pointer with it.
+func copySchedule(sch *scheduledTransfer) scheduledTransfer {
+	copied := *sch
+	for _, t := range []**time.Time{&copied.EndAt, &copied.NextRunAt, &copied.NextAttemptAt} {
+		if *t != nil {
+			v := **t
+			*t = &v
+		}
+	}
+	return copied
+}
+
+func (m *memoryQueries) InsertSchedule(ctx context.Context, sch *scheduledTransfer) error {
+	defer m.lock()()
+	stored := copySchedule(sch)
+	n := len(m.repo.schedules)
+	m.repo.schedules = append(m.repo.schedules, &stored)
+	m.onRollback(func() { m.repo.schedules = m.repo.schedules[:n] })
+	return nil
+}
+
+func (m *memoryQueries) GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	defer m.lock()()
+	for _, sch := range m.repo.schedules {
+		if sch.ID == scheduleID {
+			copied := copySchedule(sch)
+			return &copied, nil
+		}
+	}
+	return nil, ErrScheduleNotFound
+}
+
+// LockSchedule returns a copy of the schedule. The repository lock held by the
+// transaction already excludes other schedulers.
+func (m *memoryQueries) LockSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return m.GetSchedule(ctx, scheduleID)
+}
+
+func (m *memoryQueries) UpdateSchedule(ctx context.Context, sch *scheduledTransfer) error {
+	defer m.lock()()
+	for _, stored := range m.repo.schedules {
+		if stored.ID == sch.ID {
+			prev := *stored
+			*stored = copySchedule(sch)
+			m.onRollback(func() { *stored = prev })
+			return nil
+		}
+	}
+	return ErrScheduleNotFound
+}
+
+func (m *memoryQueries) ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error) {
+	defer m.lock()()
+	var schedules []scheduledTransfer
+	for _, sch := range m.repo.schedules {
+		if sch.FromWallet == walletID {
+			schedules = append(schedules, copySchedule(sch))
+		}
+	}
+	return schedules, nil
+}
+
+func (m *memoryQueries) ListDueSchedules(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	defer m.lock()()
+	var due []*scheduledTransfer
+	for _, sch := range m.repo.schedules {
+		if sch.Status == ScheduleActive && sch.NextAttemptAt != nil && !sch.NextAttemptAt.After(now) {
+			due = append(due, sch)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(*due[j].NextAttemptAt) })
+
+	var ids []uuid.UUID
+	for _, sch := range due {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, sch.ID)
+	}
+	return ids, nil
+}
+
+func (m *memoryQueries) InsertScheduleRun(ctx context.Context, run *scheduleRun) error {
+	defer m.lock()()
+	if run.IdempotencyKey != "" {
+		for _, r := range m.repo.runs {
+			if r.IdempotencyKey == run.IdempotencyKey {
+				return ErrRunAlreadyExecuted
+			}
+		}
+	}
+	n := len(m.repo.runs)
+	m.repo.runs = append(m.repo.runs, *run)
+	m.onRollback(func() { m.repo.runs = m.repo.runs[:n] })
+	return nil
+}
+
+func (m *memoryQueries) ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID, limit int) ([]scheduleRun, error) {
+	defer m.lock()()
+	var runs []scheduleRun
+	for i := len(m.repo.runs) - 1; i >= 0 && len(runs) < limit; i-- {
+		if m.repo.runs[i].ScheduleID == scheduleID {
+			runs = append(runs, m.repo.runs[i])
+		}
+	}
+	return runs, nil
+}
+
+// copyAPIClient returns a copy of c that shares no pointer with it.
+func copyAPIClient(c *apiClient) apiClient {
+	copied := *c
+	copied.Scopes = append([]string(nil), c.Scopes...)
+	for _, t := range []**time.Time{&copied.PrevKeyExpiresAt, &copied.RevokedAt} {
+		if *t != nil {
+			v := **t
+			*t = &v
+		}
+	}
+	return copied
+}
+
+func (m *memoryQueries) InsertAPIClient(ctx context.Context, c *apiClient) error {
+	defer m.lock()()
+	stored := copyAPIClient(c)
+	n := len(m.repo.apiClients)
+	m.repo.apiClients = append(m.repo.apiClients, &stored)
+	m.onRollback(func() { m.repo.apiClients = m.repo.apiClients[:n] })
+	return nil
+}
+
+func (m *memoryQueries) GetAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	defer m.lock()()
+	for _, c := range m.repo.apiClients {
+		if c.ID == clientID {
+			copied := copyAPIClient(c)
+			return &copied, nil
+		}
+	}
+	return nil, ErrAPIClientNotFound
+}
+
+// LockAPIClient returns a copy of the client. The repository lock held by the
+// transaction already excludes other writers.
+func (m *memoryQueries) LockAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	return m.GetAPIClient(ctx, clientID)
+}
+
+func (m *memoryQueries) UpdateAPIClient(ctx context.Context, c *apiClient) error {
+	defer m.lock()()
+	for _, stored := range m.repo.apiClients {
+		if stored.ID == c.ID {
+			prev := *stored
+			*stored = copyAPIClient(c)
+			m.onRollback(func() { *stored = prev })
+			return nil
+		}
+	}
+	return ErrAPIClientNotFound
+}
+
+func (m *memoryQueries) ListAPIClients(ctx context.Context) ([]apiClient, error) {
+	defer m.lock()()
+	var clients []apiClient
+	for _, c := range m.repo.apiClients {
+		clients = append(clients, copyAPIClient(c))
+	}
+	return clients, nil
+}
+
+func (m *memoryQueries) UseNonce(ctx context.Context, clientID uuid.UUID, nonce string, expiresAt time.Time) error {
+	defer m.lock()()
+	key := nonceKey{clientID: clientID, nonce: nonce}
+	if _, ok := m.repo.nonces[key]; ok {
+		return ErrNonceReused
+	}
+	m.repo.nonces[key] = expiresAt
+	m.onRollback(func() { delete(m.repo.nonces, key) })
+	return nil
+}
+
+func (m *memoryQueries) DeleteExpiredNonces(ctx context.Context, now time.Time) (int64, error) {
+	defer m.lock()()
+	var n int64
+	for key, expiresAt := range m.repo.nonces {
+		if !expiresAt.After(now) {
+			delete(m.repo.nonces, key)
+			m.onRollback(func() { m.repo.nonces[key] = expiresAt })
+			n++
+		}
+	}
+	return n, nil
+}
@@ -1,34 +1,192 @@
 package wallet
 
 import (
+	"context"
+	"time"
+
 	"github.com/google/uuid"
 )
 
 // MockService implements the Service interface for testing.
 type mockService struct {
-	MockCreateWallet    func(uuid.UUID) (*wallet, error)
-	MockDeposit         func(uuid.UUID, int64) (uuid.UUID, error)
-	MockWithdraw        func(uuid.UUID, int64) (uuid.UUID, error)
-	MockTransfer        func(uuid.UUID, uuid.UUID, int64) (uuid.UUID, error)
-	MockGetBalance      func(uuid.UUID) (int64, error)
-	MockGetTransactions func(uuid.UUID) ([]transaction, error)
+	MockCreateWallet    func(context.Context, uuid.UUID, string, string, string) (*wallet, error)
+	MockListWallets     func(context.Context, uuid.UUID) ([]wallet, error)
+	MockDeposit         func(context.Context, uuid.UUID, Money) (uuid.UUID, error)
+	MockWithdraw        func(context.Context, uuid.UUID, Money) (uuid.UUID, error)
+	MockTransfer        func(context.Context, uuid.UUID, uuid.UUID, Money) (uuid.UUID, error)
+	MockQuoteTransfer   func(context.Context, uuid.UUID, uuid.UUID, Money) (*fxQuote, error)
+	MockExecuteQuote    func(context.Context, uuid.UUID) (uuid.UUID, error)
+	MockReverse         func(context.Context, uuid.UUID, int64, string, bool) (uuid.UUID, error)
+	MockCreateHold      func(context.Context, uuid.UUID, Money, time.Duration) (*hold, error)
+	MockCaptureHold     func(context.Context, uuid.UUID, int64) (uuid.UUID, error)
+	MockVoidHold        func(context.Context, uuid.UUID) error
+	MockGetHold         func(context.Context, uuid.UUID) (*hold, error)
+	MockGetBalance      func(context.Context, uuid.UUID) (*Balance, error)
+	MockGetBalanceAt    func(context.Context, uuid.UUID, time.Time) (Money, error)
+	MockGetProof        func(context.Context, uuid.UUID) (*InclusionProof, error)
+	MockPreviewFees     func(context.Context, uuid.UUID, string, Money) (*FeePreview, error)
+	MockGetTransactions func(context.Context, uuid.UUID, TransactionFilter) (*TransactionPage, error)
+	MockGetStatement    func(context.Context, uuid.UUID, time.Time, time.Time) (*Statement, error)
+	MockResourceOwners  func(context.Context, string, uuid.UUID) ([]uuid.UUID, error)
+
+	MockChangeWalletState    func(context.Context, uuid.UUID, WalletStateChange) (*wallet, error)
+	MockGetWalletStateEvents func(context.Context, uuid.UUID) ([]walletStateEvent, error)
+	MockSetWalletLimits      func(context.Context, uuid.UUID, WalletLimitsChange) (*wallet, error)
+	MockGetWalletLimits      func(context.Context, uuid.UUID) (*WalletLimits, error)
+	MockListRevenueWallets   func(context.Context) ([]wallet, error)
+
+	MockCreateWebhook         func(context.Context, WebhookRequest) (*webhookSubscription, error)
+	MockGetWebhook            func(context.Context, uuid.UUID) (*webhookSubscription, error)
+	MockListWebhooks          func(context.Context, *uuid.UUID, *uuid.UUID) ([]webhookSubscription, error)
+	MockUpdateWebhook         func(context.Context, uuid.UUID, WebhookUpdate) (*webhookSubscription, error)
+	MockDeleteWebhook         func(context.Context, uuid.UUID) error
+	MockListWebhookDeliveries func(context.Context, uuid.UUID) ([]webhookDelivery, error)
+	MockListWebhookAttempts   func(context.Context, uuid.UUID) ([]webhookAttempt, error)
+	MockReplayWebhookDelivery func(context.Context, uuid.UUID) (*webhookDelivery, error)
+
+	MockCreateSchedule   func(context.Context, ScheduleRequest) (*scheduledTransfer, error)
+	MockGetSchedule      func(context.Context, uuid.UUID) (*scheduledTransfer, error)
+	MockListSchedules    func(context.Context, uuid.UUID) ([]scheduledTransfer, error)
+	MockUpdateSchedule   func(context.Context, uuid.UUID, ScheduleUpdate) (*scheduledTransfer, error)
+	MockCancelSchedule   func(context.Context, uuid.UUID) (*scheduledTransfer, error)
+	MockListScheduleRuns func(context.Context, uuid.UUID) ([]scheduleRun, error)
+
+	MockIssueAPIClient  func(context.Context, string, []string) (*IssuedAPIKey, error)
+	MockListAPIClients  func(context.Context) ([]apiClient, error)
+	MockRotateAPIKey    func(context.Context, uuid.UUID) (*IssuedAPIKey, error)
+	MockRevokeAPIClient func(context.Context, uuid.UUID) (*apiClient, error)
 }
 
-func (m *mockService) CreateWallet(userID uuid.UUID) (*wallet, error) {
-	return m.MockCreateWallet(userID)
+func (m *mockService) CreateWallet(ctx context.Context, userID uuid.UUID, currency, label, walletType string) (*wallet, error) {
+	return m.MockCreateWallet(ctx, userID, currency, label, walletType)
+}
+func (m *mockService) ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error) {
+	return m.MockListWallets(ctx, userID)
+}
+func (m *mockService) Deposit(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+	return m.MockDeposit(ctx, walletID, amount)
+}
+func (m *mockService) Withdraw(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+	return m.MockWithdraw(ctx, walletID, amount)
+}
+func (m *mockService) Transfer(ctx context.Context, from uuid.UUID, to uuid.UUID, amount Money) (uuid.UUID, error) {
+	return m.MockTransfer(ctx, from, to, amount)
+}
+func (m *mockService) QuoteTransfer(ctx context.Context, from uuid.UUID, to uuid.UUID, amount Money) (*fxQuote, error) {
+	return m.MockQuoteTransfer(ctx, from, to, amount)
+}
+func (m *mockService) ExecuteQuote(ctx context.Context, quoteID uuid.UUID) (uuid.UUID, error) {
+	return m.MockExecuteQuote(ctx, quoteID)
+}
+func (m *mockService) Reverse(ctx context.Context, txnID uuid.UUID, amount int64, reason string, allowNegative bool) (uuid.UUID, error) {
+	return m.MockReverse(ctx, txnID, amount, reason, allowNegative)
+}
+func (m *mockService) CreateHold(ctx context.Context, walletID uuid.UUID, amount Money, ttl time.Duration) (*hold, error) {
+	return m.MockCreateHold(ctx, walletID, amount, ttl)
+}
+func (m *mockService) CaptureHold(ctx context.Context, holdID uuid.UUID, amount int64) (uuid.UUID, error) {
+	return m.MockCaptureHold(ctx, holdID, amount)
+}
+func (m *mockService) VoidHold(ctx context.Context, holdID uuid.UUID) error {
+	return m.MockVoidHold(ctx, holdID)
+}
+func (m *mockService) GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	return m.MockGetHold(ctx, holdID)
+}
+func (m *mockService) GetBalance(ctx context.Context, walletID uuid.UUID) (*Balance, error) {
+	return m.MockGetBalance(ctx, walletID)
+}
+func (m *mockService) PreviewFees(ctx context.Context, walletID uuid.UUID, txnType string, amount Money) (*FeePreview, error) {
+	return m.MockPreviewFees(ctx, walletID, txnType, amount)
+}
+func (m *mockService) GetTransactions(ctx context.Context, walletID uuid.UUID, filter TransactionFilter) (*TransactionPage, error) {
+	return m.MockGetTransactions(ctx, walletID, filter)
+}
+func (m *mockService) ChangeWalletState(ctx context.Context, walletID uuid.UUID, change WalletStateChange) (*wallet, error) {
+	return m.MockChangeWalletState(ctx, walletID, change)
+}
+func (m *mockService) GetWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error) {
+	return m.MockGetWalletStateEvents(ctx, walletID)
+}
+func (m *mockService) SetWalletLimits(ctx context.Context, walletID uuid.UUID, change WalletLimitsChange) (*wallet, error) {
+	return m.MockSetWalletLimits(ctx, walletID, change)
+}
+func (m *mockService) GetWalletLimits(ctx context.Context, walletID uuid.UUID) (*WalletLimits, error) {
+	return m.MockGetWalletLimits(ctx, walletID)
 }
-func (m *mockService) Deposit(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
-	return m.MockDeposit(walletID, amount)
+func (m *mockService) ListRevenueWallets(ctx context.Context) ([]wallet, error) {
+	return m.MockListRevenueWallets(ctx)
 }
-func (m *mockService) Withdraw(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
-	return m.MockWithdraw(walletID, amount)
+func (m *mockService) CreateWebhook(ctx context.Context, req WebhookRequest) (*webhookSubscription, error) {
+	return m.MockCreateWebhook(ctx, req)
 }
-func (m *mockService) Transfer(from uuid.UUID, to uuid.UUID, amount int64) (uuid.UUID, error) {
-	return m.MockTransfer(from, to, amount)
+func (m *mockService) GetWebhook(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error) {
+	return m.MockGetWebhook(ctx, subscriptionID)
 }
-func (m *mockService) GetBalance(walletID uuid.UUID) (int64, error) {
-	return m.MockGetBalance(walletID)
+func (m *mockService) ListWebhooks(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error) {
+	return m.MockListWebhooks(ctx, walletID, userID)
 }
-func (m *mockService) GetTransactions(walletID uuid.UUID) ([]transaction, error) {
-	return m.MockGetTransactions(walletID)
+func (m *mockService) UpdateWebhook(ctx context.Context, subscriptionID uuid.UUID, update WebhookUpdate) (*webhookSubscription, error) {
+	return m.MockUpdateWebhook(ctx, subscriptionID, update)
+}
+func (m *mockService) DeleteWebhook(ctx context.Context, subscriptionID uuid.UUID) error {
+	return m.MockDeleteWebhook(ctx, subscriptionID)
+}
+func (m *mockService) ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID) ([]webhookDelivery, error) {
+	return m.MockListWebhookDeliveries(ctx, subscriptionID)
+}
+func (m *mockService) ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error) {
+	return m.MockListWebhookAttempts(ctx, deliveryID)
+}
+func (m *mockService) ReplayWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	return m.MockReplayWebhookDelivery(ctx, deliveryID)
+}
+func (m *mockService) CreateSchedule(ctx context.Context, req ScheduleRequest) (*scheduledTransfer, error) {
+	return m.MockCreateSchedule(ctx, req)
+}
+func (m *mockService) GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return m.MockGetSchedule(ctx, scheduleID)
+}
+func (m *mockService) ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error) {
+	return m.MockListSchedules(ctx, walletID)
+}
+func (m *mockService) UpdateSchedule(ctx context.Context, scheduleID uuid.UUID, update ScheduleUpdate) (*scheduledTransfer, error) {
+	return m.MockUpdateSchedule(ctx, scheduleID, update)
+}
+func (m *mockService) CancelSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return m.MockCancelSchedule(ctx, scheduleID)
+}
+func (m *mockService) ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]scheduleRun, error) {
+	return m.MockListScheduleRuns(ctx, scheduleID)
+}
+func (m *mockService) GetStatement(ctx context.Context, walletID uuid.UUID, from, to time.Time) (*Statement, error) {
+	return m.MockGetStatement(ctx, walletID, from, to)
+}
+func (m *mockService) GetBalanceAt(ctx context.Context, walletID uuid.UUID, at time.Time) (Money, error) {
+	return m.MockGetBalanceAt(ctx, walletID, at)
+}
+
+func (m *mockService) GetInclusionProof(ctx context.Context, txnID uuid.UUID) (*InclusionProof, error) {
+	return m.MockGetProof(ctx, txnID)
+}
+func (m *mockService) ResourceOwners(ctx context.Context, kind string, id uuid.UUID) ([]uuid.UUID, error) {
+	return m.MockResourceOwners(ctx, kind, id)
+}
+
+func (m *mockService) IssueAPIClient(ctx context.Context, name string, scopes []string) (*IssuedAPIKey, error) {
+	return m.MockIssueAPIClient(ctx, name, scopes)
+}
+func (m *mockService) ListAPIClients(ctx context.Context) ([]apiClient, error) {
+	return m.MockListAPIClients(ctx)
+}
+func (m *mockService) RotateAPIKey(ctx context.Context, clientID uuid.UUID) (*IssuedAPIKey, error) {
+	return m.MockRotateAPIKey(ctx, clientID)
+}
+func (m *mockService) RevokeAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	return m.MockRevokeAPIClient(ctx, clientID)
+}
+
+// ForClient returns the mock itself, the client is not recorded.
+func (m *mockService) ForClient(uuid.UUID) Service {
+	return m
 }
@@ -1,32 +1,371 @@
 package wallet
 
 import (
+	"context"                // Request cancellation
+	"encoding/json"          // Raw JSON payloads
 	"github.com/google/uuid" // UUID type for unique IDs
 	"time"                   // To handle timestamps
 )
 
 // wallet struct represents a user's wallet with a unique ID, the owner's user ID, and current balance.
 type wallet struct {
-	ID      uuid.UUID `json:"id"`      // Unique wallet ID
-	UserID  uuid.UUID `json:"user_id"` // Owner's user ID
-	Balance int64     `json:"balance"` // Wallet balance (in smallest currency unit, e.g. cents)
+	ID              uuid.UUID `json:"id"`               // Unique wallet ID
+	UserID          uuid.UUID `json:"user_id"`          // Owner's user ID
+	Balance         int64     `json:"balance"`          // Wallet balance (in smallest currency unit, e.g. cents)
+	Currency        string    `json:"currency"`         // ISO 4217 currency of the wallet
+	Label           string    `json:"label,omitempty"`  // Optional name given by the user, e.g. "Holiday savings"
+	Type            string    `json:"type"`             // spending, savings, business or the internal revenue
+	Held            int64     `json:"held"`             // Sum of the active holds, reserved but not yet taken
+	Status          string    `json:"status"`           // active, frozen or closed
+	InboundBlocked  bool      `json:"inbound_blocked"`  // Wallet can not receive money
+	OutboundBlocked bool      `json:"outbound_blocked"` // Wallet can not send money
+	Tier            string    `json:"tier"`             // Limit tier, see LimitSchedule
+	LimitOverrides  []Limit   `json:"-"`                // Limits replacing those of the tier, see GetWalletLimits
+}
+
+// Available is the part of the balance that is not reserved by holds.
+func (w *wallet) Available() int64 {
+	return w.Balance - w.Held
+}
+
+// WalletStateChange is an admin request to change the status or blocks of a
+// wallet. Nil fields are left unchanged.
+type WalletStateChange struct {
+	Status          string // WalletActive, WalletFrozen, WalletClosed or empty
+	InboundBlocked  *bool
+	OutboundBlocked *bool
+	Actor           string // Who made the change
+	Reason          string // Why the change was made
+}
+
+// walletStateEvent is the audit record of one applied WalletStateChange.
+type walletStateEvent struct {
+	ID              uuid.UUID `json:"id"`               // Unique event ID
+	WalletID        uuid.UUID `json:"wallet_id"`        // Wallet that was changed
+	FromStatus      string    `json:"from_status"`      // Status before the change
+	ToStatus        string    `json:"to_status"`        // Status after the change
+	InboundBlocked  bool      `json:"inbound_blocked"`  // Inbound block after the change
+	OutboundBlocked bool      `json:"outbound_blocked"` // Outbound block after the change
+	Actor           string    `json:"actor"`            // Who made the change
+	Reason          string    `json:"reason"`           // Why the change was made
+	CreatedAt       time.Time `json:"created_at"`       // Timestamp of the change
+}
+
+// WalletLimitsChange is an admin request to change the limits of a wallet.
+// Empty or nil fields are left unchanged.
+type WalletLimitsChange struct {
+	Tier      string   // New limit tier
+	Overrides *[]Limit // Replaces all overrides of the wallet, an empty list removes them
+}
+
+// WalletLimits are the limits of a wallet and how much of them is used.
+type WalletLimits struct {
+	Tier      string       `json:"tier"`      // Limit tier of the wallet
+	Overrides []Limit      `json:"overrides"` // Wallet specific limits
+	Limits    []LimitUsage `json:"limits"`    // Every limit that applies, overrides first
+}
+
+// LimitUsage is a limit with what the wallet used of it in the current period.
+type LimitUsage struct {
+	Limit
+	UsedAmount int64      `json:"used_amount"`         // Total of the period so far
+	UsedCount  int64      `json:"used_count"`          // Transactions in the period so far
+	ResetsAt   *time.Time `json:"resets_at,omitempty"` // End of the period (nullable for per transaction limits)
+}
+
+// Balance is the ledger and available balance of a wallet.
+type Balance struct {
+	Ledger    Money // Posted balance, matches the journal
+	Available Money // Ledger balance minus active holds
+}
+
+// hold reserves part of a wallet balance until it is captured, voided or expires.
+type hold struct {
+	ID             uuid.UUID  `json:"id"`                       // Unique hold ID
+	WalletID       uuid.UUID  `json:"wallet_id"`                // Wallet the funds are reserved on
+	Amount         int64      `json:"amount"`                   // Reserved amount
+	Currency       string     `json:"currency"`                 // ISO 4217 currency of the amount
+	CapturedAmount int64      `json:"captured_amount"`          // Amount taken by the capture, the rest was released
+	Status         string     `json:"status"`                   // active, captured, voided or expired
+	ExpiresAt      time.Time  `json:"expires_at"`               // Hold is released after this
+	TransactionID  *uuid.UUID `json:"transaction_id,omitempty"` // Capture transaction
+	CreatedAt      time.Time  `json:"created_at"`               // Timestamp of the hold
+	UpdatedAt      time.Time  `json:"updated_at"`               // Timestamp of the last status change
+}
+
+// webhookSubscription sends the events of one wallet, or of every wallet of
+// one user, to a URL.
+type webhookSubscription struct {
+	ID         uuid.UUID  `json:"id"`                  // Unique subscription ID
+	WalletID   *uuid.UUID `json:"wallet_id,omitempty"` // Wallet whose events are sent (nullable for user subscriptions)
+	UserID     *uuid.UUID `json:"user_id,omitempty"`   // User whose wallets' events are sent (nullable for wallet subscriptions)
+	URL        string     `json:"url"`                 // Where events are POSTed
+	EventTypes []string   `json:"event_types"`         // Events sent, all when empty
+	Secret     string     `json:"secret,omitempty"`    // HMAC key of the signature, only returned when created
+	Active     bool       `json:"active"`              // Inactive subscriptions get no new deliveries
+	CreatedAt  time.Time  `json:"created_at"`          // Timestamp of the subscription
+	UpdatedAt  time.Time  `json:"updated_at"`          // Timestamp of the last change
+}
+
+// WebhookRequest creates a webhook subscription for either a wallet or a user.
+type WebhookRequest struct {
+	WalletID   *uuid.UUID
+	UserID     *uuid.UUID
+	URL        string
+	EventTypes []string // All events when empty
+	Secret     string   // Generated when empty
+}
+
+// WebhookUpdate changes a webhook subscription. Nil or empty fields are left unchanged.
+type WebhookUpdate struct {
+	URL        string
+	EventTypes *[]string // An empty list subscribes to all events
+	Secret     string
+	Active     *bool
+}
+
+// webhookDelivery is one event to be sent to one subscription.
+type webhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`                   // Unique delivery ID, sent in the X-Webhook-Delivery header
+	SubscriptionID uuid.UUID       `json:"subscription_id"`      // Subscription the event is sent to
+	EventID        uuid.UUID       `json:"event_id"`             // Outbox event that is sent
+	EventType      string          `json:"event_type"`           // Type of the event
+	Payload        json.RawMessage `json:"payload"`              // Request body, the event as JSON
+	Status         string          `json:"status"`               // pending, delivered or dead
+	Attempts       int             `json:"attempts"`             // Failed attempts since the delivery was created or replayed
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`      // When a pending delivery is sent next
+	LastError      string          `json:"last_error,omitempty"` // Why the last attempt failed
+	CreatedAt      time.Time       `json:"created_at"`           // Timestamp of the delivery
+	UpdatedAt      time.Time       `json:"updated_at"`           // Timestamp of the last attempt or replay
+	ClaimID        *uuid.UUID      `json:"-"`                    // Set while a dispatcher sends the delivery
+}
+
+// webhookAttempt is the log entry of one attempt to send a delivery.
+type webhookAttempt struct {
+	ID         uuid.UUID `json:"id"`                    // Unique attempt ID
+	DeliveryID uuid.UUID `json:"delivery_id"`           // Delivery that was sent
+	StatusCode int       `json:"status_code,omitempty"` // HTTP status of the response (zero when there was none)
+	Error      string    `json:"error,omitempty"`       // Why the attempt failed
+	DurationMs int64     `json:"duration_ms"`           // How long the request took
+	CreatedAt  time.Time `json:"created_at"`            // Timestamp of the attempt
+}
+
+// scheduledTransfer is a standing order moving a fixed amount between two
+// wallets on a schedule.
+type scheduledTransfer struct {
+	ID            uuid.UUID  `json:"id"`                        // Unique schedule ID
+	FromWallet    uuid.UUID  `json:"from_wallet"`               // Wallet to debit
+	ToWallet      uuid.UUID  `json:"to_wallet"`                 // Wallet to credit
+	Amount        int64      `json:"amount"`                    // Amount per run in minor units of Currency
+	Currency      string     `json:"currency"`                  // ISO 4217 currency of the sender
+	Frequency     string     `json:"frequency"`                 // once, daily, weekly, monthly or cron
+	Cron          string     `json:"cron,omitempty"`            // Five field cron expression for cron schedules
+	StartAt       time.Time  `json:"start_at"`                  // First run, and the anchor of daily, weekly and monthly runs
+	EndAt         *time.Time `json:"end_at,omitempty"`          // No run after this time (nullable)
+	MaxRuns       int        `json:"max_runs,omitempty"`        // Completed after this many successful runs, unlimited when zero
+	RunCount      int        `json:"run_count"`                 // Successful runs so far
+	Status        string     `json:"status"`                    // active, paused, completed or canceled
+	NextRunAt     *time.Time `json:"next_run_at,omitempty"`     // Scheduled time of the next run (nullable once finished)
+	Attempts      int        `json:"attempts"`                  // Failed attempts of the next run
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // When the next run is tried, later than NextRunAt while retrying
+	CreatedAt     time.Time  `json:"created_at"`                // Timestamp of the schedule
+	UpdatedAt     time.Time  `json:"updated_at"`                // Timestamp of the last change or run
+}
+
+// ScheduleRequest creates a scheduled transfer.
+type ScheduleRequest struct {
+	FromWallet uuid.UUID
+	ToWallet   uuid.UUID
+	Amount     Money
+	Frequency  string
+	Cron       string     // Required for cron schedules only
+	StartAt    time.Time  // Now when zero
+	EndAt      *time.Time // Runs forever when nil
+	MaxRuns    int        // Unlimited when zero
+}
+
+// ScheduleUpdate changes a scheduled transfer. Nil fields are left unchanged.
+type ScheduleUpdate struct {
+	Amount  *int64     // New amount in the schedule currency
+	EndAt   *time.Time // New end date, the zero time removes it
+	MaxRuns *int       // New maximum runs, zero removes it
+	Status  string     // active or paused, unchanged when empty
+}
+
+// scheduleRun is one attempt to run a scheduled transfer.
+type scheduleRun struct {
+	ID             uuid.UUID  `json:"id"`                        // Unique run ID
+	ScheduleID     uuid.UUID  `json:"schedule_id"`               // Schedule that ran
+	ScheduledFor   time.Time  `json:"scheduled_for"`             // Scheduled time of the run
+	Attempt        int        `json:"attempt"`                   // 1 for the first attempt of a run
+	Status         string     `json:"status"`                    // succeeded, failed or skipped
+	IdempotencyKey string     `json:"idempotency_key,omitempty"` // Key of the run, only stored on the run that moved money
+	TransactionID  *uuid.UUID `json:"transaction_id,omitempty"`  // Transfer made by a succeeded run
+	Error          string     `json:"error,omitempty"`           // Why the attempt failed
+	CreatedAt      time.Time  `json:"created_at"`                // Timestamp of the attempt
+}
+
+// apiClient is a server-to-server caller that signs its requests with an API
+// key. Only the SHA-256 of the key is stored.
+type apiClient struct {
+	ID               uuid.UUID  `json:"id"`                   // Client ID, sent in the X-Client-ID header
+	Name             string     `json:"name"`                 // Who the client is, e.g. the calling service
+	Scopes           []string   `json:"scopes"`               // read, deposit, withdraw, transfer or admin
+	KeyPrefix        string     `json:"key_prefix"`           // Start of the current key, to tell keys apart
+	KeySeed          string     `json:"-"`                    // Hex random seed the current key is derived from with the pepper
+	PrevKeySeed      string     `json:"-"`                    // Hex seed of the key replaced by the last rotation
+	PrevKeyExpiresAt *time.Time `json:"-"`                    // The replaced key is accepted until this time
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"` // No request is accepted after a revocation
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+// IssuedAPIKey is a client with its new API key. The key is only returned
+// here, when it is issued or rotated.
+type IssuedAPIKey struct {
+	Client *apiClient `json:"client"`
+	APIKey string     `json:"api_key"`
 }
 
 // transaction struct represents a record of money movement involving wallets.
 type transaction struct {
-	ID         uuid.UUID  `json:"id"`          // Unique transaction ID
-	FromWallet *uuid.UUID `json:"from_wallet"` // Wallet sending money (nullable for deposits)
-	ToWallet   *uuid.UUID `json:"to_wallet"`   // Wallet receiving money (nullable for withdrawals)
-	Amount     int64      `json:"amount"`      // transaction amount
-	Type       string     `json:"type"`        // Type of transaction: deposit, withdrawal, transfer
-	CreatedAt  time.Time  `json:"created_at"`  // Timestamp of the transaction
+	ID         uuid.UUID     `json:"id"`                        // Unique transaction ID
+	FromWallet *uuid.UUID    `json:"from_wallet"`               // Wallet sending money (nullable for deposits)
+	ToWallet   *uuid.UUID    `json:"to_wallet"`                 // Wallet receiving money (nullable for withdrawals)
+	Amount     int64         `json:"amount"`                    // transaction amount
+	Currency   string        `json:"currency"`                  // ISO 4217 currency of the amount
+	Type       string        `json:"type"`                      // Type of transaction: deposit, withdrawal, transfer, capture, reversal
+	CreatedAt  time.Time     `json:"created_at"`                // Timestamp of the transaction
+	FX         *fxConversion `json:"fx,omitempty"`              // Currency conversion of a cross-currency transfer
+	ReversesID *uuid.UUID    `json:"reverses_id,omitempty"`     // Transaction compensated by a reversal
+	Reason     string        `json:"reason,omitempty"`          // Why a reversal was made
+	Reversed   int64         `json:"reversed_amount,omitempty"` // Part of the amount already reversed
+	Fees       []feeItem     `json:"fees,omitempty"`            // Fees charged to the sender on top of the amount
+	ChainSeq   int64         `json:"-"`                         // Position in the hash chain, 0 for rows older than the chain
+	PrevHash   string        `json:"-"`                         // Hash of the previous link of the chain
+	Hash       string        `json:"-"`                         // SHA-256 over the canonical fields and PrevHash, see linkHash
+	ClientID   *uuid.UUID    `json:"client_id,omitempty"`       // API client that made the transaction (nullable for users and background jobs)
+}
+
+// feeItem is one fee charged on a transaction.
+type feeItem struct {
+	Name     string `json:"name"`     // Name of the fee rule
+	Amount   int64  `json:"amount"`   // Fee in minor units
+	Currency string `json:"currency"` // Always the currency of the transaction amount
+}
+
+// FeePreview is the fee that a withdrawal or transfer would be charged.
+type FeePreview struct {
+	Amount     Money     `json:"amount"`      // Amount of the previewed transaction
+	Fees       []feeItem `json:"fees"`        // Fee items that would be charged
+	TotalFee   Money     `json:"total_fee"`   // Sum of the fee items
+	TotalDebit Money     `json:"total_debit"` // Amount plus fees taken from the wallet
+}
+
+// fxConversion records how the amount of a cross-currency transfer was converted.
+// The source side is the amount and currency of the transaction itself.
+type fxConversion struct {
+	QuoteID        *uuid.UUID `json:"quote_id,omitempty"` // Executed quote (nullable when converted at the spot rate)
+	Rate           string     `json:"rate"`               // Target major units per source major unit
+	RoundingMode   string     `json:"rounding_mode"`      // How the target amount was rounded to minor units
+	SourceAmount   int64      `json:"source_amount"`      // Amount debited from the sender
+	SourceCurrency string     `json:"source_currency"`    // Currency of the sender
+	TargetAmount   int64      `json:"target_amount"`      // Amount credited to the receiver
+	TargetCurrency string     `json:"target_currency"`    // Currency of the receiver
+}
+
+// fxQuote is a priced cross-currency transfer that can be executed once before it expires.
+type fxQuote struct {
+	ID            uuid.UUID  `json:"id"`                       // Unique quote ID
+	FromWallet    uuid.UUID  `json:"from_wallet"`              // Wallet to debit
+	ToWallet      uuid.UUID  `json:"to_wallet"`                // Wallet to credit
+	Source        Money      `json:"source"`                   // Amount debited from the sender
+	Target        Money      `json:"target"`                   // Amount credited to the receiver
+	Rate          string     `json:"rate"`                     // Target major units per source major unit
+	RoundingMode  string     `json:"rounding_mode"`            // How the target amount was rounded
+	ExpiresAt     time.Time  `json:"expires_at"`               // Quote can not be executed after this
+	TransactionID *uuid.UUID `json:"transaction_id,omitempty"` // Set once the quote is executed
+	CreatedAt     time.Time  `json:"created_at"`               // Timestamp of the quote
+}
+
+// ledgerEntry struct represents one line of the double-entry journal.
+type ledgerEntry struct {
+	ID            uuid.UUID `json:"id"`             // Unique entry ID
+	TransactionID uuid.UUID `json:"transaction_id"` // transaction the entry belongs to
+	AccountID     uuid.UUID `json:"account_id"`     // Wallet ID or internal ledger account ID
+	Direction     string    `json:"direction"`      // debit or credit
+	Amount        int64     `json:"amount"`         // Entry amount, always positive
+	Currency      string    `json:"currency"`       // ISO 4217 currency of the amount
+}
+
+// walletLedgerBalance is the stored balance of a wallet next to the balance
+// derived from its journal lines.
+type walletLedgerBalance struct {
+	WalletID uuid.UUID
+	Currency string
+	Balance  int64 // wallets.balance
+	Held     int64 // wallets.held
+	Ledger   int64 // Credits minus debits posted to the wallet in its currency
+}
+
+// balanceSnapshot is the ledger balance of a wallet at a point in time, after
+// every transaction created before AsOf.
+type balanceSnapshot struct {
+	WalletID  uuid.UUID
+	Currency  string
+	AsOf      time.Time
+	Balance   int64
+	CreatedAt time.Time
+}
+
+// accountMovement is the net change a transaction made to one account.
+type accountMovement struct {
+	Transaction transaction
+	Change      int64 // Credits minus debits posted to the account by the transaction
 }
 
 type Service interface {
-	CreateWallet(userID uuid.UUID) (*wallet, error)
-	Deposit(walletID uuid.UUID, amount int64) (uuid.UUID, error)
-	Withdraw(walletID uuid.UUID, amount int64) (uuid.UUID, error)
-	Transfer(fromID, toID uuid.UUID, amount int64) (uuid.UUID, error)
-	GetBalance(walletID uuid.UUID) (int64, error)
-	GetTransactions(walletID uuid.UUID) ([]transaction, error)
+	CreateWallet(ctx context.Context, userID uuid.UUID, currency, label, walletType string) (*wallet, error)
+	ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error)
+	Deposit(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error)
+	Withdraw(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error)
+	Transfer(ctx context.Context, fromID, toID uuid.UUID, amount Money) (uuid.UUID, error)
+	QuoteTransfer(ctx context.Context, fromID, toID uuid.UUID, amount Money) (*fxQuote, error)
+	ExecuteQuote(ctx context.Context, quoteID uuid.UUID) (uuid.UUID, error)
+	Reverse(ctx context.Context, txnID uuid.UUID, amount int64, reason string, allowNegative bool) (uuid.UUID, error)
+	ChangeWalletState(ctx context.Context, walletID uuid.UUID, change WalletStateChange) (*wallet, error)
+	GetWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error)
+	SetWalletLimits(ctx context.Context, walletID uuid.UUID, change WalletLimitsChange) (*wallet, error)
+	GetWalletLimits(ctx context.Context, walletID uuid.UUID) (*WalletLimits, error)
+	ListRevenueWallets(ctx context.Context) ([]wallet, error)
+	CreateWebhook(ctx context.Context, req WebhookRequest) (*webhookSubscription, error)
+	GetWebhook(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error)
+	ListWebhooks(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error)
+	UpdateWebhook(ctx context.Context, subscriptionID uuid.UUID, update WebhookUpdate) (*webhookSubscription, error)
+	DeleteWebhook(ctx context.Context, subscriptionID uuid.UUID) error
+	ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID) ([]webhookDelivery, error)
+	ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error)
+	ReplayWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error)
+	CreateSchedule(ctx context.Context, req ScheduleRequest) (*scheduledTransfer, error)
+	GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error)
+	ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error)
+	UpdateSchedule(ctx context.Context, scheduleID uuid.UUID, update ScheduleUpdate) (*scheduledTransfer, error)
+	CancelSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error)
+	ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]scheduleRun, error)
+	CreateHold(ctx context.Context, walletID uuid.UUID, amount Money, ttl time.Duration) (*hold, error)
+	CaptureHold(ctx context.Context, holdID uuid.UUID, amount int64) (uuid.UUID, error)
+	VoidHold(ctx context.Context, holdID uuid.UUID) error
+	GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error)
+	GetBalance(ctx context.Context, walletID uuid.UUID) (*Balance, error)
+	GetBalanceAt(ctx context.Context, walletID uuid.UUID, at time.Time) (Money, error)
+	GetInclusionProof(ctx context.Context, txnID uuid.UUID) (*InclusionProof, error)
+	PreviewFees(ctx context.Context, walletID uuid.UUID, txnType string, amount Money) (*FeePreview, error)
+	GetTransactions(ctx context.Context, walletID uuid.UUID, filter TransactionFilter) (*TransactionPage, error)
+	GetStatement(ctx context.Context, walletID uuid.UUID, from, to time.Time) (*Statement, error)
+	ResourceOwners(ctx context.Context, kind string, id uuid.UUID) ([]uuid.UUID, error)
+	IssueAPIClient(ctx context.Context, name string, scopes []string) (*IssuedAPIKey, error)
+	ListAPIClients(ctx context.Context) ([]apiClient, error)
+	RotateAPIKey(ctx context.Context, clientID uuid.UUID) (*IssuedAPIKey, error)
+	RevokeAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error)
+	ForClient(clientID uuid.UUID) Service
 }
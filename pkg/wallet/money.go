@@ -0,0 +1,122 @@
+package wallet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// currencyExponents lists the ISO 4217 currencies the wallet supports and the
+// number of minor units (digits after the decimal point) of each.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"IDR": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MYR": 2,
+	"NZD": 2,
+	"OMR": 3,
+	"PHP": 2,
+	"SGD": 2,
+	"THB": 2,
+	"USD": 2,
+	"VND": 0,
+}
+
+// Money is an amount in the minor unit of its currency, e.g. cents for USD,
+// yen for JPY and fils for KWD.
+type Money struct {
+	Amount   int64  `json:"amount"`   // Amount in minor units
+	Currency string `json:"currency"` // ISO 4217 currency code
+}
+
+// NormalizeCurrency upper-cases a currency code and checks that it is supported.
+func NormalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return "", ErrCurrencyRequired
+	}
+	if _, ok := currencyExponents[code]; !ok {
+		return "", ErrUnsupportedCurrency
+	}
+	return code, nil
+}
+
+// CurrencyExponent returns the number of minor-unit digits of a currency.
+func CurrencyExponent(code string) (int, error) {
+	code, err := NormalizeCurrency(code)
+	if err != nil {
+		return 0, err
+	}
+	return currencyExponents[code], nil
+}
+
+// NewMoney builds a Money value in minor units after validating the currency.
+func NewMoney(amount int64, currency string) (Money, error) {
+	code, err := NormalizeCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: code}, nil
+}
+
+// ParseMoney parses a decimal amount in major units, e.g. "12.50" USD becomes
+// 1250. More decimal places than the currency allows are rejected.
+func ParseMoney(decimal, currency string) (Money, error) {
+	exp, err := CurrencyExponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	decimal = strings.TrimSpace(decimal)
+	negative := strings.HasPrefix(decimal, "-")
+	decimal = strings.TrimPrefix(decimal, "-")
+
+	whole, frac, _ := strings.Cut(decimal, ".")
+	if whole == "" || len(frac) > exp {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidDecimal, decimal)
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+
+	amount, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidDecimal, decimal)
+	}
+	if negative {
+		amount = -amount
+	}
+	return NewMoney(amount, currency)
+}
+
+// Decimal formats the amount in major units, e.g. 1250 USD becomes "12.50".
+func (m Money) Decimal() string {
+	exp := currencyExponents[m.Currency]
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	digits := strconv.FormatInt(amount, 10)
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String formats the amount with its currency, e.g. "12.50 USD".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
@@ -0,0 +1,60 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeCurrency(t *testing.T) {
+	code, err := NormalizeCurrency(" usd ")
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", code)
+
+	_, err = NormalizeCurrency("")
+	assert.Equal(t, ErrCurrencyRequired, err)
+
+	_, err = NormalizeCurrency("XYZ")
+	assert.Equal(t, ErrUnsupportedCurrency, err)
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		decimal  string
+		currency string
+		want     int64
+	}{
+		{"12.50", "USD", 1250},
+		{"12.5", "usd", 1250},
+		{"12", "USD", 1200},
+		{"0.01", "EUR", 1},
+		{"1500", "JPY", 1500},
+		{"1.234", "KWD", 1234},
+		{"-3.10", "USD", -310},
+	}
+	for _, tt := range tests {
+		m, err := ParseMoney(tt.decimal, tt.currency)
+		assert.NoError(t, err, tt.decimal)
+		assert.Equal(t, tt.want, m.Amount, tt.decimal)
+	}
+
+	// More decimal places than the currency has minor units
+	_, err := ParseMoney("1.5", "JPY")
+	assert.True(t, errors.Is(err, ErrInvalidDecimal))
+	_, err = ParseMoney("1.005", "USD")
+	assert.True(t, errors.Is(err, ErrInvalidDecimal))
+	_, err = ParseMoney("abc", "USD")
+	assert.True(t, errors.Is(err, ErrInvalidDecimal))
+	_, err = ParseMoney("1.00", "XYZ")
+	assert.Equal(t, ErrUnsupportedCurrency, err)
+}
+
+func TestMoney_Decimal(t *testing.T) {
+	assert.Equal(t, "12.50", Money{Amount: 1250, Currency: "USD"}.Decimal())
+	assert.Equal(t, "0.05", Money{Amount: 5, Currency: "USD"}.Decimal())
+	assert.Equal(t, "-0.05", Money{Amount: -5, Currency: "USD"}.Decimal())
+	assert.Equal(t, "1500", Money{Amount: 1500, Currency: "JPY"}.Decimal())
+	assert.Equal(t, "1.234", Money{Amount: 1234, Currency: "KWD"}.Decimal())
+	assert.Equal(t, "12.50 USD", Money{Amount: 1250, Currency: "USD"}.String())
+}
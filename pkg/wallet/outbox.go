@@ -0,0 +1,232 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event is a domain event written to the outbox in the same transaction as the
+// change it describes.
+type Event struct {
+	ID        uuid.UUID       `json:"id"`            // Unique event ID, lets consumers drop duplicates
+	Seq       int64           `json:"seq,omitempty"` // Position in the outbox, see OutboxRelay
+	Type      string          `json:"type"`          // WalletCreated, FundsDeposited, FundsWithdrawn, FundsTransferred, HoldCaptured or FundsReversed
+	WalletID  uuid.UUID       `json:"wallet_id"`     // Wallet the event is about, the sender for transfers
+	Payload   json.RawMessage `json:"payload"`       // The created wallet or the transaction
+	CreatedAt time.Time       `json:"created_at"`    // Timestamp of the change
+
+	ClaimedUntil *time.Time `json:"-"` // Set while a relay publishes the event
+}
+
+// recordEvent writes an event about walletID to the outbox through q and
+// queues its webhook deliveries.
+func recordEvent(ctx context.Context, q Queries, eventType string, walletID uuid.UUID, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	e := &Event{ID: uuid.New(), Type: eventType, WalletID: walletID, Payload: data, CreatedAt: time.Now()}
+	if err := q.InsertEvent(ctx, e); err != nil {
+		return err
+	}
+	return enqueueWebhooks(ctx, q, e)
+}
+
+// Publisher delivers outbox events downstream. Publish must only return nil
+// once the event is accepted; an event may be published more than once.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// PublishEvents publishes unpublished outbox events in order and returns how
+// many were published. It stops at the first event the publisher refuses, so a
+// later event is never published before an earlier one. A batch is claimed in
+// one short transaction, published with no transaction open and marked as
+// published in a second one; if that fails the events are published again
+// once the claim has run out.
+func (s *service) PublishEvents(ctx context.Context, publisher Publisher) (int, error) {
+	published := 0
+	for {
+		now := time.Now()
+		until := now.Add(outboxClaimTTL)
+		events, full, err := s.claimEvents(ctx, now, until)
+		if err != nil || len(events) == 0 {
+			return published, err
+		}
+
+		// Stop publishing before another relay may take the batch over
+		publishCtx, cancel := context.WithDeadline(ctx, until)
+		var seqs []int64
+		var publishErr error
+		for _, e := range events {
+			if publishErr = publisher.Publish(publishCtx, e); publishErr != nil {
+				break
+			}
+			seqs = append(seqs, e.Seq)
+		}
+		cancel()
+
+		err = s.repo.RunInTx(ctx, func(q Queries) error {
+			if len(seqs) > 0 {
+				if err := q.MarkEventsPublished(ctx, seqs, time.Now()); err != nil {
+					return err
+				}
+			}
+			// Hand what was not published back to the next run
+			if rest := events[len(seqs):]; len(rest) > 0 {
+				var restSeqs []int64
+				for _, e := range rest {
+					restSeqs = append(restSeqs, e.Seq)
+				}
+				return q.ClaimEvents(ctx, restSeqs, time.Now())
+			}
+			return nil
+		})
+		if err != nil {
+			return published, err
+		}
+		published += len(seqs)
+
+		if publishErr != nil || !full {
+			return published, publishErr
+		}
+	}
+}
+
+// claimEvents claims the oldest unpublished events until the given time and
+// returns them in order, and whether the batch was full. It claims nothing
+// while another relay holds an earlier event, so a batch is never published
+// ahead of the one before it.
+func (s *service) claimEvents(ctx context.Context, now, until time.Time) ([]Event, bool, error) {
+	var events []Event
+	var full bool
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		locked, err := q.LockUnpublishedEvents(ctx, outboxBatchSize)
+		if err != nil {
+			return err
+		}
+		full = len(locked) == outboxBatchSize
+
+		events = nil
+		var seqs []int64
+		for _, e := range locked {
+			if e.ClaimedUntil != nil && e.ClaimedUntil.After(now) {
+				full = false
+				break
+			}
+			events = append(events, e)
+			seqs = append(seqs, e.Seq)
+		}
+		if len(seqs) == 0 {
+			return nil
+		}
+		return q.ClaimEvents(ctx, seqs, until)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return events, full, nil
+}
+
+// eventPublisher is the part of the service used by the OutboxRelay.
+type eventPublisher interface {
+	PublishEvents(ctx context.Context, publisher Publisher) (int, error)
+}
+
+// OutboxRelay periodically publishes the outbox. Events about one wallet are
+// published in the order they were committed, and every event is published at
+// least once.
+type OutboxRelay struct {
+	events    eventPublisher
+	publisher Publisher
+	interval  time.Duration
+}
+
+// NewOutboxRelay initializes a relay that publishes events every interval.
+func NewOutboxRelay(events eventPublisher, publisher Publisher, interval time.Duration) *OutboxRelay {
+	return &OutboxRelay{events: events, publisher: publisher, interval: interval}
+}
+
+// Run publishes the outbox every interval until ctx is canceled.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.events.PublishEvents(ctx, r.publisher); err != nil {
+				log.Printf("Outbox relay error: %v", err)
+			}
+		}
+	}
+}
+
+// memoryPublisher keeps published events in memory, for tests and local demos.
+type memoryPublisher struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewMemoryPublisher initializes an empty in-memory Publisher.
+func NewMemoryPublisher() *memoryPublisher {
+	return &memoryPublisher{}
+}
+
+func (p *memoryPublisher) Publish(ctx context.Context, e Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, e)
+	return nil
+}
+
+// Events returns the published events in publishing order.
+func (p *memoryPublisher) Events() []Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+// filePublisher appends events to a file as newline delimited JSON.
+type filePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFilePublisher opens path for appending, creating it if needed, and
+// returns a Publisher writing one JSON event per line.
+func NewFilePublisher(path string) (*filePublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &filePublisher{file: f}, nil
+}
+
+// Publish writes the event and syncs the file, so an event reported as
+// published survives a crash.
+func (p *filePublisher) Publish(ctx context.Context, e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return p.file.Sync()
+}
+
+// Close closes the file.
+func (p *filePublisher) Close() error {
+	return p.file.Close()
+}
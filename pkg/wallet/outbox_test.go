@@ -0,0 +1,190 @@
+package wallet
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPublisher accepts a number of events and then refuses every other one.
+type failingPublisher struct {
+	accept int
+	memoryPublisher
+}
+
+func (p *failingPublisher) Publish(ctx context.Context, e Event) error {
+	if p.accept == 0 {
+		return assert.AnError
+	}
+	p.accept--
+	return p.memoryPublisher.Publish(ctx, e)
+}
+
+// publisherFunc publishes events by calling itself.
+type publisherFunc func(ctx context.Context, e Event) error
+
+func (f publisherFunc) Publish(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+func TestService_EventsWrittenWithChanges(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+
+	_, err := svc.Withdraw(ctx, fromID, usd(100))
+	assert.NoError(t, err)
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(200))
+	assert.NoError(t, err)
+
+	// Refused requests roll back their event with everything else
+	_, err = svc.Withdraw(ctx, fromID, usd(5000))
+	assert.Equal(t, ErrInsufficientFunds, err)
+
+	var types []string
+	for _, e := range repo.outbox {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{EventWalletCreated, EventFundsDeposited, EventWalletCreated, EventFundsWithdrawn, EventFundsTransferred}, types)
+
+	transferred := repo.outbox[4]
+	assert.Equal(t, fromID, transferred.WalletID)
+	var txn transaction
+	assert.NoError(t, json.Unmarshal(transferred.Payload, &txn))
+	assert.Equal(t, txnID, txn.ID)
+	assert.Equal(t, toID, *txn.ToWallet)
+}
+
+func TestService_PublishEvents(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	for i := 0; i < 3; i++ {
+		_, err := svc.Withdraw(ctx, walletID, usd(10))
+		assert.NoError(t, err)
+	}
+
+	// Publishing stops at the first refused event and resumes from it
+	publisher := &failingPublisher{accept: 2}
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.Equal(t, assert.AnError, err)
+	assert.Equal(t, 2, n)
+
+	publisher.accept = 10
+	n, err = svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	var seqs []int64
+	for _, e := range publisher.Events() {
+		seqs = append(seqs, e.Seq)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, seqs)
+
+	// Nothing is left to publish
+	n, err = svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestService_PublishEventsClaimed(t *testing.T) {
+	svc, repo := newMemoryService()
+	fundedWallet(t, svc, 1000)
+
+	// Another relay is publishing the first event, the second waits for it
+	claimed := time.Now().Add(time.Minute)
+	repo.outbox[0].ClaimedUntil = &claimed
+	publisher := NewMemoryPublisher()
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Once the claim has run out the batch is taken over
+	expired := time.Now().Add(-time.Second)
+	repo.outbox[0].ClaimedUntil = &expired
+	n, err = svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestService_PublishEventsOutsideTransaction(t *testing.T) {
+	svc, repo := newMemoryService()
+	fundedWallet(t, svc, 1000)
+
+	// The memory repository holds its lock during a transaction, so a
+	// publisher that reads it would deadlock if it ran inside one
+	publisher := publisherFunc(func(ctx context.Context, e Event) error {
+		_, err := repo.WalletExists(ctx, e.WalletID)
+		return err
+	})
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestService_PublishEventsInBatches(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 10000)
+	for i := 0; i < outboxBatchSize; i++ {
+		_, err := svc.Withdraw(ctx, walletID, usd(1))
+		assert.NoError(t, err)
+	}
+
+	publisher := NewMemoryPublisher()
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, outboxBatchSize+2, n)
+	assert.Len(t, publisher.Events(), outboxBatchSize+2)
+}
+
+func TestOutboxRelay_Run(t *testing.T) {
+	svc, _ := newMemoryService()
+	fundedWallet(t, svc, 1000)
+	publisher := NewMemoryPublisher()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewOutboxRelay(svc, publisher, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		return len(publisher.Events()) == 2
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	svc, _ := newMemoryService()
+	fundedWallet(t, svc, 1000)
+
+	publisher, err := NewFilePublisher(path)
+	assert.NoError(t, err)
+	_, err = svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.NoError(t, publisher.Close())
+
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{EventWalletCreated, EventFundsDeposited}, types)
+}
@@ -0,0 +1,159 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// page sizes of the transaction history.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// directions of a transaction relative to the wallet whose history is read.
+const (
+	DirectionIn  = "in"  // the wallet received the money
+	DirectionOut = "out" // the wallet sent the money
+)
+
+// TransactionFilter narrows and pages the transaction history of a wallet.
+// Zero values mean "no filter".
+type TransactionFilter struct {
+	Type         string     // deposit, withdrawal, transfer, capture or reversal
+	Direction    string     // DirectionIn or DirectionOut
+	MinAmount    int64      // Smallest amount, inclusive
+	MaxAmount    int64      // Largest amount, inclusive
+	Since        time.Time  // Earliest created_at, inclusive
+	Until        time.Time  // Latest created_at, exclusive
+	Counterparty *uuid.UUID // The other wallet of a transfer
+	Cursor       string     // next_cursor of the previous page
+	Limit        int        // Page size, DefaultPageSize when zero
+}
+
+// TransactionPage is one page of the transaction history, newest first.
+type TransactionPage struct {
+	Transactions []transaction `json:"transactions"`          // Transactions on this page
+	NextCursor   string        `json:"next_cursor,omitempty"` // Pass as cursor to read the next page, empty on the last page
+}
+
+// txnCursor is the keyset position of the last transaction on a page.
+// Pages are ordered by (created_at, id) descending.
+type txnCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// transactionQuery is a validated TransactionFilter as passed to the repository.
+type transactionQuery struct {
+	TransactionFilter
+	After *txnCursor // Only return transactions ordered after this one
+}
+
+// encode turns the cursor into an opaque URL-safe string.
+func (c txnCursor) encode() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor parses a cursor made by encode.
+func decodeCursor(s string) (*txnCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &txnCursor{CreatedAt: time.Unix(0, n).UTC(), ID: parsed}, nil
+}
+
+// before reports whether txn sorts before the cursor, i.e. belongs on a later page.
+func (c txnCursor) before(txn transaction) bool {
+	if !txn.CreatedAt.Equal(c.CreatedAt) {
+		return txn.CreatedAt.Before(c.CreatedAt)
+	}
+	return bytes.Compare(txn.ID[:], c.ID[:]) < 0
+}
+
+// validate checks the filter and resolves its cursor and page size.
+func (f TransactionFilter) validate() (transactionQuery, error) {
+	q := transactionQuery{TransactionFilter: f}
+	switch f.Type {
+	case "", TxnTypeDeposit, TxnTypeWithdrawal, TxnTypeTransfer, TxnTypeCapture, TxnTypeReversal:
+	default:
+		return q, fmt.Errorf("%w: unknown type %q", ErrInvalidFilter, f.Type)
+	}
+	switch f.Direction {
+	case "", DirectionIn, DirectionOut:
+	default:
+		return q, fmt.Errorf("%w: direction must be %q or %q", ErrInvalidFilter, DirectionIn, DirectionOut)
+	}
+	if f.MinAmount < 0 || f.MaxAmount < 0 || (f.MaxAmount > 0 && f.MinAmount > f.MaxAmount) {
+		return q, fmt.Errorf("%w: invalid amount range", ErrInvalidFilter)
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return q, fmt.Errorf("%w: invalid date range", ErrInvalidFilter)
+	}
+	if f.Limit < 0 || f.Limit > MaxPageSize {
+		return q, fmt.Errorf("%w: limit must be between 1 and %d", ErrInvalidFilter, MaxPageSize)
+	}
+	if f.Limit == 0 {
+		q.Limit = DefaultPageSize
+	}
+	if f.Cursor != "" {
+		after, err := decodeCursor(f.Cursor)
+		if err != nil {
+			return q, err
+		}
+		q.After = after
+	}
+	return q, nil
+}
+
+// matches reports whether a transaction of walletID passes the filter and
+// sorts after the cursor. It is used by the in-memory repository.
+func (q transactionQuery) matches(walletID uuid.UUID, txn transaction) bool {
+	in := txn.ToWallet != nil && *txn.ToWallet == walletID
+	out := txn.FromWallet != nil && *txn.FromWallet == walletID
+	switch q.Direction {
+	case DirectionIn:
+		out = false
+	case DirectionOut:
+		in = false
+	}
+	if !in && !out {
+		return false
+	}
+	if q.Counterparty != nil {
+		cp := *q.Counterparty
+		if !(in && txn.FromWallet != nil && *txn.FromWallet == cp) && !(out && txn.ToWallet != nil && *txn.ToWallet == cp) {
+			return false
+		}
+	}
+	if q.Type != "" && txn.Type != q.Type {
+		return false
+	}
+	if txn.Amount < q.MinAmount || (q.MaxAmount > 0 && txn.Amount > q.MaxAmount) {
+		return false
+	}
+	if (!q.Since.IsZero() && txn.CreatedAt.Before(q.Since)) || (!q.Until.IsZero() && !txn.CreatedAt.Before(q.Until)) {
+		return false
+	}
+	return q.After == nil || q.After.before(txn)
+}
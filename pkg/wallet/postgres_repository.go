@@ -0,0 +1,1478 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// retry settings for transactions aborted by Postgres because of contention.
+const (
+	maxTxAttempts = 5
+	txRetryDelay  = 10 * time.Millisecond
+)
+
+// Postgres SQLSTATE codes that mean the transaction can safely be retried.
+const (
+	pqSerializationFailure = "40001"
+	pqDeadlockDetected     = "40P01"
+)
+
+// querier is the part of *sql.DB and *sql.Tx used by postgresQueries.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// postgresRepository is the Postgres implementation of Repository.
+type postgresRepository struct {
+	postgresQueries
+	db *sql.DB
+}
+
+// postgresQueries runs Queries against either the DB pool or an open transaction.
+type postgresQueries struct {
+	q querier
+}
+
+// NewPostgresRepository initializes a Postgres backed Repository.
+func NewPostgresRepository(db *sql.DB) *postgresRepository {
+	return &postgresRepository{postgresQueries: postgresQueries{q: db}, db: db}
+}
+
+// isRetryable reports whether err is a serialization failure or deadlock.
+func isRetryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == pqSerializationFailure || pqErr.Code == pqDeadlockDetected
+	}
+	return false
+}
+
+// RunInTx runs fn inside a DB transaction and commits when fn returns nil.
+// Serialization failures and deadlocks roll back and run fn again, unless ctx
+// is done. The transaction rolls back when ctx is canceled before the commit.
+func (r *postgresRepository) RunInTx(ctx context.Context, fn func(q Queries) error) error {
+	for attempt := 1; ; attempt++ {
+		err := r.runTx(ctx, fn)
+		if err == nil || !isRetryable(err) || attempt == maxTxAttempts {
+			return err
+		}
+		log.Printf("DB transaction retry %d after error: %v", attempt, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * txRetryDelay):
+		}
+	}
+}
+
+// runTx runs fn inside a single DB transaction attempt.
+func (r *postgresRepository) runTx(ctx context.Context, fn func(q Queries) error) error {
+	txn, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("DB Begin error: %v", err)
+		return err
+	}
+	defer txn.Rollback()
+
+	if err := fn(&postgresQueries{q: txn}); err != nil {
+		return err
+	}
+
+	if err := txn.Commit(); err != nil {
+		log.Printf("DB Commit error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// WalletExists Checks if the wallet to be updated exists
+func (p *postgresQueries) WalletExists(ctx context.Context, walletID uuid.UUID) (bool, error) {
+	var exists bool
+	err := p.q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM wallets WHERE id = $1)`, walletID).Scan(&exists)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// EnsureUser inserts a user row unless it already exists.
+func (p *postgresQueries) EnsureUser(ctx context.Context, userID uuid.UUID) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO users (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`, userID)
+	if err != nil {
+		log.Printf("DB Insertion error: %v", err)
+	}
+	return err
+}
+
+// UserExists checks if a user row exists.
+func (p *postgresQueries) UserExists(ctx context.Context, userID uuid.UUID) (bool, error) {
+	var exists bool
+	err := p.q.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return false, err
+	}
+	return exists, nil
+}
+
+// ListWallets reads the wallets of a user, oldest first.
+func (p *postgresQueries) ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT `+walletColumns+` FROM wallets WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wallets []wallet
+	for rows.Next() {
+		w, err := scanWallet(rows)
+		if err != nil {
+			return nil, err
+		}
+		wallets = append(wallets, *w)
+	}
+	return wallets, rows.Err()
+}
+
+// ListWalletIDs selects the IDs of all wallets.
+func (p *postgresQueries) ListWalletIDs(ctx context.Context) ([]uuid.UUID, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id FROM wallets ORDER BY id`)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// InsertWallet inserts a new wallet row.
+func (p *postgresQueries) InsertWallet(ctx context.Context, w *wallet) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO wallets (id, user_id, balance, currency, label, type, tier) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		w.ID, w.UserID, w.Balance, w.Currency, w.Label, w.Type, w.Tier)
+	if err != nil {
+		log.Printf("DB Insertion error: %v", err)
+	}
+	return err
+}
+
+// EnsureWallet inserts a wallet row unless one with its ID already exists.
+func (p *postgresQueries) EnsureWallet(ctx context.Context, w *wallet) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO wallets (id, user_id, balance, currency, label, type, tier) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (id) DO NOTHING`,
+		w.ID, w.UserID, w.Balance, w.Currency, w.Label, w.Type, w.Tier)
+	if err != nil {
+		log.Printf("DB Insertion error: %v", err)
+	}
+	return err
+}
+
+// walletColumns are the wallets columns scanned by scanWallet.
+const walletColumns = `id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides`
+
+// scanWallet reads a row selected with walletColumns from *sql.Row or *sql.Rows.
+func scanWallet(row interface{ Scan(...interface{}) error }) (*wallet, error) {
+	var w wallet
+	var overrides sql.NullString
+	err := row.Scan(&w.ID, &w.UserID, &w.Balance, &w.Currency, &w.Label, &w.Type, &w.Held, &w.Status, &w.InboundBlocked, &w.OutboundBlocked,
+		&w.Tier, &overrides)
+	if err == sql.ErrNoRows {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	if overrides.Valid {
+		if err := json.Unmarshal([]byte(overrides.String), &w.LimitOverrides); err != nil {
+			return nil, err
+		}
+	}
+	return &w, nil
+}
+
+// GetWallet reads a wallet row.
+func (p *postgresQueries) GetWallet(ctx context.Context, walletID uuid.UUID) (*wallet, error) {
+	return scanWallet(p.q.QueryRowContext(ctx, `SELECT `+walletColumns+` FROM wallets WHERE id = $1`, walletID))
+}
+
+// LockWallets takes row locks with SELECT ... FOR UPDATE, always in UUID order
+// so two transactions touching the same wallets cannot deadlock each other.
+func (p *postgresQueries) LockWallets(ctx context.Context, walletIDs ...uuid.UUID) (map[uuid.UUID]*wallet, error) {
+	ordered := append([]uuid.UUID(nil), walletIDs...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return bytes.Compare(ordered[i][:], ordered[j][:]) < 0
+	})
+
+	wallets := make(map[uuid.UUID]*wallet, len(ordered))
+	for _, id := range ordered {
+		w, err := scanWallet(p.q.QueryRowContext(ctx, `SELECT `+walletColumns+` FROM wallets WHERE id = $1 FOR UPDATE`, id))
+		if err != nil {
+			return nil, err
+		}
+		wallets[id] = w
+	}
+	return wallets, nil
+}
+
+// AdjustBalance adds delta to the stored wallet balance.
+func (p *postgresQueries) AdjustBalance(ctx context.Context, walletID uuid.UUID, delta int64) error {
+	var err error
+	if delta >= 0 {
+		_, err = p.q.ExecContext(ctx, `UPDATE wallets SET balance = balance + $1 WHERE id = $2`, delta, walletID)
+	} else {
+		_, err = p.q.ExecContext(ctx, `UPDATE wallets SET balance = balance - $1 WHERE id = $2`, -delta, walletID)
+	}
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// AdjustHeld adds delta to the amount held on a wallet.
+func (p *postgresQueries) AdjustHeld(ctx context.Context, walletID uuid.UUID, delta int64) error {
+	var err error
+	if delta >= 0 {
+		_, err = p.q.ExecContext(ctx, `UPDATE wallets SET held = held + $1 WHERE id = $2`, delta, walletID)
+	} else {
+		_, err = p.q.ExecContext(ctx, `UPDATE wallets SET held = held - $1 WHERE id = $2`, -delta, walletID)
+	}
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// SumTransactions adds up the transactions of some types on one side of a
+// wallet since a time. Deposits are counted on the receiving side, everything
+// else on the sending side, which the history indexes on (wallet, created_at)
+// serve.
+func (p *postgresQueries) SumTransactions(ctx context.Context, walletID uuid.UUID, txnTypes []string, since time.Time) (int64, int64, error) {
+	side := "from_wallet"
+	if len(txnTypes) > 0 && txnTypes[0] == TxnTypeDeposit {
+		side = "to_wallet"
+	}
+	var total, count int64
+	err := p.q.QueryRowContext(ctx, `SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM transactions WHERE `+side+` = $1 AND type = ANY($2) AND created_at >= $3`,
+		walletID, pq.Array(txnTypes), since).Scan(&total, &count)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return 0, 0, err
+	}
+	return total, count, nil
+}
+
+// InsertTransaction inserts a transaction row. The fx_* and target_* columns
+// are only set for cross-currency transfers, reverses_id and reason only for reversals.
+func (p *postgresQueries) InsertTransaction(ctx context.Context, txn *transaction) error {
+	var targetAmount sql.NullInt64
+	var targetCurrency, rate, rounding sql.NullString
+	var quoteID *uuid.UUID
+	reason := sql.NullString{String: txn.Reason, Valid: txn.Reason != ""}
+	var fees sql.NullString
+	if len(txn.Fees) > 0 {
+		data, err := json.Marshal(txn.Fees)
+		if err != nil {
+			return err
+		}
+		fees = sql.NullString{String: string(data), Valid: true}
+	}
+	if fx := txn.FX; fx != nil {
+		targetAmount = sql.NullInt64{Int64: fx.TargetAmount, Valid: true}
+		targetCurrency = sql.NullString{String: fx.TargetCurrency, Valid: true}
+		rate = sql.NullString{String: fx.Rate, Valid: true}
+		rounding = sql.NullString{String: fx.RoundingMode, Valid: true}
+		quoteID = fx.QuoteID
+	}
+
+	_, err := p.q.ExecContext(ctx, `INSERT INTO transactions (id, from_wallet, to_wallet, amount, currency, type, created_at,
+                      target_amount, target_currency, fx_rate, fx_rounding_mode, fx_quote_id, reverses_id, reason, fees, chain_seq, prev_hash, hash, client_id)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)`,
+		txn.ID, txn.FromWallet, txn.ToWallet, txn.Amount, txn.Currency, txn.Type, txn.CreatedAt,
+		targetAmount, targetCurrency, rate, rounding, quoteID, txn.ReversesID, reason, fees, txn.ChainSeq, txn.PrevHash, txn.Hash, txn.ClientID)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// LockTransaction reads a transaction row with SELECT ... FOR UPDATE so
+// concurrent reversals of it are serialized.
+func (p *postgresQueries) LockTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error) {
+	txn, err := scanTransaction(p.q.QueryRowContext(ctx, `SELECT `+transactionColumns+` FROM transactions WHERE id = $1 FOR UPDATE`, txnID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// AddReversedAmount adds amount to transactions.reversed_amount.
+func (p *postgresQueries) AddReversedAmount(ctx context.Context, txnID uuid.UUID, amount int64) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE transactions SET reversed_amount = reversed_amount + $1 WHERE id = $2`, amount, txnID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// InsertEntries inserts the journal lines of a transaction.
+func (p *postgresQueries) InsertEntries(ctx context.Context, txnID uuid.UUID, entries []ledgerEntry) error {
+	for _, e := range entries {
+		_, err := p.q.ExecContext(ctx, `INSERT INTO ledger_entries (id, transaction_id, account_id, direction, amount, currency)
+                      VALUES ($1, $2, $3, $4, $5, $6)`,
+			e.ID, txnID, e.AccountID, e.Direction, e.Amount, e.Currency)
+		if err != nil {
+			log.Printf("DB Insert error: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// LedgerBalance sums the journal lines of an account in a currency.
+func (p *postgresQueries) LedgerBalance(ctx context.Context, accountID uuid.UUID, currency string) (int64, error) {
+	var balance int64
+	err := p.q.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END), 0)
+        FROM ledger_entries
+        WHERE account_id = $1 AND currency = $2`, accountID, currency).Scan(&balance)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return 0, err
+	}
+	return balance, nil
+}
+
+// ListWalletLedgerBalances reads every wallet with the sum of its journal
+// lines in one statement, so the stored and derived balances are consistent
+// with each other even while transactions commit.
+func (p *postgresQueries) ListWalletLedgerBalances(ctx context.Context) ([]walletLedgerBalance, error) {
+	rows, err := p.q.QueryContext(ctx, `
+        SELECT w.id, w.currency, w.balance, w.held, COALESCE(e.ledger, 0)
+        FROM wallets w
+        LEFT JOIN (SELECT account_id, currency, SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END) AS ledger
+                   FROM ledger_entries GROUP BY account_id, currency) e
+          ON e.account_id = w.id AND e.currency = w.currency
+        ORDER BY w.id`)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var balances []walletLedgerBalance
+	for rows.Next() {
+		var b walletLedgerBalance
+		if err := rows.Scan(&b.WalletID, &b.Currency, &b.Balance, &b.Held, &b.Ledger); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// LedgerNetByCurrency sums the whole journal per currency.
+func (p *postgresQueries) LedgerNetByCurrency(ctx context.Context) (map[string]int64, error) {
+	rows, err := p.q.QueryContext(ctx, `
+        SELECT currency, SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END)
+        FROM ledger_entries
+        GROUP BY currency`)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	net := map[string]int64{}
+	for rows.Next() {
+		var currency string
+		var sum int64
+		if err := rows.Scan(&currency, &sum); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		net[currency] = sum
+	}
+	return net, rows.Err()
+}
+
+// ListUnbalancedTransactions finds transactions without journal lines or with
+// lines that do not net to zero in a currency.
+func (p *postgresQueries) ListUnbalancedTransactions(ctx context.Context, limit int) ([]uuid.UUID, error) {
+	rows, err := p.q.QueryContext(ctx, `
+        SELECT t.id
+        FROM transactions t
+        LEFT JOIN (SELECT transaction_id, SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END) AS net
+                   FROM ledger_entries GROUP BY transaction_id, currency) e
+          ON e.transaction_id = t.id
+        GROUP BY t.id
+        HAVING COUNT(e.transaction_id) = 0 OR BOOL_OR(e.net <> 0)
+        ORDER BY t.id
+        LIMIT $1`, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// LedgerNetChange sums the journal lines of an account in a currency posted
+// by transactions created in [from, to).
+func (p *postgresQueries) LedgerNetChange(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) (int64, error) {
+	var balance int64
+	err := p.q.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(CASE WHEN e.direction = 'credit' THEN e.amount ELSE -e.amount END), 0)
+        FROM ledger_entries e
+        JOIN transactions t ON t.id = e.transaction_id
+        WHERE e.account_id = $1 AND e.currency = $2 AND t.created_at >= $3 AND t.created_at < $4`,
+		accountID, currency, from, to).Scan(&balance)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return 0, err
+	}
+	return balance, nil
+}
+
+// InsertBalanceSnapshot inserts a balance_snapshots row unless the wallet
+// already has one at the same time.
+func (p *postgresQueries) InsertBalanceSnapshot(ctx context.Context, snap *balanceSnapshot) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO balance_snapshots (wallet_id, currency, as_of, balance, created_at)
+                      VALUES ($1, $2, $3, $4, $5) ON CONFLICT (wallet_id, as_of) DO NOTHING`,
+		snap.WalletID, snap.Currency, snap.AsOf, snap.Balance, snap.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// LatestBalanceSnapshot reads the last balance_snapshots row of a wallet at or before a time.
+func (p *postgresQueries) LatestBalanceSnapshot(ctx context.Context, walletID uuid.UUID, at time.Time) (*balanceSnapshot, error) {
+	var snap balanceSnapshot
+	err := p.q.QueryRowContext(ctx, `SELECT wallet_id, currency, as_of, balance, created_at FROM balance_snapshots
+                      WHERE wallet_id = $1 AND as_of <= $2 ORDER BY as_of DESC LIMIT 1`, walletID, at).
+		Scan(&snap.WalletID, &snap.Currency, &snap.AsOf, &snap.Balance, &snap.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// LockChainHead selects the single transaction_chain_head row FOR UPDATE.
+func (p *postgresQueries) LockChainHead(ctx context.Context) (*chainHead, error) {
+	var head chainHead
+	err := p.q.QueryRowContext(ctx, `SELECT seq, hash FROM transaction_chain_head WHERE id = TRUE FOR UPDATE`).Scan(&head.Seq, &head.Hash)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &head, nil
+}
+
+// UpdateChainHead updates the transaction_chain_head row.
+func (p *postgresQueries) UpdateChainHead(ctx context.Context, head *chainHead) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE transaction_chain_head SET seq = $1, hash = $2 WHERE id = TRUE`, head.Seq, head.Hash)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// GetChainHead reads the transaction_chain_head row.
+func (p *postgresQueries) GetChainHead(ctx context.Context) (*chainHead, error) {
+	var head chainHead
+	err := p.q.QueryRowContext(ctx, `SELECT seq, hash FROM transaction_chain_head WHERE id = TRUE`).Scan(&head.Seq, &head.Hash)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &head, nil
+}
+
+// InsertChainCheckpoint inserts a row into chain_checkpoints.
+func (p *postgresQueries) InsertChainCheckpoint(ctx context.Context, cp *ChainCheckpoint) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO chain_checkpoints (seq, hash, signature, created_at) VALUES ($1, $2, $3, $4)`,
+		cp.Seq, cp.Hash, cp.Signature, cp.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// NextChainCheckpoint selects the checkpoint with the lowest seq at or after seq.
+func (p *postgresQueries) NextChainCheckpoint(ctx context.Context, seq int64) (*ChainCheckpoint, error) {
+	var cp ChainCheckpoint
+	err := p.q.QueryRowContext(ctx, `SELECT seq, hash, signature, created_at FROM chain_checkpoints
+                      WHERE seq >= $1 ORDER BY seq LIMIT 1`, seq).Scan(&cp.Seq, &cp.Hash, &cp.Signature, &cp.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// scanChainedTransaction reads a row selected with transactionColumns and the
+// chain columns. Rows older than the chain have NULL chain columns.
+func scanChainedTransaction(row interface{ Scan(...interface{}) error }) (transaction, error) {
+	var seq sql.NullInt64
+	var prevSeed, hash sql.NullString
+	txn, err := scanTransaction(extraScan{row: row, extra: []interface{}{&seq, &prevSeed, &hash}})
+	if err != nil {
+		return transaction{}, err
+	}
+	txn.ChainSeq, txn.PrevHash, txn.Hash = seq.Int64, prevSeed.String, hash.String
+	return txn, nil
+}
+
+// GetChainedTransaction selects a transaction with its chain columns.
+func (p *postgresQueries) GetChainedTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error) {
+	txn, err := scanChainedTransaction(p.q.QueryRowContext(ctx, `SELECT `+transactionColumns+`, chain_seq, prev_hash, hash FROM transactions WHERE id = $1`, txnID))
+	if err == sql.ErrNoRows {
+		return nil, ErrTransactionNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &txn, nil
+}
+
+// ListChainedTransactions selects transactions by chain position.
+func (p *postgresQueries) ListChainedTransactions(ctx context.Context, afterSeq int64, limit int) ([]transaction, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT `+transactionColumns+`, chain_seq, prev_hash, hash FROM transactions
+                      WHERE chain_seq > $1 ORDER BY chain_seq LIMIT $2`, afterSeq, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txns []transaction
+	for rows.Next() {
+		txn, err := scanChainedTransaction(rows)
+		if err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, rows.Err()
+}
+
+// extraScan scans the columns of a row past those read by another scanner,
+// so scanTransaction can be reused on rows with additional columns.
+type extraScan struct {
+	row   interface{ Scan(...interface{}) error }
+	extra []interface{}
+}
+
+func (e extraScan) Scan(dest ...interface{}) error {
+	return e.row.Scan(append(dest, e.extra...)...)
+}
+
+// ListAccountMovements selects the transactions of a period with the net of
+// their journal lines on an account, oldest first.
+func (p *postgresQueries) ListAccountMovements(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) ([]accountMovement, error) {
+	rows, err := p.q.QueryContext(ctx, `
+        SELECT `+transactionColumns+`, m.change
+        FROM transactions
+        JOIN (SELECT transaction_id, SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END) AS change
+              FROM ledger_entries
+              WHERE account_id = $1 AND currency = $2
+              GROUP BY transaction_id) m ON m.transaction_id = transactions.id
+        WHERE created_at >= $3 AND created_at < $4
+        ORDER BY created_at, id`, accountID, currency, from, to)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movements []accountMovement
+	for rows.Next() {
+		var m accountMovement
+		txn, err := scanTransaction(extraScan{row: rows, extra: []interface{}{&m.Change}})
+		if err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		m.Transaction = txn
+		movements = append(movements, m)
+	}
+	return movements, rows.Err()
+}
+
+// InsertQuote inserts an FX quote row.
+func (p *postgresQueries) InsertQuote(ctx context.Context, quote *fxQuote) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO fx_quotes (id, from_wallet, to_wallet, source_amount, source_currency,
+                      target_amount, target_currency, rate, rounding_mode, expires_at, created_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		quote.ID, quote.FromWallet, quote.ToWallet, quote.Source.Amount, quote.Source.Currency,
+		quote.Target.Amount, quote.Target.Currency, quote.Rate, quote.RoundingMode, quote.ExpiresAt, quote.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// quoteColumns are the fx_quotes columns scanned by scanQuote.
+const quoteColumns = `id, from_wallet, to_wallet, source_amount, source_currency, target_amount, target_currency,
+               rate, rounding_mode, expires_at, transaction_id, created_at`
+
+// scanQuote reads a row selected with quoteColumns.
+func scanQuote(row *sql.Row) (*fxQuote, error) {
+	var quote fxQuote
+	err := row.Scan(&quote.ID, &quote.FromWallet, &quote.ToWallet, &quote.Source.Amount, &quote.Source.Currency,
+		&quote.Target.Amount, &quote.Target.Currency, &quote.Rate, &quote.RoundingMode, &quote.ExpiresAt,
+		&quote.TransactionID, &quote.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrQuoteNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &quote, nil
+}
+
+// GetQuote reads a quote row.
+func (p *postgresQueries) GetQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error) {
+	return scanQuote(p.q.QueryRowContext(ctx, `SELECT `+quoteColumns+` FROM fx_quotes WHERE id = $1`, quoteID))
+}
+
+// LockQuote reads a quote row with SELECT ... FOR UPDATE so it can only be executed once.
+func (p *postgresQueries) LockQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error) {
+	return scanQuote(p.q.QueryRowContext(ctx, `SELECT `+quoteColumns+` FROM fx_quotes WHERE id = $1 FOR UPDATE`, quoteID))
+}
+
+// MarkQuoteExecuted links a quote row to the transaction that executed it.
+func (p *postgresQueries) MarkQuoteExecuted(ctx context.Context, quoteID, txnID uuid.UUID) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE fx_quotes SET transaction_id = $1 WHERE id = $2`, txnID, quoteID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// InsertHold inserts a hold row.
+func (p *postgresQueries) InsertHold(ctx context.Context, h *hold) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO holds (id, wallet_id, amount, currency, captured_amount, status, expires_at, created_at, updated_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		h.ID, h.WalletID, h.Amount, h.Currency, h.CapturedAmount, h.Status, h.ExpiresAt, h.CreatedAt, h.UpdatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// holdColumns are the holds columns scanned by scanHold.
+const holdColumns = `id, wallet_id, amount, currency, captured_amount, status, expires_at, transaction_id, created_at, updated_at`
+
+// scanHold reads a row selected with holdColumns.
+func scanHold(row *sql.Row) (*hold, error) {
+	var h hold
+	err := row.Scan(&h.ID, &h.WalletID, &h.Amount, &h.Currency, &h.CapturedAmount, &h.Status, &h.ExpiresAt,
+		&h.TransactionID, &h.CreatedAt, &h.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &h, nil
+}
+
+// GetHold reads a hold row.
+func (p *postgresQueries) GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	return scanHold(p.q.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE id = $1`, holdID))
+}
+
+// LockHold reads a hold row with SELECT ... FOR UPDATE so it settles only once.
+func (p *postgresQueries) LockHold(ctx context.Context, holdID uuid.UUID) (*hold, error) {
+	return scanHold(p.q.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM holds WHERE id = $1 FOR UPDATE`, holdID))
+}
+
+// UpdateHold stores the settlement of a hold.
+func (p *postgresQueries) UpdateHold(ctx context.Context, h *hold) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE holds SET status = $1, captured_amount = $2, transaction_id = $3, updated_at = $4 WHERE id = $5`,
+		h.Status, h.CapturedAmount, h.TransactionID, h.UpdatedAt, h.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// ListExpiredHolds reads the IDs of active holds past their expiry, oldest first.
+func (p *postgresQueries) ListExpiredHolds(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id FROM holds WHERE status = 'active' AND expires_at <= $1
+                      ORDER BY expires_at LIMIT $2`, now, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// UpdateWalletState stores the status and blocks of a wallet.
+func (p *postgresQueries) UpdateWalletState(ctx context.Context, w *wallet) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE wallets SET status = $1, inbound_blocked = $2, outbound_blocked = $3 WHERE id = $4`,
+		w.Status, w.InboundBlocked, w.OutboundBlocked, w.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// UpdateWalletLimits stores the limit tier and overrides of a wallet. A wallet
+// without overrides stores NULL.
+func (p *postgresQueries) UpdateWalletLimits(ctx context.Context, w *wallet) error {
+	var overrides sql.NullString
+	if len(w.LimitOverrides) > 0 {
+		data, err := json.Marshal(w.LimitOverrides)
+		if err != nil {
+			return err
+		}
+		overrides = sql.NullString{String: string(data), Valid: true}
+	}
+	_, err := p.q.ExecContext(ctx, `UPDATE wallets SET tier = $1, limit_overrides = $2 WHERE id = $3`, w.Tier, overrides, w.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// InsertWalletStateEvent inserts a row into the wallet state audit log.
+func (p *postgresQueries) InsertWalletStateEvent(ctx context.Context, e *walletStateEvent) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO wallet_state_events (id, wallet_id, from_status, to_status, inbound_blocked, outbound_blocked, actor, reason, created_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		e.ID, e.WalletID, e.FromStatus, e.ToStatus, e.InboundBlocked, e.OutboundBlocked, e.Actor, e.Reason, e.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// ListWalletStateEvents reads the state changes of a wallet, oldest first.
+func (p *postgresQueries) ListWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id, wallet_id, from_status, to_status, inbound_blocked, outbound_blocked, actor, reason, created_at
+                      FROM wallet_state_events WHERE wallet_id = $1 ORDER BY created_at, id`, walletID)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []walletStateEvent
+	for rows.Next() {
+		var e walletStateEvent
+		if err := rows.Scan(&e.ID, &e.WalletID, &e.FromStatus, &e.ToStatus, &e.InboundBlocked, &e.OutboundBlocked,
+			&e.Actor, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// transactionColumns are the transactions columns scanned by scanTransaction.
+const transactionColumns = `id, from_wallet, to_wallet, amount, currency, type, created_at,
+               target_amount, target_currency, fx_rate, fx_rounding_mode, fx_quote_id, reverses_id, reason, reversed_amount, fees, client_id`
+
+// scanTransaction reads a row selected with transactionColumns from *sql.Row or *sql.Rows.
+func scanTransaction(row interface{ Scan(...interface{}) error }) (transaction, error) {
+	var txn transaction
+	var targetAmount sql.NullInt64
+	var targetCurrency, rate, rounding, reason, fees sql.NullString
+	var quoteID *uuid.UUID
+	err := row.Scan(&txn.ID, &txn.FromWallet, &txn.ToWallet, &txn.Amount, &txn.Currency, &txn.Type, &txn.CreatedAt,
+		&targetAmount, &targetCurrency, &rate, &rounding, &quoteID, &txn.ReversesID, &reason, &txn.Reversed, &fees, &txn.ClientID)
+	if err != nil {
+		return transaction{}, err
+	}
+	txn.Reason = reason.String
+	if fees.Valid {
+		if err := json.Unmarshal([]byte(fees.String), &txn.Fees); err != nil {
+			return transaction{}, err
+		}
+	}
+	if targetAmount.Valid {
+		txn.FX = &fxConversion{
+			QuoteID:        quoteID,
+			Rate:           rate.String,
+			RoundingMode:   rounding.String,
+			SourceAmount:   txn.Amount,
+			SourceCurrency: txn.Currency,
+			TargetAmount:   targetAmount.Int64,
+			TargetCurrency: targetCurrency.String,
+		}
+	}
+	return txn, nil
+}
+
+// ListTransactions fetches one page of the transactions where the wallet was
+// sender or receiver, ordered by (created_at, id) descending. Received and sent
+// transactions are read by separate branches so each one can walk the
+// (to_wallet|from_wallet, created_at, id) index in order and stop at the limit.
+func (p *postgresQueries) ListTransactions(ctx context.Context, walletID uuid.UUID, q transactionQuery) ([]transaction, error) {
+	args := []interface{}{walletID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	var filters []string
+	if q.Type != "" {
+		filters = append(filters, "type = "+arg(q.Type))
+	}
+	if q.MinAmount > 0 {
+		filters = append(filters, "amount >= "+arg(q.MinAmount))
+	}
+	if q.MaxAmount > 0 {
+		filters = append(filters, "amount <= "+arg(q.MaxAmount))
+	}
+	if !q.Since.IsZero() {
+		filters = append(filters, "created_at >= "+arg(q.Since))
+	}
+	if !q.Until.IsZero() {
+		filters = append(filters, "created_at < "+arg(q.Until))
+	}
+	if q.After != nil {
+		filters = append(filters, "(created_at, id) < ("+arg(q.After.CreatedAt)+", "+arg(q.After.ID)+")")
+	}
+	var counterparty string
+	if q.Counterparty != nil {
+		counterparty = arg(*q.Counterparty)
+	}
+	limit := arg(q.Limit)
+
+	// branch selects the transactions where the wallet is on one side
+	branch := func(side, other string) string {
+		conds := append([]string{side + " = $1"}, filters...)
+		if counterparty != "" {
+			conds = append(conds, other+" = "+counterparty)
+		}
+		return `SELECT ` + transactionColumns + ` FROM transactions WHERE ` + strings.Join(conds, " AND ") +
+			` ORDER BY created_at DESC, id DESC LIMIT ` + limit
+	}
+
+	var query string
+	switch q.Direction {
+	case DirectionIn:
+		query = branch("to_wallet", "from_wallet")
+	case DirectionOut:
+		query = branch("from_wallet", "to_wallet")
+	default:
+		query = `SELECT ` + transactionColumns + ` FROM ((` + branch("to_wallet", "from_wallet") + `) UNION ALL (` +
+			branch("from_wallet", "to_wallet") + `)) t ORDER BY created_at DESC, id DESC LIMIT ` + limit
+	}
+
+	rows, err := p.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txns []transaction
+	for rows.Next() {
+		txn, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+
+	return txns, rows.Err()
+}
+
+// Compile-time check to ensure postgresRepository implements Repository interface
+var _ Repository = (*postgresRepository)(nil)
+
+// InsertEvent inserts an outbox row. Seq is assigned by the sequence, which is
+// read while the wallet rows are locked, so events about one wallet get
+// increasing Seq in commit order.
+func (p *postgresQueries) InsertEvent(ctx context.Context, e *Event) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO outbox_events (id, type, wallet_id, payload, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		e.ID, e.Type, e.WalletID, string(e.Payload), e.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// LockUnpublishedEvents selects the oldest unpublished events FOR UPDATE, so a
+// second relay waits instead of publishing the same events out of order.
+func (p *postgresQueries) LockUnpublishedEvents(ctx context.Context, limit int) ([]Event, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT seq, id, type, wallet_id, payload, created_at, claimed_until FROM outbox_events
+                            WHERE published_at IS NULL ORDER BY seq LIMIT $1 FOR UPDATE`, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var payload string
+		if err := rows.Scan(&e.Seq, &e.ID, &e.Type, &e.WalletID, &payload, &e.CreatedAt, &e.ClaimedUntil); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		e.Payload = json.RawMessage(payload)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ClaimEvents sets claimed_until on the given outbox rows.
+func (p *postgresQueries) ClaimEvents(ctx context.Context, seqs []int64, until time.Time) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE outbox_events SET claimed_until = $1 WHERE seq = ANY($2)`, until, pq.Array(seqs))
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// MarkEventsPublished sets published_at on the given outbox rows.
+func (p *postgresQueries) MarkEventsPublished(ctx context.Context, seqs []int64, at time.Time) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE outbox_events SET published_at = $1 WHERE seq = ANY($2)`, at, pq.Array(seqs))
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// webhookColumns are the webhook_subscriptions columns scanned by scanWebhook.
+const webhookColumns = `id, wallet_id, user_id, url, event_types, secret, active, created_at, updated_at`
+
+// scanWebhook reads a row selected with webhookColumns.
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*webhookSubscription, error) {
+	var sub webhookSubscription
+	err := row.Scan(&sub.ID, &sub.WalletID, &sub.UserID, &sub.URL, pq.Array(&sub.EventTypes), &sub.Secret, &sub.Active,
+		&sub.CreatedAt, &sub.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	if sub.EventTypes == nil {
+		sub.EventTypes = []string{}
+	}
+	return &sub, nil
+}
+
+// listWebhooks reads the subscriptions selected by query.
+func (p *postgresQueries) listWebhooks(ctx context.Context, query string, args ...interface{}) ([]webhookSubscription, error) {
+	rows, err := p.q.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []webhookSubscription
+	for rows.Next() {
+		sub, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+	return subs, rows.Err()
+}
+
+// InsertWebhookSubscription inserts a webhook_subscriptions row.
+func (p *postgresQueries) InsertWebhookSubscription(ctx context.Context, sub *webhookSubscription) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO webhook_subscriptions (`+webhookColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		sub.ID, sub.WalletID, sub.UserID, sub.URL, pq.Array(sub.EventTypes), sub.Secret, sub.Active, sub.CreatedAt, sub.UpdatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// GetWebhookSubscription reads a webhook_subscriptions row.
+func (p *postgresQueries) GetWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error) {
+	return scanWebhook(p.q.QueryRowContext(ctx, `SELECT `+webhookColumns+` FROM webhook_subscriptions WHERE id = $1`, subscriptionID))
+}
+
+// ListWebhookSubscriptions reads the subscriptions of a wallet or of a user, oldest first.
+func (p *postgresQueries) ListWebhookSubscriptions(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error) {
+	return p.listWebhooks(ctx, `SELECT `+webhookColumns+` FROM webhook_subscriptions
+                          WHERE wallet_id = $1 OR user_id = $2 ORDER BY created_at, id`, walletID, userID)
+}
+
+// ListEventWebhooks reads the active subscriptions of the wallets and of the users owning them.
+func (p *postgresQueries) ListEventWebhooks(ctx context.Context, walletIDs []uuid.UUID) ([]webhookSubscription, error) {
+	ids := make([]string, len(walletIDs))
+	for i, id := range walletIDs {
+		ids[i] = id.String()
+	}
+	return p.listWebhooks(ctx, `SELECT `+webhookColumns+` FROM webhook_subscriptions
+                          WHERE active AND (wallet_id = ANY($1::uuid[]) OR user_id IN (SELECT user_id FROM wallets WHERE id = ANY($1::uuid[])))
+                          ORDER BY created_at, id`, pq.Array(ids))
+}
+
+// UpdateWebhookSubscription stores the changeable columns of a subscription.
+func (p *postgresQueries) UpdateWebhookSubscription(ctx context.Context, sub *webhookSubscription) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE webhook_subscriptions SET url = $1, event_types = $2, secret = $3, active = $4, updated_at = $5 WHERE id = $6`,
+		sub.URL, pq.Array(sub.EventTypes), sub.Secret, sub.Active, sub.UpdatedAt, sub.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// DeleteWebhookSubscription deletes a subscription; its deliveries and their
+// attempts are deleted by ON DELETE CASCADE.
+func (p *postgresQueries) DeleteWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) error {
+	res, err := p.q.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, subscriptionID)
+	if err != nil {
+		log.Printf("DB Delete error: %v", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// deliveryColumns are the webhook_deliveries columns scanned by scanDelivery.
+const deliveryColumns = `id, subscription_id, event_id, event_type, payload, status, attempts, next_attempt_at, last_error, created_at, updated_at,
+                      claim_id`
+
+// scanDelivery reads a row selected with deliveryColumns.
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*webhookDelivery, error) {
+	var d webhookDelivery
+	var payload string
+	err := row.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.LastError, &d.CreatedAt, &d.UpdatedAt, &d.ClaimID)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeliveryNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	return &d, nil
+}
+
+// InsertWebhookDelivery inserts a webhook_deliveries row.
+func (p *postgresQueries) InsertWebhookDelivery(ctx context.Context, d *webhookDelivery) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO webhook_deliveries (`+deliveryColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		d.ID, d.SubscriptionID, d.EventID, d.EventType, string(d.Payload), d.Status, d.Attempts, d.NextAttemptAt, d.LastError,
+		d.CreatedAt, d.UpdatedAt, d.ClaimID)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// ListDueWebhookDeliveries reads the IDs of pending deliveries due at now, oldest first.
+func (p *postgresQueries) ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= $1
+                      ORDER BY next_attempt_at LIMIT $2`, now, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetWebhookDelivery reads a delivery row.
+func (p *postgresQueries) GetWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	return scanDelivery(p.q.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = $1`, deliveryID))
+}
+
+// LockWebhookDelivery reads a delivery row with SELECT ... FOR UPDATE so each
+// attempt is sent by one dispatcher only.
+func (p *postgresQueries) LockWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	return scanDelivery(p.q.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id = $1 FOR UPDATE`, deliveryID))
+}
+
+// UpdateWebhookDelivery stores a claim, the outcome of an attempt or a replay.
+func (p *postgresQueries) UpdateWebhookDelivery(ctx context.Context, d *webhookDelivery) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE webhook_deliveries SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, updated_at = $5,
+                      claim_id = $6 WHERE id = $7`, d.Status, d.Attempts, d.NextAttemptAt, d.LastError, d.UpdatedAt, d.ClaimID, d.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// ListWebhookDeliveries reads the latest deliveries of a subscription, newest first.
+func (p *postgresQueries) ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID, limit int) ([]webhookDelivery, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE subscription_id = $1
+                      ORDER BY created_at DESC, id DESC LIMIT $2`, subscriptionID, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []webhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// InsertWebhookAttempt inserts a webhook_attempts row. Attempts that got no
+// response store a NULL status code.
+func (p *postgresQueries) InsertWebhookAttempt(ctx context.Context, a *webhookAttempt) error {
+	statusCode := sql.NullInt64{Int64: int64(a.StatusCode), Valid: a.StatusCode != 0}
+	_, err := p.q.ExecContext(ctx, `INSERT INTO webhook_attempts (id, delivery_id, status_code, error, duration_ms, created_at)
+                      VALUES ($1, $2, $3, $4, $5, $6)`, a.ID, a.DeliveryID, statusCode, a.Error, a.DurationMs, a.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// ListWebhookAttempts reads the attempts of a delivery, oldest first.
+func (p *postgresQueries) ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id, delivery_id, status_code, error, duration_ms, created_at FROM webhook_attempts
+                      WHERE delivery_id = $1 ORDER BY created_at, id`, deliveryID)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attempts []webhookAttempt
+	for rows.Next() {
+		var a webhookAttempt
+		var statusCode sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.DeliveryID, &statusCode, &a.Error, &a.DurationMs, &a.CreatedAt); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		a.StatusCode = int(statusCode.Int64)
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// scheduleColumns are the scheduled_transfers columns scanned by scanSchedule.
+const scheduleColumns = `id, from_wallet, to_wallet, amount, currency, frequency, cron, start_at, end_at, max_runs, run_count,
+                         status, next_run_at, attempts, next_attempt_at, created_at, updated_at`
+
+// scanSchedule reads a row selected with scheduleColumns.
+func scanSchedule(row interface{ Scan(...interface{}) error }) (*scheduledTransfer, error) {
+	var sch scheduledTransfer
+	err := row.Scan(&sch.ID, &sch.FromWallet, &sch.ToWallet, &sch.Amount, &sch.Currency, &sch.Frequency, &sch.Cron, &sch.StartAt,
+		&sch.EndAt, &sch.MaxRuns, &sch.RunCount, &sch.Status, &sch.NextRunAt, &sch.Attempts, &sch.NextAttemptAt, &sch.CreatedAt, &sch.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrScheduleNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	return &sch, nil
+}
+
+// InsertSchedule inserts a scheduled_transfers row.
+func (p *postgresQueries) InsertSchedule(ctx context.Context, sch *scheduledTransfer) error {
+	_, err := p.q.ExecContext(ctx, `INSERT INTO scheduled_transfers (`+scheduleColumns+`)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`,
+		sch.ID, sch.FromWallet, sch.ToWallet, sch.Amount, sch.Currency, sch.Frequency, sch.Cron, sch.StartAt, sch.EndAt, sch.MaxRuns,
+		sch.RunCount, sch.Status, sch.NextRunAt, sch.Attempts, sch.NextAttemptAt, sch.CreatedAt, sch.UpdatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// GetSchedule reads a scheduled_transfers row.
+func (p *postgresQueries) GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return scanSchedule(p.q.QueryRowContext(ctx, `SELECT `+scheduleColumns+` FROM scheduled_transfers WHERE id = $1`, scheduleID))
+}
+
+// LockSchedule reads a scheduled_transfers row with SELECT ... FOR UPDATE so
+// each run is made by one scheduler only.
+func (p *postgresQueries) LockSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return scanSchedule(p.q.QueryRowContext(ctx, `SELECT `+scheduleColumns+` FROM scheduled_transfers WHERE id = $1 FOR UPDATE`, scheduleID))
+}
+
+// UpdateSchedule stores the changeable columns and the run state of a schedule.
+func (p *postgresQueries) UpdateSchedule(ctx context.Context, sch *scheduledTransfer) error {
+	_, err := p.q.ExecContext(ctx, `UPDATE scheduled_transfers SET amount = $1, end_at = $2, max_runs = $3, run_count = $4, status = $5,
+                      next_run_at = $6, attempts = $7, next_attempt_at = $8, updated_at = $9 WHERE id = $10`,
+		sch.Amount, sch.EndAt, sch.MaxRuns, sch.RunCount, sch.Status, sch.NextRunAt, sch.Attempts, sch.NextAttemptAt, sch.UpdatedAt, sch.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// ListSchedules reads the schedules sent from a wallet, oldest first.
+func (p *postgresQueries) ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT `+scheduleColumns+` FROM scheduled_transfers WHERE from_wallet = $1 ORDER BY created_at, id`, walletID)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []scheduledTransfer
+	for rows.Next() {
+		sch, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *sch)
+	}
+	return schedules, rows.Err()
+}
+
+// ListDueSchedules reads the IDs of active schedules due at now, oldest first.
+func (p *postgresQueries) ListDueSchedules(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id FROM scheduled_transfers WHERE status = 'active' AND next_attempt_at <= $1
+                      ORDER BY next_attempt_at LIMIT $2`, now, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// InsertScheduleRun inserts a schedule_runs row. The unique idempotency key
+// makes a second insert of a succeeded run a no-op, reported as
+// ErrRunAlreadyExecuted; failed runs store NULL and never conflict.
+func (p *postgresQueries) InsertScheduleRun(ctx context.Context, run *scheduleRun) error {
+	key := sql.NullString{String: run.IdempotencyKey, Valid: run.IdempotencyKey != ""}
+	res, err := p.q.ExecContext(ctx, `INSERT INTO schedule_runs (id, schedule_id, scheduled_for, attempt, status, idempotency_key, transaction_id, error, created_at)
+                      VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (idempotency_key) DO NOTHING`,
+		run.ID, run.ScheduleID, run.ScheduledFor, run.Attempt, run.Status, key, run.TransactionID, run.Error, run.CreatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrRunAlreadyExecuted
+	}
+	return nil
+}
+
+// ListScheduleRuns reads the latest runs of a schedule, newest first.
+func (p *postgresQueries) ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID, limit int) ([]scheduleRun, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT id, schedule_id, scheduled_for, attempt, status, idempotency_key, transaction_id, error, created_at
+                      FROM schedule_runs WHERE schedule_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2`, scheduleID, limit)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []scheduleRun
+	for rows.Next() {
+		var run scheduleRun
+		var key sql.NullString
+		if err := rows.Scan(&run.ID, &run.ScheduleID, &run.ScheduledFor, &run.Attempt, &run.Status, &key, &run.TransactionID,
+			&run.Error, &run.CreatedAt); err != nil {
+			log.Printf("DB Select error: %v", err)
+			return nil, err
+		}
+		run.IdempotencyKey = key.String
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// apiClientColumns are the api_clients columns scanned by scanAPIClient.
+const apiClientColumns = `id, name, scopes, key_prefix, key_seed, prev_key_seed, prev_key_expires_at, revoked_at, created_at, updated_at`
+
+// scanAPIClient reads a row selected with apiClientColumns.
+func scanAPIClient(row interface{ Scan(...interface{}) error }) (*apiClient, error) {
+	var c apiClient
+	var prevSeed sql.NullString
+	err := row.Scan(&c.ID, &c.Name, pq.Array(&c.Scopes), &c.KeyPrefix, &c.KeySeed, &prevSeed, &c.PrevKeyExpiresAt,
+		&c.RevokedAt, &c.CreatedAt, &c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIClientNotFound
+	}
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	c.PrevKeySeed = prevSeed.String
+	return &c, nil
+}
+
+// InsertAPIClient inserts an api_clients row.
+func (p *postgresQueries) InsertAPIClient(ctx context.Context, c *apiClient) error {
+	prevSeed := sql.NullString{String: c.PrevKeySeed, Valid: c.PrevKeySeed != ""}
+	_, err := p.q.ExecContext(ctx, `INSERT INTO api_clients (`+apiClientColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		c.ID, c.Name, pq.Array(c.Scopes), c.KeyPrefix, c.KeySeed, prevSeed, c.PrevKeyExpiresAt, c.RevokedAt, c.CreatedAt, c.UpdatedAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+	}
+	return err
+}
+
+// GetAPIClient reads an api_clients row.
+func (p *postgresQueries) GetAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	return scanAPIClient(p.q.QueryRowContext(ctx, `SELECT `+apiClientColumns+` FROM api_clients WHERE id = $1`, clientID))
+}
+
+// LockAPIClient reads an api_clients row with SELECT ... FOR UPDATE so
+// concurrent rotations of a key are serialized.
+func (p *postgresQueries) LockAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error) {
+	return scanAPIClient(p.q.QueryRowContext(ctx, `SELECT `+apiClientColumns+` FROM api_clients WHERE id = $1 FOR UPDATE`, clientID))
+}
+
+// UpdateAPIClient stores the keys and the revocation of a client.
+func (p *postgresQueries) UpdateAPIClient(ctx context.Context, c *apiClient) error {
+	prevSeed := sql.NullString{String: c.PrevKeySeed, Valid: c.PrevKeySeed != ""}
+	_, err := p.q.ExecContext(ctx, `UPDATE api_clients SET key_prefix = $1, key_seed = $2, prev_key_seed = $3, prev_key_expires_at = $4,
+                      revoked_at = $5, updated_at = $6 WHERE id = $7`,
+		c.KeyPrefix, c.KeySeed, prevSeed, c.PrevKeyExpiresAt, c.RevokedAt, c.UpdatedAt, c.ID)
+	if err != nil {
+		log.Printf("DB Update error: %v", err)
+	}
+	return err
+}
+
+// ListAPIClients reads all clients, oldest first.
+func (p *postgresQueries) ListAPIClients(ctx context.Context) ([]apiClient, error) {
+	rows, err := p.q.QueryContext(ctx, `SELECT `+apiClientColumns+` FROM api_clients ORDER BY created_at, id`)
+	if err != nil {
+		log.Printf("DB Select error: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []apiClient
+	for rows.Next() {
+		c, err := scanAPIClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, *c)
+	}
+	return clients, rows.Err()
+}
+
+// UseNonce inserts an api_nonces row. The primary key makes a second insert
+// of the same nonce a no-op, reported as ErrNonceReused.
+func (p *postgresQueries) UseNonce(ctx context.Context, clientID uuid.UUID, nonce string, expiresAt time.Time) error {
+	res, err := p.q.ExecContext(ctx, `INSERT INTO api_nonces (client_id, nonce, expires_at) VALUES ($1, $2, $3)
+                      ON CONFLICT (client_id, nonce) DO NOTHING`, clientID, nonce, expiresAt)
+	if err != nil {
+		log.Printf("DB Insert error: %v", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNonceReused
+	}
+	return nil
+}
+
+// DeleteExpiredNonces deletes the nonces whose replay window has ended.
+func (p *postgresQueries) DeleteExpiredNonces(ctx context.Context, now time.Time) (int64, error) {
+	res, err := p.q.ExecContext(ctx, `DELETE FROM api_nonces WHERE expires_at <= $1`, now)
+	if err != nil {
+		log.Printf("DB Delete error: %v", err)
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,2082 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) (*service, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+
+	svc := NewService(NewPostgresRepository(db))
+	return svc, mock, func() { db.Close() }
+}
+
+// usd builds a USD amount for the tests.
+func usd(amount int64) Money {
+	return Money{Amount: amount, Currency: "USD"}
+}
+
+// walletColumnNames are the columns selected by scanWallet.
+var walletColumnNames = []string{"id", "user_id", "balance", "currency", "label", "type", "held", "status", "inbound_blocked", "outbound_blocked", "tier", "limit_overrides"}
+
+// walletRow returns the wallets row selected by GetWallet and LockWallets for a USD wallet.
+func walletRow(id uuid.UUID, balance int64) *sqlmock.Rows {
+	return sqlmock.NewRows(walletColumnNames).AddRow(id, uuid.New(), balance, "USD", "", WalletTypeSpending, int64(0), WalletActive, false, false, DefaultLimitTier, nil)
+}
+
+// expectWalletLocks expects the SELECT ... FOR UPDATE issued for each wallet, in UUID order.
+func expectWalletLocks(mock sqlmock.Sqlmock, balances map[uuid.UUID]int64) {
+	ids := make([]uuid.UUID, 0, len(balances))
+	for id := range balances {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+
+	for _, id := range ids {
+		mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+			WithArgs(id).
+			WillReturnRows(walletRow(id, balances[id]))
+	}
+}
+
+// webhookColumnNames are the columns selected by the webhook subscription queries.
+var webhookColumnNames = []string{"id", "wallet_id", "user_id", "url", "event_types", "secret", "active", "created_at", "updated_at"}
+
+// expectEvent expects the outbox row written in the same transaction as a
+// change, and the lookup of its webhook subscriptions, of which there are none.
+func expectEvent(mock sqlmock.Sqlmock, eventType string, walletID interface{}) {
+	mock.ExpectExec(`INSERT INTO outbox_events \(id, type, wallet_id, payload, created_at\)`).
+		WithArgs(sqlmock.AnyArg(), eventType, walletID, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`SELECT .+ FROM webhook_subscriptions\s+WHERE active`).
+		WillReturnRows(sqlmock.NewRows(webhookColumnNames))
+}
+
+// expectChainHead expects the hash chain head to be locked before a
+// transaction is inserted, with an empty chain.
+func expectChainHead(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT seq, hash FROM transaction_chain_head WHERE id = TRUE FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash"}).AddRow(int64(0), chainGenesisHash))
+}
+
+// expectChainAdvance expects the chain head to move to the inserted transaction.
+func expectChainAdvance(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`UPDATE transaction_chain_head SET seq = \$1, hash = \$2 WHERE id = TRUE`).
+		WithArgs(int64(1), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+/*
+*
+
+	CREATE WALLET Test Cases
+
+*
+*/
+func TestCreateWallet_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	userID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO users \(id\) VALUES \(\$1\) ON CONFLICT \(id\) DO NOTHING`).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO wallets \(id, user_id, balance, currency, label, type, tier\)`).
+		WithArgs(sqlmock.AnyArg(), userID, int64(0), "USD", "Savings", WalletTypeSavings, DefaultLimitTier).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, EventWalletCreated, sqlmock.AnyArg())
+	mock.ExpectCommit()
+
+	wallet, err := svc.CreateWallet(ctx, userID, "USD", " Savings ", WalletTypeSavings)
+
+	assert.NoError(t, err)
+	assert.NotEqual(t, nil, wallet)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreateWallet_InsertFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	userID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO users`).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO wallets \(id, user_id, balance, currency, label, type, tier\)`).
+		WithArgs(sqlmock.AnyArg(), userID, int64(0), "USD", "", WalletTypeSpending, DefaultLimitTier).
+		WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+
+	wallet, err := svc.CreateWallet(ctx, userID, "USD", "", "")
+	assert.Error(t, err)
+	assert.Nil(t, wallet)
+}
+
+func TestListWallets_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	userID := uuid.New()
+	spendingID, savingsID := uuid.New(), uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE id = \$1\)`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT ` + walletColumns + ` FROM wallets WHERE user_id = \$1 ORDER BY created_at, id`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows(walletColumnNames).
+			AddRow(spendingID, userID, int64(500), "USD", "", WalletTypeSpending, int64(100), WalletActive, false, false, DefaultLimitTier, nil).
+			AddRow(savingsID, userID, int64(2000), "EUR", "Holiday", WalletTypeSavings, int64(0), WalletActive, false, false, DefaultLimitTier, nil))
+
+	wallets, err := svc.ListWallets(ctx, userID)
+	assert.NoError(t, err)
+	assert.Len(t, wallets, 2)
+	assert.Equal(t, int64(400), wallets[0].Available())
+	assert.Equal(t, "Holiday", wallets[1].Label)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestListWallets_UserNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	userID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE id = \$1\)`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	_, err := svc.ListWallets(ctx, userID)
+	assert.Equal(t, ErrUserNotFound, err)
+}
+
+/*
+*
+
+	DEPOSIT Test Cases
+
+*
+*/
+
+func TestDeposit_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(200)
+
+	// Expect wallet exists
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Begin transaction
+	mock.ExpectBegin()
+
+	// Expect the wallet row lock
+	expectWalletLocks(mock, map[uuid.UUID]int64{walletID: 0})
+
+	// Expect update wallet balance
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(amount, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Expect insert transaction
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), nil, walletID, amount, "USD", TxnTypeDeposit, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+
+	// Expect balanced ledger entries: debit cash in, credit wallet
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), AccountCashIn, EntryDebit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), walletID, EntryCredit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectEvent(mock, EventFundsDeposited, walletID)
+	// Expect commit
+	mock.ExpectCommit()
+
+	txnID, err := svc.Deposit(ctx, walletID, usd(amount))
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
+}
+
+func TestDeposit_InvalidAmount(t *testing.T) {
+	ctx := context.Background()
+	svc, _, cleanup := newTestService(t)
+	defer cleanup()
+
+	txnID, err := svc.Deposit(ctx, uuid.New(), usd(0))
+	assert.Error(t, err)
+	assert.Equal(t, ErrInvalidAmount, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestDeposit_WalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	txnID, err := svc.Deposit(ctx, walletID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, ErrWalletNotFound, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestDeposit_BeginTxFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin().WillReturnError(errors.New("db error"))
+
+	txnID, err := svc.Deposit(ctx, walletID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestDeposit_CancelledContext(t *testing.T) {
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// No query reaches the database once the request is cancelled
+	txnID, err := svc.Deposit(ctx, uuid.New(), usd(100))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, uuid.Nil, txnID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeposit_InsertTxnFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+	expectWalletLocks(mock, map[uuid.UUID]int64{walletID: 0})
+
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(amount, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), nil, walletID, amount, "USD", TxnTypeDeposit, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnError(errors.New("insert failed"))
+
+	mock.ExpectRollback()
+
+	txnID, err := svc.Deposit(ctx, walletID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+/*
+*
+
+	WITHDRAW Test Cases
+
+*
+*/
+
+func TestWithdraw_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(100)
+	initialBalance := int64(200)
+
+	// Expect wallet existence check
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Begin transaction
+	mock.ExpectBegin()
+
+	// Expect SELECT balance with a row lock
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, initialBalance))
+
+	// Expect UPDATE balance
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(amount, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Expect INSERT transaction
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), walletID, nil, amount, "USD", TxnTypeWithdrawal, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+
+	// Expect balanced ledger entries: debit wallet, credit cash out
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), walletID, EntryDebit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), AccountCashOut, EntryCredit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectEvent(mock, EventFundsWithdrawn, walletID)
+	// Expect Commit
+	mock.ExpectCommit()
+
+	id, err := svc.Withdraw(ctx, walletID, usd(amount))
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, id)
+}
+
+func TestWithdraw_ChargesFees(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	fees, err := NewFeeSchedule([]FeeRule{{Name: "withdrawal_fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Flat: 25}})
+	assert.NoError(t, err)
+	svc := NewService(NewPostgresRepository(db), WithFees(fees))
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 200))
+
+	// Amount and fee leave the wallet together
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(int64(125), walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	// The fee is credited to the revenue wallet, created on the first fee
+	mock.ExpectExec(`INSERT INTO users \(id\) VALUES \(\$1\) ON CONFLICT \(id\) DO NOTHING`).
+		WithArgs(SystemUserID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO wallets .* ON CONFLICT \(id\) DO NOTHING`).
+		WithArgs(RevenueWalletID("USD"), SystemUserID, int64(0), "USD", "Fee revenue USD", WalletTypeRevenue, DefaultLimitTier).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(int64(25), RevenueWalletID("USD")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), walletID, nil, int64(100), "USD", TxnTypeWithdrawal, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil,
+			`[{"name":"withdrawal_fee","amount":25,"currency":"USD"}]`, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+	for _, line := range []struct {
+		account   uuid.UUID
+		direction string
+		amount    int64
+	}{
+		{walletID, EntryDebit, 100}, {AccountCashOut, EntryCredit, 100},
+		{walletID, EntryDebit, 25}, {RevenueWalletID("USD"), EntryCredit, 25},
+	} {
+		mock.ExpectExec(`INSERT INTO ledger_entries`).
+			WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), line.account, line.direction, line.amount, "USD").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	expectEvent(mock, EventFundsWithdrawn, walletID)
+	mock.ExpectCommit()
+
+	_, err = svc.Withdraw(ctx, walletID, usd(100))
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWithdraw_DailyLimitExceeded(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	limits, err := NewLimitSchedule(map[string][]Limit{DefaultLimitTier: {
+		{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: 1000},
+	}})
+	assert.NoError(t, err)
+	svc := NewService(NewPostgresRepository(db), WithLimits(limits))
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 5000))
+
+	// Usage is read after the wallet lock, inside the same transaction
+	mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\), COUNT\(\*\) FROM transactions WHERE from_wallet = \$1 AND type = ANY\(\$2\) AND created_at >= \$3`).
+		WithArgs(walletID, pq.Array([]string{TxnTypeWithdrawal, TxnTypeCapture}), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"sum", "count"}).AddRow(int64(900), int64(2)))
+	mock.ExpectRollback()
+
+	_, err = svc.Withdraw(ctx, walletID, usd(200))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	var limitErr *LimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, int64(100), limitErr.Remaining)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSetWalletLimits_StoresOverrides(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 0))
+	mock.ExpectExec(`UPDATE wallets SET tier = \$1, limit_overrides = \$2 WHERE id = \$3`).
+		WithArgs(DefaultLimitTier, `[{"txn_type":"deposit","currency":"USD","period":"weekly","max_count":5}]`, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	overrides := []Limit{{TxnType: TxnTypeDeposit, Period: LimitWeekly, MaxCount: 5}}
+	w, err := svc.SetWalletLimits(ctx, walletID, WalletLimitsChange{Overrides: &overrides})
+	assert.NoError(t, err)
+	assert.Len(t, w.LimitOverrides, 1)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWithdraw_InvalidAmount(t *testing.T) {
+	ctx := context.Background()
+	svc, _, cleanup := newTestService(t)
+	defer cleanup()
+
+	id, err := svc.Withdraw(ctx, uuid.New(), usd(0))
+	assert.Error(t, err)
+	assert.Equal(t, ErrInvalidAmount, err)
+	assert.Equal(t, uuid.Nil, id)
+}
+
+func TestWithdraw_WalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	id, err := svc.Withdraw(ctx, walletID, usd(100))
+	assert.Error(t, err)
+	assert.Equal(t, ErrWalletNotFound, err)
+	assert.Equal(t, uuid.Nil, id)
+}
+
+func TestWithdraw_InsufficientBalance(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(500)
+	balance := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, balance))
+
+	mock.ExpectRollback()
+
+	id, err := svc.Withdraw(ctx, walletID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	assert.Equal(t, uuid.Nil, id)
+}
+
+func TestWithdraw_DBError(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin().WillReturnError(errors.New("db down"))
+
+	id, err := svc.Withdraw(ctx, walletID, usd(100))
+	assert.Error(t, err)
+	assert.Equal(t, uuid.Nil, id)
+}
+
+func TestWithdraw_InsertTxnFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+	expectWalletLocks(mock, map[uuid.UUID]int64{walletID: 500})
+
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(amount, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), walletID, nil, amount, "USD", TxnTypeWithdrawal, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnError(errors.New("insert failed"))
+
+	mock.ExpectRollback()
+
+	txnID, err := svc.Withdraw(ctx, walletID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+/*
+*
+
+	TRANSFER Test Cases
+
+*
+*/
+
+func TestTransfer_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(100)
+
+	// WalletExists checks
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+
+	// Both wallets are locked in UUID order
+	expectWalletLocks(mock, map[uuid.UUID]int64{fromID: 1000, toID: 0})
+
+	// Subtract from sender
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(amount, fromID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Add to receiver
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(amount, toID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Insert transaction
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), fromID, toID, amount, "USD", TxnTypeTransfer, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+
+	// Ledger entries: debit sender, credit receiver
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), fromID, EntryDebit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), toID, EntryCredit, amount, "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectEvent(mock, EventFundsTransferred, fromID)
+	mock.ExpectCommit()
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_InsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(1000)
+
+	// WalletExists
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+
+	// Balance is too low
+	expectWalletLocks(mock, map[uuid.UUID]int64{fromID: 200, toID: 0}) // < amount
+
+	mock.ExpectRollback()
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_SameWallet(t *testing.T) {
+	ctx := context.Background()
+	svc, _, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	txnID, err := svc.Transfer(ctx, walletID, walletID, usd(500))
+	assert.Error(t, err)
+	assert.Equal(t, ErrSameWalletTransfer, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_InvalidAmount(t *testing.T) {
+	ctx := context.Background()
+	svc, _, cleanup := newTestService(t)
+	defer cleanup()
+
+	txnID, err := svc.Transfer(ctx, uuid.New(), uuid.New(), usd(-50))
+	assert.Error(t, err)
+	assert.Equal(t, ErrInvalidAmount, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_SourceWalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, ErrSourceInvalid, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_DestinationWalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.Error(t, err)
+	assert.Equal(t, ErrDestinationInvalid, err)
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_InsertFailsAndRollback(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(500)
+
+	// WalletExists checks
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+
+	// Balance check returns enough balance
+	expectWalletLocks(mock, map[uuid.UUID]int64{fromID: 1000, toID: 0})
+
+	// Subtract from sender
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(amount, fromID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Add to receiver
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(amount, toID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// Simulate INSERT failure
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), fromID, toID, amount, "USD", TxnTypeTransfer, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnError(errors.New("insert failed"))
+
+	mock.ExpectRollback()
+
+	// Call the actual service
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "insert failed")
+	assert.Equal(t, uuid.Nil, txnID)
+}
+
+func TestTransfer_LocksWalletsInUUIDOrder(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	// The sender sorts after the receiver, so the receiver must be locked first
+	fromID := uuid.MustParse("ffffffff-0000-0000-0000-000000000000")
+	toID := uuid.MustParse("00000000-ffff-0000-0000-000000000000")
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(toID).
+		WillReturnRows(walletRow(toID, 0))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(fromID).
+		WillReturnRows(walletRow(fromID, 50))
+	mock.ExpectRollback()
+
+	_, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.Equal(t, ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransfer_RetriesOnSerializationFailure(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+	amount := int64(100)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// First attempt is chosen as the deadlock victim
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WillReturnError(&pq.Error{Code: pqDeadlockDetected})
+	mock.ExpectRollback()
+
+	// Second attempt succeeds
+	mock.ExpectBegin()
+	expectWalletLocks(mock, map[uuid.UUID]int64{fromID: 1000, toID: 0})
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(amount, fromID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(amount, toID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, EventFundsTransferred, fromID)
+	mock.ExpectCommit()
+
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(amount))
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransfer_GivesUpAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID := uuid.New()
+	toID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	for i := 0; i < maxTxAttempts; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+			WillReturnError(&pq.Error{Code: pqSerializationFailure})
+		mock.ExpectRollback()
+	}
+
+	_, err := svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.True(t, isRetryable(err))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExecuteQuote_LocksQuoteThenWallets(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	quoteID := uuid.New()
+	fromID := uuid.MustParse("00000000-aaaa-0000-0000-000000000000")
+	toID := uuid.MustParse("00000000-bbbb-0000-0000-000000000000")
+
+	mock.ExpectBegin()
+
+	// The quote row is locked before the wallets
+	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, source_amount, source_currency, target_amount, target_currency, rate, rounding_mode, expires_at, transaction_id, created_at FROM fx_quotes WHERE id = \$1 FOR UPDATE`).
+		WithArgs(quoteID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "source_amount", "source_currency",
+			"target_amount", "target_currency", "rate", "rounding_mode", "expires_at", "transaction_id", "created_at"}).
+			AddRow(quoteID, fromID, toID, int64(100), "USD", int64(90), "EUR", "0.9", RoundingHalfEven,
+				time.Now().Add(time.Minute), nil, time.Now()))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(fromID).
+		WillReturnRows(sqlmock.NewRows(walletColumnNames).AddRow(fromID, uuid.New(), int64(1000), "USD", "", WalletTypeSpending, int64(0), WalletActive, false, false, DefaultLimitTier, nil))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(toID).
+		WillReturnRows(sqlmock.NewRows(walletColumnNames).AddRow(toID, uuid.New(), int64(0), "EUR", "", WalletTypeSpending, int64(0), WalletActive, false, false, DefaultLimitTier, nil))
+
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(int64(100), fromID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(int64(90), toID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// The conversion is recorded on the transaction
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), fromID, toID, int64(100), "USD", TxnTypeTransfer, sqlmock.AnyArg(),
+			int64(90), "EUR", "0.9", RoundingHalfEven, quoteID, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+
+	// Ledger entries pass through the FX account in each currency
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), fromID, EntryDebit, int64(100), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), AccountFX, EntryCredit, int64(100), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), AccountFX, EntryDebit, int64(90), "EUR").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), toID, EntryCredit, int64(90), "EUR").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	expectEvent(mock, EventFundsTransferred, fromID)
+
+	mock.ExpectExec(`UPDATE fx_quotes SET transaction_id = \$1 WHERE id = \$2`).
+		WithArgs(sqlmock.AnyArg(), quoteID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	txnID, err := svc.ExecuteQuote(ctx, quoteID)
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	REVERSE Test Cases
+
+*
+*/
+
+// transactionRow returns the transactions row selected by LockTransaction for a same-currency transaction.
+func transactionRow(id uuid.UUID, from, to *uuid.UUID, amount int64, txnType string, reversed int64) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "currency", "type", "created_at",
+		"target_amount", "target_currency", "fx_rate", "fx_rounding_mode", "fx_quote_id", "reverses_id", "reason", "reversed_amount", "fees", "client_id"}).
+		AddRow(id, from, to, amount, "USD", txnType, time.Now(), nil, nil, nil, nil, nil, nil, nil, reversed, nil, nil)
+}
+
+func TestReverse_LocksTransactionThenWallets(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	txnID := uuid.New()
+	fromID := uuid.MustParse("00000000-aaaa-0000-0000-000000000000")
+	toID := uuid.MustParse("00000000-bbbb-0000-0000-000000000000")
+
+	mock.ExpectBegin()
+
+	// The original is locked before the wallets
+	mock.ExpectQuery(`SELECT .* FROM transactions WHERE id = \$1 FOR UPDATE`).
+		WithArgs(txnID).
+		WillReturnRows(transactionRow(txnID, &fromID, &toID, 400, TxnTypeTransfer, 100))
+	expectWalletLocks(mock, map[uuid.UUID]int64{fromID: 600, toID: 400})
+
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(int64(300), toID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WithArgs(int64(300), fromID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), toID, fromID, int64(300), "USD", TxnTypeReversal, sqlmock.AnyArg(),
+			nil, nil, nil, nil, nil, txnID, "duplicate", nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+	mock.ExpectExec(`UPDATE transactions SET reversed_amount = reversed_amount \+ \$1 WHERE id = \$2`).
+		WithArgs(int64(300), txnID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), toID, EntryDebit, int64(300), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), fromID, EntryCredit, int64(300), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, EventFundsReversed, toID)
+	mock.ExpectCommit()
+
+	revID, err := svc.Reverse(ctx, txnID, 0, "duplicate", false)
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, revID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReverse_FundsAlreadySpent(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	txnID := uuid.New()
+	walletID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM transactions WHERE id = \$1 FOR UPDATE`).
+		WithArgs(txnID).
+		WillReturnRows(transactionRow(txnID, nil, &walletID, 400, TxnTypeDeposit, 0))
+	expectWalletLocks(mock, map[uuid.UUID]int64{walletID: 100})
+	mock.ExpectRollback()
+
+	_, err := svc.Reverse(ctx, txnID, 0, "chargeback", false)
+	assert.Equal(t, ErrFundsAlreadySpent, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	HOLD Test Cases
+
+*
+*/
+
+// holdRow returns the holds row selected by GetHold and LockHold.
+func holdRow(id, walletID uuid.UUID, amount int64, status string, expiresAt time.Time) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "wallet_id", "amount", "currency", "captured_amount", "status", "expires_at",
+		"transaction_id", "created_at", "updated_at"}).
+		AddRow(id, walletID, amount, "USD", int64(0), status, expiresAt, nil, time.Now(), time.Now())
+}
+
+func TestCaptureHold_LocksHoldThenWallet(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	holdID := uuid.New()
+	walletID := uuid.New()
+
+	mock.ExpectBegin()
+
+	// The hold row is locked before the wallet
+	mock.ExpectQuery(`SELECT id, wallet_id, amount, currency, captured_amount, status, expires_at, transaction_id, created_at, updated_at FROM holds WHERE id = \$1 FOR UPDATE`).
+		WithArgs(holdID).
+		WillReturnRows(holdRow(holdID, walletID, 400, HoldActive, time.Now().Add(time.Hour)))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows(walletColumnNames).AddRow(walletID, uuid.New(), int64(1000), "USD", "", WalletTypeSpending, int64(400), WalletActive, false, false, DefaultLimitTier, nil))
+
+	// The whole hold is released and only the captured part leaves the balance
+	mock.ExpectExec(`UPDATE wallets SET held = held - \$1 WHERE id = \$2`).
+		WithArgs(int64(400), walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
+		WithArgs(int64(250), walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainHead(mock)
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), walletID, nil, int64(250), "USD", TxnTypeCapture, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(1), chainGenesisHash, sqlmock.AnyArg(), nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectChainAdvance(mock)
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), walletID, EntryDebit, int64(250), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), AccountCashOut, EntryCredit, int64(250), "USD").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE holds SET status = \$1, captured_amount = \$2, transaction_id = \$3, updated_at = \$4 WHERE id = \$5`).
+		WithArgs(HoldCaptured, int64(250), sqlmock.AnyArg(), sqlmock.AnyArg(), holdID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, EventHoldCaptured, walletID)
+	mock.ExpectCommit()
+
+	txnID, err := svc.CaptureHold(ctx, holdID, 250)
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWithdraw_HeldFundsUnavailable(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows(walletColumnNames).AddRow(walletID, uuid.New(), int64(1000), "USD", "", WalletTypeSpending, int64(600), WalletActive, false, false, DefaultLimitTier, nil))
+	mock.ExpectRollback()
+
+	_, err := svc.Withdraw(ctx, walletID, usd(500))
+	assert.Equal(t, ErrInsufficientFunds, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestExpireHolds_SkipsSettledHolds(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	now := time.Now()
+	expiredID, settledID := uuid.New(), uuid.New()
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT id FROM holds WHERE status = 'active' AND expires_at <= \$1 ORDER BY expires_at LIMIT \$2`).
+		WithArgs(now, holdSweepBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(expiredID).AddRow(settledID))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM holds WHERE id = \$1 FOR UPDATE`).
+		WithArgs(expiredID).
+		WillReturnRows(holdRow(expiredID, walletID, 300, HoldActive, now.Add(-time.Minute)))
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 1000))
+	mock.ExpectExec(`UPDATE wallets SET held = held - \$1 WHERE id = \$2`).
+		WithArgs(int64(300), walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE holds SET status = \$1`).
+		WithArgs(HoldExpired, int64(0), nil, now, expiredID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	// Captured between the listing and the lock
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM holds WHERE id = \$1 FOR UPDATE`).
+		WithArgs(settledID).
+		WillReturnRows(holdRow(settledID, walletID, 200, HoldCaptured, now.Add(-time.Minute)))
+	mock.ExpectRollback()
+
+	n, err := svc.ExpireHolds(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	WALLET STATE Test Cases
+
+*
+*/
+
+func TestChangeWalletState_UpdatesAndAudits(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	blocked := true
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 1000))
+	mock.ExpectExec(`UPDATE wallets SET status = \$1, inbound_blocked = \$2, outbound_blocked = \$3 WHERE id = \$4`).
+		WithArgs(WalletFrozen, false, true, walletID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO wallet_state_events`).
+		WithArgs(sqlmock.AnyArg(), walletID, WalletActive, WalletFrozen, false, true, "ops", "chargeback", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	w, err := svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletFrozen, OutboundBlocked: &blocked, Actor: "ops", Reason: "chargeback"})
+	assert.NoError(t, err)
+	assert.Equal(t, WalletFrozen, w.Status)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestChangeWalletState_CloseNeedsZeroBalance(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 1))
+	mock.ExpectRollback()
+
+	_, err := svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletClosed, Actor: "ops", Reason: "user request"})
+	assert.Equal(t, ErrWalletNotEmpty, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTransfer_ReceiverFrozen(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	fromID, toID := uuid.New(), uuid.New()
+	rows := map[uuid.UUID]*sqlmock.Rows{
+		fromID: walletRow(fromID, 1000),
+		toID:   sqlmock.NewRows(walletColumnNames).AddRow(toID, uuid.New(), int64(0), "USD", "", WalletTypeSpending, int64(0), WalletFrozen, false, false, DefaultLimitTier, nil),
+	}
+	first, second := fromID, toID
+	if bytes.Compare(toID[:], fromID[:]) < 0 {
+		first, second = toID, fromID
+	}
+
+	for _, id := range []uuid.UUID{fromID, toID} {
+		mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+			WithArgs(id).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	}
+	mock.ExpectBegin()
+	for _, id := range []uuid.UUID{first, second} {
+		mock.ExpectQuery(`FROM wallets WHERE id = \$1 FOR UPDATE`).
+			WithArgs(id).
+			WillReturnRows(rows[id])
+	}
+	mock.ExpectRollback()
+
+	_, err := svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.Equal(t, ErrWalletFrozen, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	GET BALANCE Test Cases
+
+*
+*/
+
+func TestGetBalance_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	expectedBalance := int64(1000)
+
+	// Expect WalletExists to return true
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Expect balance query
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, expectedBalance))
+
+	// Run test
+	balance, err := svc.GetBalance(ctx, walletID)
+
+	assert.NoError(t, err)
+	assert.Equal(t, usd(expectedBalance), balance.Ledger)
+	assert.Equal(t, usd(expectedBalance), balance.Available)
+}
+
+func TestGetBalance_WalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	// Expect WalletExists to return false
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	// Run test
+	balance, err := svc.GetBalance(ctx, walletID)
+
+	assert.Error(t, err)
+	assert.Equal(t, ErrWalletNotFound, err)
+	assert.Nil(t, balance)
+}
+
+func TestGetBalance_WalletExistsQueryFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	// Simulate query error
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnError(assert.AnError)
+
+	// Run test
+	balance, err := svc.GetBalance(ctx, walletID)
+
+	assert.Error(t, err)
+	assert.Equal(t, assert.AnError, err)
+	assert.Nil(t, balance)
+}
+
+func TestGetBalance_SelectFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnError(assert.AnError)
+
+	// Run test
+	balance, err := svc.GetBalance(ctx, walletID)
+
+	assert.Error(t, err)
+	assert.Equal(t, assert.AnError, err)
+	assert.Nil(t, balance)
+}
+
+/*
+*
+
+	GET TRANSACTION Test Cases
+
+*
+*/
+
+func TestGetTransactions_Success(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	// Expect wallet exists
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Prepare mock transactions
+	now := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "currency", "type", "created_at",
+		"target_amount", "target_currency", "fx_rate", "fx_rounding_mode", "fx_quote_id", "reverses_id", "reason", "reversed_amount", "fees", "client_id"}).
+		AddRow(uuid.New(), walletID, uuid.New(), int64(100), "USD", TxnTypeTransfer, now, int64(92), "EUR", "0.92", RoundingHalfEven, nil, nil, nil, int64(0), `[{"name":"transfer_fee","amount":1,"currency":"USD"}]`, nil).
+		AddRow(uuid.New(), nil, walletID, int64(200), "USD", TxnTypeDeposit, now.Add(-time.Minute), nil, nil, nil, nil, nil, nil, nil, int64(0), nil, nil)
+
+	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, currency, type, created_at, target_amount, target_currency, fx_rate, fx_rounding_mode, fx_quote_id, reverses_id, reason, reversed_amount, fees, client_id FROM \(\(SELECT .* FROM transactions WHERE to_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\) UNION ALL \(SELECT .* FROM transactions WHERE from_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\)\) t ORDER BY created_at DESC, id DESC LIMIT \$2`).
+		WithArgs(walletID, DefaultPageSize+1).
+		WillReturnRows(rows)
+
+	// Execute
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{})
+
+	assert.NoError(t, err)
+	assert.Empty(t, page.NextCursor)
+	txns := page.Transactions
+	assert.Len(t, txns, 2)
+	assert.Equal(t, int64(100), txns[0].Amount)
+	assert.Equal(t, "USD", txns[0].Currency)
+	assert.Equal(t, &fxConversion{Rate: "0.92", RoundingMode: RoundingHalfEven, SourceAmount: 100, SourceCurrency: "USD",
+		TargetAmount: 92, TargetCurrency: "EUR"}, txns[0].FX)
+	assert.Nil(t, txns[1].FX)
+	assert.Equal(t, []feeItem{{Name: "transfer_fee", Amount: 1, Currency: "USD"}}, txns[0].Fees)
+	assert.Nil(t, txns[1].Fees)
+	assert.Equal(t, TxnTypeTransfer, txns[0].Type)
+	assert.Equal(t, TxnTypeDeposit, txns[1].Type)
+}
+
+func TestGetTransactions_FiltersAndCursor(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	counterparty := uuid.New()
+	after := txnCursor{CreatedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), ID: uuid.New()}
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Only the sent side is read and every filter becomes a bind parameter
+	mock.ExpectQuery(`SELECT .* FROM transactions WHERE from_wallet = \$1 AND type = \$2 AND amount >= \$3 AND amount <= \$4 AND created_at >= \$5 AND \(created_at, id\) < \(\$6, \$7\) AND to_wallet = \$8 ORDER BY created_at DESC, id DESC LIMIT \$9$`).
+		WithArgs(walletID, TxnTypeTransfer, int64(10), int64(500), since, after.CreatedAt, after.ID, counterparty, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "currency", "type", "created_at",
+			"target_amount", "target_currency", "fx_rate", "fx_rounding_mode", "fx_quote_id", "reverses_id", "reason", "reversed_amount", "fees", "client_id"}))
+
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{Type: TxnTypeTransfer, Direction: DirectionOut, MinAmount: 10,
+		MaxAmount: 500, Since: since, Counterparty: &counterparty, Cursor: after.encode(), Limit: 2})
+	assert.NoError(t, err)
+	assert.Empty(t, page.Transactions)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetTransactions_WalletNotFound(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{})
+
+	assert.Error(t, err)
+	assert.Equal(t, ErrWalletNotFound, err)
+	assert.Nil(t, page)
+}
+
+func TestGetTransactions_WalletExistsQueryFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnError(errors.New("query failed"))
+
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{})
+
+	assert.Error(t, err)
+	assert.Nil(t, page)
+}
+
+func TestGetTransactions_QueryFails(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, currency, type, created_at, target_amount, target_currency, fx_rate, fx_rounding_mode, fx_quote_id, reverses_id, reason, reversed_amount, fees, client_id FROM \(\(SELECT .* FROM transactions WHERE to_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\) UNION ALL \(SELECT .* FROM transactions WHERE from_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\)\) t ORDER BY created_at DESC, id DESC LIMIT \$2`).
+		WithArgs(walletID, DefaultPageSize+1).
+		WillReturnError(errors.New("query failed"))
+
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{})
+
+	assert.Error(t, err)
+	assert.Nil(t, page)
+}
+
+func TestGetTransactions_ScanFails_MissingFromWallet(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	// Simulate wallet exists
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Simulate corrupted row missing `from_wallet`
+	badRows := sqlmock.NewRows([]string{"id" /* missing from_wallet */, "to_wallet", "amount", "currency", "type", "created_at"}).
+		AddRow(uuid.New(), uuid.New(), int64(100), "USD", TxnTypeTransfer, time.Now())
+
+	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, currency, type, created_at, target_amount, target_currency, fx_rate, fx_rounding_mode, fx_quote_id, reverses_id, reason, reversed_amount, fees, client_id FROM \(\(SELECT .* FROM transactions WHERE to_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\) UNION ALL \(SELECT .* FROM transactions WHERE from_wallet = \$1 ORDER BY created_at DESC, id DESC LIMIT \$2\)\) t ORDER BY created_at DESC, id DESC LIMIT \$2`).
+		WithArgs(walletID, DefaultPageSize+1).
+		WillReturnRows(badRows)
+
+	// Execute the service call
+	page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{})
+
+	assert.Error(t, err)
+	assert.Nil(t, page)
+}
+
+/*
+*
+
+	LEDGER Test Cases
+
+*
+*/
+
+func TestVerifyBalance_Matches(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 700))
+	mock.ExpectQuery(`FROM ledger_entries`).
+		WithArgs(walletID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(int64(700)))
+
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
+}
+
+func TestVerifyBalance_Mismatch(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery(`SELECT id, user_id, balance, currency, label, type, held, status, inbound_blocked, outbound_blocked, tier, limit_overrides FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 900))
+	mock.ExpectQuery(`FROM ledger_entries`).
+		WithArgs(walletID, "USD").
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(int64(700)))
+
+	assert.Equal(t, ErrLedgerMismatch, svc.VerifyBalance(ctx, walletID))
+}
+
+func TestCheckLedger_Report(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	okID, badID, txnID := uuid.New(), uuid.New(), uuid.New()
+
+	mock.ExpectQuery(`SELECT w.id, w.currency, w.balance, w.held, COALESCE\(e.ledger, 0\)\s+FROM wallets w\s+LEFT JOIN .+ FROM ledger_entries GROUP BY account_id, currency\) e`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "currency", "balance", "held", "ledger"}).
+			AddRow(okID, "USD", int64(700), int64(100), int64(700)).
+			AddRow(badID, "USD", int64(900), int64(0), int64(700)))
+	mock.ExpectQuery(`SELECT currency, SUM\(.+\)\s+FROM ledger_entries\s+GROUP BY currency`).
+		WillReturnRows(sqlmock.NewRows([]string{"currency", "sum"}).AddRow("USD", int64(0)).AddRow("EUR", int64(0)))
+	mock.ExpectQuery(`SELECT t.id\s+FROM transactions t\s+LEFT JOIN .+ HAVING COUNT\(e.transaction_id\) = 0 OR BOOL_OR\(e.net <> 0\)\s+ORDER BY t.id\s+LIMIT \$1`).
+		WithArgs(ledgerCheckMaxTransactions).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(txnID))
+
+	report, err := svc.CheckLedger(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Wallets)
+	assert.Equal(t, []LedgerDiscrepancy{
+		{Kind: DiscrepancyBalanceMismatch, WalletID: &badID, Currency: "USD", Expected: 700, Actual: 900, Message: "stored balance 900, journal balance 700"},
+		{Kind: DiscrepancyUnbalancedTransaction, TransactionID: &txnID, Message: "transaction has no journal lines or its lines do not balance"},
+	}, report.Discrepancies)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	OUTBOX Test Cases
+
+*
+*/
+
+// outboxRows returns the columns selected by LockUnpublishedEvents.
+func outboxRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"seq", "id", "type", "wallet_id", "payload", "created_at", "claimed_until"})
+}
+
+func TestPublishEvents_ClaimsPublishesAndMarks(t *testing.T) {
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	ids := []uuid.UUID{uuid.New(), uuid.New()}
+	expired := time.Now().Add(-time.Minute)
+
+	// The batch is claimed in a transaction of its own, an expired claim is taken over
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT seq, id, type, wallet_id, payload, created_at, claimed_until FROM outbox_events\s+WHERE published_at IS NULL ORDER BY seq LIMIT \$1 FOR UPDATE`).
+		WithArgs(outboxBatchSize).
+		WillReturnRows(outboxRows().
+			AddRow(int64(7), ids[0], EventFundsDeposited, walletID, `{"amount":100}`, time.Now(), expired).
+			AddRow(int64(9), ids[1], EventFundsWithdrawn, walletID, `{"amount":50}`, time.Now(), nil))
+	mock.ExpectExec(`UPDATE outbox_events SET claimed_until = \$1 WHERE seq = ANY\(\$2\)`).
+		WithArgs(sqlmock.AnyArg(), "{7,9}").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	// Publishing happens between the transactions
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE outbox_events SET published_at = \$1 WHERE seq = ANY\(\$2\)`).
+		WithArgs(sqlmock.AnyArg(), "{7,9}").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	publisher := NewMemoryPublisher()
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, ids[0], publisher.Events()[0].ID)
+	assert.JSONEq(t, `{"amount":50}`, string(publisher.Events()[1].Payload))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPublishEvents_WaitsForAnotherRelay(t *testing.T) {
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT seq, id, type, wallet_id, payload, created_at, claimed_until FROM outbox_events`).
+		WithArgs(outboxBatchSize).
+		WillReturnRows(outboxRows().
+			AddRow(int64(7), uuid.New(), EventFundsDeposited, uuid.New(), `{}`, time.Now(), time.Now().Add(time.Minute)).
+			AddRow(int64(9), uuid.New(), EventFundsDeposited, uuid.New(), `{}`, time.Now(), nil))
+	mock.ExpectCommit()
+
+	publisher := NewMemoryPublisher()
+	n, err := svc.PublishEvents(context.Background(), publisher)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, publisher.Events())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	WEBHOOK Test Cases
+
+*
+*/
+
+func TestCreateWebhook_InsertsSubscription(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+	svc.resolver = testResolver
+
+	userID := uuid.New()
+
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM users WHERE id = \$1\)`).
+		WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(`INSERT INTO webhook_subscriptions \(id, wallet_id, user_id, url, event_types, secret, active, created_at, updated_at\)`).
+		WithArgs(sqlmock.AnyArg(), nil, userID, "https://example.com/hooks", "{\"FundsDeposited\"}", "0123456789abcdef", true,
+			sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{UserID: &userID, URL: "https://example.com/hooks",
+		EventTypes: []string{EventFundsDeposited}, Secret: "0123456789abcdef"})
+	assert.NoError(t, err)
+	assert.Equal(t, "0123456789abcdef", sub.Secret)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// captureArg matches any query argument and keeps the last one it saw.
+type captureArg struct {
+	value driver.Value
+}
+
+func (a *captureArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+func TestDeliverWebhooks_ClaimsSendsAndRecordsAttempt(t *testing.T) {
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+	svc.webhooks = newWebhookClient(DefaultWebhookTimeout, loopbackNetworks)
+
+	now := time.Now()
+	deliveryID, subscriptionID, walletID, eventID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	deliveryColumnNames := []string{"id", "subscription_id", "event_id", "event_type", "payload", "status", "attempts",
+		"next_attempt_at", "last_error", "created_at", "updated_at", "claim_id"}
+	claimID := &captureArg{}
+
+	// The claim has committed by the time the request arrives; the attempt is
+	// recorded in a transaction of its own
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		assert.NoError(t, mock.ExpectationsWereMet())
+		mock.ExpectBegin()
+		mock.ExpectQuery(`FROM webhook_deliveries WHERE id = \$1 FOR UPDATE`).
+			WithArgs(deliveryID).
+			WillReturnRows(sqlmock.NewRows(deliveryColumnNames).
+				AddRow(deliveryID, subscriptionID, eventID, EventFundsDeposited, `{"type":"FundsDeposited"}`, WebhookPending, 2,
+					now.Add(webhookClaimTTL), "", now, now, claimID.value))
+		mock.ExpectExec(`INSERT INTO webhook_attempts \(id, delivery_id, status_code, error, duration_ms, created_at\)`).
+			WithArgs(sqlmock.AnyArg(), deliveryID, int64(http.StatusServiceUnavailable), "unexpected response status 503 Service Unavailable",
+				sqlmock.AnyArg(), now).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`UPDATE webhook_deliveries SET status = \$1, attempts = \$2, next_attempt_at = \$3, last_error = \$4, updated_at = \$5,\s+claim_id = \$6`).
+			WithArgs(WebhookPending, 3, now.Add(4*webhookBaseBackoff), "unexpected response status 503 Service Unavailable", now, nil, deliveryID).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	mock.ExpectQuery(`SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_at <= \$1\s+ORDER BY next_attempt_at LIMIT \$2`).
+		WithArgs(now, webhookBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(deliveryID))
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM webhook_deliveries WHERE id = \$1 FOR UPDATE`).
+		WithArgs(deliveryID).
+		WillReturnRows(sqlmock.NewRows(deliveryColumnNames).
+			AddRow(deliveryID, subscriptionID, eventID, EventFundsDeposited, `{"type":"FundsDeposited"}`, WebhookPending, 2,
+				now.Add(-time.Second), "", now, now, nil))
+	mock.ExpectQuery(`FROM webhook_subscriptions WHERE id = \$1`).
+		WithArgs(subscriptionID).
+		WillReturnRows(sqlmock.NewRows(webhookColumnNames).
+			AddRow(subscriptionID, walletID, nil, server.URL, "{}", "0123456789abcdef", true, now, now))
+	mock.ExpectExec(`UPDATE webhook_deliveries SET status = \$1, attempts = \$2, next_attempt_at = \$3, last_error = \$4, updated_at = \$5,\s+claim_id = \$6`).
+		WithArgs(WebhookPending, 2, now.Add(webhookClaimTTL), "", now, claimID, deliveryID).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	n, err := svc.DeliverWebhooks(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, requests)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	SCHEDULE Test Cases
+
+*
+*/
+
+func TestRunDueSchedules_SkipsScheduleNoLongerDue(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	now := time.Now()
+	scheduleID := uuid.New()
+	scheduleColumnNames := []string{"id", "from_wallet", "to_wallet", "amount", "currency", "frequency", "cron", "start_at", "end_at",
+		"max_runs", "run_count", "status", "next_run_at", "attempts", "next_attempt_at", "created_at", "updated_at"}
+
+	mock.ExpectQuery(`SELECT id FROM scheduled_transfers WHERE status = 'active' AND next_attempt_at <= \$1\s+ORDER BY next_attempt_at LIMIT \$2`).
+		WithArgs(now, scheduleBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(scheduleID))
+	// Paused by another request after it was listed
+	mock.ExpectBegin()
+	mock.ExpectQuery(`FROM scheduled_transfers WHERE id = \$1 FOR UPDATE`).
+		WithArgs(scheduleID).
+		WillReturnRows(sqlmock.NewRows(scheduleColumnNames).
+			AddRow(scheduleID, uuid.New(), uuid.New(), int64(100), "USD", ScheduleDaily, "", now, nil, 0, 1, SchedulePaused,
+				now, 0, now, now, now))
+	mock.ExpectRollback()
+
+	n, err := svc.RunDueSchedules(ctx, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestInsertScheduleRun_DuplicateKey(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+
+	run := &scheduleRun{ID: uuid.New(), ScheduleID: uuid.New(), ScheduledFor: time.Now(), Attempt: 1, Status: RunSucceeded,
+		IdempotencyKey: "schedule:key", CreatedAt: time.Now()}
+
+	mock.ExpectExec(`INSERT INTO schedule_runs .+ ON CONFLICT \(idempotency_key\) DO NOTHING`).
+		WithArgs(run.ID, run.ScheduleID, run.ScheduledFor, 1, RunSucceeded, "schedule:key", nil, "", run.CreatedAt).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.Equal(t, ErrRunAlreadyExecuted, repo.InsertScheduleRun(ctx, run))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	STATEMENT Test Cases
+
+*
+*/
+
+func TestGetStatement_OpeningBalanceAndMovements(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	mock.ExpectQuery(`SELECT .+ FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 700))
+	mock.ExpectQuery(`FROM balance_snapshots\s+WHERE wallet_id = \$1 AND as_of <= \$2 ORDER BY as_of DESC LIMIT 1`).
+		WithArgs(walletID, from).
+		WillReturnRows(sqlmock.NewRows([]string{"wallet_id", "currency", "as_of", "balance", "created_at"}))
+	mock.ExpectQuery(`FROM ledger_entries e\s+JOIN transactions t ON t.id = e.transaction_id\s+WHERE e.account_id = \$1 AND e.currency = \$2 AND t.created_at >= \$3 AND t.created_at < \$4`).
+		WithArgs(walletID, "USD", time.Time{}, from).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(int64(1000)))
+	mock.ExpectQuery(`SELECT .+, m.change\s+FROM transactions\s+JOIN \(SELECT transaction_id, .+ GROUP BY transaction_id\) m .+ WHERE created_at >= \$3 AND created_at < \$4\s+ORDER BY created_at, id`).
+		WithArgs(walletID, "USD", from, to).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "currency", "type", "created_at",
+			"target_amount", "target_currency", "fx_rate", "fx_rounding_mode", "fx_quote_id", "reverses_id", "reason", "reversed_amount", "fees", "client_id", "change"}).
+			AddRow(uuid.New(), walletID, nil, int64(300), "USD", TxnTypeWithdrawal, from.Add(time.Hour), nil, nil, nil, nil, nil, nil, nil, int64(0), nil, nil, int64(-300)))
+
+	st, err := svc.GetStatement(ctx, walletID, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), st.OpeningBalance)
+	assert.Equal(t, int64(700), st.ClosingBalance)
+	assert.Len(t, st.Lines, 1)
+	assert.Equal(t, int64(700), st.Lines[0].Balance)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestGetBalanceAt_FromSnapshot(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	day := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	at := day.Add(6 * time.Hour)
+
+	mock.ExpectQuery(`SELECT .+ FROM wallets WHERE id = \$1`).
+		WithArgs(walletID).
+		WillReturnRows(walletRow(walletID, 900))
+	mock.ExpectQuery(`FROM balance_snapshots\s+WHERE wallet_id = \$1 AND as_of <= \$2 ORDER BY as_of DESC LIMIT 1`).
+		WithArgs(walletID, at).
+		WillReturnRows(sqlmock.NewRows([]string{"wallet_id", "currency", "as_of", "balance", "created_at"}).
+			AddRow(walletID, "USD", day, int64(1200), day.Add(5*time.Minute)))
+	// Only the journal lines since the snapshot are summed
+	mock.ExpectQuery(`FROM ledger_entries e\s+JOIN transactions t ON t.id = e.transaction_id\s+WHERE e.account_id = \$1 AND e.currency = \$2 AND t.created_at >= \$3 AND t.created_at < \$4`).
+		WithArgs(walletID, "USD", day, at).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(int64(-300)))
+
+	balance, err := svc.GetBalanceAt(ctx, walletID, at)
+	assert.NoError(t, err)
+	assert.Equal(t, usd(900), balance)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTakeBalanceSnapshots_SkipsExisting(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	done, missing := uuid.New(), uuid.New()
+	asOf := time.Date(2025, 3, 2, 0, 0, 0, 0, time.UTC)
+	snapshotColumns := []string{"wallet_id", "currency", "as_of", "balance", "created_at"}
+
+	mock.ExpectQuery(`SELECT id FROM wallets ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(done).AddRow(missing))
+	mock.ExpectQuery(`FROM balance_snapshots`).
+		WithArgs(done, asOf).
+		WillReturnRows(sqlmock.NewRows(snapshotColumns).AddRow(done, "USD", asOf, int64(100), asOf))
+	mock.ExpectQuery(`FROM balance_snapshots`).
+		WithArgs(missing, asOf).
+		WillReturnRows(sqlmock.NewRows(snapshotColumns))
+	mock.ExpectQuery(`SELECT .+ FROM wallets WHERE id = \$1`).
+		WithArgs(missing).
+		WillReturnRows(walletRow(missing, 250))
+	mock.ExpectQuery(`FROM balance_snapshots`).
+		WithArgs(missing, asOf).
+		WillReturnRows(sqlmock.NewRows(snapshotColumns))
+	mock.ExpectQuery(`FROM ledger_entries e`).
+		WithArgs(missing, "USD", time.Time{}, asOf).
+		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(int64(250)))
+	mock.ExpectExec(`INSERT INTO balance_snapshots .+ ON CONFLICT \(wallet_id, as_of\) DO NOTHING`).
+		WithArgs(missing, "USD", asOf, int64(250), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := svc.TakeBalanceSnapshots(ctx, asOf)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+/*
+*
+
+	HASH CHAIN Test Cases
+
+*
+*/
+
+func TestVerifyChain_ReadsLinksInChainOrder(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	walletID := uuid.New()
+	created := time.Date(2025, 1, 2, 3, 4, 5, 123456000, time.UTC)
+	first := transaction{ID: uuid.New(), ToWallet: &walletID, Amount: 500, Currency: "USD", Type: TxnTypeDeposit, CreatedAt: created}
+	second := transaction{ID: uuid.New(), FromWallet: &walletID, Amount: 200, Currency: "USD", Type: TxnTypeWithdrawal, CreatedAt: created.Add(time.Minute)}
+	first.Hash = linkHash(chainGenesisHash, transactionDigest(&first))
+	second.Hash = linkHash(first.Hash, transactionDigest(&second))
+
+	svc.chainKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	cp := svc.checkpoint(2, second.Hash)
+
+	mock.ExpectQuery(`SELECT seq, hash FROM transaction_chain_head WHERE id = TRUE`).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash"}).AddRow(int64(2), second.Hash))
+	mock.ExpectQuery(`SELECT seq, hash, signature, created_at FROM chain_checkpoints\s+WHERE seq >= \$1 ORDER BY seq LIMIT 1`).
+		WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash", "signature", "created_at"}).AddRow(cp.Seq, cp.Hash, cp.Signature, cp.CreatedAt))
+	mock.ExpectQuery(`SELECT .+, chain_seq, prev_hash, hash FROM transactions\s+WHERE chain_seq > \$1 ORDER BY chain_seq LIMIT \$2`).
+		WithArgs(int64(0), chainBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "currency", "type", "created_at",
+			"target_amount", "target_currency", "fx_rate", "fx_rounding_mode", "fx_quote_id", "reverses_id", "reason", "reversed_amount", "fees", "client_id",
+			"chain_seq", "prev_hash", "hash"}).
+			AddRow(first.ID, nil, walletID, int64(500), "USD", TxnTypeDeposit, first.CreatedAt, nil, nil, nil, nil, nil, nil, nil, int64(0), nil, nil,
+				int64(1), chainGenesisHash, first.Hash).
+			AddRow(second.ID, walletID, nil, int64(200), "USD", TxnTypeWithdrawal, second.CreatedAt, nil, nil, nil, nil, nil, nil, nil, int64(0), nil, nil,
+				int64(2), first.Hash, second.Hash))
+	mock.ExpectQuery(`SELECT seq, hash, signature, created_at FROM chain_checkpoints`).
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash", "signature", "created_at"}))
+
+	report, err := svc.VerifyChain(ctx)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, int64(2), report.Links)
+	assert.Equal(t, int64(1), report.Checkpoints)
+	assert.Equal(t, cp, report.LastCheckpoint)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeposit_WritesChainCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+	svc.chainKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+	walletID := uuid.New()
+	prev := strings.Repeat("ab", 32)
+	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
+		WithArgs(walletID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectBegin()
+	expectWalletLocks(mock, map[uuid.UUID]int64{walletID: 0})
+	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	// The link at chainCheckpointInterval gets a signed checkpoint
+	mock.ExpectQuery(`SELECT seq, hash FROM transaction_chain_head WHERE id = TRUE FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows([]string{"seq", "hash"}).AddRow(int64(chainCheckpointInterval-1), prev))
+	hash, signature := &captureArg{}, &captureArg{}
+	mock.ExpectExec(`INSERT INTO transactions`).
+		WithArgs(sqlmock.AnyArg(), nil, walletID, int64(100), "USD", TxnTypeDeposit, sqlmock.AnyArg(), nil, nil, nil, nil, nil, nil, nil, nil, int64(chainCheckpointInterval), prev, hash, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE transaction_chain_head SET seq = \$1, hash = \$2 WHERE id = TRUE`).
+		WithArgs(int64(chainCheckpointInterval), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO chain_checkpoints \(seq, hash, signature, created_at\) VALUES \(\$1, \$2, \$3, \$4\)`).
+		WithArgs(int64(chainCheckpointInterval), sqlmock.AnyArg(), signature, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO ledger_entries`).WillReturnResult(sqlmock.NewResult(1, 1))
+	expectEvent(mock, EventFundsDeposited, walletID)
+	mock.ExpectCommit()
+
+	_, err := svc.Deposit(ctx, walletID, usd(100))
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	public := svc.chainKey.Public().(ed25519.PublicKey)
+	assert.True(t, VerifyCheckpoint(public, &ChainCheckpoint{Seq: chainCheckpointInterval, Hash: hash.value.(string), Signature: signature.value.(string)}))
+}
+
+/*
+*
+
+	API CLIENT Test Cases
+
+*
+*/
+
+func TestUseNonce_Replay(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+	repo := NewPostgresRepository(db)
+
+	clientID, expires := uuid.New(), time.Now().Add(DefaultSignatureWindow)
+	mock.ExpectExec(`INSERT INTO api_nonces .+ ON CONFLICT \(client_id, nonce\) DO NOTHING`).
+		WithArgs(clientID, "0123456789abcdef", expires).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO api_nonces .+ ON CONFLICT \(client_id, nonce\) DO NOTHING`).
+		WithArgs(clientID, "0123456789abcdef", expires).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.UseNonce(ctx, clientID, "0123456789abcdef", expires))
+	assert.Equal(t, ErrNonceReused, repo.UseNonce(ctx, clientID, "0123456789abcdef", expires))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRotateAPIKey_LocksClient(t *testing.T) {
+	ctx := context.Background()
+	svc, mock, cleanup := newTestService(t)
+	defer cleanup()
+
+	clientID, created := uuid.New(), time.Now().Add(-time.Hour)
+	oldSeed := strings.Repeat("0a", apiKeyBytes)
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .+ FROM api_clients WHERE id = \$1 FOR UPDATE`).
+		WithArgs(clientID).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name", "scopes", "key_prefix", "key_seed", "prev_key_seed",
+			"prev_key_expires_at", "revoked_at", "created_at", "updated_at"}).
+			AddRow(clientID, "payments", "{read,deposit}", "wk_old", oldSeed, nil, nil, nil, created, created))
+	mock.ExpectExec(`UPDATE api_clients SET key_prefix = \$1, key_seed = \$2, prev_key_seed = \$3`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), oldSeed, sqlmock.AnyArg(), nil, sqlmock.AnyArg(), clientID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	issued, err := svc.RotateAPIKey(ctx, clientID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ScopeRead, ScopeDeposit}, issued.Client.Scopes)
+	seed, err := hex.DecodeString(issued.Client.KeySeed)
+	assert.NoError(t, err)
+	assert.Equal(t, issued.APIKey, svc.deriveAPIKey(seed))
+	assert.Equal(t, oldSeed, issued.Client.PrevKeySeed)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,227 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// ProblemContentType is the media type of every error response (RFC 7807).
+const ProblemContentType = "application/problem+json"
+
+// problemTypePrefix is prepended to the code to form the type URI of a problem.
+const problemTypePrefix = "urn:wallet-go:problem:"
+
+// CorrelationIDHeader carries the ID under which an internal error was logged.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// StatusClientClosedRequest is the status of a request the client gave up on
+// before it was answered (nginx's 499). Nobody reads the response, it is
+// written for the access log.
+const StatusClientClosedRequest = 499
+
+// Codes of errors raised by the handlers rather than the service.
+const (
+	CodeInvalidRequest      = "INVALID_REQUEST"       // Malformed body, path or query parameter
+	CodeRouteNotFound       = "ROUTE_NOT_FOUND"       // No endpoint at this path
+	CodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"    // The endpoint does not take this method
+	CodeClientClosedRequest = "CLIENT_CLOSED_REQUEST" // The client went away, the work was cancelled
+	CodeRequestTimeout      = "REQUEST_TIMEOUT"       // The deadline of the route passed, the work was cancelled
+	CodeInternal            = "INTERNAL_ERROR"        // Anything unexpected, details are only logged
+)
+
+// Problem is the RFC 7807 body of every error response.
+type Problem struct {
+	Type          string      `json:"type"`                     // urn:wallet-go:problem:<code>
+	Title         string      `json:"title"`                    // Text of the status code
+	Status        int         `json:"status"`                   // HTTP status code
+	Detail        string      `json:"detail,omitempty"`         // What went wrong with this request
+	Instance      string      `json:"instance,omitempty"`       // Path of the request
+	Code          string      `json:"code"`                     // Stable machine-readable code, e.g. WALLET_NOT_FOUND
+	CorrelationID string      `json:"correlation_id,omitempty"` // Set on internal errors, quoted in the server log
+	Limit         *LimitError `json:"limit,omitempty"`          // Limit that refused the request, optional
+}
+
+// Error is an error with a stable code and the HTTP status it is answered
+// with. Errors of the service are mapped through errorCodes instead.
+type Error struct {
+	Code   string
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// badRequest returns a 400 error for a malformed request.
+func badRequest(detail string) *Error {
+	return &Error{Code: CodeInvalidRequest, Status: http.StatusBadRequest, Err: errors.New(detail)}
+}
+
+// errInvalidJSON is the error of a request body that is not valid JSON.
+var errInvalidJSON = badRequest("Invalid JSON body")
+
+// errorCodes maps the errors of the service to their code and status: 404
+// for missing resources, 409 when the state of a resource forbids the
+// request and 422 for requests that are well-formed but not acceptable.
+// ErrUnbalancedEntries, ErrLedgerMismatch, ErrInvalidRate and
+// ErrInvalidFeeRule are bugs or bad configuration and are answered like any
+// other internal error. Work cancelled because the client went away is
+// answered with 499, work cut off by the deadline of its route with 503.
+var errorCodes = []struct {
+	err    error
+	code   string
+	status int
+}{
+	{ErrWalletNotFound, "WALLET_NOT_FOUND", http.StatusNotFound},
+	{ErrUserNotFound, "USER_NOT_FOUND", http.StatusNotFound},
+	{ErrQuoteNotFound, "QUOTE_NOT_FOUND", http.StatusNotFound},
+	{ErrHoldNotFound, "HOLD_NOT_FOUND", http.StatusNotFound},
+	{ErrTransactionNotFound, "TRANSACTION_NOT_FOUND", http.StatusNotFound},
+	{ErrTransactionNotChained, "TRANSACTION_NOT_CHAINED", http.StatusNotFound},
+	{ErrWebhookNotFound, "WEBHOOK_NOT_FOUND", http.StatusNotFound},
+	{ErrDeliveryNotFound, "DELIVERY_NOT_FOUND", http.StatusNotFound},
+	{ErrScheduleNotFound, "SCHEDULE_NOT_FOUND", http.StatusNotFound},
+	{ErrAPIClientNotFound, "API_CLIENT_NOT_FOUND", http.StatusNotFound},
+
+	{ErrQuoteExpired, "QUOTE_EXPIRED", http.StatusConflict},
+	{ErrQuoteExecuted, "QUOTE_EXECUTED", http.StatusConflict},
+	{ErrHoldNotActive, "HOLD_NOT_ACTIVE", http.StatusConflict},
+	{ErrHoldExpired, "HOLD_EXPIRED", http.StatusConflict},
+	{ErrAlreadyReversed, "ALREADY_REVERSED", http.StatusConflict},
+	{ErrFundsAlreadySpent, "FUNDS_ALREADY_SPENT", http.StatusConflict},
+	{ErrWalletFrozen, "WALLET_FROZEN", http.StatusConflict},
+	{ErrWalletClosed, "WALLET_CLOSED", http.StatusConflict},
+	{ErrInboundBlocked, "INBOUND_BLOCKED", http.StatusConflict},
+	{ErrOutboundBlocked, "OUTBOUND_BLOCKED", http.StatusConflict},
+	{ErrInvalidTransition, "INVALID_TRANSITION", http.StatusConflict},
+	{ErrWalletNotEmpty, "WALLET_NOT_EMPTY", http.StatusConflict},
+	{ErrDeliveryNotDue, "DELIVERY_NOT_DUE", http.StatusConflict},
+	{ErrScheduleNotDue, "SCHEDULE_NOT_DUE", http.StatusConflict},
+	{ErrScheduleFinished, "SCHEDULE_FINISHED", http.StatusConflict},
+	{ErrRunAlreadyExecuted, "RUN_ALREADY_EXECUTED", http.StatusConflict},
+	{ErrAPIClientRevoked, "API_CLIENT_REVOKED", http.StatusConflict},
+	{ErrIdempotencyKeyInUse, "IDEMPOTENCY_KEY_IN_USE", http.StatusConflict},
+
+	{ErrInsufficientFunds, "INSUFFICIENT_FUNDS", http.StatusUnprocessableEntity},
+	{ErrLimitExceeded, "LIMIT_EXCEEDED", http.StatusUnprocessableEntity},
+	{ErrInvalidAmount, "INVALID_AMOUNT", http.StatusUnprocessableEntity},
+	{ErrSameWalletTransfer, "SAME_WALLET_TRANSFER", http.StatusUnprocessableEntity},
+	{ErrSourceInvalid, "SENDER_NOT_FOUND", http.StatusUnprocessableEntity},
+	{ErrDestinationInvalid, "RECIPIENT_NOT_FOUND", http.StatusUnprocessableEntity},
+	{ErrCurrencyRequired, "CURRENCY_REQUIRED", http.StatusUnprocessableEntity},
+	{ErrUnsupportedCurrency, "UNSUPPORTED_CURRENCY", http.StatusUnprocessableEntity},
+	{ErrCurrencyMismatch, "CURRENCY_MISMATCH", http.StatusUnprocessableEntity},
+	{ErrInvalidDecimal, "INVALID_DECIMAL", http.StatusUnprocessableEntity},
+	{ErrRateUnavailable, "RATE_UNAVAILABLE", http.StatusUnprocessableEntity},
+	{ErrInvalidFilter, "INVALID_FILTER", http.StatusUnprocessableEntity},
+	{ErrInvalidCursor, "INVALID_CURSOR", http.StatusUnprocessableEntity},
+	{ErrCaptureExceedsHold, "CAPTURE_EXCEEDS_HOLD", http.StatusUnprocessableEntity},
+	{ErrInvalidHoldTTL, "INVALID_HOLD_TTL", http.StatusUnprocessableEntity},
+	{ErrReasonRequired, "REASON_REQUIRED", http.StatusUnprocessableEntity},
+	{ErrNotReversible, "NOT_REVERSIBLE", http.StatusUnprocessableEntity},
+	{ErrReversalTooLarge, "REVERSAL_TOO_LARGE", http.StatusUnprocessableEntity},
+	{ErrInvalidWalletStatus, "INVALID_WALLET_STATUS", http.StatusUnprocessableEntity},
+	{ErrActorRequired, "ACTOR_REQUIRED", http.StatusUnprocessableEntity},
+	{ErrInvalidWalletType, "INVALID_WALLET_TYPE", http.StatusUnprocessableEntity},
+	{ErrLabelTooLong, "LABEL_TOO_LONG", http.StatusUnprocessableEntity},
+	{ErrInvalidTxnType, "INVALID_TXN_TYPE", http.StatusUnprocessableEntity},
+	{ErrInvalidLimit, "INVALID_LIMIT", http.StatusUnprocessableEntity},
+	{ErrInvalidTier, "INVALID_TIER", http.StatusUnprocessableEntity},
+	{ErrInvalidWebhookURL, "INVALID_WEBHOOK_URL", http.StatusUnprocessableEntity},
+	{ErrWebhookAddressBlocked, "WEBHOOK_ADDRESS_BLOCKED", http.StatusUnprocessableEntity},
+	{ErrInvalidEventType, "INVALID_EVENT_TYPE", http.StatusUnprocessableEntity},
+	{ErrInvalidWebhookOwner, "INVALID_WEBHOOK_OWNER", http.StatusUnprocessableEntity},
+	{ErrWebhookSecretShort, "WEBHOOK_SECRET_TOO_SHORT", http.StatusUnprocessableEntity},
+	{ErrInvalidSchedule, "INVALID_SCHEDULE", http.StatusUnprocessableEntity},
+	{ErrInvalidAsOf, "INVALID_AS_OF", http.StatusUnprocessableEntity},
+	{ErrInvalidStatementPeriod, "INVALID_STATEMENT_PERIOD", http.StatusUnprocessableEntity},
+	{ErrInvalidStatementFormat, "INVALID_STATEMENT_FORMAT", http.StatusUnprocessableEntity},
+	{ErrClientNameRequired, "CLIENT_NAME_REQUIRED", http.StatusUnprocessableEntity},
+	{ErrInvalidScope, "INVALID_SCOPE", http.StatusUnprocessableEntity},
+	{ErrIdempotencyKeyReused, "IDEMPOTENCY_KEY_REUSED", http.StatusUnprocessableEntity},
+
+	{ErrUnauthenticated, "UNAUTHENTICATED", http.StatusUnauthorized},
+	{ErrInvalidToken, "INVALID_TOKEN", http.StatusUnauthorized},
+	{ErrInvalidSignature, "INVALID_SIGNATURE", http.StatusUnauthorized},
+	{ErrSignatureExpired, "SIGNATURE_EXPIRED", http.StatusUnauthorized},
+	{ErrInvalidNonce, "INVALID_NONCE", http.StatusUnauthorized},
+	{ErrNonceReused, "NONCE_REUSED", http.StatusUnauthorized},
+	{ErrForbidden, "FORBIDDEN", http.StatusForbidden},
+
+	{context.Canceled, CodeClientClosedRequest, StatusClientClosedRequest},
+	{context.DeadlineExceeded, CodeRequestTimeout, http.StatusServiceUnavailable},
+}
+
+// AsError returns the code and status of err. Errors without one are
+// internal errors with status 500.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return &Error{Code: c.code, Status: c.status, Err: err}
+		}
+	}
+	return &Error{Code: CodeInternal, Status: http.StatusInternalServerError, Err: err}
+}
+
+// writeError writes err as a problem. The detail of internal errors is only
+// logged, under a correlation ID that is returned to the caller instead.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := AsError(err)
+	// The driver reports a cancelled query with its own error, so an
+	// internal error of a request that was cancelled is the cancellation
+	if ctxErr := r.Context().Err(); ctxErr != nil && e.Status == http.StatusInternalServerError {
+		e = AsError(ctxErr)
+	}
+	title := http.StatusText(e.Status)
+	if e.Status == StatusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+	p := Problem{
+		Type:     problemTypePrefix + e.Code,
+		Title:    title,
+		Status:   e.Status,
+		Detail:   e.Error(),
+		Instance: r.URL.Path,
+		Code:     e.Code,
+	}
+
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		p.Limit = limitErr
+	}
+	if e.Status >= http.StatusInternalServerError {
+		p.CorrelationID = uuid.NewString()
+		p.Detail = "The request could not be completed, quote the correlation_id when reporting it"
+		log.Printf("Internal error %s on %s %s: %v", p.CorrelationID, r.Method, r.URL.Path, err)
+		w.Header().Set(CorrelationIDHeader, p.CorrelationID)
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound answers requests to unknown paths with a problem.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, &Error{Code: CodeRouteNotFound, Status: http.StatusNotFound, Err: errors.New("no endpoint at this path")})
+}
+
+// MethodNotAllowed answers requests with a method the path does not take.
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, &Error{Code: CodeMethodNotAllowed, Status: http.StatusMethodNotAllowed,
+		Err: errors.New("method not allowed at this path")})
+}
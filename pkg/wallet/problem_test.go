@@ -0,0 +1,112 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"not found", ErrWalletNotFound, http.StatusNotFound, "WALLET_NOT_FOUND"},
+		{"state conflict", ErrQuoteExecuted, http.StatusConflict, "QUOTE_EXECUTED"},
+		{"business rule", ErrInsufficientFunds, http.StatusUnprocessableEntity, "INSUFFICIENT_FUNDS"},
+		{"wrapped", fmt.Errorf("%w: limit must be a positive integer", ErrInvalidFilter), http.StatusUnprocessableEntity, "INVALID_FILTER"},
+		{"auth", invalidToken("token has expired"), http.StatusUnauthorized, "INVALID_TOKEN"},
+		{"malformed request", errInvalidJSON, http.StatusBadRequest, CodeInvalidRequest},
+		{"client went away", fmt.Errorf("listing transactions: %w", context.Canceled), StatusClientClosedRequest, CodeClientClosedRequest},
+		{"deadline passed", context.DeadlineExceeded, http.StatusServiceUnavailable, CodeRequestTimeout},
+		{"bug", ErrUnbalancedEntries, http.StatusInternalServerError, CodeInternal},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			writeError(res, httptest.NewRequest(http.MethodGet, "/wallet/abc/balance", nil), tc.err)
+
+			var p Problem
+			assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &p))
+			assert.Equal(t, tc.wantStatus, res.Code)
+			assert.Equal(t, ProblemContentType, res.Header().Get("Content-Type"))
+			assert.Equal(t, tc.wantStatus, p.Status)
+			assert.Equal(t, tc.wantCode, p.Code)
+			assert.Equal(t, "urn:wallet-go:problem:"+tc.wantCode, p.Type)
+			assert.Equal(t, "/wallet/abc/balance", p.Instance)
+		})
+	}
+}
+
+func TestWriteError_MasksInternalErrors(t *testing.T) {
+	res := httptest.NewRecorder()
+	writeError(res, httptest.NewRequest(http.MethodGet, "/wallet/abc/balance", nil), errors.New("pq: password authentication failed"))
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &p))
+	assert.Equal(t, http.StatusInternalServerError, res.Code)
+	assert.NotContains(t, res.Body.String(), "pq:")
+	assert.NotEmpty(t, p.CorrelationID)
+	assert.Equal(t, p.CorrelationID, res.Header().Get(CorrelationIDHeader))
+}
+
+func TestWriteError_CancelledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/wallet/abc/transactions", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+
+	// The driver's error of a cancelled query is not a context error
+	writeError(res, req, errors.New("pq: canceling statement due to user request"))
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &p))
+	assert.Equal(t, StatusClientClosedRequest, res.Code)
+	assert.Equal(t, "Client Closed Request", p.Title)
+	assert.Equal(t, CodeClientClosedRequest, p.Code)
+	assert.Empty(t, p.CorrelationID)
+}
+
+func TestWriteError_Limit(t *testing.T) {
+	res := httptest.NewRecorder()
+	limitErr := &LimitError{TxnType: TxnTypeWithdrawal, Period: LimitDaily, Kind: LimitKindAmount, Limit: 1000, Remaining: 250, Currency: "USD"}
+	writeError(res, httptest.NewRequest(http.MethodPost, "/wallet/abc/withdraw", nil), limitErr)
+
+	var p Problem
+	assert.NoError(t, json.Unmarshal(res.Body.Bytes(), &p))
+	assert.Equal(t, "LIMIT_EXCEEDED", p.Code)
+	assert.Equal(t, limitErr, p.Limit)
+	assert.Equal(t, limitErr.Error(), p.Detail)
+}
+
+func TestGetBalance_ServiceErrors(t *testing.T) {
+	mock := &mockService{
+		MockGetBalance: func(ctx context.Context, walletID uuid.UUID) (*Balance, error) {
+			if walletID == uuid.Nil {
+				return nil, ErrWalletNotFound
+			}
+			return nil, errors.New("connection refused")
+		},
+	}
+	h := NewHandler(mock)
+
+	for id, want := range map[string]int{uuid.Nil.String(): http.StatusNotFound, uuid.NewString(): http.StatusInternalServerError} {
+		req := httptest.NewRequest(http.MethodGet, "/wallet/"+id+"/balance", nil)
+		req = mux.SetURLVars(req, map[string]string{"wallet_id": id})
+		res := httptest.NewRecorder()
+
+		h.GetBalance(res, req)
+		assert.Equal(t, want, res.Code)
+		assert.NotContains(t, res.Body.String(), "connection refused")
+	}
+}
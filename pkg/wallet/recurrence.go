@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five field cron expression: minute, hour, day of month,
+// month and day of week. Each field is a bit set of the values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool // the field was "*", see matchesDay
+}
+
+// cronField is the allowed range of one cron field.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+// parseCron parses expressions such as "0 9 1 * *" (09:00 on the 1st of every
+// month) or "30 8 * * 1-5" (08:30 on weekdays). Fields are lists of values,
+// ranges ("1-5") and steps ("*/15", "0-30/10"); day of week 0 and 7 are Sunday.
+func parseCron(expr string) (*cronSpec, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("%w: cron expression needs 5 fields, got %d", ErrInvalidSchedule, len(parts))
+	}
+
+	var sets [5]uint64
+	for i, part := range parts {
+		set, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	// Sunday can be written as 0 or 7
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSpec{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domAny: parts[2] == "*", dowAny: parts[4] == "*"}, nil
+}
+
+// parseCronField parses one comma separated cron field into a bit set.
+func parseCronField(field string, f cronField) (uint64, error) {
+	invalid := fmt.Errorf("%w: invalid cron %s %q", ErrInvalidSchedule, f.name, field)
+
+	var set uint64
+	for _, item := range strings.Split(field, ",") {
+		rng, step := item, 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, invalid
+			}
+			rng, step = item[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			a, errA := strconv.Atoi(bounds[0])
+			b, errB := strconv.Atoi(bounds[1])
+			if errA != nil || errB != nil || a > b {
+				return 0, invalid
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, invalid
+			}
+			lo, hi = n, n
+			if step > 1 {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max {
+			return 0, invalid
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// matchesDay follows cron: when both day of month and day of week are
+// restricted a day matching either one matches.
+func (c *cronSpec) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first minute matching the expression strictly after t, in
+// UTC, or false when none comes within five years (e.g. "0 0 31 2 *").
+func (c *cronSpec) next(t time.Time) (time.Time, bool) {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// addMonths adds n months to t, keeping its day unless the month is shorter:
+// Jan 31 plus one month is the last day of February.
+func addMonths(t time.Time, n int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+// nextOccurrence returns the first run time of a schedule strictly after t,
+// or false when the frequency has none left. End date and maximum runs are
+// applied by the caller.
+func nextOccurrence(sch *scheduledTransfer, t time.Time) (time.Time, bool) {
+	start := sch.StartAt.UTC()
+	if t.Before(start) {
+		t = start.Add(-time.Nanosecond)
+	}
+
+	switch sch.Frequency {
+	case ScheduleOnce:
+		if start.After(t) {
+			return start, true
+		}
+		return time.Time{}, false
+	case ScheduleDaily, ScheduleWeekly:
+		days := 1
+		if sch.Frequency == ScheduleWeekly {
+			days = 7
+		}
+		// Estimate from the elapsed time, then step to the first occurrence after t
+		n := int(t.Sub(start)/(time.Duration(days)*24*time.Hour)) - 1
+		if n < 0 {
+			n = 0
+		}
+		for {
+			occ := start.AddDate(0, 0, n*days)
+			if occ.After(t) {
+				return occ, true
+			}
+			n++
+		}
+	case ScheduleMonthly:
+		n := (t.Year()-start.Year())*12 + int(t.Month()-start.Month()) - 1
+		if n < 0 {
+			n = 0
+		}
+		for {
+			occ := addMonths(start, n)
+			if occ.After(t) {
+				return occ, true
+			}
+			n++
+		}
+	case ScheduleCron:
+		spec, err := parseCron(sch.Cron)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return spec.next(t)
+	}
+	return time.Time{}, false
+}
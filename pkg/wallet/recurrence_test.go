@@ -0,0 +1,93 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestParseCron(t *testing.T) {
+	spec, err := parseCron("*/15 9-17 * * 1-5")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1|1<<15|1<<30|1<<45), spec.minute)
+	assert.True(t, spec.domAny)
+	assert.False(t, spec.dowAny)
+
+	// Sunday can be written as 7
+	spec, err = parseCron("0 0 * * 7")
+	assert.NoError(t, err)
+	assert.NotZero(t, spec.dow&1)
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(expr)
+		assert.True(t, errors.Is(err, ErrInvalidSchedule), expr)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		expr, after, want string
+	}{
+		{"0 9 1 * *", "2024-01-15T10:00:00Z", "2024-02-01T09:00:00Z"},
+		{"30 8 * * 1-5", "2024-03-08T09:00:00Z", "2024-03-11T08:30:00Z"}, // Friday to Monday
+		{"*/15 * * * *", "2024-03-08T09:00:00Z", "2024-03-08T09:15:00Z"}, // strictly after
+		{"0 0 29 2 *", "2024-03-01T00:00:00Z", "2028-02-29T00:00:00Z"},
+		{"0 12 13 * 5", "2024-01-01T00:00:00Z", "2024-01-05T12:00:00Z"}, // the 13th or a Friday
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		assert.NoError(t, err)
+		got, ok := spec.next(utc(tt.after))
+		assert.True(t, ok, tt.expr)
+		assert.Equal(t, utc(tt.want), got, tt.expr)
+	}
+
+	spec, _ := parseCron("0 0 31 2 *")
+	_, ok := spec.next(utc("2024-01-01T00:00:00Z"))
+	assert.False(t, ok)
+}
+
+func TestAddMonths(t *testing.T) {
+	assert.Equal(t, utc("2024-02-29T09:00:00Z"), addMonths(utc("2024-01-31T09:00:00Z"), 1))
+	assert.Equal(t, utc("2024-04-30T09:00:00Z"), addMonths(utc("2024-01-31T09:00:00Z"), 3))
+	assert.Equal(t, utc("2025-01-15T09:00:00Z"), addMonths(utc("2024-12-15T09:00:00Z"), 1))
+}
+
+func TestNextOccurrence(t *testing.T) {
+	start := utc("2024-01-31T09:00:00Z")
+	tests := []struct {
+		frequency, after, want string
+	}{
+		{ScheduleOnce, "2024-01-01T00:00:00Z", "2024-01-31T09:00:00Z"},
+		{ScheduleDaily, "2024-01-31T09:00:00Z", "2024-02-01T09:00:00Z"},
+		{ScheduleDaily, "2024-03-10T12:00:00Z", "2024-03-11T09:00:00Z"},
+		{ScheduleWeekly, "2024-02-07T08:59:00Z", "2024-02-07T09:00:00Z"},
+		{ScheduleWeekly, "2024-02-07T09:00:00Z", "2024-02-14T09:00:00Z"},
+		// Monthly keeps the day of the start date when the month allows it
+		{ScheduleMonthly, "2024-01-31T09:00:00Z", "2024-02-29T09:00:00Z"},
+		{ScheduleMonthly, "2024-02-29T09:00:00Z", "2024-03-31T09:00:00Z"},
+	}
+	for _, tt := range tests {
+		sch := &scheduledTransfer{Frequency: tt.frequency, StartAt: start}
+		got, ok := nextOccurrence(sch, utc(tt.after))
+		assert.True(t, ok, tt.frequency)
+		assert.Equal(t, utc(tt.want), got, tt.frequency+" after "+tt.after)
+	}
+
+	_, ok := nextOccurrence(&scheduledTransfer{Frequency: ScheduleOnce, StartAt: start}, start)
+	assert.False(t, ok)
+
+	got, ok := nextOccurrence(&scheduledTransfer{Frequency: ScheduleCron, Cron: "0 12 * * *", StartAt: start}, utc("2024-01-01T00:00:00Z"))
+	assert.True(t, ok)
+	assert.Equal(t, utc("2024-01-31T12:00:00Z"), got)
+}
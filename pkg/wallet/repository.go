@@ -0,0 +1,196 @@
+package wallet
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Repository is the storage used by the service. Besides the auto-committed
+// Queries it can run a group of Queries as one atomic, isolated transaction.
+type Repository interface {
+	Queries
+
+	// RunInTx runs fn inside a single transaction. The transaction commits when
+	// fn returns nil and rolls back, undoing every write made through q, when
+	// fn returns an error.
+	RunInTx(ctx context.Context, fn func(q Queries) error) error
+}
+
+// Queries are the storage operations available inside and outside a transaction.
+type Queries interface {
+	// EnsureUser stores a user unless it already exists
+	EnsureUser(ctx context.Context, userID uuid.UUID) error
+	// UserExists checks if the user exists
+	UserExists(ctx context.Context, userID uuid.UUID) (bool, error)
+	// ListWallets returns the wallets of a user, oldest first
+	ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error)
+	// ListWalletIDs returns the IDs of all wallets, for batch jobs
+	ListWalletIDs(ctx context.Context) ([]uuid.UUID, error)
+	// WalletExists checks if the wallet exists
+	WalletExists(ctx context.Context, walletID uuid.UUID) (bool, error)
+	// InsertWallet stores a new wallet
+	InsertWallet(ctx context.Context, w *wallet) error
+	// EnsureWallet stores a wallet unless one with its ID already exists
+	EnsureWallet(ctx context.Context, w *wallet) error
+	// GetWallet returns a wallet or ErrWalletNotFound
+	GetWallet(ctx context.Context, walletID uuid.UUID) (*wallet, error)
+	// LockWallets locks the wallets until the transaction ends and returns them.
+	// Locks are taken in UUID order so callers cannot deadlock.
+	LockWallets(ctx context.Context, walletIDs ...uuid.UUID) (map[uuid.UUID]*wallet, error)
+	// UpdateWalletState stores the status and blocks of a wallet
+	UpdateWalletState(ctx context.Context, w *wallet) error
+	// UpdateWalletLimits stores the limit tier and limit overrides of a wallet
+	UpdateWalletLimits(ctx context.Context, w *wallet) error
+	// InsertWalletStateEvent stores the audit record of a state change
+	InsertWalletStateEvent(ctx context.Context, e *walletStateEvent) error
+	// ListWalletStateEvents returns the state changes of a wallet, oldest first
+	ListWalletStateEvents(ctx context.Context, walletID uuid.UUID) ([]walletStateEvent, error)
+	// AdjustBalance adds delta (which may be negative) to the stored wallet balance
+	AdjustBalance(ctx context.Context, walletID uuid.UUID, delta int64) error
+	// AdjustHeld adds delta (which may be negative) to the amount held on a wallet
+	AdjustHeld(ctx context.Context, walletID uuid.UUID, delta int64) error
+	// SumTransactions returns the total amount and the number of transactions of
+	// the given types created since a time, sent by the wallet or, for deposits,
+	// received
+	SumTransactions(ctx context.Context, walletID uuid.UUID, txnTypes []string, since time.Time) (int64, int64, error)
+	// InsertTransaction stores a transaction record
+	InsertTransaction(ctx context.Context, txn *transaction) error
+	// LockChainHead locks the head of the transaction hash chain until the transaction ends and returns it
+	LockChainHead(ctx context.Context) (*chainHead, error)
+	// UpdateChainHead stores the head of the hash chain after a transaction was appended
+	UpdateChainHead(ctx context.Context, head *chainHead) error
+	// GetChainHead returns the head of the hash chain
+	GetChainHead(ctx context.Context) (*chainHead, error)
+	// GetChainedTransaction returns a transaction with its chain fields, or ErrTransactionNotFound
+	GetChainedTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error)
+	// ListChainedTransactions returns up to limit transactions with a chain
+	// position after afterSeq, with their chain fields, in chain order
+	ListChainedTransactions(ctx context.Context, afterSeq int64, limit int) ([]transaction, error)
+	// InsertChainCheckpoint stores a checkpoint of the hash chain
+	InsertChainCheckpoint(ctx context.Context, cp *ChainCheckpoint) error
+	// NextChainCheckpoint returns the first checkpoint at or after seq, or nil when there is none
+	NextChainCheckpoint(ctx context.Context, seq int64) (*ChainCheckpoint, error)
+	// LockTransaction locks a transaction until the transaction ends and returns it, or ErrTransactionNotFound
+	LockTransaction(ctx context.Context, txnID uuid.UUID) (*transaction, error)
+	// AddReversedAmount adds amount to the reversed part of a transaction
+	AddReversedAmount(ctx context.Context, txnID uuid.UUID, amount int64) error
+	// InsertEntries stores the journal lines of a transaction
+	InsertEntries(ctx context.Context, txnID uuid.UUID, entries []ledgerEntry) error
+	// LedgerBalance returns total credits minus total debits posted to an account in a currency
+	LedgerBalance(ctx context.Context, accountID uuid.UUID, currency string) (int64, error)
+	// ListWalletLedgerBalances returns the stored balance, held amount and journal
+	// balance of every wallet, read at one point in time, ordered by wallet ID
+	ListWalletLedgerBalances(ctx context.Context) ([]walletLedgerBalance, error)
+	// LedgerNetByCurrency returns total credits minus total debits over the whole journal per currency
+	LedgerNetByCurrency(ctx context.Context) (map[string]int64, error)
+	// ListUnbalancedTransactions returns up to limit transactions without journal
+	// lines or whose lines do not balance in some currency, ordered by ID
+	ListUnbalancedTransactions(ctx context.Context, limit int) ([]uuid.UUID, error)
+	// LedgerNetChange returns total credits minus total debits posted to an
+	// account in a currency by transactions created in [from, to)
+	LedgerNetChange(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) (int64, error)
+	// ListAccountMovements returns the transactions created in [from, to) that
+	// posted to an account in a currency, with their net change, oldest first
+	ListAccountMovements(ctx context.Context, accountID uuid.UUID, currency string, from, to time.Time) ([]accountMovement, error)
+	// InsertBalanceSnapshot stores the balance of a wallet at a time, keeping an
+	// existing snapshot of the same wallet and time
+	InsertBalanceSnapshot(ctx context.Context, snap *balanceSnapshot) error
+	// LatestBalanceSnapshot returns the last snapshot of a wallet at or before a
+	// time, or nil when there is none
+	LatestBalanceSnapshot(ctx context.Context, walletID uuid.UUID, at time.Time) (*balanceSnapshot, error)
+	// InsertQuote stores a new FX quote
+	InsertQuote(ctx context.Context, quote *fxQuote) error
+	// GetQuote returns a quote or ErrQuoteNotFound
+	GetQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error)
+	// LockQuote locks a quote until the transaction ends and returns it, or ErrQuoteNotFound
+	LockQuote(ctx context.Context, quoteID uuid.UUID) (*fxQuote, error)
+	// MarkQuoteExecuted links a quote to the transaction that executed it
+	MarkQuoteExecuted(ctx context.Context, quoteID, txnID uuid.UUID) error
+	// InsertHold stores a new hold
+	InsertHold(ctx context.Context, h *hold) error
+	// GetHold returns a hold or ErrHoldNotFound
+	GetHold(ctx context.Context, holdID uuid.UUID) (*hold, error)
+	// LockHold locks a hold until the transaction ends and returns it, or ErrHoldNotFound
+	LockHold(ctx context.Context, holdID uuid.UUID) (*hold, error)
+	// UpdateHold stores the status, captured amount and capture transaction of a hold
+	UpdateHold(ctx context.Context, h *hold) error
+	// ListExpiredHolds returns up to limit active holds that expired at or before now
+	ListExpiredHolds(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error)
+	// InsertEvent appends an event to the outbox
+	InsertEvent(ctx context.Context, e *Event) error
+	// LockUnpublishedEvents locks up to limit unpublished events until the
+	// transaction ends and returns them in Seq order
+	LockUnpublishedEvents(ctx context.Context, limit int) ([]Event, error)
+	// ClaimEvents sets the time until which the events with the given Seq are
+	// published by one relay; a claim until now releases them
+	ClaimEvents(ctx context.Context, seqs []int64, until time.Time) error
+	// MarkEventsPublished records that the events with the given Seq were published
+	MarkEventsPublished(ctx context.Context, seqs []int64, at time.Time) error
+	// InsertWebhookSubscription stores a new webhook subscription
+	InsertWebhookSubscription(ctx context.Context, sub *webhookSubscription) error
+	// GetWebhookSubscription returns a subscription or ErrWebhookNotFound
+	GetWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error)
+	// ListWebhookSubscriptions returns the subscriptions of a wallet or of a user, oldest first
+	ListWebhookSubscriptions(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error)
+	// ListEventWebhooks returns the active subscriptions of any of the wallets or
+	// of their owners
+	ListEventWebhooks(ctx context.Context, walletIDs []uuid.UUID) ([]webhookSubscription, error)
+	// UpdateWebhookSubscription stores the url, event types, secret and active flag of a subscription
+	UpdateWebhookSubscription(ctx context.Context, sub *webhookSubscription) error
+	// DeleteWebhookSubscription deletes a subscription with its deliveries and attempts, or returns ErrWebhookNotFound
+	DeleteWebhookSubscription(ctx context.Context, subscriptionID uuid.UUID) error
+	// InsertWebhookDelivery stores a new delivery
+	InsertWebhookDelivery(ctx context.Context, d *webhookDelivery) error
+	// ListDueWebhookDeliveries returns up to limit pending deliveries due at or before now, oldest first
+	ListDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error)
+	// GetWebhookDelivery returns a delivery or ErrDeliveryNotFound
+	GetWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error)
+	// LockWebhookDelivery locks a delivery until the transaction ends and returns it, or ErrDeliveryNotFound
+	LockWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error)
+	// UpdateWebhookDelivery stores the status, attempts, next attempt, last error and claim of a delivery
+	UpdateWebhookDelivery(ctx context.Context, d *webhookDelivery) error
+	// ListWebhookDeliveries returns the deliveries of a subscription, newest first
+	ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID, limit int) ([]webhookDelivery, error)
+	// InsertWebhookAttempt stores the log entry of a delivery attempt
+	InsertWebhookAttempt(ctx context.Context, a *webhookAttempt) error
+	// ListWebhookAttempts returns the attempts of a delivery, oldest first
+	ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error)
+	// InsertSchedule stores a new scheduled transfer
+	InsertSchedule(ctx context.Context, sch *scheduledTransfer) error
+	// GetSchedule returns a scheduled transfer or ErrScheduleNotFound
+	GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error)
+	// LockSchedule locks a scheduled transfer until the transaction ends and returns it, or ErrScheduleNotFound
+	LockSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error)
+	// UpdateSchedule stores the changeable fields and run state of a scheduled transfer
+	UpdateSchedule(ctx context.Context, sch *scheduledTransfer) error
+	// ListSchedules returns the scheduled transfers sent from a wallet, oldest first
+	ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error)
+	// ListDueSchedules returns up to limit active schedules whose next attempt is due at now, oldest first
+	ListDueSchedules(ctx context.Context, now time.Time, limit int) ([]uuid.UUID, error)
+	// InsertScheduleRun stores a run, or returns ErrRunAlreadyExecuted when a
+	// run with the same idempotency key exists
+	InsertScheduleRun(ctx context.Context, run *scheduleRun) error
+	// ListScheduleRuns returns up to limit runs of a schedule, newest first
+	ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID, limit int) ([]scheduleRun, error)
+	// InsertAPIClient stores a new API client
+	InsertAPIClient(ctx context.Context, c *apiClient) error
+	// GetAPIClient returns an API client or ErrAPIClientNotFound
+	GetAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error)
+	// LockAPIClient locks an API client until the transaction ends and returns it, or ErrAPIClientNotFound
+	LockAPIClient(ctx context.Context, clientID uuid.UUID) (*apiClient, error)
+	// UpdateAPIClient stores the keys and revocation of an API client
+	UpdateAPIClient(ctx context.Context, c *apiClient) error
+	// ListAPIClients returns all API clients, oldest first
+	ListAPIClients(ctx context.Context) ([]apiClient, error)
+	// UseNonce records the nonce of a signed request, or returns ErrNonceReused
+	// when the client already sent it
+	UseNonce(ctx context.Context, clientID uuid.UUID, nonce string, expiresAt time.Time) error
+	// DeleteExpiredNonces deletes the nonces whose replay window ended at or
+	// before now and returns how many were deleted
+	DeleteExpiredNonces(ctx context.Context, now time.Time) (int64, error)
+	// ListTransactions returns up to q.Limit transactions of a wallet matching q,
+	// ordered by (created_at, id) descending
+	ListTransactions(ctx context.Context, walletID uuid.UUID, q transactionQuery) ([]transaction, error)
+}
@@ -0,0 +1,157 @@
+package wallet
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reverse posts a compensating transaction that moves amount of txnID back
+// from its receiver to its sender. A zero amount reverses whatever has not been
+// reversed yet; smaller amounts are partial refunds and can be repeated until
+// the whole original amount is reversed. The receiver must still have the funds
+// available unless allowNegative is set, which lets an operator push the
+// receiver's balance below zero. Fees charged on the original are not refunded.
+func (s *service) Reverse(ctx context.Context, txnID uuid.UUID, amount int64, reason string, allowNegative bool) (uuid.UUID, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return uuid.Nil, ErrReasonRequired
+	}
+	if amount < 0 {
+		return uuid.Nil, ErrInvalidAmount
+	}
+
+	var txnId uuid.UUID
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the original first so two reversals of it are serialized
+		orig, err := q.LockTransaction(ctx, txnID)
+		if err != nil {
+			return err
+		}
+		if orig.Type == TxnTypeReversal {
+			return ErrNotReversible
+		}
+		remaining := orig.Amount - orig.Reversed
+		if remaining == 0 {
+			return ErrAlreadyReversed
+		}
+		if amount == 0 {
+			amount = remaining
+		}
+		if amount > remaining {
+			return ErrReversalTooLarge
+		}
+
+		// refund goes back to the original sender, taken is what the original
+		// receiver gives back in its own currency
+		refund := Money{Amount: amount, Currency: orig.Currency}
+		taken := refund
+		var fx *fxConversion
+		if orig.FX != nil {
+			taken = Money{Amount: reversalTarget(orig.FX, orig.Reversed, amount), Currency: orig.FX.TargetCurrency}
+			if taken.Amount <= 0 {
+				return ErrInvalidAmount
+			}
+			fx = &fxConversion{Rate: invertRate(orig.FX.Rate), RoundingMode: RoundingHalfEven,
+				SourceAmount: taken.Amount, SourceCurrency: taken.Currency,
+				TargetAmount: refund.Amount, TargetCurrency: refund.Currency}
+		}
+
+		var ids []uuid.UUID
+		for _, id := range []*uuid.UUID{orig.FromWallet, orig.ToWallet} {
+			if id != nil {
+				ids = append(ids, *id)
+			}
+		}
+		wallets, err := q.LockWallets(ctx, ids...)
+		if err != nil {
+			return err
+		}
+		// Frozen and blocked wallets can still be corrected, closed ones are final
+		for _, w := range wallets {
+			if w.Status == WalletClosed {
+				return ErrWalletClosed
+			}
+		}
+
+		// Journal accounts of both sides; deposits and withdrawals used the cash accounts
+		fromAcct, toAcct := AccountCashIn, AccountCashOut
+		if orig.FromWallet != nil {
+			fromAcct = *orig.FromWallet
+		}
+		if orig.ToWallet != nil {
+			toAcct = *orig.ToWallet
+			if !allowNegative && wallets[toAcct].Available() < taken.Amount {
+				return ErrFundsAlreadySpent
+			}
+			if err := q.AdjustBalance(ctx, toAcct, -taken.Amount); err != nil {
+				return err
+			}
+		}
+		if orig.FromWallet != nil {
+			if err := q.AdjustBalance(ctx, fromAcct, refund.Amount); err != nil {
+				return err
+			}
+		}
+
+		// Log the reversal with the sides of the original swapped
+		rev := &transaction{ID: uuid.New(), FromWallet: orig.ToWallet, ToWallet: orig.FromWallet, Amount: taken.Amount,
+			Currency: taken.Currency, Type: TxnTypeReversal, CreatedAt: time.Now(), FX: fx, ReversesID: &orig.ID, Reason: reason, ClientID: s.clientID}
+		if err := s.insertChained(ctx, q, rev); err != nil {
+			return err
+		}
+		txnId = rev.ID
+		if err := q.AddReversedAmount(ctx, orig.ID, amount); err != nil {
+			return err
+		}
+
+		// The mirror image of the original lines
+		entries := entryPair(toAcct, fromAcct, refund)
+		if fx != nil {
+			entries = append(entryPair(toAcct, AccountFX, taken), entryPair(AccountFX, fromAcct, refund)...)
+		}
+		if err := postEntries(ctx, q, txnId, entries); err != nil {
+			return err
+		}
+
+		// The event belongs to the wallet giving the money back, or to the
+		// refunded one when a withdrawal is reversed
+		walletID := fromAcct
+		if rev.FromWallet != nil {
+			walletID = *rev.FromWallet
+		}
+		return recordEvent(ctx, q, EventFundsReversed, walletID, rev)
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return txnId, nil
+}
+
+// reversalTarget returns the part of a conversion's target amount that belongs
+// to reversing amount more of its source, after reversed was already reversed.
+// Each share is rounded cumulatively, so partial reversals that add up to the
+// whole source amount also add up to the whole target amount.
+func reversalTarget(fx *fxConversion, reversed, amount int64) int64 {
+	share := func(source int64) int64 {
+		v := new(big.Rat).SetFrac(
+			new(big.Int).Mul(big.NewInt(source), big.NewInt(fx.TargetAmount)),
+			big.NewInt(fx.SourceAmount))
+		return roundHalfEven(v).Int64()
+	}
+	return share(reversed+amount) - share(reversed)
+}
+
+// invertRate returns the formatted inverse of a recorded rate, or the rate
+// itself when it can not be parsed.
+func invertRate(rate string) string {
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return rate
+	}
+	return formatRate(r.Inv(r))
+}
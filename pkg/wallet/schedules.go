@@ -0,0 +1,377 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// validateFrequency checks the frequency of a schedule and its cron expression.
+func validateFrequency(frequency, cron string) error {
+	switch frequency {
+	case ScheduleOnce, ScheduleDaily, ScheduleWeekly, ScheduleMonthly:
+		if cron != "" {
+			return fmt.Errorf("%w: cron is only allowed with the cron frequency", ErrInvalidSchedule)
+		}
+		return nil
+	case ScheduleCron:
+		_, err := parseCron(cron)
+		return err
+	}
+	return fmt.Errorf("%w: unknown frequency %q", ErrInvalidSchedule, frequency)
+}
+
+// scheduleRunKey is the idempotency key of the run of a schedule at runAt.
+// Only one run per key can move money.
+func scheduleRunKey(scheduleID uuid.UUID, runAt time.Time) string {
+	return fmt.Sprintf("schedule:%s:%d", scheduleID, runAt.Unix())
+}
+
+// finished reports whether a schedule is completed or canceled.
+func (sch *scheduledTransfer) finished() bool {
+	return sch.Status == ScheduleCompleted || sch.Status == ScheduleCanceled
+}
+
+// moveTo makes runAt the next run of the schedule, or completes the schedule
+// when ok is false (the frequency has no run left).
+func (sch *scheduledTransfer) moveTo(runAt time.Time, ok bool) {
+	sch.Attempts = 0
+	sch.NextRunAt, sch.NextAttemptAt = nil, nil
+	if ok {
+		next := runAt
+		sch.NextRunAt, sch.NextAttemptAt = &runAt, &next
+	}
+	sch.completeIfDone()
+}
+
+// completeIfDone completes the schedule when it has no next run, the next run
+// is past the end date or the maximum runs were made.
+func (sch *scheduledTransfer) completeIfDone() {
+	if sch.NextRunAt == nil || (sch.EndAt != nil && sch.NextRunAt.After(*sch.EndAt)) || (sch.MaxRuns > 0 && sch.RunCount >= sch.MaxRuns) {
+		sch.Status, sch.NextRunAt, sch.NextAttemptAt, sch.Attempts = ScheduleCompleted, nil, nil, 0
+	}
+}
+
+// CreateSchedule creates a transfer that runs on a schedule, starting with the
+// first run at or after both StartAt and now.
+func (s *service) CreateSchedule(ctx context.Context, req ScheduleRequest) (*scheduledTransfer, error) {
+	amount, err := s.validateTransfer(ctx, req.FromWallet, req.ToWallet, req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	from, err := s.repo.GetWallet(ctx, req.FromWallet)
+	if err != nil {
+		return nil, err
+	}
+	if from.Currency != amount.Currency {
+		return nil, ErrCurrencyMismatch
+	}
+	if err := validateFrequency(req.Frequency, req.Cron); err != nil {
+		return nil, err
+	}
+	if req.MaxRuns < 0 {
+		return nil, fmt.Errorf("%w: max_runs must not be negative", ErrInvalidSchedule)
+	}
+
+	now := time.Now().UTC()
+	start := req.StartAt.UTC()
+	if req.StartAt.IsZero() {
+		start = now
+	}
+	sch := &scheduledTransfer{ID: uuid.New(), FromWallet: req.FromWallet, ToWallet: req.ToWallet, Amount: amount.Amount,
+		Currency: amount.Currency, Frequency: req.Frequency, Cron: req.Cron, StartAt: start, MaxRuns: req.MaxRuns,
+		Status: ScheduleActive, CreatedAt: now, UpdatedAt: now}
+	if req.EndAt != nil {
+		end := req.EndAt.UTC()
+		sch.EndAt = &end
+	}
+
+	// Runs scheduled before the schedule was created are not made up for
+	first := start
+	if now.After(first) {
+		first = now
+	}
+	sch.moveTo(nextOccurrence(sch, first.Add(-time.Nanosecond)))
+	if sch.Status == ScheduleCompleted {
+		return nil, fmt.Errorf("%w: the schedule has no run before its end", ErrInvalidSchedule)
+	}
+
+	if err := s.repo.InsertSchedule(ctx, sch); err != nil {
+		return nil, err
+	}
+	return sch, nil
+}
+
+// GetSchedule returns a scheduled transfer.
+func (s *service) GetSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	return s.repo.GetSchedule(ctx, scheduleID)
+}
+
+// ListSchedules returns the scheduled transfers sent from a wallet, oldest first.
+func (s *service) ListSchedules(ctx context.Context, walletID uuid.UUID) ([]scheduledTransfer, error) {
+	exists, err := s.repo.WalletExists(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+
+	schedules, err := s.repo.ListSchedules(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if schedules == nil {
+		schedules = []scheduledTransfer{}
+	}
+	return schedules, nil
+}
+
+// UpdateSchedule changes the amount, end or maximum runs of a schedule, or
+// pauses or resumes it. A resumed schedule continues with its first run after
+// now; runs missed while it was paused are skipped.
+func (s *service) UpdateSchedule(ctx context.Context, scheduleID uuid.UUID, update ScheduleUpdate) (*scheduledTransfer, error) {
+	var updated *scheduledTransfer
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		sch, err := q.LockSchedule(ctx, scheduleID)
+		if err != nil {
+			return err
+		}
+		if sch.finished() {
+			return ErrScheduleFinished
+		}
+
+		if update.Amount != nil {
+			if *update.Amount <= 0 {
+				return ErrInvalidAmount
+			}
+			sch.Amount = *update.Amount
+		}
+		if update.EndAt != nil {
+			sch.EndAt = nil
+			if !update.EndAt.IsZero() {
+				end := update.EndAt.UTC()
+				sch.EndAt = &end
+			}
+		}
+		if update.MaxRuns != nil {
+			if *update.MaxRuns < 0 {
+				return fmt.Errorf("%w: max_runs must not be negative", ErrInvalidSchedule)
+			}
+			sch.MaxRuns = *update.MaxRuns
+		}
+
+		now := time.Now().UTC()
+		switch update.Status {
+		case "":
+		case SchedulePaused:
+			sch.Status = SchedulePaused
+		case ScheduleActive:
+			if sch.Status == SchedulePaused {
+				sch.Status = ScheduleActive
+				sch.moveTo(nextOccurrence(sch, now.Add(-time.Nanosecond)))
+			}
+		default:
+			return fmt.Errorf("%w: status must be active or paused", ErrInvalidSchedule)
+		}
+		// A new end or maximum can leave no run
+		sch.completeIfDone()
+		sch.UpdatedAt = now
+
+		if err := q.UpdateSchedule(ctx, sch); err != nil {
+			return err
+		}
+		updated = sch
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// CancelSchedule stops a schedule for good. It is kept with its run history.
+func (s *service) CancelSchedule(ctx context.Context, scheduleID uuid.UUID) (*scheduledTransfer, error) {
+	var canceled *scheduledTransfer
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		sch, err := q.LockSchedule(ctx, scheduleID)
+		if err != nil {
+			return err
+		}
+		if sch.finished() {
+			return ErrScheduleFinished
+		}
+
+		sch.Status, sch.NextRunAt, sch.NextAttemptAt, sch.Attempts = ScheduleCanceled, nil, nil, 0
+		sch.UpdatedAt = time.Now().UTC()
+		if err := q.UpdateSchedule(ctx, sch); err != nil {
+			return err
+		}
+		canceled = sch
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return canceled, nil
+}
+
+// ListScheduleRuns returns the latest runs of a schedule, newest first.
+func (s *service) ListScheduleRuns(ctx context.Context, scheduleID uuid.UUID) ([]scheduleRun, error) {
+	if _, err := s.repo.GetSchedule(ctx, scheduleID); err != nil {
+		return nil, err
+	}
+	runs, err := s.repo.ListScheduleRuns(ctx, scheduleID, maxScheduleRuns)
+	if err != nil {
+		return nil, err
+	}
+	if runs == nil {
+		runs = []scheduleRun{}
+	}
+	return runs, nil
+}
+
+// permanentRunError reports whether a failed run would fail again however
+// often it is retried.
+func permanentRunError(err error) bool {
+	for _, permanent := range []error{ErrWalletNotFound, ErrWalletClosed, ErrCurrencyMismatch, ErrRunAlreadyExecuted} {
+		if errors.Is(err, permanent) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunDueSchedules runs the schedules due at now and returns how many runs
+// moved money. Runs missed while the scheduler was down are made up one per
+// pass, oldest first.
+func (s *service) RunDueSchedules(ctx context.Context, now time.Time) (int, error) {
+	ids, err := s.repo.ListDueSchedules(ctx, now, scheduleBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	succeeded := 0
+	for _, id := range ids {
+		ok, err := s.runSchedule(ctx, id, now)
+		if err == ErrScheduleNotDue {
+			continue
+		}
+		if err != nil {
+			return succeeded, err
+		}
+		if ok {
+			succeeded++
+		}
+	}
+	return succeeded, nil
+}
+
+// runSchedule makes the next run of a schedule. The transfer, its run record
+// and the move to the following run commit together, and the run record claims
+// the idempotency key of the run, so a run never moves money twice. When the
+// transfer fails the attempt is recorded in a second transaction and the run
+// is retried with exponential backoff, or skipped once it has used all its
+// attempts or can not succeed.
+func (s *service) runSchedule(ctx context.Context, scheduleID uuid.UUID, now time.Time) (bool, error) {
+	var failure error
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		failure = nil
+		sch, err := q.LockSchedule(ctx, scheduleID)
+		if err != nil {
+			return err
+		}
+		if sch.Status != ScheduleActive || sch.NextAttemptAt == nil || sch.NextAttemptAt.After(now) {
+			return ErrScheduleNotDue
+		}
+
+		runAt := *sch.NextRunAt
+		txnID, err := s.transferTx(ctx, q, sch.FromWallet, sch.ToWallet, Money{Amount: sch.Amount, Currency: sch.Currency})
+		if err == nil {
+			err = q.InsertScheduleRun(ctx, &scheduleRun{ID: uuid.New(), ScheduleID: sch.ID, ScheduledFor: runAt, Attempt: sch.Attempts + 1,
+				Status: RunSucceeded, IdempotencyKey: scheduleRunKey(sch.ID, runAt), TransactionID: &txnID, CreatedAt: now})
+		}
+		if err != nil {
+			failure = err
+			return err
+		}
+
+		sch.RunCount++
+		sch.moveTo(nextOccurrence(sch, runAt))
+		sch.UpdatedAt = now
+		return q.UpdateSchedule(ctx, sch)
+	})
+	if failure == nil {
+		return err == nil, err
+	}
+
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		sch, err := q.LockSchedule(ctx, scheduleID)
+		if err != nil {
+			return err
+		}
+		if sch.Status != ScheduleActive || sch.NextAttemptAt == nil || sch.NextAttemptAt.After(now) {
+			return ErrScheduleNotDue
+		}
+
+		runAt := *sch.NextRunAt
+		sch.Attempts++
+		run := &scheduleRun{ID: uuid.New(), ScheduleID: sch.ID, ScheduledFor: runAt, Attempt: sch.Attempts, Status: RunFailed,
+			Error: failure.Error(), CreatedAt: now}
+		if sch.Attempts >= s.scheduleAttempts || permanentRunError(failure) {
+			run.Status = RunSkipped
+			sch.moveTo(nextOccurrence(sch, runAt))
+		} else {
+			retryAt := now.Add(s.scheduleBackoff << (sch.Attempts - 1))
+			sch.NextAttemptAt = &retryAt
+		}
+		sch.UpdatedAt = now
+
+		if err := q.InsertScheduleRun(ctx, run); err != nil {
+			return err
+		}
+		return q.UpdateSchedule(ctx, sch)
+	})
+	return false, err
+}
+
+// scheduleRunner is the part of the service used by the TransferScheduler.
+type scheduleRunner interface {
+	RunDueSchedules(ctx context.Context, now time.Time) (int, error)
+}
+
+// TransferScheduler periodically runs due scheduled transfers.
+type TransferScheduler struct {
+	schedules scheduleRunner
+	interval  time.Duration
+}
+
+// NewTransferScheduler initializes a scheduler that runs due transfers every interval.
+func NewTransferScheduler(schedules scheduleRunner, interval time.Duration) *TransferScheduler {
+	return &TransferScheduler{schedules: schedules, interval: interval}
+}
+
+// Run runs due scheduled transfers every interval until ctx is canceled.
+func (ts *TransferScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(ts.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := ts.schedules.RunDueSchedules(ctx, now)
+			if err != nil {
+				log.Printf("Transfer scheduler error: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Transfer scheduler made %d scheduled transfers", n)
+			}
+		}
+	}
+}
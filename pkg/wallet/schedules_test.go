@@ -0,0 +1,322 @@
+package wallet
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// dailySchedule creates a daily transfer of amount starting in an hour.
+func dailySchedule(t *testing.T, svc *service, fromID, toID uuid.UUID, amount int64) *scheduledTransfer {
+	ctx := context.Background()
+	sch, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(amount),
+		Frequency: ScheduleDaily, StartAt: time.Now().Add(time.Hour).Truncate(time.Second)})
+	assert.NoError(t, err)
+	return sch
+}
+
+func TestService_CreateSchedule(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+	assert.Equal(t, ScheduleActive, sch.Status)
+	assert.Equal(t, sch.StartAt, *sch.NextRunAt)
+	assert.Equal(t, sch.StartAt, *sch.NextAttemptAt)
+
+	// A start in the past runs at the first occurrence from now
+	past := time.Now().UTC().Add(-36 * time.Hour)
+	sch, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(100),
+		Frequency: ScheduleDaily, StartAt: past})
+	assert.NoError(t, err)
+	assert.Equal(t, past.Add(48*time.Hour), *sch.NextRunAt)
+
+	schedules, err := svc.ListSchedules(ctx, fromID)
+	assert.NoError(t, err)
+	assert.Len(t, schedules, 2)
+	schedules, err = svc.ListSchedules(ctx, toID)
+	assert.NoError(t, err)
+	assert.Empty(t, schedules)
+	_, err = svc.ListSchedules(ctx, uuid.New())
+	assert.Equal(t, ErrWalletNotFound, err)
+}
+
+func TestService_CreateScheduleValidation(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name string
+		req  ScheduleRequest
+		want error
+	}{
+		{"unknown frequency", ScheduleRequest{Frequency: "hourly"}, ErrInvalidSchedule},
+		{"cron without cron frequency", ScheduleRequest{Frequency: ScheduleDaily, Cron: "0 9 * * *"}, ErrInvalidSchedule},
+		{"invalid cron", ScheduleRequest{Frequency: ScheduleCron, Cron: "0 9 * *"}, ErrInvalidSchedule},
+		{"negative max runs", ScheduleRequest{Frequency: ScheduleDaily, MaxRuns: -1}, ErrInvalidSchedule},
+		{"once in the past", ScheduleRequest{Frequency: ScheduleOnce, StartAt: time.Now().Add(-time.Hour)}, ErrInvalidSchedule},
+		{"end before first run", ScheduleRequest{Frequency: ScheduleDaily, StartAt: later, EndAt: &time.Time{}}, ErrInvalidSchedule},
+		{"same wallet", ScheduleRequest{ToWallet: fromID, Frequency: ScheduleDaily}, ErrSameWalletTransfer},
+		{"unknown recipient", ScheduleRequest{ToWallet: uuid.New(), Frequency: ScheduleDaily}, ErrDestinationInvalid},
+		{"currency mismatch", ScheduleRequest{Amount: Money{Amount: 100, Currency: "EUR"}, Frequency: ScheduleDaily}, ErrCurrencyMismatch},
+	}
+	for _, tt := range tests {
+		req := tt.req
+		req.FromWallet = fromID
+		if req.ToWallet == uuid.Nil {
+			req.ToWallet = toID
+		}
+		if req.Amount.Currency == "" {
+			req.Amount = usd(100)
+		}
+		_, err := svc.CreateSchedule(ctx, req)
+		assert.True(t, errors.Is(err, tt.want), "%s: %v", tt.name, err)
+	}
+}
+
+func TestService_RunDueSchedules(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+
+	// Nothing is due before the first run
+	n, err := svc.RunDueSchedules(ctx, sch.StartAt.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = svc.RunDueSchedules(ctx, sch.StartAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = svc.RunDueSchedules(ctx, sch.StartAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Runs missed while the scheduler was down are made up one per pass
+	later := sch.StartAt.Add(50 * time.Hour)
+	for i := 0; i < 2; i++ {
+		n, err = svc.RunDueSchedules(ctx, later)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	n, err = svc.RunDueSchedules(ctx, later)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	from, _ := svc.GetBalance(ctx, fromID)
+	to, _ := svc.GetBalance(ctx, toID)
+	assert.Equal(t, usd(700), from.Ledger)
+	assert.Equal(t, usd(300), to.Ledger)
+
+	got, err := svc.GetSchedule(ctx, sch.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, got.RunCount)
+	assert.Equal(t, sch.StartAt.Add(72*time.Hour), *got.NextRunAt)
+
+	runs, err := svc.ListScheduleRuns(ctx, sch.ID)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 3)
+	assert.Equal(t, RunSucceeded, runs[0].Status)
+	assert.Equal(t, scheduleRunKey(sch.ID, sch.StartAt.Add(48*time.Hour)), runs[0].IdempotencyKey)
+	assert.NotNil(t, runs[0].TransactionID)
+	assert.NoError(t, svc.VerifyBalance(ctx, fromID))
+}
+
+func TestService_ScheduleRunNeverExecutesTwice(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+
+	// The run was already made, e.g. by a scheduler whose update was lost
+	assert.NoError(t, repo.InsertScheduleRun(ctx, &scheduleRun{ID: uuid.New(), ScheduleID: sch.ID, ScheduledFor: sch.StartAt,
+		Attempt: 1, Status: RunSucceeded, IdempotencyKey: scheduleRunKey(sch.ID, sch.StartAt), CreatedAt: time.Now()}))
+
+	n, err := svc.RunDueSchedules(ctx, sch.StartAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The second transfer was rolled back and the schedule moved on
+	from, _ := svc.GetBalance(ctx, fromID)
+	assert.Equal(t, usd(1000), from.Ledger)
+	got, _ := svc.GetSchedule(ctx, sch.ID)
+	assert.Equal(t, sch.StartAt.Add(24*time.Hour), *got.NextRunAt)
+	runs, _ := svc.ListScheduleRuns(ctx, sch.ID)
+	assert.Equal(t, RunSkipped, runs[0].Status)
+	assert.Contains(t, runs[0].Error, ErrRunAlreadyExecuted.Error())
+}
+
+func TestService_ScheduleRetriesThenSkips(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 0)
+	toID := fundedWallet(t, svc, 0)
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+
+	// Attempts are retried after 15m and 30m, then the run is skipped
+	now := sch.StartAt
+	for _, backoff := range []time.Duration{15 * time.Minute, 30 * time.Minute} {
+		n, err := svc.RunDueSchedules(ctx, now)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		got, _ := svc.GetSchedule(ctx, sch.ID)
+		assert.Equal(t, sch.StartAt, *got.NextRunAt)
+		assert.Equal(t, now.Add(backoff), *got.NextAttemptAt)
+		now = now.Add(backoff)
+	}
+	_, err := svc.RunDueSchedules(ctx, now)
+	assert.NoError(t, err)
+
+	got, _ := svc.GetSchedule(ctx, sch.ID)
+	assert.Equal(t, ScheduleActive, got.Status)
+	assert.Equal(t, 0, got.Attempts)
+	assert.Equal(t, sch.StartAt.Add(24*time.Hour), *got.NextAttemptAt)
+
+	runs, _ := svc.ListScheduleRuns(ctx, sch.ID)
+	assert.Len(t, runs, 3)
+	assert.Equal(t, RunSkipped, runs[0].Status)
+	assert.Equal(t, RunFailed, runs[2].Status)
+	assert.Equal(t, ErrInsufficientFunds.Error(), runs[2].Error)
+	assert.Empty(t, runs[2].IdempotencyKey)
+
+	// The next run succeeds once the wallet is funded
+	_, err = svc.Deposit(ctx, fromID, usd(100))
+	assert.NoError(t, err)
+	n, err := svc.RunDueSchedules(ctx, sch.StartAt.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestService_ScheduleCompletes(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	once, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(100), Frequency: ScheduleOnce, StartAt: start})
+	assert.NoError(t, err)
+	limited, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(100), Frequency: ScheduleWeekly,
+		StartAt: start, MaxRuns: 2})
+	assert.NoError(t, err)
+	end := start.Add(36 * time.Hour)
+	ending, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(100), Frequency: ScheduleDaily,
+		StartAt: start, EndAt: &end})
+	assert.NoError(t, err)
+
+	n, err := svc.RunDueSchedules(ctx, start.Add(30*24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	for i := 0; i < 3; i++ {
+		_, err = svc.RunDueSchedules(ctx, start.Add(30*24*time.Hour))
+		assert.NoError(t, err)
+	}
+
+	for _, sch := range []*scheduledTransfer{once, limited, ending} {
+		got, _ := svc.GetSchedule(ctx, sch.ID)
+		assert.Equal(t, ScheduleCompleted, got.Status)
+		assert.Nil(t, got.NextRunAt)
+	}
+	got, _ := svc.GetSchedule(ctx, limited.ID)
+	assert.Equal(t, 2, got.RunCount)
+	got, _ = svc.GetSchedule(ctx, ending.ID)
+	assert.Equal(t, 2, got.RunCount)
+
+	_, err = svc.UpdateSchedule(ctx, once.ID, ScheduleUpdate{Status: SchedulePaused})
+	assert.Equal(t, ErrScheduleFinished, err)
+}
+
+func TestService_PauseResumeSchedule(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+
+	amount := int64(250)
+	paused, err := svc.UpdateSchedule(ctx, sch.ID, ScheduleUpdate{Status: SchedulePaused, Amount: &amount})
+	assert.NoError(t, err)
+	assert.Equal(t, SchedulePaused, paused.Status)
+	assert.Equal(t, int64(250), paused.Amount)
+
+	n, err := svc.RunDueSchedules(ctx, sch.StartAt)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// Resuming skips the runs missed while paused
+	resumed, err := svc.UpdateSchedule(ctx, sch.ID, ScheduleUpdate{Status: ScheduleActive})
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleActive, resumed.Status)
+	assert.Equal(t, sch.StartAt, *resumed.NextRunAt)
+
+	zero := int64(0)
+	_, err = svc.UpdateSchedule(ctx, sch.ID, ScheduleUpdate{Amount: &zero})
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.UpdateSchedule(ctx, sch.ID, ScheduleUpdate{Status: ScheduleCompleted})
+	assert.True(t, errors.Is(err, ErrInvalidSchedule))
+	_, err = svc.UpdateSchedule(ctx, uuid.New(), ScheduleUpdate{})
+	assert.Equal(t, ErrScheduleNotFound, err)
+}
+
+func TestService_CancelSchedule(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	sch := dailySchedule(t, svc, fromID, toID, 100)
+	_, err := svc.RunDueSchedules(ctx, sch.StartAt)
+	assert.NoError(t, err)
+
+	canceled, err := svc.CancelSchedule(ctx, sch.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, ScheduleCanceled, canceled.Status)
+	assert.Nil(t, canceled.NextRunAt)
+
+	n, err := svc.RunDueSchedules(ctx, sch.StartAt.Add(48*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The history is kept
+	runs, err := svc.ListScheduleRuns(ctx, sch.ID)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 1)
+
+	_, err = svc.CancelSchedule(ctx, sch.ID)
+	assert.Equal(t, ErrScheduleFinished, err)
+	_, err = svc.ListScheduleRuns(ctx, uuid.New())
+	assert.Equal(t, ErrScheduleNotFound, err)
+}
+
+func TestTransferScheduler_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	_, err := svc.CreateSchedule(ctx, ScheduleRequest{FromWallet: fromID, ToWallet: toID, Amount: usd(100), Frequency: ScheduleOnce,
+		StartAt: time.Now().Add(10 * time.Millisecond)})
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		NewTransferScheduler(svc, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		b, _ := svc.GetBalance(ctx, toID)
+		return b.Ledger == usd(100)
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
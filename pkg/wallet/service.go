@@ -1,86 +1,265 @@
 package wallet
 
 import (
-	"database/sql"           // SQL DB operations
+	"context"                // Request cancellation
+	"crypto/ed25519"         // Chain checkpoint signatures
 	"github.com/google/uuid" // UUID generation and parsing
-	"log"
-	"time" // For timestamps
+	"math/big"               // Exact exchange rate arithmetic
+	"net"                    // Webhook host resolution
+	"net/http"               // Webhook requests
+	"net/netip"              // Webhook address checks
+	"strings"                // Label cleanup
+	"time"                   // For timestamps
+	"unicode/utf8"           // Label length in characters
 )
 
-// service struct holds the DB reference and encapsulates business logic.
+// service struct holds the repository reference and encapsulates business logic.
 type service struct {
-	db *sql.DB
+	repo     Repository
+	fx       FXRateProvider // nil disables cross-currency transfers
+	quoteTTL time.Duration
+	holdTTL  time.Duration  // expiry of holds created without a TTL
+	fees     *FeeSchedule   // nil charges no fees
+	limits   *LimitSchedule // nil only applies per-wallet overrides
+	webhooks *http.Client   // sends webhook deliveries
+
+	webhookTimeout time.Duration  // time a receiver has to answer
+	webhookAllowed []netip.Prefix // internal networks webhooks may still be sent to
+	resolver       hostResolver   // resolves webhook hosts when they are validated
+
+	scheduleAttempts int           // attempts per scheduled run before it is skipped
+	scheduleBackoff  time.Duration // delay after the first failed attempt of a scheduled run
+
+	keyGrace time.Duration // how long a rotated API key stays valid
+	clientID *uuid.UUID    // API client recorded on new transactions, see ForClient
+
+	keyPepper       []byte             // server secret API keys are derived with, see deriveAPIKey
+	chainKey        ed25519.PrivateKey // signs chain checkpoints, nil leaves them unsigned
+	checkpointEvery int64              // links between chain checkpoints
 }
 
-// NewService initializes a new service instance with the given DB connection.
-func NewService(db *sql.DB) *service {
-	return &service{db: db}
+// Option configures optional features of the service.
+type Option func(*service)
+
+// WithFXRates enables cross-currency transfers priced by provider. Quotes can
+// be executed until quoteTTL has passed.
+func WithFXRates(provider FXRateProvider, quoteTTL time.Duration) Option {
+	return func(s *service) {
+		s.fx = provider
+		s.quoteTTL = quoteTTL
+	}
+}
+
+// WithHoldTTL sets how long holds created without an explicit TTL stay active.
+func WithHoldTTL(ttl time.Duration) Option {
+	return func(s *service) {
+		s.holdTTL = ttl
+	}
+}
+
+// WithFees charges the fees of schedule on withdrawals and transfers.
+func WithFees(schedule *FeeSchedule) Option {
+	return func(s *service) {
+		s.fees = schedule
+	}
+}
+
+// WithLimits applies the tier limits of schedule to deposits, withdrawals and transfers.
+func WithLimits(schedule *LimitSchedule) Option {
+	return func(s *service) {
+		s.limits = schedule
+	}
+}
+
+// WithWebhookTimeout sets the time a receiver has to answer a webhook delivery.
+func WithWebhookTimeout(timeout time.Duration) Option {
+	return func(s *service) {
+		s.webhookTimeout = timeout
+	}
+}
+
+// WithWebhookAllowedNetworks lets webhooks reach the given networks even when
+// they are internal, e.g. a receiver inside the same VPC.
+func WithWebhookAllowedNetworks(networks []netip.Prefix) Option {
+	return func(s *service) {
+		s.webhookAllowed = networks
+	}
+}
+
+// WithScheduleRetries sets how often a failed scheduled transfer is attempted
+// and the delay after its first failure, which doubles after every attempt.
+func WithScheduleRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(s *service) {
+		s.scheduleAttempts = maxAttempts
+		s.scheduleBackoff = backoff
+	}
+}
+
+// WithAPIKeyRotationGrace sets how long the previous key of an API client
+// stays valid after a rotation, so callers can switch keys without downtime.
+func WithAPIKeyRotationGrace(grace time.Duration) Option {
+	return func(s *service) {
+		s.keyGrace = grace
+	}
+}
+
+// WithAPIKeyPepper derives API keys from their stored seeds with pepper, a
+// server secret kept out of the database. Changing it invalidates every key.
+func WithAPIKeyPepper(pepper []byte) Option {
+	return func(s *service) {
+		s.keyPepper = pepper
+	}
+}
+
+// WithChainSigningKey signs the checkpoints of the transaction hash chain with
+// key, see ParseChainSigningKey.
+func WithChainSigningKey(key ed25519.PrivateKey) Option {
+	return func(s *service) {
+		s.chainKey = key
+	}
+}
+
+// NewService initializes a new service instance with the given repository.
+func NewService(repo Repository, opts ...Option) *service {
+	s := &service{repo: repo, holdTTL: DefaultHoldTTL, webhookTimeout: DefaultWebhookTimeout, resolver: net.DefaultResolver,
+		scheduleAttempts: DefaultScheduleMaxAttempts, scheduleBackoff: DefaultScheduleRetryBackoff, keyGrace: DefaultAPIKeyRotationGrace,
+		checkpointEvery: chainCheckpointInterval}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.webhooks = newWebhookClient(s.webhookTimeout, s.webhookAllowed)
+	return s
 }
 
 // WalletExists Checks if the wallet to be updated exists
-func (s *service) WalletExists(walletID uuid.UUID) (bool, error) {
-	var exists bool
-	err := s.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM wallets WHERE id = $1)`, walletID).Scan(&exists)
-	if err != nil {
-		log.Printf("DB Select error: %v", err)
-		return false, err
+func (s *service) WalletExists(ctx context.Context, walletID uuid.UUID) (bool, error) {
+	return s.repo.WalletExists(ctx, walletID)
+}
+
+// validateAmount checks that amount is positive and normalizes its currency code.
+func validateAmount(amount Money) (Money, error) {
+	if amount.Amount <= 0 {
+		return Money{}, ErrInvalidAmount
 	}
-	return exists, nil
+	return NewMoney(amount.Amount, amount.Currency)
 }
 
-// CreateWallet inserts a new wallet with zero balance for a user.
-func (s *service) CreateWallet(userID uuid.UUID) (*wallet, error) {
-	id := uuid.New() // Generate a new wallet UUID
-	_, err := s.db.Exec(`INSERT INTO wallets (id, user_id, balance) VALUES ($1, $2, $3)`, id, userID, 0)
+// CreateWallet inserts a new wallet with zero balance for a user, creating the
+// user on its first wallet. A user can have any number of wallets; walletType
+// defaults to spending.
+func (s *service) CreateWallet(ctx context.Context, userID uuid.UUID, currency, label, walletType string) (*wallet, error) {
+	code, err := NormalizeCurrency(currency)
 	if err != nil {
-		log.Printf("DB Insertion error: %v", err)
 		return nil, err
 	}
-	return &wallet{ID: id, UserID: userID, Balance: 0}, nil
-}
+	label = strings.TrimSpace(label)
+	if utf8.RuneCountInString(label) > MaxWalletLabelLength {
+		return nil, ErrLabelTooLong
+	}
+	switch walletType {
+	case "":
+		walletType = WalletTypeSpending
+	case WalletTypeSpending, WalletTypeSavings, WalletTypeBusiness:
+	default:
+		return nil, ErrInvalidWalletType
+	}
 
-// Deposit adds money to a specific wallet and logs the transaction.
-func (s *service) Deposit(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
-	if amount <= 0 {
-		return uuid.Nil, ErrInvalidAmount
+	w := &wallet{ID: uuid.New(), UserID: userID, Balance: 0, Currency: code, Label: label, Type: walletType, Status: WalletActive, Tier: DefaultLimitTier} // Generate a new wallet UUID
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		if err := q.EnsureUser(ctx, userID); err != nil {
+			return err
+		}
+		if err := q.InsertWallet(ctx, w); err != nil {
+			return err
+		}
+		return recordEvent(ctx, q, EventWalletCreated, w.ID, w)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return w, nil
+}
 
-	exists, err := s.WalletExists(walletID)
+// ListWallets returns all wallets of a user with their balances, oldest first.
+func (s *service) ListWallets(ctx context.Context, userID uuid.UUID) ([]wallet, error) {
+	exists, err := s.repo.UserExists(ctx, userID)
 	if err != nil {
-		return uuid.Nil, err
+		return nil, err
 	}
 	if !exists {
-		return uuid.Nil, ErrWalletNotFound
+		return nil, ErrUserNotFound
 	}
 
-	// Begin transaction to ensure atomicity
-	txn, err := s.db.Begin()
+	wallets, err := s.repo.ListWallets(ctx, userID)
 	if err != nil {
-		log.Printf("DB Begin error: %v", err)
-		return uuid.Nil, err
+		return nil, err
 	}
-	defer txn.Rollback()
+	if wallets == nil {
+		wallets = []wallet{}
+	}
+	return wallets, nil
+}
+
+// ListWalletIDs returns the IDs of all wallets, for batch jobs such as
+// month-end statements.
+func (s *service) ListWalletIDs(ctx context.Context) ([]uuid.UUID, error) {
+	return s.repo.ListWalletIDs(ctx)
+}
 
-	// Update wallet balance
-	_, err = txn.Exec(`UPDATE wallets SET balance = balance + $1 WHERE id = $2`, amount, walletID)
+// Deposit adds money to a specific wallet and logs the transaction.
+func (s *service) Deposit(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+	amount, err := validateAmount(amount)
 	if err != nil {
-		log.Printf("DB Update error: %v", err)
 		return uuid.Nil, err
 	}
 
-	txnId := uuid.New()
-
-	// Log transaction as "deposit"
-	_, err = txn.Exec(`INSERT INTO transactions (id, from_wallet, to_wallet, amount, type, created_at)
-                      VALUES ($1, NULL, $2, $3, $4, $5)`,
-		txnId, walletID, amount, TxnTypeDeposit, time.Now())
+	exists, err := s.WalletExists(ctx, walletID)
 	if err != nil {
-		log.Printf("DB Insert error: %v", err)
 		return uuid.Nil, err
 	}
+	if !exists {
+		return uuid.Nil, ErrWalletNotFound
+	}
+
+	var txnId uuid.UUID
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the wallet row so its currency and balance cannot change until commit
+		wallets, err := q.LockWallets(ctx, walletID)
+		if err != nil {
+			return err
+		}
 
-	if err := txn.Commit(); err != nil {
-		log.Printf("DB Commit error: %v", err)
+		if err := checkInbound(wallets[walletID]); err != nil {
+			return err
+		}
+
+		if wallets[walletID].Currency != amount.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		if err := s.checkLimits(ctx, q, wallets[walletID], TxnTypeDeposit, amount.Amount); err != nil {
+			return err
+		}
+
+		// Update wallet balance
+		if err := q.AdjustBalance(ctx, walletID, amount.Amount); err != nil {
+			return err
+		}
+
+		// Log transaction as "deposit"
+		txn := &transaction{ID: uuid.New(), ToWallet: &walletID, Amount: amount.Amount, Currency: amount.Currency, Type: TxnTypeDeposit, CreatedAt: time.Now(), ClientID: s.clientID}
+		if err := s.insertChained(ctx, q, txn); err != nil {
+			return err
+		}
+		txnId = txn.ID
+
+		// Money enters the system: debit the cash in account, credit the wallet
+		if err := postEntries(ctx, q, txnId, entryPair(AccountCashIn, walletID, amount)); err != nil {
+			return err
+		}
+		return recordEvent(ctx, q, EventFundsDeposited, walletID, txn)
+	})
+	if err != nil {
 		return uuid.Nil, err
 	}
 
@@ -88,12 +267,13 @@ func (s *service) Deposit(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
 }
 
 // Withdraw subtracts money from a wallet if there's enough balance.
-func (s *service) Withdraw(walletID uuid.UUID, amount int64) (uuid.UUID, error) {
-	if amount <= 0 {
-		return uuid.Nil, ErrInvalidAmount
+func (s *service) Withdraw(ctx context.Context, walletID uuid.UUID, amount Money) (uuid.UUID, error) {
+	amount, err := validateAmount(amount)
+	if err != nil {
+		return uuid.Nil, err
 	}
 
-	exists, err := s.WalletExists(walletID)
+	exists, err := s.WalletExists(ctx, walletID)
 	if err != nil {
 		return uuid.Nil, err
 	}
@@ -101,143 +281,322 @@ func (s *service) Withdraw(walletID uuid.UUID, amount int64) (uuid.UUID, error)
 		return uuid.Nil, ErrWalletNotFound
 	}
 
-	txn, err := s.db.Begin()
-	if err != nil {
-		return uuid.Nil, err
-	}
-	defer txn.Rollback()
+	var txnId uuid.UUID
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the wallet row so the balance cannot change until commit
+		wallets, err := q.LockWallets(ctx, walletID)
+		if err != nil {
+			return err
+		}
 
-	// Check current balance
-	var balance int64
-	err = txn.QueryRow(`SELECT balance FROM wallets WHERE id = $1`, walletID).Scan(&balance)
-	if err != nil {
-		log.Printf("DB Select error: %v", err)
-		return uuid.Nil, err
-	}
+		if err := checkOutbound(wallets[walletID]); err != nil {
+			return err
+		}
 
-	if balance < amount {
-		return uuid.Nil, ErrInsufficientFunds
-	}
+		if wallets[walletID].Currency != amount.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		if err := s.checkLimits(ctx, q, wallets[walletID], TxnTypeWithdrawal, amount.Amount); err != nil {
+			return err
+		}
+
+		// Fees are paid on top of the amount; funds reserved by holds cannot be withdrawn
+		fees := s.fees.compute(TxnTypeWithdrawal, wallets[walletID].Type, amount)
+		debit, err := debitFor(amount.Amount, fees)
+		if err != nil {
+			return err
+		}
+		if wallets[walletID].Available() < debit {
+			return ErrInsufficientFunds
+		}
+
+		// Deduct from wallet
+		if err := q.AdjustBalance(ctx, walletID, -debit); err != nil {
+			return err
+		}
+		if err := creditFees(ctx, q, fees); err != nil {
+			return err
+		}
+
+		// Log transaction as "withdrawal"
+		txn := &transaction{ID: uuid.New(), FromWallet: &walletID, Amount: amount.Amount, Currency: amount.Currency, Type: TxnTypeWithdrawal, CreatedAt: time.Now(), Fees: fees, ClientID: s.clientID}
+		if err := s.insertChained(ctx, q, txn); err != nil {
+			return err
+		}
+		txnId = txn.ID
 
-	// Deduct from wallet
-	_, err = txn.Exec(`UPDATE wallets SET balance = balance - $1 WHERE id = $2`, amount, walletID)
+		// Money leaves the system: debit the wallet, credit the cash out account
+		// and the revenue wallet
+		if err := postEntries(ctx, q, txnId, append(entryPair(walletID, AccountCashOut, amount), feeEntries(walletID, fees)...)); err != nil {
+			return err
+		}
+		return recordEvent(ctx, q, EventFundsWithdrawn, walletID, txn)
+	})
 	if err != nil {
-		log.Printf("DB UPDATE error: %v", err)
 		return uuid.Nil, err
 	}
 
-	txnId := uuid.New()
+	return txnId, nil
+}
 
-	// Log transaction as "withdrawal"
-	_, err = txn.Exec(`INSERT INTO transactions (id, from_wallet, to_wallet, amount, type, created_at)
-                      VALUES ($1, $2, NULL, $3, $4, $5)`,
-		txnId, walletID, amount, TxnTypeWithdrawal, time.Now())
+// Transfer moves funds from one wallet to another in a single atomic transaction.
+// The amount must be in the sender's currency. When the receiver holds another
+// currency the amount is converted at the current rate, which needs WithFXRates.
+func (s *service) Transfer(ctx context.Context, fromID, toID uuid.UUID, amount Money) (uuid.UUID, error) {
+	amount, err := s.validateTransfer(ctx, fromID, toID, amount)
 	if err != nil {
-		log.Printf("DB Insert error: %v", err)
 		return uuid.Nil, err
 	}
 
-	if err := txn.Commit(); err != nil {
+	var txnId uuid.UUID
+	err = s.repo.RunInTx(ctx, func(q Queries) error {
+		txnId, err = s.transferTx(ctx, q, fromID, toID, amount)
+		return err
+	})
+	if err != nil {
 		return uuid.Nil, err
 	}
 
 	return txnId, nil
 }
 
-// Transfer moves funds from one wallet to another in a single atomic transaction.
-func (s *service) Transfer(fromID, toID uuid.UUID, amount int64) (uuid.UUID, error) {
-	if amount <= 0 {
-		return uuid.Nil, ErrInvalidAmount
+// validateTransfer checks the amount and both wallets of a transfer before any
+// lock is taken, and returns the normalized amount.
+func (s *service) validateTransfer(ctx context.Context, fromID, toID uuid.UUID, amount Money) (Money, error) {
+	amount, err := validateAmount(amount)
+	if err != nil {
+		return Money{}, err
 	}
 
 	if fromID == toID {
-		return uuid.Nil, ErrSameWalletTransfer
+		return Money{}, ErrSameWalletTransfer
 	}
 
-	frmExists, err := s.WalletExists(fromID)
+	frmExists, err := s.WalletExists(ctx, fromID)
 	if err != nil {
-		return uuid.Nil, err
+		return Money{}, err
 	}
 	if !frmExists {
-		return uuid.Nil, ErrSourceInvalid
+		return Money{}, ErrSourceInvalid
 	}
 
-	toExists, err := s.WalletExists(toID)
+	toExists, err := s.WalletExists(ctx, toID)
 	if err != nil {
-		return uuid.Nil, err
+		return Money{}, err
 	}
 	if !toExists {
-		return uuid.Nil, ErrDestinationInvalid
+		return Money{}, ErrDestinationInvalid
 	}
+	return amount, nil
+}
 
-	txn, err := s.db.Begin()
+// transferTx performs a validated transfer through q, converting the amount
+// when the receiver holds another currency.
+func (s *service) transferTx(ctx context.Context, q Queries, fromID, toID uuid.UUID, amount Money) (uuid.UUID, error) {
+	// Lock both wallets in UUID order so concurrent transfers cannot deadlock
+	wallets, err := q.LockWallets(ctx, fromID, toID)
 	if err != nil {
 		return uuid.Nil, err
 	}
-	defer txn.Rollback()
+	from, to := wallets[fromID], wallets[toID]
 
-	var balance int64
-	err = txn.QueryRow(`SELECT balance FROM wallets WHERE id = $1`, fromID).Scan(&balance)
-	if err != nil {
+	if from.Currency != amount.Currency {
+		return uuid.Nil, ErrCurrencyMismatch
+	}
+
+	target := amount
+	var fx *fxConversion
+	if to.Currency != amount.Currency {
+		if s.fx == nil {
+			return uuid.Nil, ErrCurrencyMismatch
+		}
+		var rate string
+		target, rate, err = s.convertAtSpot(amount, to.Currency)
+		if err != nil {
+			return uuid.Nil, err
+		}
+		fx = &fxConversion{Rate: rate, RoundingMode: RoundingHalfEven,
+			SourceAmount: amount.Amount, SourceCurrency: amount.Currency,
+			TargetAmount: target.Amount, TargetCurrency: target.Currency}
+	}
+
+	return s.moveFunds(ctx, q, from, to, amount, target, fx)
+}
+
+// moveFunds debits source from one locked wallet and credits target to the
+// other, then logs the transfer and its journal lines. Cross-currency transfers
+// pass through the FX account so the lines balance in each currency.
+func (s *service) moveFunds(ctx context.Context, q Queries, from, to *wallet, source, target Money, fx *fxConversion) (uuid.UUID, error) {
+	if err := checkOutbound(from); err != nil {
+		return uuid.Nil, err
+	}
+	if err := checkInbound(to); err != nil {
+		return uuid.Nil, err
+	}
+	if err := s.checkLimits(ctx, q, from, TxnTypeTransfer, source.Amount); err != nil {
 		return uuid.Nil, err
 	}
 
-	if balance < amount {
+	// The sender pays the fees on top of the amount
+	fees := s.fees.compute(TxnTypeTransfer, from.Type, source)
+	debit, err := debitFor(source.Amount, fees)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if from.Available() < debit {
 		return uuid.Nil, ErrInsufficientFunds
 	}
 
 	// Subtract from sender
-	_, err = txn.Exec(`UPDATE wallets SET balance = balance - $1 WHERE id = $2`, amount, fromID)
-	if err != nil {
+	if err := q.AdjustBalance(ctx, from.ID, -debit); err != nil {
 		return uuid.Nil, err
 	}
 
 	// Add to receiver
-	_, err = txn.Exec(`UPDATE wallets SET balance = balance + $1 WHERE id = $2`, amount, toID)
-	if err != nil {
+	if err := q.AdjustBalance(ctx, to.ID, target.Amount); err != nil {
+		return uuid.Nil, err
+	}
+	if err := creditFees(ctx, q, fees); err != nil {
 		return uuid.Nil, err
 	}
-
-	txnId := uuid.New()
 
 	// Log the transaction as "transfer"
-	_, err = txn.Exec(`INSERT INTO transactions (id, from_wallet, to_wallet, amount, type, created_at)
-                      VALUES ($1, $2, $3, $4, $5, $6)`,
-		txnId, fromID, toID, amount, TxnTypeTransfer, time.Now())
-	if err != nil {
+	txn := &transaction{ID: uuid.New(), FromWallet: &from.ID, ToWallet: &to.ID, Amount: source.Amount, Currency: source.Currency, Type: TxnTypeTransfer, CreatedAt: time.Now(), FX: fx, Fees: fees, ClientID: s.clientID}
+	if err := s.insertChained(ctx, q, txn); err != nil {
 		return uuid.Nil, err
 	}
 
-	if err := txn.Commit(); err != nil {
+	// Debit the sender, credit the receiver
+	entries := entryPair(from.ID, to.ID, source)
+	if fx != nil {
+		entries = append(entryPair(from.ID, AccountFX, source), entryPair(AccountFX, to.ID, target)...)
+	}
+	entries = append(entries, feeEntries(from.ID, fees)...)
+	if err := postEntries(ctx, q, txn.ID, entries); err != nil {
 		return uuid.Nil, err
 	}
+	if err := recordEvent(ctx, q, EventFundsTransferred, from.ID, txn); err != nil {
+		return uuid.Nil, err
+	}
+	return txn.ID, nil
+}
+
+// convertAtSpot converts amount at the provider's current rate. The rate is
+// rounded to rateDecimals first and returned formatted, so the recorded rate
+// reproduces the converted amount.
+func (s *service) convertAtSpot(amount Money, currency string) (Money, string, error) {
+	spot, err := s.fx.Rate(amount.Currency, currency)
+	if err != nil {
+		return Money{}, "", err
+	}
+	rate := formatRate(spot)
+	r, ok := new(big.Rat).SetString(rate)
+	if !ok || r.Sign() <= 0 {
+		return Money{}, "", ErrInvalidRate
+	}
 
-	return txnId, nil
+	target, err := convert(amount, currency, r)
+	if err != nil {
+		return Money{}, "", err
+	}
+	if target.Amount <= 0 {
+		return Money{}, "", ErrInvalidAmount
+	}
+	return target, rate, nil
 }
 
-// GetBalance returns the current balance of a wallet.
-func (s *service) GetBalance(walletID uuid.UUID) (int64, error) {
-	var balance int64
+// QuoteTransfer prices a transfer of amount (in the sender's currency) to a
+// wallet in another currency. The quote can be executed once before it expires.
+func (s *service) QuoteTransfer(ctx context.Context, fromID, toID uuid.UUID, amount Money) (*fxQuote, error) {
+	amount, err := validateAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	if fromID == toID {
+		return nil, ErrSameWalletTransfer
+	}
+	if s.fx == nil {
+		return nil, ErrRateUnavailable
+	}
 
-	exists, err := s.WalletExists(walletID)
+	from, err := s.repo.GetWallet(ctx, fromID)
+	if err == ErrWalletNotFound {
+		return nil, ErrSourceInvalid
+	}
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if !exists {
-		return 0, ErrWalletNotFound
+	to, err := s.repo.GetWallet(ctx, toID)
+	if err == ErrWalletNotFound {
+		return nil, ErrDestinationInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if from.Currency != amount.Currency {
+		return nil, ErrCurrencyMismatch
 	}
 
-	err = s.db.QueryRow(`SELECT balance FROM wallets WHERE id = $1`, walletID).Scan(&balance)
+	target, rate, err := s.convertAtSpot(amount, to.Currency)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+
+	now := time.Now()
+	quote := &fxQuote{ID: uuid.New(), FromWallet: fromID, ToWallet: toID, Source: amount, Target: target,
+		Rate: rate, RoundingMode: RoundingHalfEven, ExpiresAt: now.Add(s.quoteTTL), CreatedAt: now}
+	if err := s.repo.InsertQuote(ctx, quote); err != nil {
+		return nil, err
 	}
-	return balance, nil
+	return quote, nil
 }
 
-// GetTransactions fetches all transactions where the wallet was either sender or receiver.
-func (s *service) GetTransactions(walletID uuid.UUID) ([]transaction, error) {
+// ExecuteQuote performs the transfer priced by a quote at the quoted amounts.
+// A quote can only be executed once and only before it expires.
+func (s *service) ExecuteQuote(ctx context.Context, quoteID uuid.UUID) (uuid.UUID, error) {
+	var txnId uuid.UUID
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		// Lock the quote first so two executions of it are serialized
+		quote, err := q.LockQuote(ctx, quoteID)
+		if err != nil {
+			return err
+		}
+		if quote.TransactionID != nil {
+			return ErrQuoteExecuted
+		}
+		if time.Now().After(quote.ExpiresAt) {
+			return ErrQuoteExpired
+		}
+
+		wallets, err := q.LockWallets(ctx, quote.FromWallet, quote.ToWallet)
+		if err != nil {
+			return err
+		}
+		from, to := wallets[quote.FromWallet], wallets[quote.ToWallet]
+		if from.Currency != quote.Source.Currency || to.Currency != quote.Target.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		fx := &fxConversion{QuoteID: &quote.ID, Rate: quote.Rate, RoundingMode: quote.RoundingMode,
+			SourceAmount: quote.Source.Amount, SourceCurrency: quote.Source.Currency,
+			TargetAmount: quote.Target.Amount, TargetCurrency: quote.Target.Currency}
+		txnId, err = s.moveFunds(ctx, q, from, to, quote.Source, quote.Target, fx)
+		if err != nil {
+			return err
+		}
+		return q.MarkQuoteExecuted(ctx, quote.ID, txnId)
+	})
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return txnId, nil
+}
 
-	exists, err := s.WalletExists(walletID)
+// GetBalance returns the ledger and available balance of a wallet in its currency.
+func (s *service) GetBalance(ctx context.Context, walletID uuid.UUID) (*Balance, error) {
+	exists, err := s.WalletExists(ctx, walletID)
 	if err != nil {
 		return nil, err
 	}
@@ -245,27 +604,50 @@ func (s *service) GetTransactions(walletID uuid.UUID) ([]transaction, error) {
 		return nil, ErrWalletNotFound
 	}
 
-	rows, err := s.db.Query(`
-        SELECT id, from_wallet, to_wallet, amount, type, created_at
-        FROM transactions
-        WHERE from_wallet = $1 OR to_wallet = $1
-        ORDER BY created_at DESC`, walletID)
+	w, err := s.repo.GetWallet(ctx, walletID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	return &Balance{
+		Ledger:    Money{Amount: w.Balance, Currency: w.Currency},
+		Available: Money{Amount: w.Available(), Currency: w.Currency},
+	}, nil
+}
 
-	var txns []transaction
-	for rows.Next() {
-		var txn transaction
-		err := rows.Scan(&txn.ID, &txn.FromWallet, &txn.ToWallet, &txn.Amount, &txn.Type, &txn.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		txns = append(txns, txn)
+// GetTransactions returns one page of the transactions where the wallet was
+// either sender or receiver, newest first.
+func (s *service) GetTransactions(ctx context.Context, walletID uuid.UUID, filter TransactionFilter) (*TransactionPage, error) {
+	q, err := filter.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := s.WalletExists(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWalletNotFound
 	}
 
-	return txns, nil
+	// Read one extra row to learn whether there is a next page
+	limit := q.Limit
+	q.Limit++
+	txns, err := s.repo.ListTransactions(ctx, walletID, q)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &TransactionPage{Transactions: txns}
+	if len(txns) > limit {
+		page.Transactions = txns[:limit]
+		last := page.Transactions[limit-1]
+		page.NextCursor = txnCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	if page.Transactions == nil {
+		page.Transactions = []transaction{}
+	}
+	return page, nil
 }
 
 // Compile-time check to ensure service implements Service interface
@@ -1,717 +1,1240 @@
 package wallet
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"github.com/DATA-DOG/go-sqlmock"
-	"github.com/google/uuid"
-	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 )
 
-func newTestService(t *testing.T) (*service, sqlmock.Sqlmock, func()) {
-	db, mock, err := sqlmock.New()
+// newMemoryService returns a service backed by an empty in-memory repository.
+func newMemoryService() (*service, *memoryRepository) {
+	repo := NewMemoryRepository()
+	return NewService(repo), repo
+}
+
+// fundedWallet creates a wallet and deposits amount into it.
+func fundedWallet(t *testing.T, svc *service, amount int64) uuid.UUID {
+	ctx := context.Background()
+	w, err := svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
 	assert.NoError(t, err)
+	if amount > 0 {
+		_, err = svc.Deposit(ctx, w.ID, usd(amount))
+		assert.NoError(t, err)
+	}
+	return w.ID
+}
 
-	svc := &service{db: db}
-	return svc, mock, func() { db.Close() }
+// cutoff returns a time strictly after the transactions created before the
+// call and not after those created after it. Transactions are stored with
+// microseconds, so it waits a little on both sides.
+func cutoff() time.Time {
+	time.Sleep(2 * time.Microsecond)
+	t := time.Now().Truncate(time.Microsecond)
+	time.Sleep(2 * time.Microsecond)
+	return t
 }
 
 /*
 *
 
-	CREATE WALLET Test Cases
+	Service Test Cases (in-memory repository)
 
 *
 */
-func TestCreateWallet_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
 
+func TestService_CreateWallet(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
 	userID := uuid.New()
 
-	mock.ExpectExec(`INSERT INTO wallets \(id, user_id, balance\)`).
-		WithArgs(sqlmock.AnyArg(), userID, int64(0)).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	wallet, err := svc.CreateWallet(userID)
+	w, err := svc.CreateWallet(ctx, userID, "USD", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, userID, w.UserID)
+	assert.Equal(t, int64(0), w.Balance)
+	assert.Equal(t, "USD", w.Currency)
 
+	exists, err := svc.WalletExists(ctx, w.ID)
 	assert.NoError(t, err)
-	assert.NotEqual(t, nil, wallet)
+	assert.True(t, exists)
 }
 
-func TestCreateWallet_InsertFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
+func TestService_MultipleWalletsPerUser(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
 	userID := uuid.New()
 
-	mock.ExpectExec(`INSERT INTO wallets \(id, user_id, balance\)`).
-		WithArgs(sqlmock.AnyArg(), userID, int64(0)).
-		WillReturnError(assert.AnError)
-
-	wallet, err := svc.CreateWallet(userID)
-	assert.Error(t, err)
-	assert.Nil(t, wallet)
-}
+	_, err := svc.ListWallets(ctx, userID)
+	assert.Equal(t, ErrUserNotFound, err)
 
-/*
-*
+	spending, err := svc.CreateWallet(ctx, userID, "USD", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, WalletTypeSpending, spending.Type)
+	savings, err := svc.CreateWallet(ctx, userID, "EUR", "  Holiday  ", WalletTypeSavings)
+	assert.NoError(t, err)
+	assert.Equal(t, "Holiday", savings.Label)
+	_, err = svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, spending.ID, usd(500))
+	assert.NoError(t, err)
 
-	DEPOSIT Test Cases
+	wallets, err := svc.ListWallets(ctx, userID)
+	assert.NoError(t, err)
+	assert.Len(t, wallets, 2)
+	assert.Equal(t, spending.ID, wallets[0].ID)
+	assert.Equal(t, int64(500), wallets[0].Balance)
+	assert.Equal(t, savings.ID, wallets[1].ID)
+
+	_, err = svc.CreateWallet(ctx, userID, "USD", "", "checking")
+	assert.Equal(t, ErrInvalidWalletType, err)
+	_, err = svc.CreateWallet(ctx, userID, "USD", strings.Repeat("x", MaxWalletLabelLength+1), "")
+	assert.Equal(t, ErrLabelTooLong, err)
+	wallets, _ = svc.ListWallets(ctx, userID)
+	assert.Len(t, wallets, 2)
+}
 
-*
-*/
+func TestService_DepositWithdraw(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 500)
 
-func TestDeposit_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	_, err := svc.Withdraw(ctx, walletID, usd(200))
+	assert.NoError(t, err)
 
-	walletID := uuid.New()
-	amount := int64(200)
+	balance, err := svc.GetBalance(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, usd(300), balance.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
+
+	// The internal accounts mirror the money that entered and left
+	cashIn, _ := svc.LedgerBalance(ctx, AccountCashIn, "USD")
+	cashOut, _ := svc.LedgerBalance(ctx, AccountCashOut, "USD")
+	assert.Equal(t, int64(-500), cashIn)
+	assert.Equal(t, int64(200), cashOut)
+}
 
-	// Expect wallet exists
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+func TestService_DepositValidation(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
 
-	// Begin transaction
-	mock.ExpectBegin()
+	_, err := svc.Deposit(ctx, uuid.New(), usd(0))
+	assert.Equal(t, ErrInvalidAmount, err)
 
-	// Expect update wallet balance
-	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
-		WithArgs(amount, walletID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err = svc.Deposit(ctx, uuid.New(), usd(100))
+	assert.Equal(t, ErrWalletNotFound, err)
+}
 
-	// Expect insert transaction
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), walletID, amount, TxnTypeDeposit, sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+func TestService_CancelledContextRollsBack(t *testing.T) {
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 500)
 
-	// Expect commit
-	mock.ExpectCommit()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := svc.Withdraw(ctx, walletID, usd(200))
+	assert.ErrorIs(t, err, context.Canceled)
 
-	txnID, err := svc.Deposit(walletID, amount)
+	balance, err := svc.GetBalance(context.Background(), walletID)
 	assert.NoError(t, err)
-	assert.NotEqual(t, uuid.Nil, txnID)
+	assert.Equal(t, usd(500), balance.Ledger)
 }
 
-func TestDeposit_InvalidAmount(t *testing.T) {
-	svc, _, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_WithdrawInsufficientFunds(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 100)
 
-	txnID, err := svc.Deposit(uuid.New(), 0)
-	assert.Error(t, err)
-	assert.Equal(t, ErrInvalidAmount, err)
-	assert.Equal(t, uuid.Nil, txnID)
-}
+	_, err := svc.Withdraw(ctx, walletID, usd(101))
+	assert.Equal(t, ErrInsufficientFunds, err)
 
-func TestDeposit_WalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	// Nothing was written for the failed withdrawal
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(100), balance.Ledger)
+	assert.Len(t, repo.transactions, 1)
+	assert.Len(t, repo.entries, 2)
+}
 
-	walletID := uuid.New()
-	amount := int64(100)
+func TestService_Transfer(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	txnID, err := svc.Transfer(ctx, fromID, toID, usd(400))
+	assert.NoError(t, err)
+	assert.NotEqual(t, uuid.Nil, txnID)
 
-	txnID, err := svc.Deposit(walletID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, ErrWalletNotFound, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	from, _ := svc.GetBalance(ctx, fromID)
+	to, _ := svc.GetBalance(ctx, toID)
+	assert.Equal(t, usd(600), from.Ledger)
+	assert.Equal(t, usd(400), to.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, fromID))
+	assert.NoError(t, svc.VerifyBalance(ctx, toID))
 }
 
-func TestDeposit_BeginTxFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_TransferErrors(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 100)
+	toID := fundedWallet(t, svc, 0)
 
-	walletID := uuid.New()
-	amount := int64(100)
+	_, err := svc.Transfer(ctx, fromID, toID, usd(-1))
+	assert.Equal(t, ErrInvalidAmount, err)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	_, err = svc.Transfer(ctx, fromID, fromID, usd(10))
+	assert.Equal(t, ErrSameWalletTransfer, err)
 
-	mock.ExpectBegin().WillReturnError(errors.New("db error"))
+	_, err = svc.Transfer(ctx, uuid.New(), toID, usd(10))
+	assert.Equal(t, ErrSourceInvalid, err)
 
-	txnID, err := svc.Deposit(walletID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, uuid.Nil, txnID)
-}
+	_, err = svc.Transfer(ctx, fromID, uuid.New(), usd(10))
+	assert.Equal(t, ErrDestinationInvalid, err)
 
-func TestDeposit_InsertTxnFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	_, err = svc.Transfer(ctx, fromID, toID, usd(1000))
+	assert.Equal(t, ErrInsufficientFunds, err)
+}
 
-	walletID := uuid.New()
-	amount := int64(100)
+func TestService_CurrencyMismatch(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	usdID := fundedWallet(t, svc, 1000)
+	eur, err := svc.CreateWallet(ctx, uuid.New(), "eur", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "EUR", eur.Currency)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	_, err = svc.Deposit(ctx, eur.ID, usd(100))
+	assert.Equal(t, ErrCurrencyMismatch, err)
 
-	mock.ExpectBegin()
+	_, err = svc.Withdraw(ctx, usdID, Money{Amount: 100, Currency: "EUR"})
+	assert.Equal(t, ErrCurrencyMismatch, err)
 
-	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
-		WithArgs(amount, walletID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err = svc.Transfer(ctx, usdID, eur.ID, usd(100))
+	assert.Equal(t, ErrCurrencyMismatch, err)
 
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), nil, walletID, amount, TxnTypeDeposit, sqlmock.AnyArg()).
-		WillReturnError(errors.New("insert failed"))
+	_, err = svc.Deposit(ctx, usdID, Money{Amount: 100, Currency: "XXX"})
+	assert.Equal(t, ErrUnsupportedCurrency, err)
 
-	mock.ExpectRollback()
+	_, err = svc.CreateWallet(ctx, uuid.New(), "", "", "")
+	assert.Equal(t, ErrCurrencyRequired, err)
 
-	txnID, err := svc.Deposit(walletID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	// Only the opening deposit was written
+	assert.Len(t, repo.transactions, 1)
 }
 
-/*
-*
+func TestService_LedgerBalancePerCurrency(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fundedWallet(t, svc, 500)
+	jpy, err := svc.CreateWallet(ctx, uuid.New(), "JPY", "", "")
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, jpy.ID, Money{Amount: 300, Currency: "JPY"})
+	assert.NoError(t, err)
 
-	WITHDRAW Test Cases
+	cashInUSD, _ := svc.LedgerBalance(ctx, AccountCashIn, "USD")
+	cashInJPY, _ := svc.LedgerBalance(ctx, AccountCashIn, "JPY")
+	assert.Equal(t, int64(-500), cashInUSD)
+	assert.Equal(t, int64(-300), cashInJPY)
+	assert.NoError(t, svc.VerifyBalance(ctx, jpy.ID))
+}
 
-*
-*/
+// newFXService returns a memory backed service that prices USD/EUR at 0.9.
+func newFXService(t *testing.T) (*service, *memoryRepository) {
+	rates, err := NewStaticRateProvider(map[string]string{"USD/EUR": "0.9"})
+	assert.NoError(t, err)
+	repo := NewMemoryRepository()
+	return NewService(repo, WithFXRates(rates, time.Minute)), repo
+}
 
-func TestWithdraw_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_TransferCrossCurrency(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFXService(t)
+	fromID := fundedWallet(t, svc, 1000)
+	eur, err := svc.CreateWallet(ctx, uuid.New(), "EUR", "", "")
+	assert.NoError(t, err)
 
-	walletID := uuid.New()
-	amount := int64(100)
-	initialBalance := int64(200)
+	_, err = svc.Transfer(ctx, fromID, eur.ID, usd(500))
+	assert.NoError(t, err)
 
-	// Expect wallet existence check
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	to, _ := svc.GetBalance(ctx, eur.ID)
+	assert.Equal(t, Money{Amount: 450, Currency: "EUR"}, to.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, fromID))
+	assert.NoError(t, svc.VerifyBalance(ctx, eur.ID))
+
+	// The FX account is long USD and short EUR
+	fxUSD, _ := svc.LedgerBalance(ctx, AccountFX, "USD")
+	fxEUR, _ := svc.LedgerBalance(ctx, AccountFX, "EUR")
+	assert.Equal(t, int64(500), fxUSD)
+	assert.Equal(t, int64(-450), fxEUR)
+
+	page, _ := svc.GetTransactions(ctx, eur.ID, TransactionFilter{})
+	txns := page.Transactions
+	assert.Len(t, txns, 1)
+	assert.Equal(t, &fxConversion{Rate: "0.9", RoundingMode: RoundingHalfEven, SourceAmount: 500, SourceCurrency: "USD",
+		TargetAmount: 450, TargetCurrency: "EUR"}, txns[0].FX)
+
+	// The amount must be in the sender's currency
+	_, err = svc.Transfer(ctx, fromID, eur.ID, Money{Amount: 100, Currency: "EUR"})
+	assert.Equal(t, ErrCurrencyMismatch, err)
+
+	jpy, _ := svc.CreateWallet(ctx, uuid.New(), "JPY", "", "")
+	_, err = svc.Transfer(ctx, fromID, jpy.ID, usd(100))
+	assert.Equal(t, ErrRateUnavailable, err)
+}
 
-	// Begin transaction
-	mock.ExpectBegin()
+func TestService_QuoteAndExecute(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newFXService(t)
+	fromID := fundedWallet(t, svc, 1000)
+	eur, _ := svc.CreateWallet(ctx, uuid.New(), "EUR", "", "")
 
-	// Expect SELECT balance
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(initialBalance))
+	quote, err := svc.QuoteTransfer(ctx, fromID, eur.ID, usd(333))
+	assert.NoError(t, err)
+	assert.Equal(t, Money{Amount: 300, Currency: "EUR"}, quote.Target)
+	assert.Equal(t, "0.9", quote.Rate)
+	assert.True(t, quote.ExpiresAt.After(time.Now()))
 
-	// Expect UPDATE balance
-	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
-		WithArgs(amount, walletID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// The rate moves after the quote, but the quoted amounts are kept
+	assert.NoError(t, svc.fx.(*staticRateProvider).SetRate("USD", "EUR", "0.5"))
 
-	// Expect INSERT transaction
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), walletID, amount, TxnTypeWithdrawal, sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	txnID, err := svc.ExecuteQuote(ctx, quote.ID)
+	assert.NoError(t, err)
+	to, _ := svc.GetBalance(ctx, eur.ID)
+	assert.Equal(t, Money{Amount: 300, Currency: "EUR"}, to.Ledger)
 
-	// Expect Commit
-	mock.ExpectCommit()
+	page, _ := svc.GetTransactions(ctx, eur.ID, TransactionFilter{})
+	txns := page.Transactions
+	assert.Equal(t, txnID, txns[0].ID)
+	assert.Equal(t, &quote.ID, txns[0].FX.QuoteID)
 
-	id, err := svc.Withdraw(walletID, amount)
-	assert.NoError(t, err)
-	assert.NotEqual(t, uuid.Nil, id)
-}
+	_, err = svc.ExecuteQuote(ctx, quote.ID)
+	assert.Equal(t, ErrQuoteExecuted, err)
 
-func TestWithdraw_InvalidAmount(t *testing.T) {
-	svc, _, cleanup := newTestService(t)
-	defer cleanup()
+	_, err = svc.ExecuteQuote(ctx, uuid.New())
+	assert.Equal(t, ErrQuoteNotFound, err)
 
-	id, err := svc.Withdraw(uuid.New(), 0)
-	assert.Error(t, err)
-	assert.Equal(t, ErrInvalidAmount, err)
-	assert.Equal(t, uuid.Nil, id)
+	// An expired quote moves no money
+	expired, err := svc.QuoteTransfer(ctx, fromID, eur.ID, usd(100))
+	assert.NoError(t, err)
+	repo.quotes[expired.ID].ExpiresAt = time.Now().Add(-time.Second)
+	_, err = svc.ExecuteQuote(ctx, expired.ID)
+	assert.Equal(t, ErrQuoteExpired, err)
+	from, _ := svc.GetBalance(ctx, fromID)
+	assert.Equal(t, usd(667), from.Ledger)
 }
 
-func TestWithdraw_WalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_QuoteErrors(t *testing.T) {
+	ctx := context.Background()
+	plain, _ := newMemoryService()
+	_, err := plain.QuoteTransfer(ctx, uuid.New(), uuid.New(), usd(100))
+	assert.Equal(t, ErrRateUnavailable, err)
 
-	walletID := uuid.New()
+	svc, _ := newFXService(t)
+	fromID := fundedWallet(t, svc, 100)
+	eur, _ := svc.CreateWallet(ctx, uuid.New(), "EUR", "", "")
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	_, err = svc.QuoteTransfer(ctx, fromID, fromID, usd(100))
+	assert.Equal(t, ErrSameWalletTransfer, err)
+	_, err = svc.QuoteTransfer(ctx, uuid.New(), eur.ID, usd(100))
+	assert.Equal(t, ErrSourceInvalid, err)
+	_, err = svc.QuoteTransfer(ctx, fromID, uuid.New(), usd(100))
+	assert.Equal(t, ErrDestinationInvalid, err)
 
-	id, err := svc.Withdraw(walletID, 100)
-	assert.Error(t, err)
-	assert.Equal(t, ErrWalletNotFound, err)
-	assert.Equal(t, uuid.Nil, id)
+	// A quote can be larger than the balance, but executing it fails
+	quote, err := svc.QuoteTransfer(ctx, fromID, eur.ID, usd(1000))
+	assert.NoError(t, err)
+	_, err = svc.ExecuteQuote(ctx, quote.ID)
+	assert.Equal(t, ErrInsufficientFunds, err)
 }
 
-func TestWithdraw_InsufficientBalance(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+// newFeeService returns a service that charges a flat 50 on withdrawals and 1% on transfers.
+func newFeeService(t *testing.T) (*service, *memoryRepository) {
+	fees, err := NewFeeSchedule([]FeeRule{
+		{Name: "withdrawal_fee", TxnType: TxnTypeWithdrawal, Currency: "USD", Flat: 50},
+		{Name: "transfer_fee", TxnType: TxnTypeTransfer, Percent: "1"},
+	})
+	assert.NoError(t, err)
+	repo := NewMemoryRepository()
+	return NewService(repo, WithFees(fees)), repo
+}
 
-	walletID := uuid.New()
-	amount := int64(500)
-	balance := int64(100)
+func TestService_WithdrawCharged(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	txnID, err := svc.Withdraw(ctx, walletID, usd(400))
+	assert.NoError(t, err)
 
-	mock.ExpectBegin()
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(balance))
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(550), balance.Ledger)
+	revenue, _ := svc.GetBalance(ctx, RevenueWalletID("USD"))
+	assert.Equal(t, usd(50), revenue.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, RevenueWalletID("USD")))
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
 
-	mock.ExpectRollback()
+	txn := repo.transactions[len(repo.transactions)-1]
+	assert.Equal(t, txnID, txn.ID)
+	assert.Equal(t, int64(400), txn.Amount)
+	assert.Equal(t, []feeItem{{Name: "withdrawal_fee", Amount: 50, Currency: "USD"}}, txn.Fees)
 
-	id, err := svc.Withdraw(walletID, amount)
-	assert.Error(t, err)
+	// The fee must be covered too
+	_, err = svc.Withdraw(ctx, walletID, usd(550))
 	assert.Equal(t, ErrInsufficientFunds, err)
-	assert.Equal(t, uuid.Nil, id)
+	_, err = svc.Withdraw(ctx, walletID, usd(500))
+	assert.NoError(t, err)
 }
 
-func TestWithdraw_DBError(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_FeesOverflowingAmount(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	emptyID := fundedWallet(t, svc, 0)
+	toID := fundedWallet(t, svc, 0)
 
-	walletID := uuid.New()
+	// Amount plus fee would wrap around to a negative debit
+	_, err := svc.Withdraw(ctx, emptyID, usd(math.MaxInt64-1))
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.Transfer(ctx, emptyID, toID, usd(math.MaxInt64))
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.CreateHold(ctx, emptyID, usd(math.MaxInt64-1), time.Hour)
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.PreviewFees(ctx, emptyID, TxnTypeWithdrawal, usd(math.MaxInt64-1))
+	assert.Equal(t, ErrInvalidAmount, err)
+	balance, _ := svc.GetBalance(ctx, emptyID)
+	assert.Equal(t, usd(0), balance.Ledger)
+
+	// A hold placed before the fee applied can not be captured past the limit either
+	fees := svc.fees
+	svc.fees = nil
+	heldID := fundedWallet(t, svc, math.MaxInt64-1)
+	h, err := svc.CreateHold(ctx, heldID, usd(math.MaxInt64-1), time.Hour)
+	assert.NoError(t, err)
+	svc.fees = fees
+	_, err = svc.CaptureHold(ctx, h.ID, math.MaxInt64-1)
+	assert.Equal(t, ErrInvalidAmount, err)
+	assert.NoError(t, svc.VerifyBalance(ctx, heldID))
+}
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+func TestService_RevenueWallets(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
 
-	mock.ExpectBegin().WillReturnError(errors.New("db down"))
+	wallets, err := svc.ListRevenueWallets(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, wallets)
 
-	id, err := svc.Withdraw(walletID, 100)
-	assert.Error(t, err)
-	assert.Equal(t, uuid.Nil, id)
+	// A refused withdrawal does not leave a revenue wallet behind
+	_, err = svc.Withdraw(ctx, walletID, usd(1000))
+	assert.Equal(t, ErrInsufficientFunds, err)
+	wallets, _ = svc.ListRevenueWallets(ctx)
+	assert.Empty(t, wallets)
+
+	// The first fee creates the wallet, later fees add to it
+	for i := 0; i < 2; i++ {
+		_, err = svc.Withdraw(ctx, walletID, usd(100))
+		assert.NoError(t, err)
+	}
+	wallets, err = svc.ListRevenueWallets(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, wallets, 1) {
+		assert.Equal(t, RevenueWalletID("USD"), wallets[0].ID)
+		assert.Equal(t, SystemUserID, wallets[0].UserID)
+		assert.Equal(t, WalletTypeRevenue, wallets[0].Type)
+		assert.Equal(t, int64(100), wallets[0].Balance)
+	}
+
+	// Revenue wallets can not be created through the API
+	_, err = svc.CreateWallet(ctx, uuid.New(), "USD", "", WalletTypeRevenue)
+	assert.Equal(t, ErrInvalidWalletType, err)
+	id, other := RevenueWalletID("EUR"), uuid.New()
+	assert.Equal(t, 1, bytes.Compare(id[:], other[:]), "revenue wallets are locked last")
 }
 
-func TestWithdraw_InsertTxnFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
-	amount := int64(100)
+func TestService_TransferCharged(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-
-	mock.ExpectBegin()
+	_, err := svc.Transfer(ctx, fromID, toID, usd(500))
+	assert.NoError(t, err)
 
-	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
-		WithArgs(amount, walletID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	from, _ := svc.GetBalance(ctx, fromID)
+	to, _ := svc.GetBalance(ctx, toID)
+	assert.Equal(t, usd(495), from.Ledger)
+	assert.Equal(t, usd(500), to.Ledger)
+	revenue, _ := svc.GetBalance(ctx, RevenueWalletID("USD"))
+	assert.Equal(t, usd(5), revenue.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, RevenueWalletID("USD")))
+	assert.NoError(t, svc.VerifyBalance(ctx, fromID))
+	assert.NoError(t, svc.VerifyBalance(ctx, toID))
+}
 
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), nil, walletID, amount, TxnTypeWithdrawal, sqlmock.AnyArg()).
-		WillReturnError(errors.New("insert failed"))
+func TestService_PreviewFees(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
 
-	mock.ExpectRollback()
+	preview, err := svc.PreviewFees(ctx, walletID, TxnTypeTransfer, usd(250))
+	assert.NoError(t, err)
+	assert.Equal(t, []feeItem{{Name: "transfer_fee", Amount: 2, Currency: "USD"}}, preview.Fees)
+	assert.Equal(t, usd(2), preview.TotalFee)
+	assert.Equal(t, usd(252), preview.TotalDebit)
+
+	// Nothing moved
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(1000), balance.Ledger)
+
+	_, err = svc.PreviewFees(ctx, walletID, TxnTypeDeposit, usd(250))
+	assert.Equal(t, ErrInvalidTxnType, err)
+	_, err = svc.PreviewFees(ctx, walletID, TxnTypeTransfer, Money{Amount: 250, Currency: "EUR"})
+	assert.Equal(t, ErrCurrencyMismatch, err)
+	_, err = svc.PreviewFees(ctx, uuid.New(), TxnTypeTransfer, usd(250))
+	assert.Equal(t, ErrWalletNotFound, err)
 
-	txnID, err := svc.Withdraw(walletID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	// Without a schedule nothing is charged
+	plain, _ := newMemoryService()
+	walletID = fundedWallet(t, plain, 1000)
+	preview, err = plain.PreviewFees(ctx, walletID, TxnTypeWithdrawal, usd(250))
+	assert.NoError(t, err)
+	assert.Empty(t, preview.Fees)
+	assert.Equal(t, usd(250), preview.TotalDebit)
 }
 
-/*
-*
+func newLimitService(t *testing.T) (*service, *memoryRepository) {
+	limits, err := NewLimitSchedule(map[string][]Limit{
+		DefaultLimitTier: {
+			{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitPerTransaction, MaxAmount: 500},
+			{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: 800, MaxCount: 3},
+			{TxnType: TxnTypeTransfer, Period: LimitDaily, MaxCount: 1},
+		},
+		"premium": {
+			{TxnType: TxnTypeWithdrawal, Currency: "USD", Period: LimitDaily, MaxAmount: 5000},
+		},
+	})
+	assert.NoError(t, err)
+	repo := NewMemoryRepository()
+	return NewService(repo, WithLimits(limits)), repo
+}
 
-	TRANSFER Test Cases
+func TestService_WithdrawLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newLimitService(t)
+	walletID := fundedWallet(t, svc, 10000)
 
-*
-*/
+	_, err := svc.Withdraw(ctx, walletID, usd(600))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	var limitErr *LimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, LimitError{TxnType: TxnTypeWithdrawal, Period: LimitPerTransaction, Kind: LimitKindAmount,
+		Limit: 500, Remaining: 500, Currency: "USD"}, *limitErr)
 
-func TestTransfer_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	_, err = svc.Withdraw(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(400))
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, LimitDaily, limitErr.Period)
+	assert.Equal(t, int64(300), limitErr.Remaining)
+	assert.Equal(t, "limit exceeded: daily withdrawal amount limit of 800 USD, 300 USD remaining", err.Error())
 
-	fromID := uuid.New()
-	toID := uuid.New()
-	amount := int64(100)
+	_, err = svc.Withdraw(ctx, walletID, usd(100))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(100))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(1))
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, LimitKindCount, limitErr.Kind)
+	assert.Equal(t, int64(0), limitErr.Remaining)
+
+	// Refused withdrawals move no money
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(9300), balance.Ledger)
+}
 
-	// WalletExists checks
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+func TestService_TransferLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newLimitService(t)
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
 
-	mock.ExpectBegin()
+	_, err := svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
 
-	// Balance check
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(1000))
+	// Only the sender's transfers count
+	_, err = svc.Transfer(ctx, toID, fromID, usd(50))
+	assert.NoError(t, err)
+}
 
-	// Subtract from sender
-	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
-		WithArgs(amount, fromID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+func TestService_WalletLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newLimitService(t)
+	walletID := fundedWallet(t, svc, 10000)
 
-	// Add to receiver
-	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
-		WithArgs(amount, toID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	// An override replaces the tier limit of its period only
+	overrides := []Limit{{TxnType: TxnTypeWithdrawal, Period: LimitPerTransaction, MaxAmount: 2000}}
+	w, err := svc.SetWalletLimits(ctx, walletID, WalletLimitsChange{Overrides: &overrides})
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultLimitTier, w.Tier)
+	assert.Equal(t, "USD", w.LimitOverrides[0].Currency)
 
-	// Insert transaction
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), fromID, toID, amount, TxnTypeTransfer, sqlmock.AnyArg()).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err = svc.Withdraw(ctx, walletID, usd(1000))
+	var limitErr *LimitError
+	assert.True(t, errors.As(err, &limitErr))
+	assert.Equal(t, LimitDaily, limitErr.Period)
 
-	mock.ExpectCommit()
+	_, err = svc.SetWalletLimits(ctx, walletID, WalletLimitsChange{Tier: "premium"})
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(1000))
+	assert.NoError(t, err)
 
-	txnID, err := svc.Transfer(fromID, toID, amount)
+	limits, err := svc.GetWalletLimits(ctx, walletID)
 	assert.NoError(t, err)
-	assert.NotEqual(t, uuid.Nil, txnID)
+	assert.Equal(t, "premium", limits.Tier)
+	assert.Len(t, limits.Limits, 2)
+	assert.Nil(t, limits.Limits[0].ResetsAt)
+	assert.Equal(t, int64(1000), limits.Limits[1].UsedAmount)
+	assert.Equal(t, int64(1), limits.Limits[1].UsedCount)
+	assert.True(t, limits.Limits[1].ResetsAt.After(time.Now()))
+
+	_, err = svc.SetWalletLimits(ctx, walletID, WalletLimitsChange{Tier: "gold"})
+	assert.Equal(t, ErrInvalidTier, err)
+	bad := []Limit{{TxnType: TxnTypeWithdrawal, Currency: "EUR", Period: LimitDaily, MaxAmount: 1}}
+	_, err = svc.SetWalletLimits(ctx, walletID, WalletLimitsChange{Overrides: &bad})
+	assert.Equal(t, ErrCurrencyMismatch, err)
+	_, err = svc.SetWalletLimits(ctx, uuid.New(), WalletLimitsChange{Tier: "premium"})
+	assert.Equal(t, ErrWalletNotFound, err)
 }
 
-func TestTransfer_InsufficientFunds(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	fromID := uuid.New()
-	toID := uuid.New()
-	amount := int64(1000)
-
-	// WalletExists
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+func TestService_GetTransactionsNewestFirst(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
 
-	mock.ExpectBegin()
-
-	// Balance is too low
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(200)) // < amount
+	_, err := svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.NoError(t, err)
 
-	mock.ExpectRollback()
+	page, err := svc.GetTransactions(ctx, fromID, TransactionFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Transactions, 2)
+	assert.Equal(t, TxnTypeTransfer, page.Transactions[0].Type)
+	assert.Equal(t, TxnTypeDeposit, page.Transactions[1].Type)
+	assert.Empty(t, page.NextCursor)
 
-	txnID, err := svc.Transfer(fromID, toID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, ErrInsufficientFunds, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	_, err = svc.GetTransactions(ctx, uuid.New(), TransactionFilter{})
+	assert.Equal(t, ErrWalletNotFound, err)
 }
 
-func TestTransfer_SameWallet(t *testing.T) {
-	svc, _, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
-	txnID, err := svc.Transfer(walletID, walletID, 500)
-	assert.Error(t, err)
-	assert.Equal(t, ErrSameWalletTransfer, err)
-	assert.Equal(t, uuid.Nil, txnID)
+func TestService_GetTransactionsPaging(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 0)
+
+	// Seven deposits, three of them sharing a timestamp so the id breaks the tie
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		created := base.Add(time.Duration(i) * time.Minute)
+		if i >= 4 {
+			created = base.Add(4 * time.Minute)
+		}
+		repo.transactions = append(repo.transactions, transaction{ID: uuid.New(), ToWallet: &walletID,
+			Amount: int64(100 * (i + 1)), Currency: "USD", Type: TxnTypeDeposit, CreatedAt: created})
+	}
+
+	var seen []transaction
+	cursor := ""
+	for pages := 0; ; pages++ {
+		page, err := svc.GetTransactions(ctx, walletID, TransactionFilter{Cursor: cursor, Limit: 3})
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Transactions), 3)
+		seen = append(seen, page.Transactions...)
+		if page.NextCursor == "" {
+			assert.Equal(t, 2, pages)
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	// Every transaction is returned exactly once, newest first
+	assert.Len(t, seen, 7)
+	for i := 1; i < len(seen); i++ {
+		assert.True(t, txnCursor{CreatedAt: seen[i-1].CreatedAt, ID: seen[i-1].ID}.before(seen[i]))
+	}
+
+	_, err := svc.GetTransactions(ctx, walletID, TransactionFilter{Cursor: "not-a-cursor"})
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, err = svc.GetTransactions(ctx, walletID, TransactionFilter{Limit: MaxPageSize + 1})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
 }
 
-func TestTransfer_InvalidAmount(t *testing.T) {
-	svc, _, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_GetTransactionsFilters(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	aliceID := fundedWallet(t, svc, 1000)
+	bobID := fundedWallet(t, svc, 1000)
+	carolID := fundedWallet(t, svc, 0)
 
-	txnID, err := svc.Transfer(uuid.New(), uuid.New(), -50)
-	assert.Error(t, err)
-	assert.Equal(t, ErrInvalidAmount, err)
-	assert.Equal(t, uuid.Nil, txnID)
-}
+	_, err := svc.Transfer(ctx, aliceID, bobID, usd(100))
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, bobID, aliceID, usd(250))
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, aliceID, carolID, usd(300))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, aliceID, usd(50))
+	assert.NoError(t, err)
 
-func TestTransfer_SourceWalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	count := func(filter TransactionFilter) int {
+		page, err := svc.GetTransactions(ctx, aliceID, filter)
+		assert.NoError(t, err)
+		return len(page.Transactions)
+	}
+	assert.Equal(t, 5, count(TransactionFilter{}))
+	assert.Equal(t, 3, count(TransactionFilter{Type: TxnTypeTransfer}))
+	assert.Equal(t, 2, count(TransactionFilter{Direction: DirectionIn}))
+	assert.Equal(t, 3, count(TransactionFilter{Direction: DirectionOut}))
+	assert.Equal(t, 2, count(TransactionFilter{Counterparty: &bobID}))
+	assert.Equal(t, 1, count(TransactionFilter{Counterparty: &bobID, Direction: DirectionIn}))
+	assert.Equal(t, 1, count(TransactionFilter{Counterparty: &carolID}))
+	assert.Equal(t, 3, count(TransactionFilter{MinAmount: 100, MaxAmount: 300}))
+	assert.Equal(t, 0, count(TransactionFilter{Since: time.Now().Add(time.Hour)}))
+	assert.Equal(t, 5, count(TransactionFilter{Until: time.Now().Add(time.Hour)}))
+
+	_, err = svc.GetTransactions(ctx, aliceID, TransactionFilter{Type: "refund"})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+	_, err = svc.GetTransactions(ctx, aliceID, TransactionFilter{Direction: "sideways"})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+	_, err = svc.GetTransactions(ctx, aliceID, TransactionFilter{MinAmount: 500, MaxAmount: 100})
+	assert.ErrorIs(t, err, ErrInvalidFilter)
+}
 
-	fromID := uuid.New()
-	toID := uuid.New()
-	amount := int64(100)
+func TestService_ReverseDeposit(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	deposit := repo.transactions[0].ID
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	revID, err := svc.Reverse(ctx, deposit, 0, "deposited twice by mistake", false)
+	assert.NoError(t, err)
 
-	txnID, err := svc.Transfer(fromID, toID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, ErrSourceInvalid, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(0), balance.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
+	cashIn, _ := svc.LedgerBalance(ctx, AccountCashIn, "USD")
+	assert.Equal(t, int64(0), cashIn)
+
+	rev := repo.transactions[1]
+	assert.Equal(t, revID, rev.ID)
+	assert.Equal(t, TxnTypeReversal, rev.Type)
+	assert.Equal(t, &deposit, rev.ReversesID)
+	assert.Equal(t, "deposited twice by mistake", rev.Reason)
+	assert.Equal(t, &walletID, rev.FromWallet)
+	assert.Nil(t, rev.ToWallet)
+
+	reversed := repo.outbox[len(repo.outbox)-1]
+	assert.Equal(t, EventFundsReversed, reversed.Type)
+	assert.Equal(t, walletID, reversed.WalletID)
+
+	// Neither the original nor the reversal can be reversed again
+	_, err = svc.Reverse(ctx, deposit, 0, "again", false)
+	assert.Equal(t, ErrAlreadyReversed, err)
+	_, err = svc.Reverse(ctx, revID, 0, "undo the undo", false)
+	assert.Equal(t, ErrNotReversible, err)
 }
 
-func TestTransfer_DestinationWalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_ReverseKeepsFees(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
+	txnID, _ := svc.Withdraw(ctx, walletID, usd(400))
 
-	fromID := uuid.New()
-	toID := uuid.New()
-	amount := int64(100)
+	revID, err := svc.Reverse(ctx, txnID, 0, "withdrawn by mistake", false)
+	assert.NoError(t, err)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// The amount comes back, the fee stays with the revenue wallet
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(950), balance.Ledger)
+	revenue, _ := svc.GetBalance(ctx, RevenueWalletID("USD"))
+	assert.Equal(t, usd(50), revenue.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, RevenueWalletID("USD")))
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
+
+	reversed := repo.outbox[len(repo.outbox)-1]
+	assert.Equal(t, EventFundsReversed, reversed.Type)
+	assert.Equal(t, walletID, reversed.WalletID)
+	var rev transaction
+	assert.NoError(t, json.Unmarshal(reversed.Payload, &rev))
+	assert.Equal(t, revID, rev.ID)
+	assert.Equal(t, &txnID, rev.ReversesID)
+}
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+func TestService_ReversePartialTransfer(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	txnID, _ := svc.Transfer(ctx, fromID, toID, usd(400))
 
-	txnID, err := svc.Transfer(fromID, toID, amount)
-	assert.Error(t, err)
-	assert.Equal(t, ErrDestinationInvalid, err)
-	assert.Equal(t, uuid.Nil, txnID)
+	_, err := svc.Reverse(ctx, txnID, 150, "partial refund", false)
+	assert.NoError(t, err)
+	_, err = svc.Reverse(ctx, txnID, 300, "too much", false)
+	assert.Equal(t, ErrReversalTooLarge, err)
+	_, err = svc.Reverse(ctx, txnID, 0, "rest of the refund", false)
+	assert.NoError(t, err)
+	_, err = svc.Reverse(ctx, txnID, 1, "one more", false)
+	assert.Equal(t, ErrAlreadyReversed, err)
+
+	from, _ := svc.GetBalance(ctx, fromID)
+	to, _ := svc.GetBalance(ctx, toID)
+	assert.Equal(t, usd(1000), from.Ledger)
+	assert.Equal(t, usd(0), to.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, fromID))
+	assert.NoError(t, svc.VerifyBalance(ctx, toID))
+
+	orig, _ := repo.LockTransaction(ctx, txnID)
+	assert.Equal(t, int64(400), orig.Reversed)
 }
 
-func TestTransfer_InsertFailsAndRollback(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_ReverseSpentFunds(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	txnID, _ := svc.Transfer(ctx, fromID, toID, usd(400))
+	_, err := svc.Withdraw(ctx, toID, usd(300))
+	assert.NoError(t, err)
 
-	fromID := uuid.New()
-	toID := uuid.New()
-	amount := int64(500)
+	_, err = svc.Reverse(ctx, txnID, 0, "fraud", false)
+	assert.Equal(t, ErrFundsAlreadySpent, err)
 
-	// WalletExists checks
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// An operator can push the receiver below zero
+	_, err = svc.Reverse(ctx, txnID, 0, "fraud", true)
+	assert.NoError(t, err)
+	to, _ := svc.GetBalance(ctx, toID)
+	assert.Equal(t, usd(-300), to.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, toID))
+}
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(toID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+func TestService_ReverseCrossCurrency(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newFXService(t)
+	fromID := fundedWallet(t, svc, 1000)
+	eur, _ := svc.CreateWallet(ctx, uuid.New(), "EUR", "", "")
+	txnID, err := svc.Transfer(ctx, fromID, eur.ID, usd(333))
+	assert.NoError(t, err)
 
-	mock.ExpectBegin()
+	// Partial reversals at the original rate add up to the converted amount
+	for _, amount := range []int64{111, 111, 111} {
+		_, err := svc.Reverse(ctx, txnID, amount, "refund", false)
+		assert.NoError(t, err)
+	}
+
+	from, _ := svc.GetBalance(ctx, fromID)
+	to, _ := svc.GetBalance(ctx, eur.ID)
+	assert.Equal(t, usd(1000), from.Ledger)
+	assert.Equal(t, Money{Amount: 0, Currency: "EUR"}, to.Ledger)
+	for _, currency := range []string{"USD", "EUR"} {
+		fx, _ := svc.LedgerBalance(ctx, AccountFX, currency)
+		assert.Equal(t, int64(0), fx, currency)
+	}
+}
 
-	// Balance check returns enough balance
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(fromID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(1000))
+func TestService_ReverseValidation(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	fundedWallet(t, svc, 1000)
 
-	// Subtract from sender
-	mock.ExpectExec(`UPDATE wallets SET balance = balance - \$1 WHERE id = \$2`).
-		WithArgs(amount, fromID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	_, err := svc.Reverse(ctx, repo.transactions[0].ID, 0, " ", false)
+	assert.Equal(t, ErrReasonRequired, err)
+	_, err = svc.Reverse(ctx, repo.transactions[0].ID, -1, "refund", false)
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.Reverse(ctx, uuid.New(), 0, "refund", false)
+	assert.Equal(t, ErrTransactionNotFound, err)
+}
 
-	// Add to receiver
-	mock.ExpectExec(`UPDATE wallets SET balance = balance \+ \$1 WHERE id = \$2`).
-		WithArgs(amount, toID).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+func TestReversalTarget(t *testing.T) {
+	fx := &fxConversion{SourceAmount: 333, TargetAmount: 300}
+	assert.Equal(t, int64(100), reversalTarget(fx, 0, 111))
+	assert.Equal(t, int64(100), reversalTarget(fx, 111, 111))
+	assert.Equal(t, int64(100), reversalTarget(fx, 222, 111))
+	assert.Equal(t, int64(300), reversalTarget(fx, 0, 333))
+	assert.Equal(t, "1.111111111111", invertRate("0.9"))
+}
 
-	// Simulate INSERT failure
-	mock.ExpectExec(`INSERT INTO transactions`).
-		WithArgs(sqlmock.AnyArg(), fromID, toID, amount, TxnTypeTransfer, sqlmock.AnyArg()).
-		WillReturnError(errors.New("insert failed"))
+func TestService_HoldReducesAvailable(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
 
-	mock.ExpectRollback()
+	h, err := svc.CreateHold(ctx, walletID, usd(400), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, HoldActive, h.Status)
+	assert.WithinDuration(t, time.Now().Add(DefaultHoldTTL), h.ExpiresAt, time.Minute)
 
-	// Call the actual service
-	txnID, err := svc.Transfer(fromID, toID, amount)
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(1000), balance.Ledger)
+	assert.Equal(t, usd(600), balance.Available)
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
 
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "insert failed")
-	assert.Equal(t, uuid.Nil, txnID)
+	// Held funds can be neither withdrawn nor held twice
+	_, err = svc.Withdraw(ctx, walletID, usd(700))
+	assert.Equal(t, ErrInsufficientFunds, err)
+	_, err = svc.CreateHold(ctx, walletID, usd(700), 0)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	_, err = svc.Transfer(ctx, walletID, fundedWallet(t, svc, 0), usd(601))
+	assert.Equal(t, ErrInsufficientFunds, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(600))
+	assert.NoError(t, err)
 }
 
-/*
-*
+func TestService_CaptureHold(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	h, _ := svc.CreateHold(ctx, walletID, usd(400), time.Hour)
 
-	GET BALANCE Test Cases
+	// Partial capture releases the rest of the hold
+	txnID, err := svc.CaptureHold(ctx, h.ID, 250)
+	assert.NoError(t, err)
 
-*
-*/
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(750), balance.Ledger)
+	assert.Equal(t, usd(750), balance.Available)
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
 
-func TestGetBalance_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	captured, _ := svc.GetHold(ctx, h.ID)
+	assert.Equal(t, HoldCaptured, captured.Status)
+	assert.Equal(t, int64(250), captured.CapturedAmount)
+	assert.Equal(t, &txnID, captured.TransactionID)
+	assert.Equal(t, TxnTypeCapture, repo.transactions[len(repo.transactions)-1].Type)
 
-	walletID := uuid.New()
-	expectedBalance := int64(1000)
+	cashOut, _ := svc.LedgerBalance(ctx, AccountCashOut, "USD")
+	assert.Equal(t, int64(250), cashOut)
 
-	// Expect WalletExists to return true
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// A hold settles only once
+	_, err = svc.CaptureHold(ctx, h.ID, 0)
+	assert.Equal(t, ErrHoldNotActive, err)
+	assert.Equal(t, ErrHoldNotActive, svc.VoidHold(ctx, h.ID))
+}
 
-	// Expect balance query
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"balance"}).AddRow(expectedBalance))
+func TestService_CaptureHoldErrors(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	h, _ := svc.CreateHold(ctx, walletID, usd(400), time.Hour)
 
-	// Run test
-	balance, err := svc.GetBalance(walletID)
+	_, err := svc.CaptureHold(ctx, h.ID, 401)
+	assert.Equal(t, ErrCaptureExceedsHold, err)
+	_, err = svc.CaptureHold(ctx, h.ID, -1)
+	assert.Equal(t, ErrInvalidAmount, err)
+	_, err = svc.CaptureHold(ctx, uuid.New(), 0)
+	assert.Equal(t, ErrHoldNotFound, err)
 
+	// Without an amount the whole hold is captured
+	_, err = svc.CaptureHold(ctx, h.ID, 0)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedBalance, balance)
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(600), balance.Ledger)
+
+	_, err = svc.CreateHold(ctx, walletID, usd(100), -time.Second)
+	assert.Equal(t, ErrInvalidHoldTTL, err)
+	_, err = svc.CreateHold(ctx, walletID, Money{Amount: 100, Currency: "EUR"}, 0)
+	assert.Equal(t, ErrCurrencyMismatch, err)
+
+	// Expired holds cannot be captured even before the sweeper releases them
+	short, _ := svc.CreateHold(ctx, walletID, usd(100), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	_, err = svc.CaptureHold(ctx, short.ID, 0)
+	assert.Equal(t, ErrHoldExpired, err)
 }
 
-func TestGetBalance_WalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
+func TestService_CaptureHoldCharged(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
 
-	// Expect WalletExists to return false
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	// The hold leaves room for the fee of its capture
+	_, err := svc.CreateHold(ctx, walletID, usd(960), time.Hour)
+	assert.Equal(t, ErrInsufficientFunds, err)
+	h, err := svc.CreateHold(ctx, walletID, usd(400), time.Hour)
+	assert.NoError(t, err)
 
-	// Run test
-	balance, err := svc.GetBalance(walletID)
+	txnID, err := svc.CaptureHold(ctx, h.ID, 300)
+	assert.NoError(t, err)
 
-	assert.Error(t, err)
-	assert.Equal(t, ErrWalletNotFound, err)
-	assert.Equal(t, int64(0), balance)
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(650), balance.Ledger)
+	revenue, _ := svc.GetBalance(ctx, RevenueWalletID("USD"))
+	assert.Equal(t, usd(50), revenue.Ledger)
+	assert.NoError(t, svc.VerifyBalance(ctx, RevenueWalletID("USD")))
+	assert.NoError(t, svc.VerifyBalance(ctx, walletID))
+
+	captured := repo.outbox[len(repo.outbox)-1]
+	assert.Equal(t, EventHoldCaptured, captured.Type)
+	assert.Equal(t, walletID, captured.WalletID)
+	var txn transaction
+	assert.NoError(t, json.Unmarshal(captured.Payload, &txn))
+	assert.Equal(t, txnID, txn.ID)
+	assert.Equal(t, []feeItem{{Name: "withdrawal_fee", Amount: 50, Currency: "USD"}}, txn.Fees)
 }
 
-func TestGetBalance_WalletExistsQueryFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_CaptureHoldLimits(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newLimitService(t)
+	walletID := fundedWallet(t, svc, 10000)
 
-	walletID := uuid.New()
+	_, err := svc.CreateHold(ctx, walletID, usd(600), time.Hour)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
 
-	// Simulate query error
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnError(assert.AnError)
+	// Captures count toward the withdrawal limits
+	h, _ := svc.CreateHold(ctx, walletID, usd(500), time.Hour)
+	_, err = svc.CaptureHold(ctx, h.ID, 0)
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(400))
+	assert.ErrorIs(t, err, ErrLimitExceeded)
 
-	// Run test
-	balance, err := svc.GetBalance(walletID)
+	h, _ = svc.CreateHold(ctx, walletID, usd(300), time.Hour)
+	_, err = svc.Withdraw(ctx, walletID, usd(300))
+	assert.NoError(t, err)
+	_, err = svc.CaptureHold(ctx, h.ID, 0)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
 
-	assert.Error(t, err)
-	assert.Equal(t, assert.AnError, err)
-	assert.Equal(t, int64(0), balance)
+	// A refused capture leaves the hold active
+	refused, _ := svc.GetHold(ctx, h.ID)
+	assert.Equal(t, HoldActive, refused.Status)
 }
 
-func TestGetBalance_SelectFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
-
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-
-	mock.ExpectQuery(`SELECT balance FROM wallets WHERE id = \$1`).
-		WithArgs(walletID).
-		WillReturnError(assert.AnError)
+func TestService_VoidHold(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	h, _ := svc.CreateHold(ctx, walletID, usd(400), time.Hour)
 
-	// Run test
-	balance, err := svc.GetBalance(walletID)
+	assert.NoError(t, svc.VoidHold(ctx, h.ID))
 
-	assert.Error(t, err)
-	assert.Equal(t, assert.AnError, err)
-	assert.Equal(t, int64(0), balance)
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(1000), balance.Ledger)
+	assert.Equal(t, usd(1000), balance.Available)
+	voided, _ := svc.GetHold(ctx, h.ID)
+	assert.Equal(t, HoldVoided, voided.Status)
 }
 
-/*
-*
-
-	GET TRANSACTION Test Cases
-
-*
-*/
+func TestService_ExpireHolds(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	short, _ := svc.CreateHold(ctx, walletID, usd(300), time.Minute)
+	long, _ := svc.CreateHold(ctx, walletID, usd(200), time.Hour)
 
-func TestGetTransactions_Success(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+	n, err := svc.ExpireHolds(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
 
-	walletID := uuid.New()
+	n, err = svc.ExpireHolds(ctx, time.Now().Add(2*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
 
-	// Expect wallet exists
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	expired, _ := svc.GetHold(ctx, short.ID)
+	assert.Equal(t, HoldExpired, expired.Status)
+	active, _ := svc.GetHold(ctx, long.ID)
+	assert.Equal(t, HoldActive, active.Status)
 
-	// Prepare mock transactions
-	now := time.Now()
-	rows := sqlmock.NewRows([]string{"id", "from_wallet", "to_wallet", "amount", "type", "created_at"}).
-		AddRow(uuid.New(), walletID, uuid.New(), int64(100), TxnTypeTransfer, now).
-		AddRow(uuid.New(), nil, walletID, int64(200), TxnTypeDeposit, now.Add(-time.Minute))
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(800), balance.Available)
 
-	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, type, created_at FROM transactions`).
-		WithArgs(walletID).
-		WillReturnRows(rows)
+	// An expired hold can no longer be captured
+	_, err = svc.CaptureHold(ctx, short.ID, 0)
+	assert.Equal(t, ErrHoldNotActive, err)
+}
 
-	// Execute
-	txns, err := svc.GetTransactions(walletID)
+func TestHoldSweeper_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	h, _ := svc.CreateHold(ctx, walletID, usd(300), time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		NewHoldSweeper(svc, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		expired, _ := svc.GetHold(ctx, h.ID)
+		return expired.Status == HoldExpired
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
 
+func TestService_WalletStateTransitions(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 100)
+	change := func(status string) error {
+		_, err := svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: status, Actor: "ops", Reason: "test"})
+		return err
+	}
+
+	assert.NoError(t, change(WalletFrozen))
+	_, err := svc.Deposit(ctx, walletID, usd(100))
+	assert.Equal(t, ErrWalletFrozen, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(50))
+	assert.Equal(t, ErrWalletFrozen, err)
+	assert.NoError(t, change(WalletActive))
+
+	// Closing needs an empty wallet and is final
+	assert.Equal(t, ErrWalletNotEmpty, change(WalletClosed))
+	_, err = svc.Withdraw(ctx, walletID, usd(100))
 	assert.NoError(t, err)
-	assert.Len(t, txns, 2)
-	assert.Equal(t, int64(100), txns[0].Amount)
-	assert.Equal(t, TxnTypeTransfer, txns[0].Type)
-	assert.Equal(t, TxnTypeDeposit, txns[1].Type)
+	assert.NoError(t, change(WalletClosed))
+	assert.Equal(t, ErrWalletClosed, change(WalletActive))
+	_, err = svc.Deposit(ctx, walletID, usd(100))
+	assert.Equal(t, ErrWalletClosed, err)
+
+	assert.Equal(t, ErrInvalidWalletStatus, change("deleted"))
+	_, err = svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletFrozen, Reason: "test"})
+	assert.Equal(t, ErrActorRequired, err)
+	_, err = svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletFrozen, Actor: "ops"})
+	assert.Equal(t, ErrReasonRequired, err)
 }
 
-func TestGetTransactions_WalletNotFound(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestService_WalletBlocks(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	fromID := fundedWallet(t, svc, 1000)
+	toID := fundedWallet(t, svc, 0)
+	blocked := true
 
-	walletID := uuid.New()
+	_, err := svc.ChangeWalletState(ctx, toID, WalletStateChange{InboundBlocked: &blocked, Actor: "ops", Reason: "kyc"})
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.Equal(t, ErrInboundBlocked, err)
+	_, err = svc.Deposit(ctx, toID, usd(100))
+	assert.Equal(t, ErrInboundBlocked, err)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	_, err = svc.ChangeWalletState(ctx, fromID, WalletStateChange{OutboundBlocked: &blocked, Actor: "ops", Reason: "fraud"})
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, fromID, toID, usd(100))
+	assert.Equal(t, ErrOutboundBlocked, err)
+	_, err = svc.Withdraw(ctx, fromID, usd(100))
+	assert.Equal(t, ErrOutboundBlocked, err)
+	_, err = svc.CreateHold(ctx, fromID, usd(100), 0)
+	assert.Equal(t, ErrOutboundBlocked, err)
+
+	// An outbound block still lets money in
+	_, err = svc.Deposit(ctx, fromID, usd(100))
+	assert.NoError(t, err)
+	balance, _ := svc.GetBalance(ctx, fromID)
+	assert.Equal(t, usd(1100), balance.Ledger)
+}
+
+func TestService_WalletStateEvents(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 0)
+	blocked := true
 
-	txns, err := svc.GetTransactions(walletID)
+	_, err := svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletFrozen, Actor: "alice", Reason: "chargeback"})
+	assert.NoError(t, err)
+	w, err := svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: WalletActive, InboundBlocked: &blocked, Actor: "bob", Reason: "resolved"})
+	assert.NoError(t, err)
+	assert.Equal(t, WalletActive, w.Status)
+	assert.True(t, w.InboundBlocked)
 
+	// A rejected change leaves no event behind
+	_, err = svc.ChangeWalletState(ctx, walletID, WalletStateChange{Status: "deleted", Actor: "bob", Reason: "typo"})
 	assert.Error(t, err)
+
+	events, err := svc.GetWalletStateEvents(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, []string{WalletActive, WalletFrozen}, []string{events[0].FromStatus, events[0].ToStatus})
+	assert.Equal(t, "alice", events[0].Actor)
+	assert.Equal(t, "chargeback", events[0].Reason)
+	assert.Equal(t, []string{WalletFrozen, WalletActive}, []string{events[1].FromStatus, events[1].ToStatus})
+	assert.True(t, events[1].InboundBlocked)
+
+	_, err = svc.GetWalletStateEvents(ctx, uuid.New())
 	assert.Equal(t, ErrWalletNotFound, err)
-	assert.Nil(t, txns)
 }
 
-func TestGetTransactions_WalletExistsQueryFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
+func TestService_VerifyBalanceDetectsTampering(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 100)
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnError(errors.New("query failed"))
+	// Simulate a write to the balance that bypassed the service
+	repo.wallets[walletID].Balance = 1000
 
-	txns, err := svc.GetTransactions(walletID)
-
-	assert.Error(t, err)
-	assert.Nil(t, txns)
+	assert.Equal(t, ErrLedgerMismatch, svc.VerifyBalance(ctx, walletID))
 }
 
-func TestGetTransactions_QueryFails(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
+func TestPostEntries_Unbalanced(t *testing.T) {
+	ctx := context.Background()
+	_, repo := newMemoryService()
 
-	walletID := uuid.New()
+	entries := []ledgerEntry{
+		{AccountID: uuid.New(), Direction: EntryDebit, Amount: 100, Currency: "USD"},
+		{AccountID: uuid.New(), Direction: EntryCredit, Amount: 90, Currency: "USD"},
+	}
 
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// Nothing should be written when the lines do not balance
+	err := postEntries(ctx, repo, uuid.New(), entries)
+	assert.Equal(t, ErrUnbalancedEntries, err)
+	assert.Empty(t, repo.entries)
 
-	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, type, created_at FROM transactions`).
-		WithArgs(walletID).
-		WillReturnError(errors.New("query failed"))
-
-	txns, err := svc.GetTransactions(walletID)
-
-	assert.Error(t, err)
-	assert.Nil(t, txns)
+	err = postEntries(ctx, repo, uuid.New(), nil)
+	assert.Equal(t, ErrUnbalancedEntries, err)
 }
 
-func TestGetTransactions_ScanFails_MissingFromWallet(t *testing.T) {
-	svc, mock, cleanup := newTestService(t)
-	defer cleanup()
-
-	walletID := uuid.New()
-
-	// Simulate wallet exists
-	mock.ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM wallets WHERE id = \$1\)`).
-		WithArgs(walletID).
-		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
-
-	// Simulate corrupted row missing `from_wallet`
-	badRows := sqlmock.NewRows([]string{"id" /* missing from_wallet */, "to_wallet", "amount", "type", "created_at"}).
-		AddRow(uuid.New(), uuid.New(), int64(100), TxnTypeTransfer, time.Now())
+func TestMemoryRepository_RollbackUndoesWrites(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 100)
+	failure := errors.New("boom")
+
+	err := repo.RunInTx(ctx, func(q Queries) error {
+		if err := q.AdjustBalance(ctx, walletID, 50); err != nil {
+			return err
+		}
+		if err := q.InsertTransaction(ctx, &transaction{ID: uuid.New(), ToWallet: &walletID, Amount: 50, Currency: "USD", Type: TxnTypeDeposit}); err != nil {
+			return err
+		}
+		if err := q.InsertWallet(ctx, &wallet{ID: uuid.New(), UserID: uuid.New()}); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, usd(100), balance.Ledger)
+	assert.Len(t, repo.transactions, 1)
+	assert.Len(t, repo.wallets, 1)
+}
 
-	mock.ExpectQuery(`SELECT id, from_wallet, to_wallet, amount, type, created_at FROM transactions`).
-		WithArgs(walletID).
-		WillReturnRows(badRows)
+func TestMemoryRepository_RollbackOnPanic(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 100)
 
-	// Execute the service call
-	txns, err := svc.GetTransactions(walletID)
+	assert.Panics(t, func() {
+		_ = repo.RunInTx(ctx, func(q Queries) error {
+			_ = q.AdjustBalance(ctx, walletID, 50)
+			panic("boom")
+		})
+	})
 
-	assert.Error(t, err)
-	assert.Nil(t, txns)
+	// The lock was released and the write undone
+	balance, err := svc.GetBalance(ctx, walletID)
+	assert.NoError(t, err)
+	assert.Equal(t, usd(100), balance.Ledger)
 }
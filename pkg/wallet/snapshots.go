@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// balanceAt returns the ledger balance of a wallet at t, i.e. after every
+// transaction created before t: the last snapshot at or before t plus the
+// journal lines posted since.
+func (s *service) balanceAt(ctx context.Context, walletID uuid.UUID, currency string, t time.Time) (int64, error) {
+	var from time.Time
+	var balance int64
+	snap, err := s.repo.LatestBalanceSnapshot(ctx, walletID, t)
+	if err != nil {
+		return 0, err
+	}
+	if snap != nil {
+		from, balance = snap.AsOf, snap.Balance
+	}
+
+	change, err := s.repo.LedgerNetChange(ctx, walletID, currency, from, t)
+	if err != nil {
+		return 0, err
+	}
+	return balance + change, nil
+}
+
+// GetBalanceAt returns the ledger balance a wallet had at a point in time.
+func (s *service) GetBalanceAt(ctx context.Context, walletID uuid.UUID, at time.Time) (Money, error) {
+	if at.IsZero() || at.After(time.Now()) {
+		return Money{}, ErrInvalidAsOf
+	}
+
+	w, err := s.repo.GetWallet(ctx, walletID)
+	if err != nil {
+		return Money{}, err
+	}
+	balance, err := s.balanceAt(ctx, walletID, w.Currency, at)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: balance, Currency: w.Currency}, nil
+}
+
+// TakeBalanceSnapshots stores the balance of every wallet at asOf, unless it
+// was already stored, and returns how many snapshots were taken. Each snapshot
+// builds on the previous one, so only the journal lines in between are read.
+func (s *service) TakeBalanceSnapshots(ctx context.Context, asOf time.Time) (int, error) {
+	ids, err := s.repo.ListWalletIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	taken := 0
+	for _, id := range ids {
+		last, err := s.repo.LatestBalanceSnapshot(ctx, id, asOf)
+		if err != nil {
+			return taken, err
+		}
+		if last != nil && last.AsOf.Equal(asOf) {
+			continue
+		}
+
+		w, err := s.repo.GetWallet(ctx, id)
+		if err != nil {
+			return taken, err
+		}
+		balance, err := s.balanceAt(ctx, id, w.Currency, asOf)
+		if err != nil {
+			return taken, err
+		}
+		snap := &balanceSnapshot{WalletID: id, Currency: w.Currency, AsOf: asOf, Balance: balance, CreatedAt: time.Now().UTC()}
+		if err := s.repo.InsertBalanceSnapshot(ctx, snap); err != nil {
+			return taken, err
+		}
+		taken++
+	}
+	return taken, nil
+}
+
+// snapshotTaker is the part of the service used by the BalanceSnapshotter.
+type snapshotTaker interface {
+	TakeBalanceSnapshots(ctx context.Context, asOf time.Time) (int, error)
+}
+
+// BalanceSnapshotter periodically snapshots wallet balances at the last
+// midnight UTC.
+type BalanceSnapshotter struct {
+	snapshots snapshotTaker
+	interval  time.Duration
+}
+
+// NewBalanceSnapshotter initializes a snapshotter that checks for a missing
+// daily snapshot every interval.
+func NewBalanceSnapshotter(snapshots snapshotTaker, interval time.Duration) *BalanceSnapshotter {
+	return &BalanceSnapshotter{snapshots: snapshots, interval: interval}
+}
+
+// Run takes the daily snapshots until ctx is canceled. A day is only
+// snapshotted snapshotSettleDelay after midnight, so transactions created just
+// before midnight have committed.
+func (bs *BalanceSnapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(bs.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			asOf := now.UTC().Add(-snapshotSettleDelay).Truncate(24 * time.Hour)
+			n, err := bs.snapshots.TakeBalanceSnapshots(ctx, asOf)
+			if err != nil {
+				log.Printf("Balance snapshot error: %v", err)
+			}
+			if n > 0 {
+				log.Printf("Took %d balance snapshots as of %s", n, asOf.Format(time.RFC3339))
+			}
+		}
+	}
+}
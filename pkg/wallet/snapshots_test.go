@@ -0,0 +1,119 @@
+package wallet
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_GetBalanceAt(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	before := cutoff()
+
+	_, err := svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(200))
+	assert.NoError(t, err)
+
+	balance, err := svc.GetBalanceAt(ctx, walletID, before)
+	assert.NoError(t, err)
+	assert.Equal(t, usd(1000), balance)
+
+	balance, err = svc.GetBalanceAt(ctx, walletID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, usd(1300), balance)
+}
+
+func TestService_GetBalanceAtUsesSnapshot(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+	asOf := cutoff()
+	_, err := svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	// A snapshot replaces the journal before it, so a different stored
+	// balance shows through
+	assert.NoError(t, repo.InsertBalanceSnapshot(ctx, &balanceSnapshot{WalletID: walletID, Currency: "USD", AsOf: asOf, Balance: 900}))
+	balance, err := svc.GetBalanceAt(ctx, walletID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, usd(1400), balance)
+
+	balance, err = svc.GetBalanceAt(ctx, walletID, asOf.Add(-time.Nanosecond))
+	assert.NoError(t, err)
+	assert.Equal(t, usd(1000), balance)
+}
+
+func TestService_GetBalanceAtErrors(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+
+	_, err := svc.GetBalanceAt(ctx, walletID, time.Now().Add(time.Hour))
+	assert.Equal(t, ErrInvalidAsOf, err)
+	_, err = svc.GetBalanceAt(ctx, walletID, time.Time{})
+	assert.Equal(t, ErrInvalidAsOf, err)
+	_, err = svc.GetBalanceAt(ctx, uuid.New(), time.Now())
+	assert.Equal(t, ErrWalletNotFound, err)
+}
+
+func TestService_TakeBalanceSnapshots(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newMemoryService()
+	firstID := fundedWallet(t, svc, 1000)
+	secondID := fundedWallet(t, svc, 250)
+	asOf := cutoff()
+	_, err := svc.Deposit(ctx, firstID, usd(500))
+	assert.NoError(t, err)
+
+	n, err := svc.TakeBalanceSnapshots(ctx, asOf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	snap, err := repo.LatestBalanceSnapshot(ctx, firstID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), snap.Balance)
+	snap, err = repo.LatestBalanceSnapshot(ctx, secondID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(250), snap.Balance)
+
+	// Running again for the same time takes nothing
+	n, err = svc.TakeBalanceSnapshots(ctx, asOf)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The next snapshot builds on the previous one
+	n, err = svc.TakeBalanceSnapshots(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	snap, err = repo.LatestBalanceSnapshot(ctx, firstID, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500), snap.Balance)
+}
+
+func TestBalanceSnapshotter_Run(t *testing.T) {
+	svc, repo := newMemoryService()
+	walletID := fundedWallet(t, svc, 1000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewBalanceSnapshotter(svc, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		snap, _ := repo.LatestBalanceSnapshot(ctx, walletID, time.Now())
+		return snap != nil
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	snap, _ := repo.LatestBalanceSnapshot(ctx, walletID, time.Now())
+	assert.Equal(t, snap.AsOf, snap.AsOf.Truncate(24*time.Hour))
+}
@@ -0,0 +1,215 @@
+package wallet
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statement is the account statement of a wallet for the period [From, To).
+type Statement struct {
+	WalletID       uuid.UUID        `json:"wallet_id"`
+	Currency       string           `json:"currency"`
+	From           time.Time        `json:"from"`            // Start of the period, inclusive
+	To             time.Time        `json:"to"`              // End of the period, exclusive
+	OpeningBalance int64            `json:"opening_balance"` // Ledger balance at From
+	ClosingBalance int64            `json:"closing_balance"` // Ledger balance at To
+	Lines          []StatementLine  `json:"lines"`           // Transactions of the period, oldest first
+	Totals         []StatementTotal `json:"totals"`          // Totals per transaction type, by type
+	GeneratedAt    time.Time        `json:"generated_at"`
+}
+
+// StatementLine is one transaction on a statement.
+type StatementLine struct {
+	TransactionID uuid.UUID  `json:"transaction_id"`
+	Type          string     `json:"type"`                   // deposit, withdrawal, transfer, capture or reversal
+	CreatedAt     time.Time  `json:"created_at"`             // Time of the transaction
+	Counterparty  *uuid.UUID `json:"counterparty,omitempty"` // The other wallet of a transfer
+	Amount        int64      `json:"amount"`                 // Change of the balance, negative for money out, fees included
+	Fees          int64      `json:"fees,omitempty"`         // Part of Amount charged as fees
+	Balance       int64      `json:"balance"`                // Running balance after the transaction
+}
+
+// StatementTotal sums the transactions of one type on a statement.
+type StatementTotal struct {
+	Type    string `json:"type"`
+	Count   int    `json:"count"`
+	Credits int64  `json:"credits"` // Money in
+	Debits  int64  `json:"debits"`  // Money out, fees included
+	Fees    int64  `json:"fees"`    // Part of Debits charged as fees
+}
+
+// GetStatement builds the statement of a wallet for [from, to) from the
+// journal: the opening balance, every transaction with the running balance,
+// totals per type and the closing balance.
+func (s *service) GetStatement(ctx context.Context, walletID uuid.UUID, from, to time.Time) (*Statement, error) {
+	if from.IsZero() || to.IsZero() || !from.Before(to) {
+		return nil, ErrInvalidStatementPeriod
+	}
+
+	w, err := s.repo.GetWallet(ctx, walletID)
+	if err != nil {
+		return nil, err
+	}
+
+	opening, err := s.balanceAt(ctx, walletID, w.Currency, from)
+	if err != nil {
+		return nil, err
+	}
+	movements, err := s.repo.ListAccountMovements(ctx, walletID, w.Currency, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Statement{WalletID: walletID, Currency: w.Currency, From: from.UTC(), To: to.UTC(), OpeningBalance: opening,
+		Lines: []StatementLine{}, Totals: []StatementTotal{}, GeneratedAt: time.Now().UTC()}
+	totals := map[string]*StatementTotal{}
+	balance := opening
+	for _, m := range movements {
+		txn := m.Transaction
+		balance += m.Change
+		line := StatementLine{TransactionID: txn.ID, Type: txn.Type, CreatedAt: txn.CreatedAt.UTC(), Amount: m.Change, Balance: balance}
+		if txn.FromWallet != nil && *txn.FromWallet == walletID {
+			line.Counterparty = txn.ToWallet
+			for _, fee := range txn.Fees {
+				line.Fees += fee.Amount
+			}
+		} else {
+			line.Counterparty = txn.FromWallet
+		}
+		st.Lines = append(st.Lines, line)
+
+		total, ok := totals[txn.Type]
+		if !ok {
+			total = &StatementTotal{Type: txn.Type}
+			totals[txn.Type] = total
+		}
+		total.Count++
+		total.Fees += line.Fees
+		if m.Change >= 0 {
+			total.Credits += m.Change
+		} else {
+			total.Debits -= m.Change
+		}
+	}
+	st.ClosingBalance = balance
+
+	for _, total := range totals {
+		st.Totals = append(st.Totals, *total)
+	}
+	sort.Slice(st.Totals, func(i, j int) bool { return st.Totals[i].Type < st.Totals[j].Type })
+	return st, nil
+}
+
+// formatAmount formats a minor unit amount in major units, e.g. "-12.50".
+func formatAmount(amount int64, currency string) string {
+	return Money{Amount: amount, Currency: currency}.Decimal()
+}
+
+// Write renders the statement in format: StatementJSON, StatementCSV or StatementHTML.
+func (st *Statement) Write(w io.Writer, format string) error {
+	switch format {
+	case StatementJSON:
+		return json.NewEncoder(w).Encode(st)
+	case StatementCSV:
+		return st.writeCSV(w)
+	case StatementHTML:
+		return statementTemplate.Execute(w, st)
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidStatementFormat, format)
+}
+
+// StatementContentType returns the media type of a statement format.
+func StatementContentType(format string) string {
+	switch format {
+	case StatementCSV:
+		return "text/csv; charset=utf-8"
+	case StatementHTML:
+		return "text/html; charset=utf-8"
+	}
+	return "application/json"
+}
+
+// writeCSV writes one row per transaction between an opening and a closing
+// balance row. Amounts are in major units so the file opens as-is in a
+// spreadsheet.
+func (st *Statement) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	rows := [][]string{
+		{"date", "transaction_id", "type", "counterparty", "amount", "fees", "balance", "currency"},
+		{st.From.Format(time.RFC3339), "", "opening_balance", "", "", "", formatAmount(st.OpeningBalance, st.Currency), st.Currency},
+	}
+	for _, line := range st.Lines {
+		counterparty := ""
+		if line.Counterparty != nil {
+			counterparty = line.Counterparty.String()
+		}
+		rows = append(rows, []string{line.CreatedAt.Format(time.RFC3339), line.TransactionID.String(), line.Type, counterparty,
+			formatAmount(line.Amount, st.Currency), formatAmount(line.Fees, st.Currency), formatAmount(line.Balance, st.Currency), st.Currency})
+	}
+	rows = append(rows, []string{st.To.Format(time.RFC3339), "", "closing_balance", "", "", "", formatAmount(st.ClosingBalance, st.Currency), st.Currency})
+
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// statementTemplate is a self-contained printable page, laid out for A4 so it
+// can be printed or converted to PDF by a browser or a headless renderer.
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"date":  func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"count": strconv.Itoa,
+	"money": formatAmount,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Statement {{.WalletID}} {{.From.Format "2006-01-02"}} to {{.To.Format "2006-01-02"}}</title>
+<style>
+@page { size: A4; margin: 15mm; }
+body { font-family: Helvetica, Arial, sans-serif; font-size: 10pt; color: #222; }
+h1 { font-size: 16pt; margin-bottom: 4pt; }
+table { width: 100%; border-collapse: collapse; margin-top: 12pt; }
+th, td { padding: 3pt 4pt; border-bottom: 1px solid #ddd; text-align: left; }
+td.num, th.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.balance td { font-weight: bold; background: #f4f4f4; }
+thead { display: table-header-group; }
+tr { page-break-inside: avoid; }
+</style>
+</head>
+<body>
+<h1>Account statement</h1>
+<p>Wallet {{.WalletID}}<br>
+Period {{date .From}} to {{date .To}} (UTC), amounts in {{.Currency}}<br>
+Generated {{date .GeneratedAt}}</p>
+<table>
+<thead><tr><th>Date</th><th>Type</th><th>Transaction</th><th>Counterparty</th><th class="num">Amount</th><th class="num">Fees</th><th class="num">Balance</th></tr></thead>
+<tbody>
+<tr class="balance"><td>{{date .From}}</td><td colspan="5">Opening balance</td><td class="num">{{money .OpeningBalance .Currency}}</td></tr>
+{{- range .Lines}}
+<tr><td>{{date .CreatedAt}}</td><td>{{.Type}}</td><td>{{.TransactionID}}</td><td>{{with .Counterparty}}{{.}}{{end}}</td><td class="num">{{money .Amount $.Currency}}</td><td class="num">{{if .Fees}}{{money .Fees $.Currency}}{{end}}</td><td class="num">{{money .Balance $.Currency}}</td></tr>
+{{- end}}
+<tr class="balance"><td>{{date .To}}</td><td colspan="5">Closing balance</td><td class="num">{{money .ClosingBalance .Currency}}</td></tr>
+</tbody>
+</table>
+<table>
+<thead><tr><th>Type</th><th class="num">Count</th><th class="num">Credits</th><th class="num">Debits</th><th class="num">Fees</th></tr></thead>
+<tbody>
+{{- range .Totals}}
+<tr><td>{{.Type}}</td><td class="num">{{count .Count}}</td><td class="num">{{money .Credits $.Currency}}</td><td class="num">{{money .Debits $.Currency}}</td><td class="num">{{money .Fees $.Currency}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+</body>
+</html>
+`))
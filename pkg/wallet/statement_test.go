@@ -0,0 +1,119 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// statementFixture makes a deposit before the period, then a deposit, a
+// charged withdrawal and a charged transfer out within it.
+func statementFixture(t *testing.T) (*service, uuid.UUID, uuid.UUID, time.Time, time.Time) {
+	ctx := context.Background()
+	svc, _ := newFeeService(t)
+	walletID := fundedWallet(t, svc, 1000)
+	otherID := fundedWallet(t, svc, 0)
+	from := cutoff()
+
+	_, err := svc.Deposit(ctx, walletID, usd(2000))
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, walletID, usd(400))
+	assert.NoError(t, err)
+	_, err = svc.Transfer(ctx, walletID, otherID, usd(500))
+	assert.NoError(t, err)
+	return svc, walletID, otherID, from, time.Now().Add(time.Second)
+}
+
+func TestService_GetStatement(t *testing.T) {
+	ctx := context.Background()
+	svc, walletID, otherID, from, to := statementFixture(t)
+
+	st, err := svc.GetStatement(ctx, walletID, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, "USD", st.Currency)
+	assert.Equal(t, int64(1000), st.OpeningBalance)
+	assert.Equal(t, int64(2045), st.ClosingBalance)
+
+	balance, _ := svc.GetBalance(ctx, walletID)
+	assert.Equal(t, balance.Ledger.Amount, st.ClosingBalance)
+
+	assert.Len(t, st.Lines, 3)
+	assert.Equal(t, TxnTypeDeposit, st.Lines[0].Type)
+	assert.Equal(t, int64(2000), st.Lines[0].Amount)
+	assert.Equal(t, int64(3000), st.Lines[0].Balance)
+	assert.Equal(t, int64(-450), st.Lines[1].Amount)
+	assert.Equal(t, int64(50), st.Lines[1].Fees)
+	assert.Equal(t, int64(2550), st.Lines[1].Balance)
+	assert.Equal(t, int64(-505), st.Lines[2].Amount)
+	assert.Equal(t, &otherID, st.Lines[2].Counterparty)
+
+	assert.Equal(t, []StatementTotal{
+		{Type: TxnTypeDeposit, Count: 1, Credits: 2000},
+		{Type: TxnTypeTransfer, Count: 1, Debits: 505, Fees: 5},
+		{Type: TxnTypeWithdrawal, Count: 1, Debits: 450, Fees: 50},
+	}, st.Totals)
+
+	// The receiver sees the transfer without the sender's fee
+	st, err = svc.GetStatement(ctx, otherID, from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), st.OpeningBalance)
+	assert.Len(t, st.Lines, 1)
+	assert.Equal(t, int64(500), st.Lines[0].Amount)
+	assert.Equal(t, int64(0), st.Lines[0].Fees)
+	assert.Equal(t, &walletID, st.Lines[0].Counterparty)
+}
+
+func TestService_GetStatementEmptyPeriod(t *testing.T) {
+	ctx := context.Background()
+	svc, walletID, _, _, to := statementFixture(t)
+
+	st, err := svc.GetStatement(ctx, walletID, to, to.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2045), st.OpeningBalance)
+	assert.Equal(t, int64(2045), st.ClosingBalance)
+	assert.Empty(t, st.Lines)
+	assert.Empty(t, st.Totals)
+
+	_, err = svc.GetStatement(ctx, walletID, to, to)
+	assert.Equal(t, ErrInvalidStatementPeriod, err)
+	_, err = svc.GetStatement(ctx, uuid.New(), to, to.Add(time.Hour))
+	assert.Equal(t, ErrWalletNotFound, err)
+}
+
+func TestStatement_Write(t *testing.T) {
+	ctx := context.Background()
+	svc, walletID, _, from, to := statementFixture(t)
+	st, err := svc.GetStatement(ctx, walletID, from, to)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, st.Write(&buf, StatementCSV))
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Len(t, rows, 6)
+	assert.Equal(t, []string{"opening_balance", "10.00"}, []string{rows[1][2], rows[1][6]})
+	assert.Equal(t, "withdrawal", rows[3][2])
+	assert.Equal(t, []string{"-4.50", "0.50", "25.50"}, rows[3][4:7])
+	assert.Equal(t, []string{"closing_balance", "20.45"}, []string{rows[5][2], rows[5][6]})
+
+	buf.Reset()
+	assert.NoError(t, st.Write(&buf, StatementHTML))
+	html := buf.String()
+	assert.True(t, strings.HasPrefix(html, "<!DOCTYPE html>"))
+	assert.Contains(t, html, "Opening balance</td><td class=\"num\">10.00")
+	assert.Contains(t, html, "Closing balance</td><td class=\"num\">20.45")
+	assert.Contains(t, html, "@page { size: A4")
+
+	buf.Reset()
+	assert.NoError(t, st.Write(&buf, StatementJSON))
+	assert.Contains(t, buf.String(), `"closing_balance":2045`)
+
+	assert.True(t, errors.Is(st.Write(&buf, "pdf"), ErrInvalidStatementFormat))
+}
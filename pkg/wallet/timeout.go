@@ -0,0 +1,32 @@
+package wallet
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Timeout puts a deadline on the context of every request, so the service
+// calls and database queries of a request that takes too long are cancelled
+// and the request is answered with 503. timeoutFor returns the deadline of a
+// route by its name, see mux.Route.Name; zero or less means no deadline.
+func Timeout(timeoutFor func(route string) time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var name string
+			if route := mux.CurrentRoute(r); route != nil {
+				name = route.GetName()
+			}
+			d := timeoutFor(name)
+			if d <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
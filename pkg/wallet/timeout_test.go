@@ -0,0 +1,73 @@
+package wallet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeout(t *testing.T) {
+	timeouts := map[string]time.Duration{"GetStatement": time.Minute, "GetBalance": 0}
+	timeoutFor := func(route string) time.Duration {
+		if d, ok := timeouts[route]; ok {
+			return d
+		}
+		return time.Second
+	}
+
+	var deadline time.Time
+	var hasDeadline bool
+	next := func(w http.ResponseWriter, r *http.Request) {
+		deadline, hasDeadline = r.Context().Deadline()
+	}
+	r := mux.NewRouter()
+	r.Use(Timeout(timeoutFor))
+	r.HandleFunc("/wallet/{wallet_id}/statement", next).Name("GetStatement")
+	r.HandleFunc("/wallet/{wallet_id}/balance", next).Name("GetBalance")
+	r.HandleFunc("/wallet/{wallet_id}/transactions", next)
+
+	tests := []struct {
+		path         string
+		wantDeadline time.Duration
+	}{
+		{"/wallet/abc/statement", time.Minute},
+		{"/wallet/abc/balance", 0},
+		{"/wallet/abc/transactions", time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if tc.wantDeadline == 0 {
+				assert.False(t, hasDeadline)
+				return
+			}
+			assert.True(t, hasDeadline)
+			assert.WithinDuration(t, time.Now().Add(tc.wantDeadline), deadline, 100*time.Millisecond)
+		})
+	}
+}
+
+func TestTimeout_SlowServiceCall(t *testing.T) {
+	mock := &mockService{
+		MockGetTransactions: func(ctx context.Context, walletID uuid.UUID, filter TransactionFilter) (*TransactionPage, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	h := Timeout(func(string) time.Duration { return 10 * time.Millisecond })(http.HandlerFunc(NewHandler(mock).GetTransactions))
+
+	walletID := uuid.NewString()
+	req := httptest.NewRequest(http.MethodGet, "/wallet/"+walletID+"/transactions", nil)
+	req = mux.SetURLVars(req, map[string]string{"wallet_id": walletID})
+	res := httptest.NewRecorder()
+
+	h.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusServiceUnavailable, res.Code)
+	assert.Contains(t, res.Body.String(), CodeRequestTimeout)
+}
@@ -0,0 +1,156 @@
+package wallet
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"wallet-go/pkg/db"
+)
+
+// concurrent transfer test settings.
+const (
+	concurrentWallets   = 4
+	concurrentTransfers = 400
+	concurrentOpening   = int64(1000)
+)
+
+// TestTransfer_ConcurrentNeverOverdraws_Memory runs the parallel transfer
+// check against the in-memory repository. Its lock serializes transactions,
+// so this only covers the service logic; races need the Postgres variant.
+func TestTransfer_ConcurrentNeverOverdraws_Memory(t *testing.T) {
+	checkConcurrentTransfers(t, NewService(NewMemoryRepository()))
+}
+
+// TestTransfer_ConcurrentNeverOverdraws_Postgres runs the parallel transfer
+// check against a real Postgres. Set WALLET_TEST_DSN to run it; CI always
+// does, see .github/workflows/test.yml.
+func TestTransfer_ConcurrentNeverOverdraws_Postgres(t *testing.T) {
+	dsn := os.Getenv("WALLET_TEST_DSN")
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("WALLET_TEST_DSN must be set in CI")
+		}
+		t.Skip("WALLET_TEST_DSN not set, skipping Postgres concurrency test")
+	}
+
+	conn, err := sql.Open("postgres", dsn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	if !assert.NoError(t, db.InitSchema(conn, "../db/schema/schema.sql")) {
+		return
+	}
+
+	checkConcurrentTransfers(t, NewService(NewPostgresRepository(conn)))
+}
+
+// checkConcurrentTransfers fires hundreds of parallel transfers between a
+// handful of wallets and checks that no balance goes negative, no money is
+// created or lost and every wallet still matches the ledger.
+func checkConcurrentTransfers(t *testing.T, svc *service) {
+	ctx := context.Background()
+	start, err := svc.repo.GetChainHead(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids := make([]uuid.UUID, concurrentWallets)
+	for i := range ids {
+		w, err := svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
+		if !assert.NoError(t, err) {
+			return
+		}
+		ids[i] = w.ID
+		_, err = svc.Deposit(ctx, w.ID, Money{Amount: concurrentOpening, Currency: "USD"})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentTransfers)
+	for i := 0; i < concurrentTransfers; i++ {
+		from := ids[rand.Intn(len(ids))]
+		to := ids[rand.Intn(len(ids))]
+		for to == from {
+			to = ids[rand.Intn(len(ids))]
+		}
+		amount := int64(rand.Intn(300) + 1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := svc.Transfer(ctx, from, to, Money{Amount: amount, Currency: "USD"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Only insufficient funds is an acceptable failure
+	for err := range errs {
+		if err != nil {
+			assert.Equal(t, ErrInsufficientFunds, err)
+		}
+	}
+
+	var total int64
+	for _, id := range ids {
+		balance, err := svc.GetBalance(ctx, id)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, balance.Ledger.Amount, int64(0))
+		assert.NoError(t, svc.VerifyBalance(ctx, id))
+		total += balance.Ledger.Amount
+	}
+	assert.Equal(t, concurrentOpening*concurrentWallets, total)
+	checkNoNegativePrefix(t, svc, start.Seq, ids)
+}
+
+// checkNoNegativePrefix replays the journal of each wallet in hash chain
+// order and checks that its balance never went negative, not even between
+// the final balances checked above. A transaction takes its place in the
+// chain while it holds its wallet locks, so chain order is the order in
+// which the transactions of a wallet committed.
+func checkNoNegativePrefix(t *testing.T, svc *service, afterSeq int64, ids []uuid.UUID) {
+	ctx := context.Background()
+	order := map[uuid.UUID]int64{}
+	for {
+		txns, err := svc.repo.ListChainedTransactions(ctx, afterSeq, chainBatchSize)
+		if !assert.NoError(t, err) || len(txns) == 0 {
+			break
+		}
+		for _, txn := range txns {
+			order[txn.ID] = txn.ChainSeq
+		}
+		afterSeq = txns[len(txns)-1].ChainSeq
+	}
+
+	for _, id := range ids {
+		movements, err := svc.repo.ListAccountMovements(ctx, id, "USD", time.Time{}, time.Now().Add(time.Hour))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		for _, m := range movements {
+			assert.Contains(t, order, m.Transaction.ID, "transaction %s is not chained", m.Transaction.ID)
+		}
+		sort.Slice(movements, func(i, j int) bool {
+			return order[movements[i].Transaction.ID] < order[movements[j].Transaction.ID]
+		})
+
+		var running int64
+		for _, m := range movements {
+			running += m.Change
+			if !assert.GreaterOrEqual(t, running, int64(0), "wallet %s went negative at chain seq %d", id, order[m.Transaction.ID]) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,595 @@
+package wallet
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxWebhookDeliveries is the number of deliveries listed per subscription.
+const maxWebhookDeliveries = 100
+
+// SignWebhook returns the signature header value of a webhook body sent at
+// timestamp (Unix seconds). Receivers recompute it with their secret and
+// compare it in constant time.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before the next attempt after attempts failures:
+// webhookBaseBackoff doubled after every failure, at most webhookMaxBackoff.
+func webhookBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return webhookMaxBackoff
+	}
+	d := webhookBaseBackoff << (attempts - 1)
+	if d > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return d
+}
+
+// hostResolver looks up the addresses of a host, see net.Resolver.
+type hostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// blockedWebhookNetworks are the reserved networks webhooks are never sent to
+// on top of the loopback, private, link-local and multicast ones.
+var blockedWebhookNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, can map to any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("100::/64"),       // discard-only
+}
+
+// webhookAddrAllowed reports whether webhooks may be sent to addr: a public
+// address, or one in allowed. Loopback, private, link-local (which includes
+// cloud metadata endpoints such as 169.254.169.254) and other reserved
+// addresses are refused.
+func webhookAddrAllowed(addr netip.Addr, allowed []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, p := range allowed {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, p := range blockedWebhookNetworks {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateWebhookURL checks that raw is an absolute http or https URL whose
+// host resolves to allowed addresses only. The addresses are checked again
+// whenever a delivery connects, see newWebhookClient, since DNS can change.
+func (s *service) validateWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+
+	host := u.Hostname()
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else if addrs, err = s.resolver.LookupNetIP(ctx, "ip", host); err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: %s does not resolve", ErrWebhookAddressBlocked, host)
+	}
+	for _, addr := range addrs {
+		if !webhookAddrAllowed(addr, s.webhookAllowed) {
+			return fmt.Errorf("%w: %s is %s", ErrWebhookAddressBlocked, host, addr)
+		}
+	}
+	return nil
+}
+
+// newWebhookClient returns the client webhooks are sent with. Every connection
+// it opens, including those of redirects, is refused unless the address is
+// allowed by webhookAddrAllowed, so a host can not be pointed at an internal
+// address after it was validated. Proxies are not used, they would hide the
+// address.
+func newWebhookClient(timeout time.Duration, allowed []netip.Prefix) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddrAllowed(addrPort.Addr(), allowed) {
+				return fmt.Errorf("%w: %s", ErrWebhookAddressBlocked, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// validateEventTypes checks that every type is a known event type.
+func validateEventTypes(types []string) error {
+	for _, t := range types {
+		switch t {
+		case EventWalletCreated, EventFundsDeposited, EventFundsWithdrawn, EventFundsTransferred, EventHoldCaptured,
+			EventFundsReversed:
+		default:
+			return fmt.Errorf("%w: %q", ErrInvalidEventType, t)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the subscription sends events of eventType.
+func (sub *webhookSubscription) wants(eventType string) bool {
+	if len(sub.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range sub.EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateWebhook subscribes a URL to the events of a wallet or of all wallets of
+// a user. The returned subscription is the only place its secret is shown.
+func (s *service) CreateWebhook(ctx context.Context, req WebhookRequest) (*webhookSubscription, error) {
+	if (req.WalletID == nil) == (req.UserID == nil) {
+		return nil, ErrInvalidWebhookOwner
+	}
+	if err := s.validateWebhookURL(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	if err := validateEventTypes(req.EventTypes); err != nil {
+		return nil, err
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		req.Secret = hex.EncodeToString(secret)
+	}
+	if len(req.Secret) < webhookMinSecretBytes {
+		return nil, ErrWebhookSecretShort
+	}
+
+	if req.WalletID != nil {
+		exists, err := s.repo.WalletExists(ctx, *req.WalletID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrWalletNotFound
+		}
+	} else {
+		exists, err := s.repo.UserExists(ctx, *req.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrUserNotFound
+		}
+	}
+
+	eventTypes := req.EventTypes
+	if eventTypes == nil {
+		eventTypes = []string{}
+	}
+	now := time.Now()
+	sub := &webhookSubscription{ID: uuid.New(), WalletID: req.WalletID, UserID: req.UserID, URL: req.URL,
+		EventTypes: eventTypes, Secret: req.Secret, Active: true, CreatedAt: now, UpdatedAt: now}
+	if err := s.repo.InsertWebhookSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// GetWebhook returns a subscription without its secret.
+func (s *service) GetWebhook(ctx context.Context, subscriptionID uuid.UUID) (*webhookSubscription, error) {
+	sub, err := s.repo.GetWebhookSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+// ListWebhooks returns the subscriptions of a wallet or of a user, oldest
+// first and without their secrets.
+func (s *service) ListWebhooks(ctx context.Context, walletID, userID *uuid.UUID) ([]webhookSubscription, error) {
+	if (walletID == nil) == (userID == nil) {
+		return nil, ErrInvalidWebhookOwner
+	}
+
+	subs, err := s.repo.ListWebhookSubscriptions(ctx, walletID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if subs == nil {
+		subs = []webhookSubscription{}
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, nil
+}
+
+// UpdateWebhook changes the URL, event types, secret or active flag of a subscription.
+func (s *service) UpdateWebhook(ctx context.Context, subscriptionID uuid.UUID, update WebhookUpdate) (*webhookSubscription, error) {
+	sub, err := s.repo.GetWebhookSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.URL != "" {
+		if err := s.validateWebhookURL(ctx, update.URL); err != nil {
+			return nil, err
+		}
+		sub.URL = update.URL
+	}
+	if update.EventTypes != nil {
+		if err := validateEventTypes(*update.EventTypes); err != nil {
+			return nil, err
+		}
+		sub.EventTypes = append([]string{}, *update.EventTypes...)
+	}
+	if update.Secret != "" {
+		if len(update.Secret) < webhookMinSecretBytes {
+			return nil, ErrWebhookSecretShort
+		}
+		sub.Secret = update.Secret
+	}
+	if update.Active != nil {
+		sub.Active = *update.Active
+	}
+	sub.UpdatedAt = time.Now()
+
+	if err := s.repo.UpdateWebhookSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+// DeleteWebhook deletes a subscription together with its deliveries.
+func (s *service) DeleteWebhook(ctx context.Context, subscriptionID uuid.UUID) error {
+	return s.repo.DeleteWebhookSubscription(ctx, subscriptionID)
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a subscription, newest first.
+func (s *service) ListWebhookDeliveries(ctx context.Context, subscriptionID uuid.UUID) ([]webhookDelivery, error) {
+	if _, err := s.repo.GetWebhookSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	deliveries, err := s.repo.ListWebhookDeliveries(ctx, subscriptionID, maxWebhookDeliveries)
+	if err != nil {
+		return nil, err
+	}
+	if deliveries == nil {
+		deliveries = []webhookDelivery{}
+	}
+	return deliveries, nil
+}
+
+// ListWebhookAttempts returns every attempt to send a delivery, oldest first.
+func (s *service) ListWebhookAttempts(ctx context.Context, deliveryID uuid.UUID) ([]webhookAttempt, error) {
+	var attempts []webhookAttempt
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		if _, err := q.LockWebhookDelivery(ctx, deliveryID); err != nil {
+			return err
+		}
+		var err error
+		attempts, err = q.ListWebhookAttempts(ctx, deliveryID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attempts == nil {
+		attempts = []webhookAttempt{}
+	}
+	return attempts, nil
+}
+
+// ReplayWebhookDelivery sends a delivery again with a new round of attempts,
+// whether it was delivered, is dead or is still pending.
+func (s *service) ReplayWebhookDelivery(ctx context.Context, deliveryID uuid.UUID) (*webhookDelivery, error) {
+	var replayed *webhookDelivery
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		d, err := q.LockWebhookDelivery(ctx, deliveryID)
+		if err != nil {
+			return err
+		}
+		// An attempt still being sent no longer changes the delivery
+		now := time.Now()
+		d.Status, d.Attempts, d.NextAttemptAt, d.UpdatedAt, d.ClaimID = WebhookPending, 0, now, now, nil
+		if err := q.UpdateWebhookDelivery(ctx, d); err != nil {
+			return err
+		}
+		replayed = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replayed, nil
+}
+
+// eventWallets returns the wallets an event is about: both sides of a
+// transaction, or the wallet of the event.
+func eventWallets(e *Event) []uuid.UUID {
+	ids := []uuid.UUID{e.WalletID}
+	if e.Type == EventWalletCreated {
+		return ids
+	}
+	var txn transaction
+	if err := json.Unmarshal(e.Payload, &txn); err != nil {
+		return ids
+	}
+	for _, id := range []*uuid.UUID{txn.FromWallet, txn.ToWallet} {
+		if id != nil && *id != e.WalletID {
+			ids = append(ids, *id)
+		}
+	}
+	return ids
+}
+
+// enqueueWebhooks queues a delivery of e through q for every active
+// subscription of the wallets the event is about or of their owners. The
+// deliveries commit or roll back with the change that fired the event.
+func enqueueWebhooks(ctx context.Context, q Queries, e *Event) error {
+	subs, err := q.ListEventWebhooks(ctx, eventWallets(e))
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+
+	// The outbox position is not part of the webhook body, it is not known
+	// before the insert commits
+	sent := *e
+	sent.Seq = 0
+	body, err := json.Marshal(sent)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range subs {
+		if !sub.wants(e.Type) {
+			continue
+		}
+		d := &webhookDelivery{ID: uuid.New(), SubscriptionID: sub.ID, EventID: e.ID, EventType: e.Type, Payload: body,
+			Status: WebhookPending, NextAttemptAt: e.CreatedAt, CreatedAt: e.CreatedAt, UpdatedAt: e.CreatedAt}
+		if err := q.InsertWebhookDelivery(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendWebhook POSTs a delivery to the subscription URL and returns the log
+// entry of the attempt. Only a 2xx response counts as delivered.
+func (s *service) sendWebhook(ctx context.Context, sub *webhookSubscription, d *webhookDelivery, now time.Time) *webhookAttempt {
+	attempt := &webhookAttempt{ID: uuid.New(), DeliveryID: d.ID, CreatedAt: now}
+	start := time.Now()
+	defer func() { attempt.DurationMs = time.Since(start).Milliseconds() }()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.EventType)
+	req.Header.Set(WebhookDeliveryHeader, d.ID.String())
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(sub.Secret, now.Unix(), d.Payload))
+
+	res, err := s.webhooks.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	attempt.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		attempt.Error = "unexpected response status " + res.Status
+	}
+	return attempt
+}
+
+// DeliverWebhooks sends the deliveries that are due at now and returns how
+// many succeeded. Each delivery is claimed in a short transaction, sent with no
+// transaction open and its attempt recorded in a second transaction, so a
+// claimed delivery is sent by one dispatcher only until webhookClaimTTL has
+// passed. A failed delivery is retried with exponential backoff until
+// WebhookMaxAttempts, then it is dead.
+func (s *service) DeliverWebhooks(ctx context.Context, now time.Time) (int, error) {
+	ids, err := s.repo.ListDueWebhookDeliveries(ctx, now, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, id := range ids {
+		d, sub, err := s.claimWebhookDelivery(ctx, id, now)
+		if err == ErrDeliveryNotDue {
+			continue
+		}
+		if err != nil {
+			return delivered, err
+		}
+		if d == nil {
+			continue
+		}
+
+		// Give up on the request before another dispatcher may claim it
+		sendCtx, cancel := context.WithTimeout(ctx, webhookClaimTTL)
+		attempt := s.sendWebhook(sendCtx, sub, d, now)
+		cancel()
+
+		ok, err := s.recordWebhookAttempt(ctx, d, attempt, now)
+		if err != nil {
+			return delivered, err
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// claimWebhookDelivery claims a due delivery for webhookClaimTTL and returns
+// it with its subscription. A delivery of an inactive subscription is dead and
+// nil is returned for it.
+func (s *service) claimWebhookDelivery(ctx context.Context, id uuid.UUID, now time.Time) (*webhookDelivery, *webhookSubscription, error) {
+	var claimed *webhookDelivery
+	var sub *webhookSubscription
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		claimed, sub = nil, nil
+		// The delivery may have been claimed by another dispatcher since it was listed
+		d, err := q.LockWebhookDelivery(ctx, id)
+		if err != nil {
+			return err
+		}
+		if d.Status != WebhookPending || d.NextAttemptAt.After(now) {
+			return ErrDeliveryNotDue
+		}
+		sub, err = q.GetWebhookSubscription(ctx, d.SubscriptionID)
+		if err != nil {
+			return err
+		}
+
+		d.UpdatedAt = now
+		if !sub.Active {
+			d.Status, d.LastError, d.ClaimID = WebhookDead, "subscription is inactive", nil
+			return q.UpdateWebhookDelivery(ctx, d)
+		}
+
+		// Due again once the claim has run out, in case the dispatcher stops
+		claimID := uuid.New()
+		d.ClaimID, d.NextAttemptAt = &claimID, now.Add(webhookClaimTTL)
+		if err := q.UpdateWebhookDelivery(ctx, d); err != nil {
+			return err
+		}
+		claimed = d
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return claimed, sub, nil
+}
+
+// recordWebhookAttempt logs an attempt to send a claimed delivery and stores
+// its outcome, and reports whether the delivery succeeded. A delivery that was
+// replayed or claimed again while it was sent keeps its newer state.
+func (s *service) recordWebhookAttempt(ctx context.Context, claimed *webhookDelivery, attempt *webhookAttempt, now time.Time) (bool, error) {
+	var delivered bool
+	err := s.repo.RunInTx(ctx, func(q Queries) error {
+		delivered = false
+		d, err := q.LockWebhookDelivery(ctx, claimed.ID)
+		if err != nil {
+			return err
+		}
+		if err := q.InsertWebhookAttempt(ctx, attempt); err != nil {
+			return err
+		}
+		if d.ClaimID == nil || *d.ClaimID != *claimed.ClaimID {
+			return nil
+		}
+
+		d.ClaimID, d.UpdatedAt = nil, now
+		if attempt.Error == "" {
+			d.Status, d.LastError = WebhookDelivered, ""
+			delivered = true
+		} else {
+			d.Attempts++
+			d.LastError = attempt.Error
+			if d.Attempts >= WebhookMaxAttempts {
+				d.Status = WebhookDead
+			} else {
+				d.NextAttemptAt = now.Add(webhookBackoff(d.Attempts))
+			}
+		}
+		return q.UpdateWebhookDelivery(ctx, d)
+	})
+	// The subscription was deleted while the delivery was sent
+	if err == ErrDeliveryNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return delivered, nil
+}
+
+// webhookDeliverer is the part of the service used by the WebhookDispatcher.
+type webhookDeliverer interface {
+	DeliverWebhooks(ctx context.Context, now time.Time) (int, error)
+}
+
+// WebhookDispatcher periodically sends due webhook deliveries.
+type WebhookDispatcher struct {
+	webhooks webhookDeliverer
+	interval time.Duration
+}
+
+// NewWebhookDispatcher initializes a dispatcher that sends deliveries every interval.
+func NewWebhookDispatcher(webhooks webhookDeliverer, interval time.Duration) *WebhookDispatcher {
+	return &WebhookDispatcher{webhooks: webhooks, interval: interval}
+}
+
+// Run sends due deliveries every interval until ctx is canceled.
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(wd.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := wd.webhooks.DeliverWebhooks(ctx, now); err != nil {
+				log.Printf("Webhook dispatcher error: %v", err)
+			}
+		}
+	}
+}
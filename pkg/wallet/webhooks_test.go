@@ -0,0 +1,452 @@
+package wallet
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// staticResolver resolves the hosts it knows to fixed addresses.
+type staticResolver map[string][]netip.Addr
+
+func (r staticResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// testResolver resolves example.com to a public address and internal.example
+// to a private one without asking DNS.
+var testResolver = staticResolver{
+	"example.com":      {netip.MustParseAddr("93.184.215.14")},
+	"internal.example": {netip.MustParseAddr("93.184.215.14"), netip.MustParseAddr("10.0.0.7")},
+}
+
+// loopbackNetworks lets webhooks reach the httptest servers.
+var loopbackNetworks = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// newWebhookService returns a service backed by an empty in-memory repository
+// that resolves hosts with testResolver and may send webhooks to the loopback
+// test servers.
+func newWebhookService() (*service, *memoryRepository) {
+	repo := NewMemoryRepository()
+	svc := NewService(repo, WithWebhookAllowedNetworks(loopbackNetworks))
+	svc.resolver = testResolver
+	return svc, repo
+}
+
+// webhookReceiver records the requests it gets and answers with status.
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+	w.WriteHeader(wr.status)
+}
+
+// newWebhookReceiver starts a server answering status to every request.
+func newWebhookReceiver(t *testing.T, status int) (*webhookReceiver, string) {
+	receiver := &webhookReceiver{status: status}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server.URL
+}
+
+func TestSignWebhook(t *testing.T) {
+	// Known value of HMAC-SHA256("secret", "1700000000.{}")
+	assert.Equal(t, "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163", SignWebhook("secret", 1700000000, []byte("{}")))
+	assert.NotEqual(t, SignWebhook("secret", 1700000000, []byte("{}")), SignWebhook("secret", 1700000001, []byte("{}")))
+	assert.NotEqual(t, SignWebhook("secret", 1700000000, []byte("{}")), SignWebhook("other", 1700000000, []byte("{}")))
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhookBackoff(1))
+	assert.Equal(t, time.Minute, webhookBackoff(2))
+	assert.Equal(t, 8*time.Minute, webhookBackoff(5))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(12))
+	assert.Equal(t, webhookMaxBackoff, webhookBackoff(100))
+}
+
+func TestService_CreateWebhook(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newWebhookService()
+	w, err := svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
+	assert.NoError(t, err)
+
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &w.ID, URL: "https://example.com/hooks"})
+	assert.NoError(t, err)
+	assert.Len(t, sub.Secret, 64)
+	assert.True(t, sub.Active)
+	assert.Equal(t, []string{}, sub.EventTypes)
+
+	// The secret is only shown when the subscription is created
+	got, err := svc.GetWebhook(ctx, sub.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, got.Secret)
+	subs, err := svc.ListWebhooks(ctx, nil, &w.UserID)
+	assert.NoError(t, err)
+	assert.Empty(t, subs)
+	subs, err = svc.ListWebhooks(ctx, &w.ID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, subs, 1)
+	assert.Empty(t, subs[0].Secret)
+
+	missing := uuid.New()
+	invalid := []struct {
+		req WebhookRequest
+		err error
+	}{
+		{WebhookRequest{URL: "https://example.com"}, ErrInvalidWebhookOwner},
+		{WebhookRequest{WalletID: &w.ID, UserID: &w.UserID, URL: "https://example.com"}, ErrInvalidWebhookOwner},
+		{WebhookRequest{WalletID: &w.ID, URL: "ftp://example.com"}, ErrInvalidWebhookURL},
+		{WebhookRequest{WalletID: &w.ID, URL: "/hooks"}, ErrInvalidWebhookURL},
+		{WebhookRequest{WalletID: &w.ID, URL: "https://example.com", EventTypes: []string{"FundsLost"}}, ErrInvalidEventType},
+		{WebhookRequest{WalletID: &w.ID, URL: "https://example.com", Secret: "short"}, ErrWebhookSecretShort},
+		{WebhookRequest{WalletID: &missing, URL: "https://example.com"}, ErrWalletNotFound},
+		{WebhookRequest{UserID: &missing, URL: "https://example.com"}, ErrUserNotFound},
+	}
+	for _, tc := range invalid {
+		_, err := svc.CreateWebhook(ctx, tc.req)
+		assert.ErrorIs(t, err, tc.err)
+	}
+}
+
+func TestWebhookAddrAllowed(t *testing.T) {
+	for _, addr := range []string{"93.184.215.14", "2606:2800:21f:cb07:6820:80da:af6b:8b2c", "::ffff:93.184.215.14"} {
+		assert.True(t, webhookAddrAllowed(netip.MustParseAddr(addr), nil), addr)
+	}
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.100.100.200",
+		"0.0.0.0", "255.255.255.255", "224.0.0.1", "::1", "::", "fe80::1", "fd00:ec2::254", "::ffff:127.0.0.1", "64:ff9b::a00:1"}
+	for _, addr := range blocked {
+		assert.False(t, webhookAddrAllowed(netip.MustParseAddr(addr), nil), addr)
+	}
+
+	allowed := []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}
+	assert.True(t, webhookAddrAllowed(netip.MustParseAddr("10.1.2.3"), allowed))
+	assert.False(t, webhookAddrAllowed(netip.MustParseAddr("10.2.0.1"), allowed))
+}
+
+func TestService_CreateWebhookInternalURL(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newMemoryService()
+	svc.resolver = testResolver
+	w, err := svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
+	assert.NoError(t, err)
+
+	// Refused when any address of the host is internal or it does not resolve
+	for _, url := range []string{"http://169.254.169.254/latest/meta-data", "http://127.0.0.1:8080/hooks",
+		"http://[::1]/hooks", "https://internal.example/hooks", "https://unknown.example/hooks"} {
+		_, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &w.ID, URL: url})
+		assert.ErrorIs(t, err, ErrWebhookAddressBlocked, url)
+	}
+
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &w.ID, URL: "https://example.com/hooks"})
+	assert.NoError(t, err)
+	_, err = svc.UpdateWebhook(ctx, sub.ID, WebhookUpdate{URL: "http://10.0.0.7/hooks"})
+	assert.ErrorIs(t, err, ErrWebhookAddressBlocked)
+}
+
+func TestService_DeliverWebhooksRefusesInternalAddress(t *testing.T) {
+	ctx := context.Background()
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	svc, _ := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: url})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	// The host now points at an address that is not allowed, e.g. after a DNS change
+	svc.webhooks = newWebhookClient(time.Second, nil)
+	n, err := svc.DeliverWebhooks(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, receiver.requests)
+
+	deliveries, _ := svc.ListWebhookDeliveries(ctx, sub.ID)
+	assert.Contains(t, deliveries[0].LastError, ErrWebhookAddressBlocked.Error())
+}
+
+func TestService_UpdateAndDeleteWebhook(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: "https://example.com/hooks"})
+	assert.NoError(t, err)
+
+	inactive := false
+	types := []string{EventFundsDeposited}
+	updated, err := svc.UpdateWebhook(ctx, sub.ID, WebhookUpdate{EventTypes: &types, Active: &inactive, Secret: "0123456789abcdef"})
+	assert.NoError(t, err)
+	assert.Equal(t, types, updated.EventTypes)
+	assert.False(t, updated.Active)
+	assert.Equal(t, "https://example.com/hooks", updated.URL)
+	assert.Empty(t, updated.Secret)
+	assert.Equal(t, "0123456789abcdef", repo.webhooks[0].Secret)
+
+	_, err = svc.UpdateWebhook(ctx, sub.ID, WebhookUpdate{URL: "not a url"})
+	assert.Equal(t, ErrInvalidWebhookURL, err)
+
+	assert.NoError(t, svc.DeleteWebhook(ctx, sub.ID))
+	assert.Equal(t, ErrWebhookNotFound, svc.DeleteWebhook(ctx, sub.ID))
+	_, err = svc.GetWebhook(ctx, sub.ID)
+	assert.Equal(t, ErrWebhookNotFound, err)
+}
+
+func TestService_WebhookDeliveriesQueuedWithEvents(t *testing.T) {
+	ctx := context.Background()
+	svc, repo := newWebhookService()
+	from, err := svc.CreateWallet(ctx, uuid.New(), "USD", "", "")
+	assert.NoError(t, err)
+	toID := fundedWallet(t, svc, 0)
+	to, err := svc.repo.GetWallet(ctx, toID)
+	assert.NoError(t, err)
+
+	// The receiver's owner only wants transfers, the sender's wallet wants everything
+	ownerSub, err := svc.CreateWebhook(ctx, WebhookRequest{UserID: &to.UserID, URL: "https://example.com/owner",
+		EventTypes: []string{EventFundsTransferred}})
+	assert.NoError(t, err)
+	walletSub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &from.ID, URL: "https://example.com/wallet"})
+	assert.NoError(t, err)
+
+	_, err = svc.Deposit(ctx, from.ID, usd(1000))
+	assert.NoError(t, err)
+	txnID, err := svc.Transfer(ctx, from.ID, toID, usd(300))
+	assert.NoError(t, err)
+
+	// Refused requests roll back their deliveries with everything else
+	_, err = svc.Withdraw(ctx, from.ID, usd(5000))
+	assert.Equal(t, ErrInsufficientFunds, err)
+
+	deliveries, err := svc.ListWebhookDeliveries(ctx, walletSub.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, EventFundsTransferred, deliveries[0].EventType)
+	assert.Equal(t, EventFundsDeposited, deliveries[1].EventType)
+
+	deliveries, err = svc.ListWebhookDeliveries(ctx, ownerSub.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, WebhookPending, deliveries[0].Status)
+
+	var e Event
+	assert.NoError(t, json.Unmarshal(deliveries[0].Payload, &e))
+	assert.Equal(t, repo.outbox[len(repo.outbox)-1].ID, e.ID)
+	assert.Equal(t, deliveries[0].EventID, e.ID)
+	assert.Zero(t, e.Seq)
+	var txn transaction
+	assert.NoError(t, json.Unmarshal(e.Payload, &txn))
+	assert.Equal(t, txnID, txn.ID)
+
+	// Paused subscriptions get no new deliveries
+	inactive := false
+	_, err = svc.UpdateWebhook(ctx, walletSub.ID, WebhookUpdate{Active: &inactive})
+	assert.NoError(t, err)
+	_, err = svc.Withdraw(ctx, from.ID, usd(100))
+	assert.NoError(t, err)
+	deliveries, err = svc.ListWebhookDeliveries(ctx, walletSub.ID)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+}
+
+func TestService_DeliverWebhooks(t *testing.T) {
+	ctx := context.Background()
+	receiver, url := newWebhookReceiver(t, http.StatusNoContent)
+	svc, _ := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: url, Secret: "0123456789abcdef"})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	n, err := svc.DeliverWebhooks(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	assert.Len(t, receiver.requests, 1)
+	req, body := receiver.requests[0], receiver.bodies[0]
+	deliveries, err := svc.ListWebhookDeliveries(ctx, sub.ID)
+	assert.NoError(t, err)
+	d := deliveries[0]
+	assert.Equal(t, WebhookDelivered, d.Status)
+	assert.JSONEq(t, string(d.Payload), string(body))
+	assert.Equal(t, EventFundsDeposited, req.Header.Get(WebhookEventHeader))
+	assert.Equal(t, d.ID.String(), req.Header.Get(WebhookDeliveryHeader))
+	assert.Equal(t, strconv.FormatInt(now.Unix(), 10), req.Header.Get(WebhookTimestampHeader))
+	assert.Equal(t, SignWebhook("0123456789abcdef", now.Unix(), body), req.Header.Get(WebhookSignatureHeader))
+
+	attempts, err := svc.ListWebhookAttempts(ctx, d.ID)
+	assert.NoError(t, err)
+	assert.Len(t, attempts, 1)
+	assert.Equal(t, http.StatusNoContent, attempts[0].StatusCode)
+	assert.Empty(t, attempts[0].Error)
+
+	// Delivered deliveries are not sent again
+	n, err = svc.DeliverWebhooks(context.Background(), now.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, receiver.requests, 1)
+}
+
+func TestService_DeliverWebhooksRetriesUntilDead(t *testing.T) {
+	ctx := context.Background()
+	receiver, url := newWebhookReceiver(t, http.StatusInternalServerError)
+	svc, _ := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: url})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	_, err = svc.DeliverWebhooks(context.Background(), now)
+	assert.NoError(t, err)
+	deliveries, _ := svc.ListWebhookDeliveries(ctx, sub.ID)
+	d := deliveries[0]
+	assert.Equal(t, WebhookPending, d.Status)
+	assert.Equal(t, 1, d.Attempts)
+	assert.Equal(t, now.Add(webhookBaseBackoff), d.NextAttemptAt)
+	assert.Contains(t, d.LastError, "500")
+
+	// Nothing is sent before the backoff has passed
+	_, err = svc.DeliverWebhooks(context.Background(), now.Add(webhookBaseBackoff-time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, receiver.requests, 1)
+
+	for i := 1; i < WebhookMaxAttempts; i++ {
+		now = now.Add(webhookMaxBackoff)
+		_, err = svc.DeliverWebhooks(context.Background(), now)
+		assert.NoError(t, err)
+	}
+	deliveries, _ = svc.ListWebhookDeliveries(ctx, sub.ID)
+	d = deliveries[0]
+	assert.Equal(t, WebhookDead, d.Status)
+	assert.Equal(t, WebhookMaxAttempts, d.Attempts)
+	assert.Len(t, receiver.requests, WebhookMaxAttempts)
+
+	attempts, err := svc.ListWebhookAttempts(ctx, d.ID)
+	assert.NoError(t, err)
+	assert.Len(t, attempts, WebhookMaxAttempts)
+
+	// Dead deliveries are only sent again when replayed
+	_, err = svc.DeliverWebhooks(context.Background(), now.Add(webhookMaxBackoff))
+	assert.NoError(t, err)
+	assert.Len(t, receiver.requests, WebhookMaxAttempts)
+
+	receiver.status = http.StatusOK
+	replayed, err := svc.ReplayWebhookDelivery(ctx, d.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, WebhookPending, replayed.Status)
+	assert.Equal(t, 0, replayed.Attempts)
+
+	n, err := svc.DeliverWebhooks(context.Background(), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	deliveries, _ = svc.ListWebhookDeliveries(ctx, sub.ID)
+	assert.Equal(t, WebhookDelivered, deliveries[0].Status)
+
+	_, err = svc.ReplayWebhookDelivery(ctx, uuid.New())
+	assert.Equal(t, ErrDeliveryNotFound, err)
+}
+
+func TestService_DeliverWebhooksReplayedWhileSent(t *testing.T) {
+	ctx := context.Background()
+	svc, _ := newWebhookService()
+
+	// The memory repository holds its lock during a transaction, so the
+	// replay would deadlock if the request were sent inside one
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := svc.ReplayWebhookDelivery(r.Context(), uuid.MustParse(r.Header.Get(WebhookDeliveryHeader)))
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: server.URL})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	n, err := svc.DeliverWebhooks(ctx, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	// The attempt is logged but the replay is kept
+	deliveries, _ := svc.ListWebhookDeliveries(ctx, sub.ID)
+	d := deliveries[0]
+	assert.Equal(t, WebhookPending, d.Status)
+	assert.Equal(t, 0, d.Attempts)
+	assert.Empty(t, d.LastError)
+	attempts, _ := svc.ListWebhookAttempts(ctx, d.ID)
+	assert.Len(t, attempts, 1)
+}
+
+func TestService_DeliverWebhooksToInactiveSubscription(t *testing.T) {
+	ctx := context.Background()
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	svc, _ := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	sub, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: url})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	// Deliveries queued before a subscription is paused are not sent
+	inactive := false
+	_, err = svc.UpdateWebhook(ctx, sub.ID, WebhookUpdate{Active: &inactive})
+	assert.NoError(t, err)
+	n, err := svc.DeliverWebhooks(context.Background(), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, receiver.requests)
+
+	deliveries, _ := svc.ListWebhookDeliveries(ctx, sub.ID)
+	assert.Equal(t, WebhookDead, deliveries[0].Status)
+}
+
+func TestWebhookDispatcher_Run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	receiver, url := newWebhookReceiver(t, http.StatusOK)
+	svc, _ := newWebhookService()
+	walletID := fundedWallet(t, svc, 0)
+	_, err := svc.CreateWebhook(ctx, WebhookRequest{WalletID: &walletID, URL: url})
+	assert.NoError(t, err)
+	_, err = svc.Deposit(ctx, walletID, usd(500))
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		NewWebhookDispatcher(svc, 5*time.Millisecond).Run(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		return len(receiver.requests) == 1
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}